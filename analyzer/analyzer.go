@@ -0,0 +1,291 @@
+// Package analyzer finds common misuse of bintest mocks in test code, such as setting
+// expectations that are never checked. It's a go/analysis analyzer, so it runs with type
+// information and can be used by go vet, see cmd/bintestvet.
+package analyzer
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"sort"
+
+	"golang.org/x/tools/go/analysis"
+	"golang.org/x/tools/go/analysis/passes/inspect"
+	"golang.org/x/tools/go/ast/inspector"
+)
+
+// Analyzer reports mocks whose expectations are never checked, mocks that are closed
+// without checking them, and expectations on stdin in functions that never set a command's
+// Stdin
+var Analyzer = &analysis.Analyzer{
+	Name:     "bintest",
+	Doc:      "report common misuse of bintest mocks, like expectations that are never checked",
+	Requires: []*analysis.Analyzer{inspect.Analyzer},
+	Run:      run,
+}
+
+const bintestPath = "github.com/buildkite/bintest/v3"
+
+var (
+	// methods of Mock that register expectations
+	expecters = map[string]bool{
+		"Expect":           true,
+		"ExpectAll":        true,
+		"LoadExpectations": true,
+	}
+
+	// methods of Mock that check expectations
+	checkers = map[string]bool{
+		"Check":         true,
+		"CheckAndClose": true,
+	}
+
+	// methods of Expectation that expect stdin
+	stdinMatchers = map[string]bool{
+		"WithStdin":       true,
+		"WithStdinBytes":  true,
+		"WithStdinGolden": true,
+		"WithStdinSHA256": true,
+		"WithStdinJSON":   true,
+		"WithStdinLines":  true,
+	}
+)
+
+// mockUsage is how a mock variable is used within a function
+type mockUsage struct {
+	name    string
+	pos     token.Pos
+	methods map[string]token.Pos
+	stdin   token.Pos
+	escapes bool
+}
+
+func run(pass *analysis.Pass) (interface{}, error) {
+	inspect := pass.ResultOf[inspect.Analyzer].(*inspector.Inspector)
+
+	inspect.Preorder([]ast.Node{(*ast.FuncDecl)(nil)}, func(n ast.Node) {
+		if fn := n.(*ast.FuncDecl); fn.Body != nil {
+			checkFunc(pass, fn.Body)
+		}
+	})
+
+	return nil, nil
+}
+
+func checkFunc(pass *analysis.Pass, body *ast.BlockStmt) {
+	mocks := map[types.Object]*mockUsage{}
+	setsStdin := false
+
+	// first find the mocks that are created and whether any command's Stdin is set
+	ast.Inspect(body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.AssignStmt:
+			for _, lhs := range n.Lhs {
+				if isCmdStdin(pass, lhs) {
+					setsStdin = true
+				}
+			}
+			if len(n.Rhs) != 1 || !isConstructor(pass, n.Rhs[0]) {
+				return true
+			}
+			for _, lhs := range n.Lhs {
+				ident, ok := lhs.(*ast.Ident)
+				if !ok || ident.Name == "_" {
+					continue
+				}
+				if obj := pass.TypesInfo.ObjectOf(ident); obj != nil && isBintestType(obj.Type(), "Mock") {
+					mocks[obj] = &mockUsage{name: ident.Name, pos: ident.Pos(), methods: map[string]token.Pos{}}
+				}
+			}
+		case *ast.CompositeLit:
+			if isExecCmd(pass.TypesInfo.TypeOf(n)) {
+				for _, elt := range n.Elts {
+					if kv, ok := elt.(*ast.KeyValueExpr); ok {
+						if key, ok := kv.Key.(*ast.Ident); ok && key.Name == "Stdin" {
+							setsStdin = true
+						}
+					}
+				}
+			}
+		}
+		return true
+	})
+
+	if len(mocks) == 0 {
+		return
+	}
+
+	// then find how they are used
+	ast.Inspect(body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.CallExpr:
+			markEscapes(pass, mocks, n.Args...)
+
+			sel, ok := n.Fun.(*ast.SelectorExpr)
+			if !ok {
+				return true
+			}
+			m := mocks[rootObject(pass, sel.X)]
+			if m == nil {
+				return true
+			}
+			switch name := sel.Sel.Name; {
+			case isMethodOf(pass, sel, "Mock"):
+				m.methods[name] = sel.Sel.Pos()
+			case isMethodOf(pass, sel, "Expectation") && stdinMatchers[name] && m.stdin == token.NoPos:
+				m.stdin = sel.Sel.Pos()
+			}
+		case *ast.ReturnStmt:
+			markEscapes(pass, mocks, n.Results...)
+		case *ast.CompositeLit:
+			markEscapes(pass, mocks, n.Elts...)
+		case *ast.KeyValueExpr:
+			markEscapes(pass, mocks, n.Value)
+		case *ast.AssignStmt:
+			markEscapes(pass, mocks, n.Rhs...)
+		case *ast.SendStmt:
+			markEscapes(pass, mocks, n.Value)
+		}
+		return true
+	})
+
+	usages := make([]*mockUsage, 0, len(mocks))
+	for _, m := range mocks {
+		usages = append(usages, m)
+	}
+	sort.Slice(usages, func(i, j int) bool {
+		return usages[i].pos < usages[j].pos
+	})
+
+	for _, m := range usages {
+		if m.escapes {
+			continue
+		}
+
+		var expects, checks bool
+		for method := range m.methods {
+			expects = expects || expecters[method]
+			checks = checks || checkers[method]
+		}
+
+		if expects && !checks {
+			name := m.name
+			msg := fmt.Sprintf("expectations on %s are never checked, call %s.Check(t) or %s.CheckAndClose(t)", name, name, name)
+			if _, ok := m.methods["Close"]; ok {
+				msg = fmt.Sprintf("%s is closed without checking expectations, use %s.CheckAndClose(t)", name, name)
+			}
+			pass.Reportf(m.pos, "%s", msg)
+		}
+
+		if m.stdin != token.NoPos && !setsStdin {
+			pass.Reportf(m.stdin, "%s expects stdin, but no command in this function sets Stdin", m.name)
+		}
+	}
+}
+
+// markEscapes marks mocks that are used as values in exprs, rather than having methods
+// called on them, as they might be checked somewhere else
+func markEscapes(pass *analysis.Pass, mocks map[types.Object]*mockUsage, exprs ...ast.Expr) {
+	for _, expr := range exprs {
+		if ident, ok := ast.Unparen(expr).(*ast.Ident); ok {
+			if m := mocks[pass.TypesInfo.Uses[ident]]; m != nil {
+				m.escapes = true
+			}
+		}
+	}
+}
+
+// isConstructor returns whether expr is a call to a bintest function or method that
+// returns a *Mock, like NewMock or Server.NewMock
+func isConstructor(pass *analysis.Pass, expr ast.Expr) bool {
+	call, ok := ast.Unparen(expr).(*ast.CallExpr)
+	if !ok {
+		return false
+	}
+	var ident *ast.Ident
+	switch fun := ast.Unparen(call.Fun).(type) {
+	case *ast.Ident:
+		ident = fun
+	case *ast.SelectorExpr:
+		ident = fun.Sel
+	default:
+		return false
+	}
+	fn, ok := pass.TypesInfo.Uses[ident].(*types.Func)
+	if !ok || fn.Pkg() == nil || fn.Pkg().Path() != bintestPath {
+		return false
+	}
+	results := fn.Type().(*types.Signature).Results()
+	for i := 0; i < results.Len(); i++ {
+		if isBintestType(results.At(i).Type(), "Mock") {
+			return true
+		}
+	}
+	return false
+}
+
+// isMethodOf returns whether sel selects a method of bintest's *typeName
+func isMethodOf(pass *analysis.Pass, sel *ast.SelectorExpr, typeName string) bool {
+	fn, ok := pass.TypesInfo.Uses[sel.Sel].(*types.Func)
+	if !ok {
+		return false
+	}
+	recv := fn.Type().(*types.Signature).Recv()
+	return recv != nil && isBintestType(recv.Type(), typeName)
+}
+
+// isBintestType returns whether t is a pointer to bintest's typeName
+func isBintestType(t types.Type, typeName string) bool {
+	ptr, ok := t.(*types.Pointer)
+	if !ok {
+		return false
+	}
+	named, ok := ptr.Elem().(*types.Named)
+	if !ok {
+		return false
+	}
+	obj := named.Obj()
+	return obj.Pkg() != nil && obj.Pkg().Path() == bintestPath && obj.Name() == typeName
+}
+
+// isCmdStdin returns whether expr is the Stdin field of an exec.Cmd
+func isCmdStdin(pass *analysis.Pass, expr ast.Expr) bool {
+	sel, ok := ast.Unparen(expr).(*ast.SelectorExpr)
+	if !ok || sel.Sel.Name != "Stdin" {
+		return false
+	}
+	selection, ok := pass.TypesInfo.Selections[sel]
+	return ok && selection.Kind() == types.FieldVal && isExecCmd(selection.Recv())
+}
+
+// isExecCmd returns whether t is an exec.Cmd or a pointer to one
+func isExecCmd(t types.Type) bool {
+	if ptr, ok := t.(*types.Pointer); ok {
+		t = ptr.Elem()
+	}
+	named, ok := t.(*types.Named)
+	if !ok {
+		return false
+	}
+	obj := named.Obj()
+	return obj.Pkg() != nil && obj.Pkg().Path() == "os/exec" && obj.Name() == "Cmd"
+}
+
+// rootObject finds the object at the start of a chain like m.Expect().AndExitWith(1)
+func rootObject(pass *analysis.Pass, x ast.Expr) types.Object {
+	for {
+		switch e := x.(type) {
+		case *ast.Ident:
+			return pass.TypesInfo.Uses[e]
+		case *ast.SelectorExpr:
+			x = e.X
+		case *ast.CallExpr:
+			x = e.Fun
+		case *ast.ParenExpr:
+			x = e.X
+		default:
+			return nil
+		}
+	}
+}
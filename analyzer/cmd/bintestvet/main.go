@@ -0,0 +1,16 @@
+// Command bintestvet reports misuse of bintest mocks in test code, see the analyzer package.
+// Run it with go vet:
+//
+//	go install github.com/buildkite/bintest/v3/analyzer/cmd/bintestvet@latest
+//	go vet -vettool=$(which bintestvet) ./...
+package main
+
+import (
+	"golang.org/x/tools/go/analysis/singlechecker"
+
+	"github.com/buildkite/bintest/v3/analyzer"
+)
+
+func main() {
+	singlechecker.Main(analyzer.Analyzer)
+}
@@ -0,0 +1,78 @@
+package example_test
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/bintest/v3"
+)
+
+func TestNeverChecked(t *testing.T) {
+	m, _ := bintest.NewMock("git") // want `expectations on m are never checked, call m.Check\(t\) or m.CheckAndClose\(t\)`
+	m.Expect("fetch").AndExitWith(0)
+}
+
+func TestClosedWithoutCheck(t *testing.T) {
+	m, _ := bintest.NewMock("git") // want `m is closed without checking expectations, use m.CheckAndClose\(t\)`
+	defer m.Close()
+	m.Expect("fetch")
+}
+
+func TestStdinNeverSet(t *testing.T) {
+	m, _ := bintest.NewMock("kubectl")
+	m.Expect("apply").WithStdin("manifest") // want `m expects stdin, but no command in this function sets Stdin`
+	_ = exec.Command(m.Path, "apply").Run()
+	_ = m.CheckAndClose(t)
+}
+
+func TestGoldenStdinNeverSet(t *testing.T) {
+	m, _ := bintest.NewMock("kubectl")
+	m.Expect("apply").WithStdinGolden(t, "testdata/manifest.golden") // want `m expects stdin, but no command in this function sets Stdin`
+	_ = exec.Command(m.Path, "apply").Run()
+	_ = m.CheckAndClose(t)
+}
+
+func TestFine(t *testing.T) {
+	m, _ := bintest.NewMock("kubectl")
+	m.Expect("apply").WithStdin("manifest")
+	cmd := exec.Command(m.Path, "apply")
+	cmd.Stdin = strings.NewReader("manifest")
+	m.Check(t)
+}
+
+func TestStdinInCommandLiteral(t *testing.T) {
+	m, _ := bintest.NewMock("kubectl")
+	m.Expect("apply").WithStdin("manifest")
+	cmd := &exec.Cmd{Path: m.Path, Stdin: strings.NewReader("manifest")}
+	_ = cmd.Run()
+	m.Check(t)
+}
+
+func TestEscapes(t *testing.T) {
+	m, _ := bintest.NewMock("git")
+	m.Expect("fetch")
+	bintest.CheckAll(t, m)
+}
+
+// other types with the same method and field names aren't mistaken for mocks and commands
+type fakeMock struct {
+	Stdin string
+}
+
+func newFakeMock() *fakeMock                        { return &fakeMock{} }
+func (f *fakeMock) Expect(args ...string) *fakeMock { return f }
+func (f *fakeMock) WithStdin(s string) *fakeMock    { return f }
+func (f *fakeMock) Close() error                    { return nil }
+
+func TestOtherTypes(t *testing.T) {
+	f := newFakeMock()
+	defer f.Close()
+	f.Expect("fetch")
+
+	// setting Stdin on something that isn't a command doesn't hide a missing one
+	m, _ := bintest.NewMock("kubectl")
+	m.Expect("apply").WithStdin("manifest") // want `m expects stdin, but no command in this function sets Stdin`
+	f.Stdin = "manifest"
+	m.Check(t)
+}
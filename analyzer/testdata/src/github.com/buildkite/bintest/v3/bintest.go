@@ -0,0 +1,23 @@
+// Package bintest is a stub of the real package with just enough for the analyzer tests
+package bintest
+
+type TestingT interface{}
+
+type Mock struct {
+	Path string
+}
+
+func NewMock(path string) (*Mock, error) { return &Mock{Path: path}, nil }
+
+func CheckAll(t TestingT, mocks ...*Mock) {}
+
+func (m *Mock) Expect(args ...interface{}) *Expectation { return &Expectation{} }
+func (m *Mock) Check(t TestingT) bool                   { return true }
+func (m *Mock) CheckAndClose(t TestingT) error          { return nil }
+func (m *Mock) Close() error                            { return nil }
+
+type Expectation struct{}
+
+func (e *Expectation) AndExitWith(code int) *Expectation                    { return e }
+func (e *Expectation) WithStdin(stdin interface{}) *Expectation             { return e }
+func (e *Expectation) WithStdinGolden(t TestingT, path string) *Expectation { return e }
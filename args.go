@@ -2,8 +2,13 @@ package bintest
 
 import (
 	"fmt"
+	"path"
+	"path/filepath"
 	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func ArgumentsFromStrings(s []string) Arguments {
@@ -134,6 +139,88 @@ func MatchPattern(pattern string) Matcher {
 	}
 }
 
+// MatchInt matches an integer argument from min to max inclusive
+func MatchInt(min, max int) Matcher {
+	return MatcherFunc{
+		f: func(s string) (bool, string) {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return false, fmt.Sprintf("Expected an integer, got %q", s)
+			}
+			if n < min || n > max {
+				return false, fmt.Sprintf("Expected an integer from %d to %d, got %d", min, max, n)
+			}
+			return true, ""
+		},
+		str: fmt.Sprintf("bintest.MatchInt(%d, %d)", min, max),
+	}
+}
+
+// MatchDuration matches an argument that time.ParseDuration can parse, like 30s or 1h15m
+func MatchDuration() Matcher {
+	return MatcherFunc{
+		f: func(s string) (bool, string) {
+			if _, err := time.ParseDuration(s); err != nil {
+				return false, fmt.Sprintf("Expected a duration like 30s, got %q", s)
+			}
+			return true, ""
+		},
+		str: "bintest.MatchDuration()",
+	}
+}
+
+// MatchAbsPath matches an argument that is an absolute path on the current platform
+func MatchAbsPath() Matcher {
+	return MatcherFunc{
+		f: func(s string) (bool, string) {
+			if !filepath.IsAbs(s) {
+				return false, fmt.Sprintf("Expected an absolute path, got %q", s)
+			}
+			return true, ""
+		},
+		str: "bintest.MatchAbsPath()",
+	}
+}
+
+// MatchPath matches an argument that is the same path as p once both are normalized, so
+// tests can match paths portably. Separators can be / or \ on Windows, case is ignored on
+// Windows and macOS, and the /private prefix macOS adds to temp dirs is ignored
+func MatchPath(p string) Matcher {
+	expected := normalizePath(p, runtime.GOOS)
+	return MatcherFunc{
+		f: func(s string) (bool, string) {
+			if normalizePath(s, runtime.GOOS) != expected {
+				return false, fmt.Sprintf("Expected path %q, got %q", p, s)
+			}
+			return true, ""
+		},
+		str: fmt.Sprintf("bintest.MatchPath(%q)", p),
+	}
+}
+
+// normalizePath returns p with forward slashes and the case and prefixes that goos ignores removed
+func normalizePath(p, goos string) string {
+	if goos == "windows" {
+		p = strings.ReplaceAll(p, `\`, "/")
+	}
+	p = path.Clean(p)
+
+	switch goos {
+	case "darwin":
+		// /var, /tmp and /etc are symlinks into /private, which resolved paths include
+		for _, dir := range []string{"/var", "/tmp", "/etc"} {
+			if p == "/private"+dir || strings.HasPrefix(p, "/private"+dir+"/") {
+				p = strings.TrimPrefix(p, "/private")
+				break
+			}
+		}
+		p = strings.ToLower(p)
+	case "windows":
+		p = strings.ToLower(p)
+	}
+	return p
+}
+
 // FormatStrings formats a slice of strings as quoted comma-separated arguments
 func FormatStrings(a []string) string {
 	var s = make([]string, len(a))
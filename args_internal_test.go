@@ -0,0 +1,24 @@
+package bintest
+
+import "testing"
+
+func TestNormalizePath(t *testing.T) {
+	var testCases = []struct {
+		goos, path, expected string
+	}{
+		{"linux", "foo/bar/", "foo/bar"},
+		{"linux", `foo\bar`, `foo\bar`},
+		{"linux", "/Foo/./bar", "/Foo/bar"},
+		{"linux", "/private/var/folders/x", "/private/var/folders/x"},
+		{"darwin", "/private/var/folders/X", "/var/folders/x"},
+		{"darwin", "/private/tmp", "/tmp"},
+		{"darwin", "/private/llamas", "/private/llamas"},
+		{"windows", `C:\Users\Llama\..\foo`, "c:/users/foo"},
+	}
+
+	for _, test := range testCases {
+		if actual := normalizePath(test.path, test.goos); actual != test.expected {
+			t.Errorf("Expected %q on %s to normalize to %q, got %q", test.path, test.goos, test.expected, actual)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package bintest_test
 
 import (
+	"path/filepath"
 	"testing"
 
 	"github.com/buildkite/bintest/v3"
@@ -76,3 +77,45 @@ func TestArgumentsToString(t *testing.T) {
 		}
 	}
 }
+
+func TestTypedMatchers(t *testing.T) {
+	abs, err := filepath.Abs("llamas")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var testCases = []struct {
+		matcher  bintest.Matcher
+		arg      string
+		expected string
+	}{
+		{bintest.MatchInt(1, 65535), "8080", ""},
+		{bintest.MatchInt(1, 65535), "http", `Expected an integer, got "http"`},
+		{bintest.MatchInt(1, 65535), "0", "Expected an integer from 1 to 65535, got 0"},
+		{bintest.MatchDuration(), "1h15m", ""},
+		{bintest.MatchDuration(), "10", `Expected a duration like 30s, got "10"`},
+		{bintest.MatchAbsPath(), abs, ""},
+		{bintest.MatchAbsPath(), "llamas", `Expected an absolute path, got "llamas"`},
+	}
+
+	for _, test := range testCases {
+		ok, msg := test.matcher.Match(test.arg)
+		if ok != (test.expected == "") || msg != test.expected {
+			t.Errorf("Expected %s to match %q with %q, got %v and %q", test.matcher, test.arg, test.expected, ok, msg)
+		}
+	}
+}
+
+func TestMatchPath(t *testing.T) {
+	m := bintest.MatchPath("foo/bar")
+
+	if ok, msg := m.Match(filepath.Join("foo", "bar")); !ok {
+		t.Fatalf("Expected a match, got %s", msg)
+	}
+	if ok, msg := m.Match("foo/baz"); ok || msg != `Expected path "foo/bar", got "foo/baz"` {
+		t.Fatalf("Expected a mismatch, got %v and %q", ok, msg)
+	}
+	if expected := `bintest.MatchPath("foo/bar")`; m.String() != expected {
+		t.Fatalf("Expected %s, got %s", expected, m.String())
+	}
+}
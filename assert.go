@@ -0,0 +1,98 @@
+package bintest
+
+import (
+	"strings"
+)
+
+// callsMatching returns how many recorded invocations match the arguments
+func (m *Mock) callsMatching(args []interface{}) int {
+	m.Lock()
+	defer m.Unlock()
+
+	var count int
+	for _, invocation := range m.invocations {
+		if Arguments(args).Match(invocation.Args...).IsMatch {
+			count++
+		}
+	}
+	return count
+}
+
+// formatInvocations lists the recorded invocations for failure messages
+func (m *Mock) formatInvocations() string {
+	m.Lock()
+	defer m.Unlock()
+
+	if len(m.invocations) == 0 {
+		return "  (none)"
+	}
+
+	lines := make([]string, len(m.invocations))
+	for idx, invocation := range m.invocations {
+		lines[idx] = "  " + m.Name + " " + FormatStrings(invocation.Args)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// AssertCalledWith checks that an invocation with matching arguments occurred, regardless
+// of the expectations on the mock. Arguments can be strings or Matchers
+func (m *Mock) AssertCalledWith(t TestingT, args ...interface{}) bool {
+	if h, ok := t.(helper); ok {
+		h.Helper()
+	}
+	if m.callsMatching(args) == 0 {
+		t.Errorf("Expected a call to %s %s, got calls:\n%s",
+			m.Name, FormatInterfaces(args), m.formatInvocations())
+		return false
+	}
+	return true
+}
+
+// AssertNotCalled checks that no invocation with matching arguments occurred
+func (m *Mock) AssertNotCalled(t TestingT, args ...interface{}) bool {
+	if h, ok := t.(helper); ok {
+		h.Helper()
+	}
+	if n := m.callsMatching(args); n > 0 {
+		t.Errorf("Expected no calls to %s %s, got %d",
+			m.Name, FormatInterfaces(args), n)
+		return false
+	}
+	return true
+}
+
+// AssertNumberOfCalls checks that exactly n invocations with matching arguments occurred
+func (m *Mock) AssertNumberOfCalls(t TestingT, n int, args ...interface{}) bool {
+	if h, ok := t.(helper); ok {
+		h.Helper()
+	}
+	if actual := m.callsMatching(args); actual != n {
+		t.Errorf("Expected %d calls to %s %s, got %d. Calls were:\n%s",
+			n, m.Name, FormatInterfaces(args), actual, m.formatInvocations())
+		return false
+	}
+	return true
+}
+
+// AssertOrder checks that invocations happened in the order they are passed, which can be
+// across different mocks, for instance AssertOrder(t, git.Invocation(0), docker.Invocation(0))
+func AssertOrder(t TestingT, invocations ...Invocation) bool {
+	if h, ok := t.(helper); ok {
+		h.Helper()
+	}
+	for idx, invocation := range invocations {
+		if invocation.Sequence == 0 {
+			t.Errorf("Expected invocation %d to have happened, but it didn't", idx)
+			return false
+		}
+		if idx == 0 {
+			continue
+		}
+		if prev := invocations[idx-1]; prev.Sequence >= invocation.Sequence {
+			t.Errorf("Expected %s %s to happen before %s %s",
+				prev.Name, FormatStrings(prev.Args), invocation.Name, FormatStrings(invocation.Args))
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,80 @@
+package bintest_test
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/bintest/v3"
+	"github.com/buildkite/bintest/v3/testutil"
+	"github.com/fortytw2/leaktest"
+)
+
+func TestMockAssertions(t *testing.T) {
+	defer leaktest.Check(t)()
+	m, close := mustMock(t, "llamas")
+	defer close()
+
+	m.IgnoreUnexpectedInvocations()
+
+	_ = exec.Command(m.Path, "eat", "grass").Run()
+	_ = exec.Command(m.Path, "eat", "hay").Run()
+
+	m.AssertCalledWith(t, "eat", "grass")
+	m.AssertCalledWith(t, "eat", bintest.MatchPattern(`^h`))
+	m.AssertNotCalled(t, "spit")
+	m.AssertNumberOfCalls(t, 2, "eat", bintest.MatchAny())
+
+	mt := &testutil.TestingT{}
+	if m.AssertCalledWith(mt, "spit") {
+		t.Errorf("AssertCalledWith should have failed")
+	}
+	if m.AssertNotCalled(mt, "eat", "hay") {
+		t.Errorf("AssertNotCalled should have failed")
+	}
+	if m.AssertNumberOfCalls(mt, 1, "eat", bintest.MatchAny()) {
+		t.Errorf("AssertNumberOfCalls should have failed")
+	}
+
+	expected := "Expected a call to llamas \"spit\", got calls:\n" +
+		"  llamas \"eat\", \"grass\"\n" +
+		"  llamas \"eat\", \"hay\""
+	if mt.Errors[0] != expected {
+		t.Errorf("Unexpected error %q", mt.Errors[0])
+	}
+	if !strings.HasPrefix(mt.Errors[2], "Expected 1 calls to llamas \"eat\", bintest.MatchAny(), got 2") {
+		t.Errorf("Unexpected error %q", mt.Errors[2])
+	}
+}
+
+func TestAssertOrder(t *testing.T) {
+	defer leaktest.Check(t)()
+	git, closeGit := mustMock(t, "git")
+	defer closeGit()
+	docker, closeDocker := mustMock(t, "docker")
+	defer closeDocker()
+
+	git.IgnoreUnexpectedInvocations()
+	docker.IgnoreUnexpectedInvocations()
+
+	_ = exec.Command(git.Path, "fetch").Run()
+	_ = exec.Command(docker.Path, "build").Run()
+	_ = exec.Command(git.Path, "push").Run()
+
+	if !bintest.AssertOrder(t, git.Invocation(0), docker.Invocation(0), git.Invocation(1)) {
+		t.Errorf("AssertOrder should have passed")
+	}
+
+	mt := &testutil.TestingT{}
+	if bintest.AssertOrder(mt, docker.Invocation(0), git.Invocation(0)) {
+		t.Errorf("AssertOrder should have failed")
+	}
+	if expected := `Expected docker "build" to happen before git "fetch"`; len(mt.Errors) != 1 || mt.Errors[0] != expected {
+		t.Errorf("Expected error %q, got %q", expected, mt.Errors)
+	}
+
+	mt = &testutil.TestingT{}
+	if bintest.AssertOrder(mt, git.Invocation(0), docker.Invocation(1)) {
+		t.Errorf("AssertOrder should have failed for a missing invocation")
+	}
+}
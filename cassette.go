@@ -0,0 +1,176 @@
+package bintest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Interaction is a single recorded invocation of a binary and its results
+type Interaction struct {
+	Args     []string `json:"args"`
+	Stdin    string   `json:"stdin,omitempty"`
+	Stdout   string   `json:"stdout,omitempty"`
+	Stderr   string   `json:"stderr,omitempty"`
+	ExitCode int      `json:"exitCode"`
+}
+
+// cassette records interactions with a real binary to a fixture file, or replays
+// them from the fixture without running the binary
+type cassette struct {
+	sync.Mutex
+
+	// The fixture file interactions are stored in
+	path string
+
+	// The real binary to record, empty when replaying
+	recordPath string
+
+	interactions []Interaction
+	replayed     []bool
+}
+
+func loadCassette(path string) (*cassette, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &cassette{path: path}
+	if err := json.Unmarshal(b, &c.interactions); err != nil {
+		return nil, fmt.Errorf("Error parsing cassette %s: %v", path, err)
+	}
+	c.replayed = make([]bool, len(c.interactions))
+
+	return c, nil
+}
+
+func (c *cassette) respond(call *Call, timeout time.Duration) {
+	stdin, err := io.ReadAll(call.Stdin)
+	if err != nil {
+		call.Fatal(err)
+		return
+	}
+
+	if c.recordPath != "" {
+		c.record(call, stdin, timeout)
+	} else {
+		c.replay(call, stdin)
+	}
+}
+
+func (c *cassette) record(call *Call, stdin []byte, timeout time.Duration) {
+	var stdout, stderr bytes.Buffer
+
+	call.Stdin = io.NopCloser(bytes.NewReader(stdin))
+	call.Stdout = teeWriteCloser{call.Stdout, &stdout}
+	call.Stderr = teeWriteCloser{call.Stderr, &stderr}
+	call.PassthroughWithTimeout(c.recordPath, timeout)
+
+	c.Lock()
+	defer c.Unlock()
+
+	c.interactions = append(c.interactions, Interaction{
+		Args:     call.Args[1:],
+		Stdin:    string(stdin),
+		Stdout:   stdout.String(),
+		Stderr:   stderr.String(),
+		ExitCode: call.exitCode,
+	})
+
+	b, err := json.MarshalIndent(c.interactions, "", "  ")
+	if err == nil {
+		err = os.WriteFile(c.path, b, 0o644)
+	}
+	if err != nil {
+		errorf("Failed to write cassette %s: %v", c.path, err)
+	}
+}
+
+func (c *cassette) replay(call *Call, stdin []byte) {
+	c.Lock()
+	interaction, ok := c.find(call.Args[1:], string(stdin))
+	c.Unlock()
+
+	if !ok {
+		call.Fatal(fmt.Errorf("No recorded interaction in %s for %s", c.path, FormatStrings(call.Args[1:])))
+		return
+	}
+
+	_, _ = io.WriteString(call.Stdout, interaction.Stdout)
+	_, _ = io.WriteString(call.Stderr, interaction.Stderr)
+	call.Exit(interaction.ExitCode)
+}
+
+// find returns the first interaction that hasn't been replayed yet that matches, falling
+// back to a previously replayed one so that interactions can be repeated
+func (c *cassette) find(args []string, stdin string) (Interaction, bool) {
+	found := -1
+	for idx, i := range c.interactions {
+		if !reflect.DeepEqual(i.Args, args) || i.Stdin != stdin {
+			continue
+		}
+		if !c.replayed[idx] {
+			found = idx
+			break
+		}
+		if found == -1 {
+			found = idx
+		}
+	}
+	if found == -1 {
+		return Interaction{}, false
+	}
+	c.replayed[found] = true
+	return c.interactions[found], true
+}
+
+type teeWriteCloser struct {
+	io.WriteCloser
+	copy io.Writer
+}
+
+func (t teeWriteCloser) Write(p []byte) (int, error) {
+	_, _ = t.copy.Write(p)
+	return t.WriteCloser.Write(p)
+}
+
+// RecordTo passes invocations through to the local command of the same name (looked up in PATH)
+// and records them to the fixture at path, which can later be used with ReplayFrom
+func (m *Mock) RecordTo(path string) *Mock {
+	m.Lock()
+	defer m.Unlock()
+	debugf("[mock] Looking up %s in path", m.Name)
+	recordPath, err := m.localCommand()
+	if err != nil {
+		panic(err)
+	}
+	m.cassette = &cassette{path: path, recordPath: recordPath}
+	return m
+}
+
+// ReplayFrom responds to invocations with the interactions recorded with RecordTo, without
+// executing the real command
+func (m *Mock) ReplayFrom(path string) *Mock {
+	m.Lock()
+	defer m.Unlock()
+	c, err := loadCassette(path)
+	if err != nil {
+		panic(err)
+	}
+	m.cassette = c
+	return m
+}
+
+// RecordOrReplay replays from the fixture at path if it exists, otherwise it records to it
+func (m *Mock) RecordOrReplay(path string) *Mock {
+	if _, err := os.Stat(path); err == nil {
+		return m.ReplayFrom(path)
+	}
+	return m.RecordTo(path)
+}
@@ -0,0 +1,62 @@
+package bintest_test
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fortytw2/leaktest"
+)
+
+func TestMockRecordAndReplay(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	fixture := filepath.Join(t.TempDir(), "tr.json")
+
+	run := func(path string) string {
+		cmd := exec.Command(path, "a-z", "A-Z")
+		cmd.Stdin = strings.NewReader("llamas")
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(out)
+	}
+
+	recorder, close := mustMock(t, "tr")
+	recorder.RecordOrReplay(fixture)
+	recorder.Expect("a-z", "A-Z")
+
+	if out := run(recorder.Path); out != "LLAMAS" {
+		t.Fatalf("Expected recorded output %q, got %q", "LLAMAS", out)
+	}
+	if recorder.Check(t) == false {
+		t.Errorf("Assertions should have passed")
+	}
+	close()
+
+	if _, err := os.Stat(fixture); err != nil {
+		t.Fatalf("Expected fixture to be written: %v", err)
+	}
+
+	replayer, close := mustMock(t, "tr")
+	defer close()
+
+	// replace the recording with something that can't have come from tr
+	b, _ := os.ReadFile(fixture)
+	if err := os.WriteFile(fixture, []byte(strings.Replace(string(b), "LLAMAS", "ALPACAS", 1)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	replayer.RecordOrReplay(fixture)
+	replayer.Expect("a-z", "A-Z")
+
+	if out := run(replayer.Path); out != "ALPACAS" {
+		t.Fatalf("Expected replayed output %q, got %q", "ALPACAS", out)
+	}
+	if replayer.Check(t) == false {
+		t.Errorf("Assertions should have passed")
+	}
+}
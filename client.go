@@ -1,31 +1,166 @@
 package bintest
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
+)
+
+const (
+	// TransportEnvVar selects the transport the client uses to talk to the server
+	TransportEnvVar = `BINTEST_TRANSPORT`
+
+	// TransportHTTP makes separate HTTP requests for the call, stdin, stdout, stderr and exit code
+	TransportHTTP = `http`
+
+	// TransportStream runs the call over a single connection with the streams multiplexed
+	// as frames. It's bintest's own protocol rather than gRPC, which would add dependencies
+	TransportStream = `stream`
+
+	// TransportWebSocket is like TransportStream, but over a websocket, which is more
+	// likely to make it through HTTP proxies
+	TransportWebSocket = `websocket`
+
+	// FallbackEnvVar makes clients run the real binary from later in PATH when the server
+	// can't be reached, for instance once the test that installed a mock has finished
+	FallbackEnvVar = `BINTEST_FALLBACK_TO_REAL_BINARY`
+
+	// ExtraFilesEnvVar is the number of files after stdio, starting at fd 3, that the
+	// client forwards to the call, see Call.ExtraFiles. Only TransportStream and
+	// TransportWebSocket forward extra files, and only on unix
+	ExtraFilesEnvVar = `BINTEST_EXTRA_FILES`
+
+	// CombinedOutputEnvVar makes the client receive stdout and stderr in the order the call
+	// wrote them, rather than as separate streams which can be reordered
+	CombinedOutputEnvVar = `BINTEST_COMBINED_OUTPUT`
+
+	// StdinEnvVar overrides whether the client sends stdin to the server, it's one of
+	// StdinAuto, StdinAlways or StdinNever
+	StdinEnvVar = `BINTEST_STDIN`
+
+	// StdinAuto sends stdin unless it's a terminal
+	StdinAuto = `auto`
+
+	// StdinAlways sends stdin, even if it's a terminal
+	StdinAlways = `always`
+
+	// StdinNever closes stdin without reading it
+	StdinNever = `never`
+
+	// DialTimeoutEnvVar overrides how long the client waits to connect to the server, as a
+	// duration like 5s. Zero waits forever
+	DialTimeoutEnvVar = `BINTEST_DIAL_TIMEOUT`
+
+	// ResponseHeaderTimeoutEnvVar overrides how long the client waits for the server to
+	// respond to requests that should be answered straight away, as a duration like 30s.
+	// Zero waits forever
+	ResponseHeaderTimeoutEnvVar = `BINTEST_RESPONSE_HEADER_TIMEOUT`
+
+	// DefaultClientDialTimeout is how long NewClient clients wait to connect to the server
+	DefaultClientDialTimeout = 10 * time.Second
+
+	// DefaultClientResponseHeaderTimeout is how long NewClient clients wait for the server to
+	// start a call. It's generous as calls can queue for a slot, see Server.SetMaxConcurrentCalls
+	DefaultClientResponseHeaderTimeout = time.Minute
+
+	// DefaultClientRetries is how many times NewClient clients retry connecting to the server
+	DefaultClientRetries = 5
+
+	// DefaultClientRetryBackoff is how long NewClient clients wait before the first retry,
+	// which doubles for each retry after that
+	DefaultClientRetryBackoff = 20 * time.Millisecond
 )
 
 type Client struct {
 	Debug bool
 	URL   string
 
+	// Transport is one of TransportHTTP, TransportStream or TransportWebSocket. NewClient
+	// defaults to TransportStream, an empty value uses TransportHTTP
+	Transport string
+
 	Args []string
 	Dir  string
 	Env  []string
 	PID  int
 
+	// The process that ran the client, ParentPath is empty if it can't be determined
+	ParentPID  int
+	ParentPath string
+
+	// Caller is the command line of the process that ran the client, empty if it can't be
+	// determined
+	Caller string
+
 	Stdin  io.ReadCloser
 	Stdout io.WriteCloser
 	Stderr io.WriteCloser
+
+	// StderrIsTerminal is whether Stderr is a terminal, so that errors from mocks are only
+	// colored when they will be displayed. NewClient detects it
+	StderrIsTerminal bool
+
+	// CombinedOutput receives stdout and stderr in the order the call wrote them, which
+	// keeps their interleaving for CombinedOutput() style assertions. NewClient sets it from
+	// CombinedOutputEnvVar
+	CombinedOutput bool
+
+	// ExtraFiles are forwarded to the call as Call.ExtraFiles. Read-only files are read
+	// and sent to the call, the others receive what the call writes. NewClient sets them
+	// from ExtraFilesEnvVar
+	ExtraFiles []*os.File
+
+	// StdinMode is one of StdinAuto, StdinAlways or StdinNever. NewClient sets it from
+	// StdinEnvVar, an empty value is StdinAuto
+	StdinMode string
+
+	// Retries is how many times to retry requests that couldn't connect to the server, which
+	// happens occasionally with loopback listeners under load. Requests that reached the
+	// server aren't retried. RetryBackoff is the wait before the first retry, it doubles after
+	Retries      int
+	RetryBackoff time.Duration
+
+	// FallbackToRealBinary runs the next binary of the same name in PATH if the server
+	// can't be reached, rather than failing
+	FallbackToRealBinary bool
+
+	// DialTimeout limits how long connecting to the server takes. ResponseHeaderTimeout
+	// limits how long the server takes to respond to starting a call, but not how long the
+	// call's output and exit code take, which are as long as the call runs. Zero is no limit
+	DialTimeout           time.Duration
+	ResponseHeaderTimeout time.Duration
+
+	// Token is sent with every request, for servers that require one, see
+	// NewExternalServer. NewClient sets it from TokenEnvVar
+	Token string
+
+	// TLSConfig is used to connect to servers with MutualTLS. NewClient sets it from
+	// TLSEnvVar, see ClientTLSConfig
+	TLSConfig *tls.Config
+
+	// an error from NewClient's configuration, which Run reports
+	configErr error
+
+	httpClientsOnce sync.Once
+	httpClient      *http.Client
+	streamingClient *http.Client
 }
 
 func NewClient(URL string) *Client {
@@ -34,16 +169,69 @@ func NewClient(URL string) *Client {
 		panic(err)
 	}
 
+	transport := os.Getenv(TransportEnvVar)
+	if transport == `` {
+		transport = TransportStream
+	}
+
+	var tlsConfig *tls.Config
+	var configErr error
+	if bundle := os.Getenv(TLSEnvVar); bundle != "" {
+		tlsConfig, configErr = ClientTLSConfig(bundle)
+	}
+
 	return &Client{
-		URL:    URL,
-		Args:   os.Args,
-		Env:    os.Environ(),
-		Dir:    wd,
-		Stdin:  os.Stdin,
-		Stdout: os.Stdout,
-		Stderr: os.Stderr,
-		PID:    os.Getpid(),
+		URL:              URL,
+		Transport:        transport,
+		Args:             os.Args,
+		Env:              os.Environ(),
+		Dir:              wd,
+		Stdin:            os.Stdin,
+		Stdout:           os.Stdout,
+		Stderr:           os.Stderr,
+		StderrIsTerminal: isTerminal(os.Stderr),
+		PID:              os.Getpid(),
+		ParentPID:        os.Getppid(),
+		ParentPath:       processExecutable(os.Getppid()),
+		Caller:           processCommandLine(os.Getppid()),
+		ExtraFiles:       inheritedFiles(extraFilesCount()),
+
+		StdinMode: os.Getenv(StdinEnvVar),
+
+		Retries:      DefaultClientRetries,
+		RetryBackoff: DefaultClientRetryBackoff,
+
+		Token:     os.Getenv(TokenEnvVar),
+		TLSConfig: tlsConfig,
+		configErr: configErr,
+
+		DialTimeout:           durationFromEnv(DialTimeoutEnvVar, DefaultClientDialTimeout),
+		ResponseHeaderTimeout: durationFromEnv(ResponseHeaderTimeoutEnvVar, DefaultClientResponseHeaderTimeout),
+
+		FallbackToRealBinary: os.Getenv(FallbackEnvVar) == "true" || os.Getenv(FallbackEnvVar) == "1",
+		CombinedOutput:       os.Getenv(CombinedOutputEnvVar) == "true" || os.Getenv(CombinedOutputEnvVar) == "1",
+	}
+}
+
+// extraFilesCount returns how many extra files ExtraFilesEnvVar says to forward
+func extraFilesCount() int {
+	n, err := strconv.Atoi(os.Getenv(ExtraFilesEnvVar))
+	if err != nil || n < 0 {
+		return 0
+	}
+	if n > maxExtraFiles {
+		return maxExtraFiles
 	}
+	return n
+}
+
+// durationFromEnv parses envVar as a duration, or returns def if it's unset or invalid
+func durationFromEnv(envVar string, def time.Duration) time.Duration {
+	d, err := time.ParseDuration(os.Getenv(envVar))
+	if err != nil || d < 0 {
+		return def
+	}
+	return d
 }
 
 func NewClientFromEnv() *Client {
@@ -54,8 +242,44 @@ func NewClientFromEnv() *Client {
 	return NewClient(server)
 }
 
-// Run the client, panics on error and returns an exit code on success
+// ClientErrorExitCode is the exit code of proxied binaries that fail to talk to the server,
+// which is reserved so that it can be told apart from exit codes the mocks provide
+const ClientErrorExitCode = 27
+
+// Run the client and return the exit code. If the client fails to talk to the server, a one
+// line error is written to Stderr and ClientErrorExitCode is returned
 func (c *Client) Run() int {
+	exitCode, err := c.run()
+	if err != nil {
+		c.debugf("Error from server: %v", err)
+
+		stderr := io.Writer(c.Stderr)
+		if c.Stderr == nil {
+			stderr = os.Stderr
+		}
+
+		var unreachable *serverUnreachableError
+		if errors.As(err, &unreachable) && c.FallbackToRealBinary {
+			return c.runRealBinary(stderr)
+		}
+
+		if unreachable == nil && isConnectError(err) {
+			fmt.Fprintf(stderr, "bintest: server unreachable at %s: %v\n", c.URL, err)
+		} else {
+			fmt.Fprintf(stderr, "bintest: %v\n", err)
+		}
+		return ClientErrorExitCode
+	}
+
+	c.debugf("Got an exit code of %d", exitCode)
+	return exitCode
+}
+
+func (c *Client) run() (int, error) {
+	if c.configErr != nil {
+		return 0, c.configErr
+	}
+
 	c.debugf("Invoked with %v", c.Args)
 	c.debugf("Server is %s", c.URL)
 
@@ -74,34 +298,66 @@ func (c *Client) Run() int {
 		// Typically, allowing PATH to include . is a security vulnerability.
 		// However, we're not in control of how we were invoked.
 		if err != nil && !errors.Is(err, exec.ErrDot) {
-			panic(err)
+			return 0, err
 		}
 		filename, err := filepath.Abs(lookpath)
 		if err != nil {
-			panic(err)
+			return 0, err
 		}
 		c.debugf("Using executable %s in place of relative %s", filename, args[0])
 		args[0] = filename
 	}
 
 	var req = callRequest{
-		PID:      c.PID,
-		Args:     c.Args,
-		Env:      c.Env,
-		Dir:      c.Dir,
-		HasStdin: c.isStdinReadable(),
+		PID:        c.PID,
+		ParentPID:  c.ParentPID,
+		ParentPath: c.ParentPath,
+		Caller:     c.Caller,
+		Args:       c.Args,
+		Env:        c.Env,
+		Dir:        c.Dir,
+		HasStdin:   c.isStdinReadable(),
+
+		StderrIsTerminal: c.StderrIsTerminal,
+		CombinedOutput:   c.CombinedOutput,
+	}
+
+	if c.Transport == TransportStream || c.Transport == TransportWebSocket {
+		req.LazyStdin = true
+		for _, f := range c.ExtraFiles {
+			req.ExtraFilesReadOnly = append(req.ExtraFilesReadOnly, isReadOnly(f))
+		}
+		return c.runStream(req)
+	}
+
+	if len(c.ExtraFiles) > 0 {
+		c.debugf("Not forwarding %d extra files, the %s transport doesn't support them", len(c.ExtraFiles), c.Transport)
 	}
 
 	// Fire off an initial request to start the flow
-	if err := c.postJSON(c.URL+`/calls/new`, req); err != nil {
-		c.debugf("Error from server: %v", err)
-		panic(err)
+	var call callResponse
+	if err := c.postJSON(c.URL+`/calls/new`, req, &call); err != nil {
+		if isConnectError(err) {
+			return 0, &serverUnreachableError{URL: c.URL, err: err}
+		}
+		return 0, err
+	}
+
+	// the first error from the goroutines that copy the streams
+	var streamErr error
+	var streamErrMu sync.Mutex
+	setStreamErr := func(err error) {
+		streamErrMu.Lock()
+		defer streamErrMu.Unlock()
+		if streamErr == nil {
+			streamErr = err
+		}
 	}
 
 	var wg sync.WaitGroup
 	wg.Add(2)
 
-	if c.isStdinReadable() {
+	if req.HasStdin {
 		go func() {
 			r, w := io.Pipe()
 			wg.Add(1)
@@ -109,7 +365,7 @@ func (c *Client) Run() int {
 			go func() {
 				defer wg.Done()
 				c.debugf("Copying from Stdin")
-				_, err := io.Copy(w, os.Stdin)
+				_, err := io.Copy(w, c.Stdin)
 				if err != nil {
 					c.debugf("Error copying from stdin: %v", err)
 					_ = w.CloseWithError(err)
@@ -119,18 +375,21 @@ func (c *Client) Run() int {
 				c.debugf("Done copying from Stdin")
 			}()
 
-			stdinReq, stdinErr := http.NewRequest("POST", fmt.Sprintf("%s/calls/%d/stdin", c.URL, req.PID), r)
+			stdinReq, stdinErr := http.NewRequest("POST", fmt.Sprintf("%s/calls/%d/stdin", c.URL, call.ID), r)
 			if stdinErr != nil {
-				panic(stdinErr)
+				setStreamErr(stdinErr)
+				return
 			}
 
-			resp, err := http.DefaultClient.Do(stdinReq)
+			resp, err := c.streamingHTTPClient().Do(stdinReq)
 			if err != nil {
-				panic(err)
+				setStreamErr(err)
+				return
 			}
+			_ = resp.Body.Close()
 
 			if resp.StatusCode != http.StatusOK {
-				panic(fmt.Errorf(
+				setStreamErr(fmt.Errorf(
 					"Request to %s failed: %s",
 					resp.Request.URL.String(),
 					resp.Status))
@@ -143,38 +402,220 @@ func (c *Client) Run() int {
 		c.debugf("No stdin, skipping")
 	}
 
-	go func() {
-		c.debugf("Reading stdout")
-		err := c.getStream(fmt.Sprintf("/calls/%d/stdout", req.PID), c.Stdout, &wg)
-		if err != nil {
-			panic(err)
-		}
-	}()
+	if req.CombinedOutput {
+		wg.Done()
+		go func() {
+			defer wg.Done()
+			c.debugf("Reading combined output")
+			if err := c.getCombinedOutput(fmt.Sprintf("/calls/%d/output", call.ID)); err != nil {
+				setStreamErr(err)
+			}
+		}()
+	} else {
+		go func() {
+			c.debugf("Reading stdout")
+			err := c.getStream(fmt.Sprintf("/calls/%d/stdout", call.ID), c.Stdout, &wg)
+			if err != nil {
+				setStreamErr(err)
+				wg.Done()
+			}
+		}()
 
-	go func() {
-		c.debugf("Reading stderr")
-		err := c.getStream(fmt.Sprintf("/calls/%d/stderr", req.PID), c.Stderr, &wg)
-		if err != nil {
-			panic(err)
-		}
-	}()
+		go func() {
+			c.debugf("Reading stderr")
+			err := c.getStream(fmt.Sprintf("/calls/%d/stderr", call.ID), c.Stderr, &wg)
+			if err != nil {
+				setStreamErr(err)
+				wg.Done()
+			}
+		}()
+	}
 
 	c.debugf("Waiting for streams to finish")
 	wg.Wait()
 	c.debugf("Streams finished, waiting for exit code")
 
-	exitCodeResp, err := http.Get(fmt.Sprintf("%s/calls/%d/exitcode", c.URL, req.PID))
+	streamErrMu.Lock()
+	err := streamErr
+	streamErrMu.Unlock()
 	if err != nil {
-		panic(err)
+		return 0, err
+	}
+
+	var exitCodeResp *http.Response
+	err = c.retry(func() (err error) {
+		exitCodeResp, err = c.streamingHTTPClient().Get(fmt.Sprintf("%s/calls/%d/exitcode", c.URL, call.ID))
+		return err
+	})
+	if err != nil {
+		return 0, err
 	}
+	defer exitCodeResp.Body.Close()
 
 	var exitCode int
 	if err = json.NewDecoder(exitCodeResp.Body).Decode(&exitCode); err != nil {
-		panic(err)
+		return 0, fmt.Errorf("Failed to read exit code: %v", err)
 	}
 
-	c.debugf("Got an exit code of %d", exitCode)
-	return exitCode
+	return exitCode, nil
+}
+
+// runStream runs the call over a single upgraded connection, see stream.go
+func (c *Client) runStream(req callRequest) (int, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return 0, err
+	}
+
+	var conn net.Conn
+	err = c.retry(func() (err error) {
+		conn, err = c.dial(u)
+		return err
+	})
+	if err != nil {
+		return 0, &serverUnreachableError{URL: c.URL, err: err}
+	}
+	defer conn.Close()
+
+	var wsKey string
+	if c.Transport == TransportWebSocket {
+		key := make([]byte, 16)
+		_, _ = rand.Read(key)
+		wsKey = base64.StdEncoding.EncodeToString(key)
+
+		fmt.Fprintf(conn, "GET /calls/websocket HTTP/1.1\r\n"+
+			"Host: %s\r\n"+
+			"Connection: Upgrade\r\n"+
+			"Upgrade: websocket\r\n"+
+			"Sec-WebSocket-Version: 13\r\n"+
+			"Sec-WebSocket-Key: %s\r\n%s\r\n", u.Host, wsKey, c.tokenHeaderLine())
+	} else {
+		fmt.Fprintf(conn, "POST /calls/stream HTTP/1.1\r\n"+
+			"Host: %s\r\n"+
+			"Connection: Upgrade\r\n"+
+			"Upgrade: %s\r\n%s\r\n", u.Host, streamUpgrade, c.tokenHeaderLine())
+	}
+
+	if c.ResponseHeaderTimeout > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(c.ResponseHeaderTimeout))
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		return 0, err
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return 0, fmt.Errorf("Upgrade request to %s failed: %s", c.URL, resp.Status)
+	}
+
+	var r io.Reader = br
+	var w io.Writer = conn
+
+	if wsKey != "" {
+		if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != websocketAccept(wsKey) {
+			return 0, fmt.Errorf("Invalid Sec-WebSocket-Accept %q", accept)
+		}
+		r = &wsReader{r: br}
+		w = &wsWriter{w: bufio.NewWriter(conn), mask: true}
+	}
+
+	var writeMu sync.Mutex
+	send := func(t byte, payload []byte) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return writeFrame(w, t, payload)
+	}
+
+	b, err := json.Marshal(req)
+	if err != nil {
+		return 0, err
+	}
+	if err := send(frameCall, b); err != nil {
+		return 0, err
+	}
+
+	// stdin is only read once the call reads it, so that input the call doesn't use is left
+	// for whatever reads stdin next
+	var stdinOnce sync.Once
+	copyStdin := func() {
+		go func() {
+			c.debugf("Copying from Stdin")
+			buf := make([]byte, 32*1024)
+			for {
+				n, err := c.Stdin.Read(buf)
+				if n > 0 {
+					if werr := send(frameStdin, buf[:n]); werr != nil {
+						return
+					}
+				}
+				if err != nil {
+					c.debugf("Done copying from Stdin: %v", err)
+					_ = send(frameStdin, nil)
+					return
+				}
+			}
+		}()
+	}
+
+	if req.HasStdin && !req.LazyStdin {
+		stdinOnce.Do(copyStdin)
+	} else if !req.HasStdin && c.Stdin != nil {
+		c.debugf("Closing stdin, nothing to read")
+		_ = c.Stdin.Close()
+	}
+
+	for i, readOnly := range req.ExtraFilesReadOnly {
+		if !readOnly {
+			continue
+		}
+		go func(idx byte, f *os.File) {
+			c.debugf("Copying from extra file %d", idx)
+			buf := make([]byte, 32*1024)
+			for {
+				n, err := f.Read(buf[1:])
+				if n > 0 {
+					buf[0] = idx
+					if werr := send(frameFile, buf[:n+1]); werr != nil {
+						return
+					}
+				}
+				if err != nil {
+					c.debugf("Done copying from extra file %d: %v", idx, err)
+					_ = send(frameFile, []byte{idx})
+					return
+				}
+			}
+		}(byte(i), c.ExtraFiles[i])
+	}
+
+	for {
+		t, payload, err := readFrame(r)
+		if err != nil {
+			return 0, err
+		}
+		switch t {
+		case frameStdout:
+			_, _ = c.Stdout.Write(payload)
+		case frameStderr:
+			_, _ = c.Stderr.Write(payload)
+		case frameStdinRequest:
+			if req.HasStdin {
+				stdinOnce.Do(copyStdin)
+			}
+		case frameFile:
+			if len(payload) == 0 || int(payload[0]) >= len(c.ExtraFiles) {
+				continue
+			}
+			if f := c.ExtraFiles[payload[0]]; len(payload) == 1 {
+				_ = f.Close()
+			} else {
+				_, _ = f.Write(payload[1:])
+			}
+		case frameExit:
+			return exitCodeFromFrame(payload)
+		}
+	}
 }
 
 func (c *Client) isStdinReadable() bool {
@@ -183,17 +624,32 @@ func (c *Client) isStdinReadable() bool {
 		return false
 	}
 
-	// check that we have a named pipe with stuff to read
+	switch c.StdinMode {
+	case StdinAlways:
+		c.debugf("Reading stdin, %s is %s", StdinEnvVar, StdinAlways)
+		return true
+	case StdinNever:
+		c.debugf("Not reading stdin, %s is %s", StdinEnvVar, StdinNever)
+		return false
+	}
+
+	// stdin is streamed to the server as it's read until it's closed, so everything but a
+	// terminal is sent, regardless of how much is available up front
 	// See https://stackoverflow.com/a/26567513
 	if stdinFile, ok := c.Stdin.(*os.File); ok {
-		stat, _ := stdinFile.Stat()
+		stat, err := stdinFile.Stat()
+		if err != nil {
+			c.debugf("Failed to stat stdin, assuming it's readable: %v", err)
+			return true
+		}
+
 		if (stat.Mode() & os.ModeCharDevice) != 0 {
 			c.debugf("Stdin is a terminal, nothing to read")
 			return false
 		}
 
-		if stat.Size() > 0 {
-			c.debugf("Stdin has %d bytes to read", stat.Size())
+		if (stat.Mode() & os.ModeNamedPipe) != 0 {
+			c.debugf("Stdin is a pipe")
 			return true
 		}
 	}
@@ -208,7 +664,7 @@ func (c *Client) debugf(pattern string, args ...interface{}) {
 		b := bytes.NewBufferString(fmt.Sprintf(format, args...))
 		u := c.URL + "/debug"
 
-		resp, err := http.Post(u, "text/plain; charset=utf-8", b)
+		resp, err := c.requestHTTPClient().Post(u, "text/plain; charset=utf-8", b)
 		if err != nil {
 			log.Printf("Error posting to debug: %v", err)
 		} else {
@@ -217,8 +673,215 @@ func (c *Client) debugf(pattern string, args ...interface{}) {
 	}
 }
 
+// serverUnreachableError is returned when the call couldn't be started because the server
+// couldn't be reached
+type serverUnreachableError struct {
+	URL string
+	err error
+}
+
+func (e *serverUnreachableError) Error() string {
+	return fmt.Sprintf("server unreachable at %s: %v", e.URL, e.err)
+}
+
+func (e *serverUnreachableError) Unwrap() error {
+	return e.err
+}
+
+// runRealBinary runs the next binary in PATH with the same name as the proxy and returns its
+// exit code, for when the server is gone
+func (c *Client) runRealBinary(stderr io.Writer) int {
+	path, err := c.realBinary()
+	if err != nil {
+		fmt.Fprintf(stderr, "bintest: server unreachable at %s, and %v\n", c.URL, err)
+		return ClientErrorExitCode
+	}
+
+	c.debugf("Server unreachable, falling back to %s", path)
+
+	cmd := exec.Command(path, c.Args[1:]...)
+	cmd.Dir = c.Dir
+	cmd.Env = c.Env
+	cmd.Stdin = c.Stdin
+	cmd.Stdout = c.Stdout
+	cmd.Stderr = c.Stderr
+
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return exitErr.ExitCode()
+		}
+		fmt.Fprintf(stderr, "bintest: failed to run %s: %v\n", path, err)
+		return ClientErrorExitCode
+	}
+
+	return 0
+}
+
+// realBinary finds the first binary in PATH with the same name as the proxy that isn't the proxy
+func (c *Client) realBinary() (string, error) {
+	name := filepath.Base(c.Args[0])
+
+	var self []os.FileInfo
+	for _, path := range []string{c.Args[0], executable()} {
+		if info, err := os.Stat(path); err == nil {
+			self = append(self, info)
+		}
+	}
+
+	pathEnv := os.Getenv("PATH")
+	for _, e := range c.Env {
+		if pair := strings.SplitN(e, "=", 2); len(pair) == 2 && strings.EqualFold(pair[0], "PATH") {
+			pathEnv = pair[1]
+		}
+	}
+
+	for _, dir := range filepath.SplitList(pathEnv) {
+		if dir == "" {
+			continue
+		}
+		path, err := exec.LookPath(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		isSelf := false
+		for _, s := range self {
+			if os.SameFile(s, info) {
+				isSelf = true
+			}
+		}
+		if !isSelf {
+			return path, nil
+		}
+	}
+
+	return "", fmt.Errorf("no real %s found in PATH", name)
+}
+
+func executable() string {
+	path, _ := os.Executable()
+	return path
+}
+
+// retry calls f until it succeeds, it fails with an error other than failing to connect,
+// or it has been retried c.Retries times
+func (c *Client) retry(f func() error) error {
+	backoff := c.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= c.Retries || !isConnectError(err) {
+			return err
+		}
+		c.debugf("Failed to connect to server, retrying in %v: %v", backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// isConnectError returns whether err is from failing to connect, in which case the request
+// never made it to the server and is safe to retry
+func isConnectError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// dial connects to the server at u for the stream transports, over TLS if the client has
+// a TLSConfig
+func (c *Client) dial(u *url.URL) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", u.Host, c.DialTimeout)
+	if err != nil || c.TLSConfig == nil {
+		return conn, err
+	}
+
+	config := c.TLSConfig.Clone()
+	if config.ServerName == "" {
+		config.ServerName = u.Hostname()
+	}
+
+	if c.DialTimeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(c.DialTimeout))
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	return tlsConn, nil
+}
+
+// tokenHeaderLine returns the header line for the client's Token, or nothing if it has none
+func (c *Client) tokenHeaderLine() string {
+	if c.Token == "" {
+		return ""
+	}
+	return TokenHeader + ": " + c.Token + "\r\n"
+}
+
+// requestHTTPClient returns the client for requests the server answers straight away, which
+// are limited by DialTimeout and ResponseHeaderTimeout
+func (c *Client) requestHTTPClient() *http.Client {
+	c.initHTTPClients()
+	return c.httpClient
+}
+
+// streamingHTTPClient returns the client for requests that last as long as the call, which
+// are only limited by DialTimeout
+func (c *Client) streamingHTTPClient() *http.Client {
+	c.initHTTPClients()
+	return c.streamingClient
+}
+
+func (c *Client) initHTTPClients() {
+	c.httpClientsOnce.Do(func() {
+		dialer := &net.Dialer{Timeout: c.DialTimeout, KeepAlive: 30 * time.Second}
+
+		// the server is local, or at least never behind the HTTP_PROXY a test environment
+		// sets for reaching the internet, and Go only bypasses proxies for loopback hosts
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.Proxy = nil
+		transport.DialContext = dialer.DialContext
+		transport.TLSClientConfig = c.TLSConfig
+		transport.ResponseHeaderTimeout = c.ResponseHeaderTimeout
+		c.httpClient = &http.Client{Transport: c.withToken(transport)}
+
+		streaming := transport.Clone()
+		streaming.ResponseHeaderTimeout = 0
+		c.streamingClient = &http.Client{Transport: c.withToken(streaming)}
+	})
+}
+
+// withToken returns rt, adding the client's Token to requests if it has one
+func (c *Client) withToken(rt http.RoundTripper) http.RoundTripper {
+	if c.Token == "" {
+		return rt
+	}
+	return tokenTransport{rt: rt, token: c.Token}
+}
+
+// tokenTransport adds a server's token to requests
+type tokenTransport struct {
+	rt    http.RoundTripper
+	token string
+}
+
+func (t tokenTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set(TokenHeader, t.token)
+	return t.rt.RoundTrip(r)
+}
+
 func (c *Client) get(path string) (*http.Response, error) {
-	resp, err := http.Get(c.URL + path)
+	var resp *http.Response
+	err := c.retry(func() (err error) {
+		resp, err = c.streamingHTTPClient().Get(c.URL + path)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -250,16 +913,45 @@ func (c *Client) getStream(path string, w io.WriteCloser, wg *sync.WaitGroup) er
 	return nil
 }
 
-func (c *Client) postJSON(url string, from interface{}) (err error) {
-	body := new(bytes.Buffer)
-	if err = json.NewEncoder(body).Encode(from); err != nil {
+// getCombinedOutput reads stdout and stderr frames from path and writes them to Stdout and
+// Stderr in the order they were written
+func (c *Client) getCombinedOutput(path string) error {
+	resp, err := c.get(path)
+	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
+
+	for {
+		t, payload, err := readFrame(resp.Body)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		switch t {
+		case frameStdout:
+			_, _ = c.Stdout.Write(payload)
+		case frameStderr:
+			_, _ = c.Stderr.Write(payload)
+		}
+	}
+}
 
-	resp, respErr := http.Post(url, "application/json; charset=utf-8", body)
-	if respErr != nil {
+func (c *Client) postJSON(url string, from interface{}, into interface{}) (err error) {
+	body, err := json.Marshal(from)
+	if err != nil {
 		return err
 	}
+
+	var resp *http.Response
+	respErr := c.retry(func() (err error) {
+		resp, err = c.requestHTTPClient().Post(url, "application/json; charset=utf-8", bytes.NewReader(body))
+		return err
+	})
+	if respErr != nil {
+		return respErr
+	}
 	defer func() {
 		if respErr := resp.Body.Close(); respErr != nil {
 			err = respErr
@@ -273,5 +965,11 @@ func (c *Client) postJSON(url string, from interface{}) (err error) {
 			resp.Status)
 	}
 
+	if into != nil {
+		if err := json.NewDecoder(resp.Body).Decode(into); err != nil {
+			return fmt.Errorf("Failed to read response from %s: %v", url, err)
+		}
+	}
+
 	return nil
 }
@@ -0,0 +1,25 @@
+package bintest
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestClientIgnoresProxyEnvironment(t *testing.T) {
+	t.Setenv("HTTP_PROXY", "http://127.0.0.1:1")
+	t.Setenv("HTTPS_PROXY", "http://127.0.0.1:1")
+
+	c := &Client{}
+	for name, client := range map[string]*http.Client{
+		"request":   c.requestHTTPClient(),
+		"streaming": c.streamingHTTPClient(),
+	} {
+		transport, ok := client.Transport.(*http.Transport)
+		if !ok {
+			t.Fatalf("Expected the %s client to use an *http.Transport, got %T", name, client.Transport)
+		}
+		if transport.Proxy != nil {
+			t.Errorf("Expected the %s client not to use a proxy", name)
+		}
+	}
+}
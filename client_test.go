@@ -1,26 +1,34 @@
 package bintest_test
 
 import (
+	"bufio"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/buildkite/bintest/v3"
 	"github.com/buildkite/bintest/v3/testutil"
+	"github.com/fortytw2/leaktest"
 )
 
 func TestClient(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		switch r.URL.Path {
 		case `/calls/new`:
-			w.WriteHeader(http.StatusOK)
-		case `/calls/1234567/stdout`:
+			fmt.Fprintln(w, `{"ID": 42}`)
+		case `/calls/42/stdout`:
 			fmt.Fprintln(w, `Success (stdout)!`)
-		case `/calls/1234567/stderr`:
+		case `/calls/42/stderr`:
 			fmt.Fprintln(w, `Success (stderr)!`)
-		case `/calls/1234567/exitcode`:
+		case `/calls/42/exitcode`:
 			fmt.Fprintln(w, `0`)
 		case `/debug`:
 			out, _ := io.ReadAll(r.Body)
@@ -55,3 +63,305 @@ func TestClient(t *testing.T) {
 		t.Fatalf("Expected stdout of %q, got %q", expected, stdout.String())
 	}
 }
+
+func TestClientRetriesConnecting(t *testing.T) {
+	// reserve an address, and then only start listening on it after the client has started
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case `/calls/new`:
+			fmt.Fprintln(w, `{"ID": 1234567}`)
+		case `/calls/1234567/stdout`, `/calls/1234567/stderr`:
+		case `/calls/1234567/exitcode`:
+			fmt.Fprintln(w, `3`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})}
+	defer srv.Close()
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		_ = srv.Serve(l)
+	}()
+
+	c := bintest.Client{
+		URL:          "http://" + addr,
+		PID:          1234567,
+		Args:         []string{"/tmp/llamasbin", "llamas"},
+		Stdout:       &testutil.ClosingBuffer{},
+		Stderr:       &testutil.ClosingBuffer{},
+		Retries:      10,
+		RetryBackoff: 10 * time.Millisecond,
+	}
+
+	if exitCode := c.Run(); exitCode != 3 {
+		t.Fatalf("Expected error code of 3, got %d", exitCode)
+	}
+}
+
+func TestClientReportsUnreachableServer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + l.Addr().String()
+	_ = l.Close()
+
+	for _, transport := range []string{bintest.TransportHTTP, bintest.TransportStream} {
+		t.Run(transport, func(t *testing.T) {
+			stderr := &testutil.ClosingBuffer{}
+
+			c := bintest.Client{
+				URL:       url,
+				Transport: transport,
+				PID:       1234567,
+				Args:      []string{"/tmp/llamasbin", "llamas"},
+				Stdout:    &testutil.ClosingBuffer{},
+				Stderr:    stderr,
+			}
+
+			if exitCode := c.Run(); exitCode != bintest.ClientErrorExitCode {
+				t.Fatalf("Expected error code of %d, got %d", bintest.ClientErrorExitCode, exitCode)
+			}
+			if expected := "bintest: server unreachable at " + url; !strings.HasPrefix(stderr.String(), expected) {
+				t.Fatalf("Expected stderr to start with %q, got %q", expected, stderr.String())
+			}
+			if strings.Count(stderr.String(), "\n") != 1 {
+				t.Fatalf("Expected a single line of stderr, got %q", stderr.String())
+			}
+		})
+	}
+}
+
+func TestClientTimesOutOnWedgedServer(t *testing.T) {
+	// a server that accepts connections and never responds
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	var conns []net.Conn
+	var connsMu sync.Mutex
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			connsMu.Lock()
+			conns = append(conns, conn)
+			connsMu.Unlock()
+		}
+	}()
+	defer func() {
+		connsMu.Lock()
+		defer connsMu.Unlock()
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	}()
+
+	for _, transport := range []string{bintest.TransportHTTP, bintest.TransportStream} {
+		t.Run(transport, func(t *testing.T) {
+			c := bintest.Client{
+				URL:                   "http://" + l.Addr().String(),
+				Transport:             transport,
+				PID:                   1234567,
+				Args:                  []string{"/tmp/llamasbin", "llamas"},
+				Stdout:                &testutil.ClosingBuffer{},
+				Stderr:                &testutil.ClosingBuffer{},
+				ResponseHeaderTimeout: 100 * time.Millisecond,
+			}
+
+			done := make(chan int)
+			go func() {
+				done <- c.Run()
+			}()
+
+			select {
+			case exitCode := <-done:
+				if exitCode != bintest.ClientErrorExitCode {
+					t.Fatalf("Expected error code of %d, got %d", bintest.ClientErrorExitCode, exitCode)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("Timed out waiting for the client to give up")
+			}
+		})
+	}
+}
+
+func TestClientDoesntTimeOutSlowOutput(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case `/calls/new`:
+			fmt.Fprintln(w, `{"ID": 42}`)
+		case `/calls/42/stdout`:
+			time.Sleep(300 * time.Millisecond)
+			fmt.Fprintln(w, `Slow llamas`)
+		case `/calls/42/stderr`:
+		case `/calls/42/exitcode`:
+			time.Sleep(300 * time.Millisecond)
+			fmt.Fprintln(w, `0`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	stdout := &testutil.ClosingBuffer{}
+
+	c := bintest.Client{
+		URL:                   ts.URL,
+		Transport:             bintest.TransportHTTP,
+		PID:                   1234567,
+		Args:                  []string{"/tmp/llamasbin", "llamas"},
+		Stdout:                stdout,
+		Stderr:                &testutil.ClosingBuffer{},
+		ResponseHeaderTimeout: 100 * time.Millisecond,
+	}
+
+	if exitCode := c.Run(); exitCode != 0 {
+		t.Fatalf("Expected error code of 0, got %d", exitCode)
+	}
+	if expected := "Slow llamas\n"; stdout.String() != expected {
+		t.Fatalf("Expected stdout of %q, got %q", expected, stdout.String())
+	}
+}
+
+func TestClientStdinMode(t *testing.T) {
+	for _, tc := range []struct {
+		mode          string
+		expectedStdin string
+	}{
+		{bintest.StdinAuto, "llamas"},
+		{bintest.StdinAlways, "llamas"},
+		{bintest.StdinNever, ""},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			var mu sync.Mutex
+			var stdin string
+			stdinDone := make(chan struct{})
+
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case `/calls/new`:
+					fmt.Fprintln(w, `{"ID": 1234567}`)
+				case `/calls/1234567/stdin`:
+					b, _ := io.ReadAll(r.Body)
+					mu.Lock()
+					stdin = string(b)
+					mu.Unlock()
+					close(stdinDone)
+				case `/calls/1234567/stdout`, `/calls/1234567/stderr`:
+				case `/calls/1234567/exitcode`:
+					// the client doesn't wait for the stdin request to finish
+					if tc.expectedStdin != "" {
+						<-stdinDone
+					}
+					fmt.Fprintln(w, `0`)
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer ts.Close()
+
+			// a pipe has a size of zero, even once it's written to
+			r, w, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _ = io.WriteString(w, "llamas")
+			_ = w.Close()
+
+			c := bintest.Client{
+				URL:       ts.URL,
+				PID:       1234567,
+				Args:      []string{"/tmp/llamasbin", "llamas"},
+				Stdin:     r,
+				Stdout:    &testutil.ClosingBuffer{},
+				Stderr:    &testutil.ClosingBuffer{},
+				StdinMode: tc.mode,
+			}
+
+			if exitCode := c.Run(); exitCode != 0 {
+				t.Fatalf("Expected error code of 0, got %d", exitCode)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if stdin != tc.expectedStdin {
+				t.Fatalf("Expected stdin %q, got %q", tc.expectedStdin, stdin)
+			}
+		})
+	}
+}
+
+func TestCallingMockWithInteractiveStdin(t *testing.T) {
+	defer leaktest.Check(t)()
+	m, close := mustMock(t, "git")
+	defer close()
+
+	m.Expect("credential", "fill").AndCallFunc(func(c *bintest.Call) {
+		r := bufio.NewReader(c.Stdin)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				break
+			}
+			fmt.Fprintf(c.Stdout, "got %s", line)
+		}
+		c.Exit(0)
+	})
+
+	cmd := exec.Command(m.Path, "credential", "fill")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// each line has to make it to the call and back before the next is written
+	out := bufio.NewReader(stdout)
+	for _, line := range []string{"protocol=https\n", "host=github.com\n"} {
+		if _, err := io.WriteString(stdin, line); err != nil {
+			t.Fatal(err)
+		}
+		response, err := out.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := "got " + line; response != expected {
+			t.Fatalf("Expected %q, got %q", expected, response)
+		}
+	}
+	_ = stdin.Close()
+
+	if err := cmd.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	m.Check(t)
+
+	if stdin := string(m.Invocations()[0].Stdin); stdin != "protocol=https\nhost=github.com\n" {
+		t.Fatalf("Expected stdin to be recorded, got %q", stdin)
+	}
+}
@@ -0,0 +1,379 @@
+// Command bintest runs a command with mock binaries installed in its PATH and then
+// verifies that the expected invocations occurred. It lets shell or Python based test
+// suites use the same mock binaries as Go tests.
+//
+//	bintest run -expect 'git fetch origin' -expect 'git commit -m "Bump version"' -- ./deploy.sh
+//	bintest run -config expectations.json -- python -m pytest
+//
+// Each -expect is split into arguments the way a shell would split it, so arguments with
+// spaces in them can be quoted. The config file is a JSON object of binary names to expectations, in the format
+// read by Mock.LoadExpectations:
+//
+//	{
+//	  "git": [
+//	    {"args": ["rev-parse", "HEAD"], "stdout": "abc123\n", "times": 1},
+//	    {"args": ["push"], "exitCode": 1, "stderr": "rejected\n"}
+//	  ]
+//	}
+//
+// The serve subcommand runs a long-lived server with the remote expectation API enabled,
+// see Server.EnableRemote, so mocks outlive short-lived test processes like bats files.
+// It listens on a fixed address and saves the mocks to a state file, so it can be
+// restarted without them being registered again:
+//
+//	BINTEST_REMOTE_TOKEN=secret bintest serve -addr 127.0.0.1:7357 -state mocks.json
+//
+// The gen subcommand generates typed expectation builders from a command's --help output,
+// see the helpgen package:
+//
+//	bintest gen -package gitexp -subcommands -o gitexp/gitexp.go -- git
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/buildkite/bintest/v3"
+	"github.com/buildkite/bintest/v3/helpgen"
+)
+
+const (
+	// exitCheckFailed is returned when the command succeeded but expectations weren't met
+	exitCheckFailed = 3
+
+	// remoteTokenEnvVar is the default token for serve
+	remoteTokenEnvVar = "BINTEST_REMOTE_TOKEN"
+)
+
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ", ")
+}
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+func main() {
+	// When invoked via a mock's symlink, act as the client for the server
+	if name := strings.TrimSuffix(filepath.Base(os.Args[0]), `.exe`); name != `bintest` {
+		os.Exit(bintest.NewClientFromEnv().Run())
+	}
+
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	switch os.Args[1] {
+	case "run":
+		os.Exit(run(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+	case "gen":
+		os.Exit(gen(os.Args[2:], os.Stdout, os.Stderr))
+	case "serve":
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		exitCode := serve(ctx, os.Args[2:], os.Stdout, os.Stderr)
+		stop()
+		os.Exit(exitCode)
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: bintest run [-config file.json] [-expect 'name args...'] -- command [args...]")
+	fmt.Fprintln(os.Stderr, "       bintest gen -package name [-o file.go] [-help-flag --help] [-subcommands] -- command")
+	fmt.Fprintln(os.Stderr, "       bintest serve [-addr 127.0.0.1:7357] [-token token] [-state file.json]")
+	os.Exit(2)
+}
+
+// flagError is an error from parsing flags, which the flag package has already reported
+type flagError struct {
+	error
+}
+
+// exitParseError reports an error from parsing a subcommand's arguments and returns the
+// exit code for it
+func exitParseError(stderr io.Writer, err error) int {
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	var fe flagError
+	if !errors.As(err, &fe) {
+		fmt.Fprintf(stderr, "bintest: %v\n", err)
+	}
+	return 2
+}
+
+// runConfig is the command to run and the expectations of the mocks to run it with
+type runConfig struct {
+	command      []string
+	expectations map[string][]bintest.ExpectationFixture
+	debug        bool
+}
+
+// parseRunArgs parses the arguments of run and loads the expectations they refer to
+func parseRunArgs(args []string, stderr io.Writer) (runConfig, error) {
+	var expects stringsFlag
+	var config string
+	cfg := runConfig{expectations: map[string][]bintest.ExpectationFixture{}}
+
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Var(&expects, "expect", "An expected invocation as 'name args...', quoted like a shell command, can be repeated")
+	fs.StringVar(&config, "config", "", "A JSON file of expectations, keyed by binary name")
+	fs.BoolVar(&cfg.debug, "debug", false, "Show debugging output from bintest")
+	if err := fs.Parse(args); err != nil {
+		return cfg, flagError{err}
+	}
+
+	if fs.NArg() == 0 {
+		return cfg, errors.New("no command provided")
+	}
+	cfg.command = fs.Args()
+
+	if config != "" {
+		b, err := os.ReadFile(config)
+		if err != nil {
+			return cfg, err
+		}
+		if err := json.Unmarshal(b, &cfg.expectations); err != nil {
+			return cfg, fmt.Errorf("error parsing %s: %v", config, err)
+		}
+	}
+
+	for _, e := range expects {
+		words, err := splitWords(e)
+		if err != nil {
+			return cfg, fmt.Errorf("error parsing -expect %q: %v", e, err)
+		}
+		if len(words) == 0 {
+			return cfg, errors.New("empty -expect")
+		}
+		cfg.expectations[words[0]] = append(cfg.expectations[words[0]], bintest.ExpectationFixture{Args: words[1:]})
+	}
+
+	return cfg, nil
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	cfg, err := parseRunArgs(args, stderr)
+	if err != nil {
+		return exitParseError(stderr, err)
+	}
+
+	// Debug is read by servers that are already running, so it's only ever turned on
+	if cfg.debug {
+		bintest.Debug = true
+	}
+
+	// Mocks link to this binary, so it needs to be an absolute path
+	self, err := os.Executable()
+	if err != nil {
+		fmt.Fprintf(stderr, "bintest: %v\n", err)
+		return 2
+	}
+	os.Args[0] = self
+
+	dir, err := os.MkdirTemp("", "bintest-run")
+	if err != nil {
+		fmt.Fprintf(stderr, "bintest: %v\n", err)
+		return 2
+	}
+	defer os.RemoveAll(dir)
+
+	names := make([]string, 0, len(cfg.expectations))
+	for name := range cfg.expectations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var mocks []*bintest.Mock
+	for _, name := range names {
+		m, err := bintest.NewMockFromTestMain(filepath.Join(dir, name))
+		if err != nil {
+			fmt.Fprintf(stderr, "bintest: %v\n", err)
+			return 2
+		}
+		b, _ := json.Marshal(cfg.expectations[name])
+		if _, err := m.LoadExpectations(bytes.NewReader(b)); err != nil {
+			fmt.Fprintf(stderr, "bintest: %v\n", err)
+			return 2
+		}
+		mocks = append(mocks, m)
+	}
+
+	server, err := bintest.StartServer()
+	if err != nil {
+		fmt.Fprintf(stderr, "bintest: %v\n", err)
+		return 2
+	}
+
+	// The command itself might be mocked, so it needs to be looked up with the mocks in PATH
+	_ = os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	cmd := exec.Command(cfg.command[0], cfg.command[1:]...)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.Env = append(os.Environ(),
+		bintest.ServerEnvVar+"="+server.URL,
+		bintest.TokenEnvVar+"="+server.Token(),
+	)
+
+	exitCode := 0
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			fmt.Fprintf(stderr, "bintest: %v\n", err)
+			return 2
+		}
+		exitCode = exitErr.ExitCode()
+	}
+
+	t := &reporter{w: stderr}
+	for _, m := range mocks {
+		if err := m.CheckAndClose(t); err != nil {
+			t.Errorf("%s: %v", m.Name, err)
+		}
+	}
+
+	if exitCode == 0 && t.failed {
+		return exitCheckFailed
+	}
+	return exitCode
+}
+
+func gen(args []string, stdout, stderr io.Writer) int {
+	var pkg, output, helpFlag string
+	var subcommands bool
+
+	fs := flag.NewFlagSet("gen", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&pkg, "package", "", "The package name of the generated code")
+	fs.StringVar(&output, "o", "", "The file to write to, defaults to stdout")
+	fs.StringVar(&helpFlag, "help-flag", "--help", "The flag that makes the command print help")
+	fs.BoolVar(&subcommands, "subcommands", false, "Also parse the help of each subcommand for flags")
+	if err := fs.Parse(args); err != nil {
+		return exitParseError(stderr, flagError{err})
+	}
+
+	if fs.NArg() != 1 {
+		fmt.Fprintln(stderr, "bintest: expected a single command")
+		return 2
+	}
+
+	path, err := exec.LookPath(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(stderr, "bintest: %v\n", err)
+		return 2
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	spec, err := helpgen.Inspect(ctx, path, helpFlag, subcommands)
+	if err != nil {
+		fmt.Fprintf(stderr, "bintest: %v\n", err)
+		return 2
+	}
+
+	var buf bytes.Buffer
+	if err := helpgen.Generate(&buf, pkg, spec); err != nil {
+		fmt.Fprintf(stderr, "bintest: %v\n", err)
+		return 2
+	}
+
+	if output == "" {
+		_, _ = stdout.Write(buf.Bytes())
+		return 0
+	}
+	if err := os.WriteFile(output, buf.Bytes(), 0o644); err != nil {
+		fmt.Fprintf(stderr, "bintest: %v\n", err)
+		return 2
+	}
+	return 0
+}
+
+// serve runs a server with the remote API until ctx is done, which main does on SIGINT or
+// SIGTERM, and then shuts it down
+func serve(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	var addr, token, state string
+	var debug bool
+
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&addr, "addr", "127.0.0.1:7357", "The address to listen on, mocks keep working when the server is restarted on the same one")
+	fs.StringVar(&token, "token", os.Getenv(remoteTokenEnvVar), "The token that remote API requests need, defaults to $"+remoteTokenEnvVar)
+	fs.StringVar(&state, "state", "", "A JSON file to save mocks and expectations to, and restore them from")
+	fs.BoolVar(&debug, "debug", false, "Show debugging output from bintest")
+	if err := fs.Parse(args); err != nil {
+		return exitParseError(stderr, flagError{err})
+	}
+
+	if debug {
+		bintest.Debug = true
+	}
+
+	if token == "" {
+		fmt.Fprintf(stderr, "bintest: a token is required, use -token or $%s\n", remoteTokenEnvVar)
+		return 2
+	}
+
+	server, err := bintest.NewServerOn(addr)
+	if err != nil {
+		fmt.Fprintf(stderr, "bintest: %v\n", err)
+		return 2
+	}
+
+	server.EnableRemote(token)
+	if state != "" {
+		if err := server.PersistRemote(state); err != nil {
+			_ = server.Shutdown(context.Background())
+			fmt.Fprintf(stderr, "bintest: %v\n", err)
+			return 2
+		}
+	}
+
+	// the harness reads the url to talk to the server
+	fmt.Fprintln(stdout, server.URL)
+
+	<-ctx.Done()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), bintest.DefaultDrainTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		fmt.Fprintf(stderr, "bintest: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// reporter implements bintest.TestingT by writing to w, which is stderr
+type reporter struct {
+	w      io.Writer
+	failed bool
+}
+
+func (r *reporter) Logf(format string, args ...interface{}) {
+	fmt.Fprintf(r.w, "bintest: "+format+"\n", args...)
+}
+
+func (r *reporter) Errorf(format string, args ...interface{}) {
+	r.failed = true
+	fmt.Fprintf(r.w, "bintest: "+format+"\n", args...)
+}
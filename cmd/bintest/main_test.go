@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/bintest/v3"
+)
+
+func TestMain(m *testing.M) {
+	// run links its mocks to the test binary, which acts as their client
+	if strings.TrimSuffix(filepath.Base(os.Args[0]), `.exe`) != `bintest.test` {
+		os.Exit(bintest.NewClientFromEnv().Run())
+	}
+	os.Exit(m.Run())
+}
+
+// runCommand calls run, restoring the process state that it changes afterwards
+func runCommand(t *testing.T, args ...string) (int, string) {
+	t.Helper()
+	t.Setenv("PATH", os.Getenv("PATH"))
+	arg0 := os.Args[0]
+	t.Cleanup(func() { os.Args[0] = arg0 })
+
+	var stdout, stderr bytes.Buffer
+	exitCode := run(args, strings.NewReader(""), &stdout, &stderr)
+	return exitCode, stderr.String()
+}
+
+func TestRunPassesWhenExpectationsAreMet(t *testing.T) {
+	exitCode, stderr := runCommand(t,
+		"-expect", `llamas eat 'green grass' "and \"hay\""`,
+		"--", "llamas", "eat", "green grass", `and "hay"`)
+	if exitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d: %s", exitCode, stderr)
+	}
+}
+
+func TestRunFailsWhenExpectationsAreNotMet(t *testing.T) {
+	exitCode, stderr := runCommand(t,
+		"-expect", "llamas eat",
+		"-expect", "alpacas sleep",
+		"--", "llamas", "eat")
+	if exitCode != exitCheckFailed {
+		t.Fatalf("Expected exit code %d, got %d: %s", exitCheckFailed, exitCode, stderr)
+	}
+	if !strings.Contains(stderr, "alpacas") {
+		t.Errorf("Expected the unmet expectation to be reported, got %q", stderr)
+	}
+}
+
+func TestRunReturnsTheCommandsExitCode(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "expectations.json")
+	if err := os.WriteFile(config, []byte(`{"llamas": [{"args": ["spit"], "exitCode": 4}]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	exitCode, stderr := runCommand(t, "-config", config, "--", "llamas", "spit")
+	if exitCode != 4 {
+		t.Fatalf("Expected exit code 4, got %d: %s", exitCode, stderr)
+	}
+}
+
+func TestRunRejectsInvalidArguments(t *testing.T) {
+	for _, tc := range []struct {
+		args   []string
+		stderr string
+	}{
+		{[]string{"-expect", "llamas"}, "no command provided"},
+		{[]string{"-expect", "llamas 'eat", "--", "llamas"}, "unterminated single quote"},
+		{[]string{"-expect", "", "--", "llamas"}, "empty -expect"},
+		{[]string{"-config", "nope.json", "--", "llamas"}, "nope.json"},
+		{[]string{"-llamas", "--", "llamas"}, "flag provided but not defined"},
+	} {
+		var stdout, stderr bytes.Buffer
+		if exitCode := run(tc.args, strings.NewReader(""), &stdout, &stderr); exitCode != 2 {
+			t.Errorf("Expected %v to exit with 2, got %d", tc.args, exitCode)
+		}
+		if !strings.Contains(stderr.String(), tc.stderr) {
+			t.Errorf("Expected %v to report %q, got %q", tc.args, tc.stderr, stderr.String())
+		}
+	}
+}
+
+func TestGen(t *testing.T) {
+	help, err := os.ReadFile("../../helpgen/testdata/cobra.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := bintest.NewMock("deployer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.CheckAndClose(t)
+	m.Expect("--help").AndWriteToStdout(string(help)).Exactly(2)
+
+	var stdout, stderr bytes.Buffer
+	if exitCode := gen([]string{"-package", "deployexp", "--", m.Path}, &stdout, &stderr); exitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d: %s", exitCode, stderr.String())
+	}
+	for _, s := range []string{"package deployexp", "Namespace(v interface{})"} {
+		if !strings.Contains(stdout.String(), s) {
+			t.Errorf("Expected generated code to contain %q, got %s", s, stdout.String())
+		}
+	}
+
+	output := filepath.Join(t.TempDir(), "deployexp.go")
+	stdout.Reset()
+	if exitCode := gen([]string{"-package", "deployexp", "-o", output, "--", m.Path}, &stdout, &stderr); exitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d: %s", exitCode, stderr.String())
+	}
+	if b, err := os.ReadFile(output); err != nil || !bytes.Contains(b, []byte("package deployexp")) {
+		t.Errorf("Expected generated code in %s, got %q, %v", output, b, err)
+	}
+	if stdout.Len() > 0 {
+		t.Errorf("Expected nothing on stdout with -o, got %q", stdout.String())
+	}
+}
+
+func TestGenRequiresOneCommand(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if exitCode := gen([]string{"-package", "deployexp"}, &stdout, &stderr); exitCode != 2 {
+		t.Errorf("Expected exit code 2, got %d", exitCode)
+	}
+	if !strings.Contains(stderr.String(), "expected a single command") {
+		t.Errorf("Unexpected stderr %q", stderr.String())
+	}
+}
+
+// startServe runs serve in the background until the returned func is called, which returns
+// its exit code
+func startServe(t *testing.T, args ...string) (string, func() int) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stdoutR, stdoutW := io.Pipe()
+	stderr := &bytes.Buffer{}
+	exited := make(chan int, 1)
+
+	go func() {
+		exited <- serve(ctx, args, stdoutW, stderr)
+		_ = stdoutW.Close()
+	}()
+
+	url, err := bufio.NewReader(stdoutR).ReadString('\n')
+	if err != nil {
+		cancel()
+		t.Fatalf("Expected serve to print its URL, it exited with %d: %s", <-exited, stderr.String())
+	}
+
+	return strings.TrimSpace(url), func() int {
+		cancel()
+		return <-exited
+	}
+}
+
+func remoteRequest(t *testing.T, url, token, method, path, body string) int {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestServeRestoresMocksFromTheStateFile(t *testing.T) {
+	state := filepath.Join(t.TempDir(), "mocks.json")
+
+	url, stop := startServe(t, "-addr", "127.0.0.1:0", "-token", "secret", "-state", state)
+	if status := remoteRequest(t, url, "wrong", "POST", "/remote/mocks", `{"path":"llamas"}`); status != http.StatusUnauthorized {
+		t.Errorf("Expected a request with the wrong token to be rejected, got %d", status)
+	}
+	if status := remoteRequest(t, url, "secret", "POST", "/remote/mocks", `{"path":"llamas"}`); status != http.StatusCreated {
+		t.Fatalf("Expected the mock to be created, got %d", status)
+	}
+	if exitCode := stop(); exitCode != 0 {
+		t.Fatalf("Expected serve to exit with 0 when stopped, got %d", exitCode)
+	}
+
+	if b, err := os.ReadFile(state); err != nil || !bytes.Contains(b, []byte("llamas")) {
+		t.Fatalf("Expected the mock in the state file, got %q, %v", b, err)
+	}
+
+	// the token defaults to the environment
+	t.Setenv(remoteTokenEnvVar, "secret")
+	url, stop = startServe(t, "-addr", strings.TrimPrefix(url, "http://"), "-state", state)
+	defer stop()
+
+	if status := remoteRequest(t, url, "secret", "GET", "/remote/mocks/llamas", ""); status != http.StatusOK {
+		t.Errorf("Expected the mock to be restored, got %d", status)
+	}
+}
+
+func TestServeRequiresAToken(t *testing.T) {
+	t.Setenv(remoteTokenEnvVar, "")
+
+	var stdout, stderr bytes.Buffer
+	if exitCode := serve(context.Background(), []string{"-addr", "127.0.0.1:0"}, &stdout, &stderr); exitCode != 2 {
+		t.Errorf("Expected exit code 2, got %d", exitCode)
+	}
+	if !strings.Contains(stderr.String(), "a token is required") {
+		t.Errorf("Unexpected stderr %q", stderr.String())
+	}
+}
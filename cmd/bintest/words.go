@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// splitWords splits s into words like a POSIX shell does, without any expansion. Single
+// quotes keep everything in them, double quotes keep everything but backslash escapes of
+// \, ", $ and `, and a backslash outside of quotes escapes the next character
+func splitWords(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case ' ', '\t', '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+
+		case '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return nil, errors.New("unterminated single quote")
+			}
+			word.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+
+		case '"':
+			closed := false
+			for i++; i < len(s); i++ {
+				if s[i] == '"' {
+					closed = true
+					break
+				}
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte("\\\"$`", s[i+1]) >= 0 {
+					i++
+				}
+				word.WriteByte(s[i])
+			}
+			if !closed {
+				return nil, errors.New("unterminated double quote")
+			}
+			inWord = true
+
+		case '\\':
+			if i+1 == len(s) {
+				return nil, errors.New("trailing backslash")
+			}
+			i++
+			word.WriteByte(s[i])
+			inWord = true
+
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
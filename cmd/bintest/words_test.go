@@ -0,0 +1,36 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitWords(t *testing.T) {
+	for _, tc := range []struct {
+		s     string
+		words []string
+	}{
+		{"", nil},
+		{"  git   fetch\torigin ", []string{"git", "fetch", "origin"}},
+		{`git commit -m 'Bump version'`, []string{"git", "commit", "-m", "Bump version"}},
+		{`echo "it's \"quoted\" \n"`, []string{"echo", `it's "quoted" \n`}},
+		{`echo a\ b \'c`, []string{"echo", "a b", "'c"}},
+		{`echo ''`, []string{"echo", ""}},
+		{`echo pre'mid'"post"`, []string{"echo", "premidpost"}},
+	} {
+		words, err := splitWords(tc.s)
+		if err != nil {
+			t.Errorf("Unexpected error splitting %q: %v", tc.s, err)
+		} else if !reflect.DeepEqual(words, tc.words) {
+			t.Errorf("Expected %q to split into %q, got %q", tc.s, tc.words, words)
+		}
+	}
+}
+
+func TestSplitWordsRejectsUnterminatedQuotes(t *testing.T) {
+	for _, s := range []string{`echo 'a`, `echo "a`, `echo a\`} {
+		if words, err := splitWords(s); err == nil {
+			t.Errorf("Expected an error splitting %q, got %q", s, words)
+		}
+	}
+}
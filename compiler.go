@@ -2,6 +2,8 @@ package bintest
 
 import (
 	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -9,6 +11,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -19,13 +22,20 @@ const (
 	clientSrc = `package main
 
 import (
+	"fmt"
 	"github.com/buildkite/bintest/v3"
 	"os"
+	"time"
 )
 
 var (
-	debug  string
-	server string
+	debug                 string
+	server                string
+	fallback              string
+	dialTimeout           string
+	responseHeaderTimeout string
+	token                 string
+	tlsBundle             string
 )
 
 func main() {
@@ -35,6 +45,31 @@ func main() {
 		c.Debug = true
 	}
 
+	if fallback == "true" {
+		c.FallbackToRealBinary = true
+	}
+
+	if token != "" {
+		c.Token = token
+	}
+
+	if tlsBundle != "" {
+		config, err := bintest.ClientTLSConfig(tlsBundle)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "bintest: %v\n", err)
+			os.Exit(bintest.ClientErrorExitCode)
+		}
+		c.TLSConfig = config
+	}
+
+	// timeouts compiled in are overridden by the environment
+	if d, err := time.ParseDuration(dialTimeout); err == nil && os.Getenv(bintest.DialTimeoutEnvVar) == "" {
+		c.DialTimeout = d
+	}
+	if d, err := time.ParseDuration(responseHeaderTimeout); err == nil && os.Getenv(bintest.ResponseHeaderTimeoutEnvVar) == "" {
+		c.ResponseHeaderTimeout = d
+	}
+
 	os.Exit(c.Run())
 }
 `
@@ -43,17 +78,80 @@ func main() {
 var (
 	compileCacheInstance *compileCache
 	compileLock          sync.Mutex
+	compilerOptions      CompilerOptions
 )
 
-func compile(dest string, src string, vars []string) error {
+// CompilerOptions configure how the client binaries for proxies are compiled
+type CompilerOptions struct {
+	// GoBinary is the go command to build with, defaults to go in PATH
+	GoBinary string
+
+	// GoFlags sets GOFLAGS for the build
+	GoFlags string
+
+	// GoCache sets GOCACHE for the build
+	GoCache string
+
+	// LDFlags are added to the linker flags, for instance "-s -w"
+	LDFlags string
+
+	// Tags are build tags to build with
+	Tags []string
+
+	// Env is extra environment for the build, for instance GOTOOLCHAIN=go1.22.0
+	Env []string
+
+	// FallbackToRealBinary compiles clients that run the real binary from later in PATH
+	// when the server can't be reached, see FallbackEnvVar
+	FallbackToRealBinary bool
+
+	// DialTimeout and ResponseHeaderTimeout are compiled into clients in place of
+	// DefaultClientDialTimeout and DefaultClientResponseHeaderTimeout, see Client. The
+	// environment vars still override them
+	DialTimeout           time.Duration
+	ResponseHeaderTimeout time.Duration
+}
+
+// SetCompilerOptions changes how client binaries are compiled from then on. Binaries that
+// were compiled with different options aren't reused
+func SetCompilerOptions(opts CompilerOptions) {
+	compileLock.Lock()
+	defer compileLock.Unlock()
+	compilerOptions = opts
+}
+
+func currentCompilerOptions() CompilerOptions {
+	compileLock.Lock()
+	defer compileLock.Unlock()
+	return compilerOptions
+}
+
+func compile(dest string, src string, vars []string, opts CompilerOptions) error {
+	// -trimpath and -buildvcs=false keep the output independent of where and
+	// when it was built, so identical inputs produce identical binaries
 	args := []string{
 		"build",
+		"-trimpath",
+		"-buildvcs=false",
 		"-o", dest,
 	}
 
-	if len(vars) > 0 || Debug {
-		varsCopy := make([]string, len(vars))
-		copy(varsCopy, vars)
+	if len(opts.Tags) > 0 {
+		args = append(args, "-tags", strings.Join(opts.Tags, ","))
+	}
+
+	if opts.FallbackToRealBinary {
+		vars = append(append([]string{}, vars...), "main.fallback=true")
+	}
+	if opts.DialTimeout != 0 {
+		vars = append(append([]string{}, vars...), "main.dialTimeout="+opts.DialTimeout.String())
+	}
+	if opts.ResponseHeaderTimeout != 0 {
+		vars = append(append([]string{}, vars...), "main.responseHeaderTimeout="+opts.ResponseHeaderTimeout.String())
+	}
+
+	if len(vars) > 0 || Debug || opts.LDFlags != "" {
+		varsCopy := sortedVars(vars)
 
 		args = append(args, "-ldflags")
 
@@ -65,41 +163,181 @@ func compile(dest string, src string, vars []string) error {
 			varsCopy = append(varsCopy, "-X main.debug=true")
 		}
 
+		if opts.LDFlags != "" {
+			varsCopy = append(varsCopy, opts.LDFlags)
+		}
+
 		args = append(args, strings.Join(varsCopy, " "))
 	}
 
+	goBinary := opts.GoBinary
+	if goBinary == "" {
+		goBinary = "go"
+	}
+
+	cmd := exec.Command(goBinary, append(args, src)...)
+	cmd.Env = os.Environ()
+	if opts.GoFlags != "" {
+		cmd.Env = SetEnv(cmd.Env, "GOFLAGS="+opts.GoFlags)
+	}
+	if opts.GoCache != "" {
+		cmd.Env = SetEnv(cmd.Env, "GOCACHE="+opts.GoCache)
+	}
+	for _, e := range opts.Env {
+		cmd.Env = SetEnv(cmd.Env, e)
+	}
+
 	t := time.Now()
 
-	output, err := exec.Command("go", append(args, src)...).CombinedOutput()
+	output, err := cmd.CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("Compile of %s failed: %s", src, output)
+		return newCompileError(goBinary, cmd.Env, src, output, err)
 	}
 
 	debugf("[compiler] Compiled %s in %v", dest, time.Now().Sub(t))
 	return nil
 }
 
-func compileClient(dest string, vars []string) error {
+// CompileError is returned when go build fails to compile a proxy client. Along with the
+// output of go build it has details of the go environment, which are often the cause
+type CompileError struct {
+	// The source file that was compiled and what go build printed
+	Src    string
+	Output string
+
+	// The go environment that go build ran in, from go env
+	GoVersion   string
+	GOPATH      string
+	GOFLAGS     string
+	GOCACHE     string
+	GOMOD       string
+	GO111MODULE string
+
+	// Hint suggests a fix for common failures, it's empty if there isn't one
+	Hint string
+
+	// Err is the error from running go build
+	Err error
+}
+
+func (e *CompileError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Compile of %s failed: %s", e.Src, e.Output)
+	fmt.Fprintf(&b, "\ngo version: %s, GOMOD: %s, GO111MODULE: %s", e.GoVersion, e.GOMOD, e.GO111MODULE)
+	fmt.Fprintf(&b, "\nGOPATH: %s, GOFLAGS: %s, GOCACHE: %s", e.GOPATH, e.GOFLAGS, e.GOCACHE)
+	if e.Hint != "" {
+		fmt.Fprintf(&b, "\nHint: %s", e.Hint)
+	}
+	return b.String()
+}
+
+func (e *CompileError) Unwrap() error {
+	return e.Err
+}
+
+// newCompileError builds a CompileError for a failed compile, with the go environment
+// that go build ran in
+func newCompileError(goBinary string, env []string, src string, output []byte, err error) *CompileError {
+	ce := &CompileError{
+		Src:    src,
+		Output: string(output),
+		Hint:   compileHint(string(output)),
+		Err:    err,
+	}
+
+	cmd := exec.Command(goBinary, "env", "-json", "GOVERSION", "GOPATH", "GOFLAGS", "GOCACHE", "GOMOD", "GO111MODULE")
+	cmd.Env = env
+	if out, err := cmd.Output(); err == nil {
+		var goEnv map[string]string
+		if err := json.Unmarshal(out, &goEnv); err == nil {
+			ce.GoVersion = goEnv["GOVERSION"]
+			ce.GOPATH = goEnv["GOPATH"]
+			ce.GOFLAGS = goEnv["GOFLAGS"]
+			ce.GOCACHE = goEnv["GOCACHE"]
+			ce.GOMOD = goEnv["GOMOD"]
+			ce.GO111MODULE = goEnv["GO111MODULE"]
+		}
+	} else {
+		debugf("[compiler] Failed to read go env: %v", err)
+	}
+
+	if errors.Is(err, exec.ErrNotFound) {
+		ce.Hint = fmt.Sprintf("%s isn't in PATH, set CompilerOptions.GoBinary to the path of go", goBinary)
+	} else if ce.Hint == "" && ce.GoVersion != "" && (ce.GOMOD == "" || ce.GOMOD == os.DevNull) {
+		ce.Hint = "go build didn't find a go.mod, bintest must be compiled from within a module that requires it"
+	}
+
+	return ce
+}
+
+// compileHint returns a suggested fix for common compile failures
+func compileHint(output string) string {
+	switch {
+	case strings.Contains(output, "no required module provides package github.com/buildkite/bintest"),
+		strings.Contains(output, "cannot find module providing package github.com/buildkite/bintest"),
+		strings.Contains(output, "cannot find package \"github.com/buildkite/bintest"):
+		return "the module being tested doesn't require bintest, run go get github.com/buildkite/bintest/v3"
+	case strings.Contains(output, "missing go.sum entry"):
+		return "go.sum is missing entries, run go mod tidy"
+	}
+	return ""
+}
+
+// compileClient compiles the client to dest and returns the content hash of the binary
+func compileClient(dest string, vars []string) (string, error) {
+	serverLock.Lock()
+	defer serverLock.Unlock()
+
+	cacheBinaryPath, hash, err := cachedClient(vars)
+	if err != nil {
+		return "", err
+	}
+
+	// Link to the binary in the compile cache
+	return hash, replaceLink(cacheBinaryPath, dest)
+}
+
+// Precompile starts the shared server and compiles the client for it, so that the first proxy
+// or mock doesn't have to wait for the compile. Call it from TestMain before m.Run
+func Precompile() error {
+	server, err := StartServer()
+	if err != nil {
+		return err
+	}
+
 	serverLock.Lock()
 	defer serverLock.Unlock()
 
+	t := time.Now()
+	if _, _, err := cachedClient(server.clientVars()); err != nil {
+		return err
+	}
+
+	debugf("[compiler] Precompiled client for %s in %v", server.URL, time.Now().Sub(t))
+	return nil
+}
+
+// cachedClient returns the path and content hash of the client for vars in the compile
+// cache, compiling it if it isn't there yet. serverLock must be held
+func cachedClient(vars []string) (string, string, error) {
 	// first off we create a temp dir for caching
 	if compileCacheInstance == nil {
 		cci, err := newCompileCache()
 		if err != nil {
-			return err
+			return "", "", err
 		}
 		compileCacheInstance = cci
 	}
 
-	cacheBinaryPath, err := compileCacheInstance.file(vars)
+	opts := currentCompilerOptions()
+
+	cacheBinaryPath, err := compileCacheInstance.file(vars, opts)
 	if err != nil {
-		return err
+		return "", "", err
 	}
 
-	// if we can, symlink to an existing file in the compile cache
-	if compileCacheInstance.IsCached(vars) {
-		return replaceSymlink(cacheBinaryPath, dest)
+	if compileCacheInstance.IsCached(vars, opts) {
+		return cacheBinaryPath, compileCacheInstance.hash(cacheBinaryPath), nil
 	}
 
 	// we create a temp subdir relative to current dir so that
@@ -107,47 +345,184 @@ func compileClient(dest string, vars []string) error {
 	dir := fmt.Sprintf(`_bintest_%x`, sha1.Sum([]byte(clientSrc)))
 	f := filepath.Join(dir, `main.go`)
 
+	// other test binaries running in the same directory, like packages tested in parallel
+	// by go test ./..., use the same subdir, so only one of them can compile at a time
+	unlock, err := lockFile(buildDirLockPath(dir))
+	if err != nil {
+		return "", "", fmt.Errorf("Error locking %s: %v", dir, err)
+	}
+	defer func() {
+		_ = unlock()
+	}()
+
 	if err := os.MkdirAll(dir, 0o700); err != nil {
-		return err
+		return "", "", err
 	}
 	defer os.RemoveAll(dir)
 
 	if err := os.WriteFile(f, []byte(clientSrc), 0o500); err != nil {
-		return err
+		return "", "", err
 	}
 
-	if err := compile(cacheBinaryPath, f, vars); err != nil {
-		return err
+	// compile next to the cache path and then rename it into place, so the cache never
+	// has a partially written binary in it
+	tempBinaryPath := fmt.Sprintf("%s.%d.tmp", cacheBinaryPath, os.Getpid())
+	if err := compile(tempBinaryPath, f, vars, opts); err != nil {
+		_ = os.Remove(tempBinaryPath)
+		return "", "", err
+	}
+	if err := os.Rename(tempBinaryPath, cacheBinaryPath); err != nil {
+		_ = os.Remove(tempBinaryPath)
+		return "", "", err
 	}
 
 	if err := os.RemoveAll(dir); err != nil {
-		return err
+		return "", "", err
+	}
+
+	hash, err := fileHash(cacheBinaryPath)
+	if err != nil {
+		return "", "", err
+	}
+	compileCacheInstance.hashes[cacheBinaryPath] = hash
+
+	return cacheBinaryPath, hash, nil
+}
+
+// buildDirLockPath returns the path of the lock file for a build dir relative to the current
+// directory. It's in the temp dir rather than next to the build dir so that it isn't left
+// behind in the directory being tested
+func buildDirLockPath(dir string) string {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		abs = dir
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("bintest-%x.lock", sha1.Sum([]byte(abs))))
+}
+
+// sortedVars returns a sorted copy of vars, so that the order they are provided in
+// doesn't change the ldflags or the cache key
+func sortedVars(vars []string) []string {
+	sorted := make([]string, len(vars))
+	copy(sorted, vars)
+	sort.Strings(sorted)
+	return sorted
+}
+
+// fileHash returns the hex-encoded sha256 of the contents of the file at path
+func fileHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
 	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
 
-	// Create a symlink to the binary.
-	return replaceSymlink(cacheBinaryPath, dest)
+// linkStrategy is a way of making newname point at the binary at oldname
+type linkStrategy struct {
+	name string
+	link func(oldname, newname string) error
 }
 
+var (
+	// linkStrategies are tried in order, symlinks aren't available on Windows without
+	// Developer Mode or on some network filesystems, and hardlinks don't work across devices
+	linkStrategies = []linkStrategy{
+		{"symlink", os.Symlink},
+		{"hardlink", os.Link},
+		{"copy", copyFile},
+	}
+
+	// linkStrategyIdx is the first strategy that worked, so that we don't retry ones
+	// that are known to fail on this platform
+	linkStrategyIdx int
+	linkLock        sync.Mutex
+)
+
 // To keep the old behaviour of overwriting what was in the destination path,
-// replaceSymlink creates a symlink with a temporary name and then renames it
-// over the destination path.
-func replaceSymlink(oldname, newname string) error {
-	tempname := fmt.Sprintf("%s.%x", newname, rand.Int())
-	if err := os.Symlink(oldname, tempname); err != nil {
+// replaceLink links with a temporary name and then renames it over the destination
+// path. It falls back from symlinks to hardlinks to a copy when they aren't supported.
+func replaceLink(oldname, newname string) error {
+	linkLock.Lock()
+	defer linkLock.Unlock()
+
+	var lastErr error
+	for idx := linkStrategyIdx; idx < len(linkStrategies); idx++ {
+		strategy := linkStrategies[idx]
+		tempname := fmt.Sprintf("%s.%x", newname, rand.Int())
+
+		if err := strategy.link(oldname, tempname); err != nil {
+			debugf("[linker] Failed to %s %s to %s: %v", strategy.name, oldname, tempname, err)
+			_ = os.Remove(tempname)
+			lastErr = err
+			continue
+		}
+
+		if idx != linkStrategyIdx {
+			debugf("[linker] Falling back to %s", strategy.name)
+			linkStrategyIdx = idx
+		}
+
+		if err := os.Rename(tempname, newname); err != nil {
+			_ = os.Remove(tempname)
+			return err
+		}
+		return nil
+	}
+
+	return fmt.Errorf("Error linking %s to %s: %v", oldname, newname, lastErr)
+}
+
+// copyFile copies the file at src to dest with the same permissions
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
 		return err
 	}
-	return os.Rename(tempname, newname)
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+
+	if err := out.Sync(); err != nil {
+		_ = out.Close()
+		return err
+	}
+
+	return out.Close()
 }
 
 type compileCache struct {
 	Dir string
+
+	// content hashes of the binaries in the cache
+	hashes map[string]string
 }
 
 func newCompileCache() (*compileCache, error) {
-	cc := &compileCache{}
+	cc := &compileCache{hashes: map[string]string{}}
 
 	var err error
-	cc.Dir, err = os.MkdirTemp("", "binproxy")
+	cc.Dir, err = mkdirTemp("binproxy")
 	if err != nil {
 		return nil, fmt.Errorf("Error creating temp dir: %v", err)
 	}
@@ -155,8 +530,8 @@ func newCompileCache() (*compileCache, error) {
 	return cc, nil
 }
 
-func (c *compileCache) IsCached(vars []string) bool {
-	path, err := c.file(vars)
+func (c *compileCache) IsCached(vars []string, opts CompilerOptions) bool {
+	path, err := c.file(vars, opts)
 	if err != nil {
 		panic(err)
 	}
@@ -165,27 +540,33 @@ func (c *compileCache) IsCached(vars []string) bool {
 	return err == nil
 }
 
-func (c *compileCache) Key(vars []string) (string, error) {
+func (c *compileCache) hash(path string) string {
+	return c.hashes[path]
+}
+
+func (c *compileCache) Key(vars []string, opts CompilerOptions) (string, error) {
 	h := sha1.New()
 
 	// add the vars to the hash
-	for _, v := range vars {
+	for _, v := range sortedVars(vars) {
 		if _, err := io.WriteString(h, v); err != nil {
 			return "", err
 		}
 	}
+	// and the options that change the output
+	_, _ = fmt.Fprintf(h, "%#v", opts)
 	// factor in client source as well
 	_, _ = io.WriteString(h, clientSrc)
 
 	return fmt.Sprintf("%x", h.Sum(nil)), nil
 }
 
-func (c *compileCache) file(vars []string) (string, error) {
+func (c *compileCache) file(vars []string, opts CompilerOptions) (string, error) {
 	if c.Dir == "" {
 		return "", errors.New("No compile cache dir set")
 	}
 
-	k, err := c.Key(vars)
+	k, err := c.Key(vars, opts)
 	if err != nil {
 		return "", err
 	}
@@ -1,11 +1,14 @@
 package bintest_test
 
 import (
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
 	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/buildkite/bintest/v3"
@@ -81,3 +84,119 @@ func TestCompileProxy_GoBug22315(t *testing.T) {
 		})
 	}
 }
+
+func TestCompileProxyContentHash(t *testing.T) {
+	p, err := bintest.CompileProxy("llamas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	b, err := os.ReadFile(p.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := fmt.Sprintf("%x", sha256.Sum256(b)); p.ContentHash != expected {
+		t.Fatalf("Expected content hash %q, got %q", expected, p.ContentHash)
+	}
+}
+
+func TestCompileProxyWithCompilerOptions(t *testing.T) {
+	defaultProxy, err := bintest.CompileProxy("llamas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer defaultProxy.Close()
+
+	bintest.SetCompilerOptions(bintest.CompilerOptions{
+		LDFlags: "-s -w",
+		Tags:    []string{"llamas"},
+		Env:     []string{"CGO_ENABLED=0"},
+	})
+	defer bintest.SetCompilerOptions(bintest.CompilerOptions{})
+
+	m, err := bintest.NewMock("llamas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.CheckAndClose(t)
+
+	m.Expect("spit").AndExitWith(0)
+
+	if err := exec.Command(m.Path, "spit").Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(m.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%x", sha256.Sum256(b)) == defaultProxy.ContentHash {
+		t.Fatalf("Expected the options to change the compiled binary")
+	}
+}
+
+func TestPrecompileWarmsCache(t *testing.T) {
+	if err := bintest.Precompile(); err != nil {
+		t.Fatal(err)
+	}
+
+	logger := &recordingLogger{}
+	bintest.SetLogger(logger)
+	defer bintest.SetLogger(nil)
+
+	p, err := bintest.CompileProxy("llamas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// compiling is logged along with registering the proxy
+	if !logger.contains("Registering proxy") || logger.contains("[compiler] Compiled") {
+		t.Fatalf("Expected the client for the shared server to be cached, got %q", logger.lines)
+	}
+}
+
+func TestCompileErrorHasDiagnostics(t *testing.T) {
+	bintest.SetCompilerOptions(bintest.CompilerOptions{
+		Env: []string{"GOFLAGS=-mod=llamas"},
+	})
+	defer bintest.SetCompilerOptions(bintest.CompilerOptions{})
+
+	_, err := bintest.CompileProxy("broken")
+	if err == nil {
+		t.Fatal("Expected compile to fail")
+	}
+
+	var compileErr *bintest.CompileError
+	if !errors.As(err, &compileErr) {
+		t.Fatalf("Expected a CompileError, got %T: %v", err, err)
+	}
+	if compileErr.GOFLAGS != "-mod=llamas" {
+		t.Errorf("Expected GOFLAGS of -mod=llamas, got %q", compileErr.GOFLAGS)
+	}
+	if compileErr.GoVersion == "" || compileErr.GOMOD == "" {
+		t.Errorf("Expected go version and GOMOD to be set, got %q and %q", compileErr.GoVersion, compileErr.GOMOD)
+	}
+	if !strings.Contains(err.Error(), "GOFLAGS: -mod=llamas") {
+		t.Errorf("Expected diagnostics in error, got %q", err.Error())
+	}
+}
+
+func TestCompileErrorHintsWhenGoIsMissing(t *testing.T) {
+	bintest.SetCompilerOptions(bintest.CompilerOptions{
+		GoBinary: "go-llamas-not-found",
+	})
+	defer bintest.SetCompilerOptions(bintest.CompilerOptions{})
+
+	_, err := bintest.CompileProxy("broken")
+
+	var compileErr *bintest.CompileError
+	if !errors.As(err, &compileErr) {
+		t.Fatalf("Expected a CompileError, got %T: %v", err, err)
+	}
+	if !strings.Contains(compileErr.Hint, "CompilerOptions.GoBinary") {
+		t.Errorf("Expected a hint about GoBinary, got %q", compileErr.Hint)
+	}
+}
@@ -0,0 +1,196 @@
+// Package corpus provides a serializable format for argument matching cases, so that
+// the behaviour of bintest.Arguments and custom matchers can be recorded and then
+// compared between versions.
+package corpus
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+
+	"github.com/buildkite/bintest/v3"
+)
+
+var (
+	matchersMu sync.RWMutex
+	matchers   = map[string]func(arg string) (bintest.Matcher, error){
+		"any": func(arg string) (bintest.Matcher, error) {
+			return bintest.MatchAny(), nil
+		},
+		"pattern": func(arg string) (bintest.Matcher, error) {
+			return bintest.MatchPattern(arg), nil
+		},
+	}
+)
+
+// RegisterMatcher registers a constructor for a custom matcher kind, so it can be used
+// in a corpus as {"matcher": kind, "arg": "..."}
+func RegisterMatcher(kind string, f func(arg string) (bintest.Matcher, error)) {
+	matchersMu.Lock()
+	defer matchersMu.Unlock()
+	matchers[kind] = f
+}
+
+// Argument is a single expected argument, either a literal string or a matcher
+type Argument struct {
+	Literal string
+	Matcher string
+	Arg     string
+}
+
+// MarshalJSON encodes literals as plain strings and matchers as objects
+func (a Argument) MarshalJSON() ([]byte, error) {
+	if a.Matcher == "" {
+		return json.Marshal(a.Literal)
+	}
+	return json.Marshal(struct {
+		Matcher string `json:"matcher"`
+		Arg     string `json:"arg,omitempty"`
+	}{a.Matcher, a.Arg})
+}
+
+// UnmarshalJSON decodes either a plain string or a matcher object
+func (a *Argument) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &a.Literal); err == nil {
+		return nil
+	}
+	var m struct {
+		Matcher string `json:"matcher"`
+		Arg     string `json:"arg"`
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	if m.Matcher == "" {
+		return fmt.Errorf("Argument %s has no matcher kind", b)
+	}
+	a.Matcher, a.Arg = m.Matcher, m.Arg
+	return nil
+}
+
+func (a Argument) value() (interface{}, error) {
+	if a.Matcher == "" {
+		return a.Literal, nil
+	}
+
+	matchersMu.RLock()
+	f, ok := matchers[a.Matcher]
+	matchersMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("Unknown matcher kind %q", a.Matcher)
+	}
+	return f(a.Arg)
+}
+
+// Result is the serializable form of bintest.ArgumentsMatchResult
+type Result struct {
+	IsMatch     bool   `json:"isMatch"`
+	MatchCount  int    `json:"matchCount"`
+	Explanation string `json:"explanation,omitempty"`
+}
+
+// Case is a set of expected arguments applied to actual arguments, along with the
+// recorded result of matching them
+type Case struct {
+	Name     string     `json:"name,omitempty"`
+	Expected []Argument `json:"expected"`
+	Actual   []string   `json:"actual"`
+	Result   Result     `json:"result"`
+}
+
+// Arguments builds the bintest.Arguments for the expected arguments of the case
+func (c Case) Arguments() (bintest.Arguments, error) {
+	args := make(bintest.Arguments, len(c.Expected))
+	for idx, a := range c.Expected {
+		v, err := a.value()
+		if err != nil {
+			return nil, err
+		}
+		args[idx] = v
+	}
+	return args, nil
+}
+
+// MatchFunc matches a case and returns the result
+type MatchFunc func(c Case) (Result, error)
+
+// Match matches a case with the current bintest.Arguments engine
+func Match(c Case) (Result, error) {
+	args, err := c.Arguments()
+	if err != nil {
+		return Result{}, err
+	}
+	r := args.Match(c.Actual...)
+	return Result{IsMatch: r.IsMatch, MatchCount: r.MatchCount, Explanation: r.Explanation}, nil
+}
+
+// Corpus is a collection of cases
+type Corpus []Case
+
+// Read decodes a corpus from JSON
+func Read(r io.Reader) (Corpus, error) {
+	var c Corpus
+	if err := json.NewDecoder(r).Decode(&c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Write encodes the corpus as indented JSON
+func (c Corpus) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(c)
+}
+
+// Record returns a copy of the corpus with results recorded from f
+func (c Corpus) Record(f MatchFunc) (Corpus, error) {
+	recorded := make(Corpus, len(c))
+	for idx, tc := range c {
+		r, err := f(tc)
+		if err != nil {
+			return nil, fmt.Errorf("Case #%d %s: %v", idx+1, tc.Name, err)
+		}
+		tc.Result = r
+		recorded[idx] = tc
+	}
+	return recorded, nil
+}
+
+// Difference is a case where two matchers disagreed
+type Difference struct {
+	Case     Case
+	Expected Result
+	Actual   Result
+}
+
+func (d Difference) String() string {
+	return fmt.Sprintf("%s: expected %+v, got %+v", d.Case.Name, d.Expected, d.Actual)
+}
+
+// Verify compares the recorded results in the corpus with the results from f
+func (c Corpus) Verify(f MatchFunc) ([]Difference, error) {
+	var diffs []Difference
+	for idx, tc := range c {
+		r, err := f(tc)
+		if err != nil {
+			return nil, fmt.Errorf("Case #%d %s: %v", idx+1, tc.Name, err)
+		}
+		if !reflect.DeepEqual(r, tc.Result) {
+			diffs = append(diffs, Difference{Case: tc, Expected: tc.Result, Actual: r})
+		}
+	}
+	return diffs, nil
+}
+
+// Compare runs the corpus through two matchers and returns where they disagree
+func (c Corpus) Compare(old, new MatchFunc) ([]Difference, error) {
+	recorded, err := c.Record(old)
+	if err != nil {
+		return nil, err
+	}
+	return recorded.Verify(new)
+}
@@ -0,0 +1,86 @@
+package corpus_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/bintest/v3"
+	"github.com/buildkite/bintest/v3/corpus"
+)
+
+const testCorpus = `[
+  {
+    "name": "literal",
+    "expected": ["llamas", "rock"],
+    "actual": ["llamas", "rock"],
+    "result": {"isMatch": true, "matchCount": 2}
+  },
+  {
+    "name": "pattern",
+    "expected": ["llamas", {"matcher": "pattern", "arg": "^r"}],
+    "actual": ["llamas", "rock"],
+    "result": {"isMatch": true, "matchCount": 2}
+  },
+  {
+    "name": "mismatch",
+    "expected": ["llamas", {"matcher": "any"}],
+    "actual": ["alpacas", "rock"],
+    "result": {"isMatch": false, "matchCount": 0, "explanation": "Argument #1 doesn't match: Expected \"llamas\", got \"alpacas\""}
+  }
+]`
+
+func TestCorpusVerify(t *testing.T) {
+	c, err := corpus.Read(strings.NewReader(testCorpus))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diffs, err := c.Verify(corpus.Match)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range diffs {
+		t.Error(d)
+	}
+}
+
+func TestCorpusCompareWithCustomMatcher(t *testing.T) {
+	corpus.RegisterMatcher("prefix", func(arg string) (bintest.Matcher, error) {
+		return bintest.MatchPattern("^" + arg), nil
+	})
+
+	c := corpus.Corpus{
+		{Name: "prefix", Expected: []corpus.Argument{{Matcher: "prefix", Arg: "ll"}}, Actual: []string{"llamas"}},
+		{Name: "extra", Expected: []corpus.Argument{{Literal: "llamas"}}, Actual: []string{"llamas", "rock"}},
+	}
+
+	// a matcher that ignores extra arguments
+	lenient := func(tc corpus.Case) (corpus.Result, error) {
+		r, err := corpus.Match(tc)
+		if err == nil && r.MatchCount == len(tc.Expected) {
+			r.IsMatch, r.Explanation = true, ""
+		}
+		return r, err
+	}
+
+	diffs, err := c.Compare(corpus.Match, lenient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 1 || diffs[0].Case.Name != "extra" {
+		t.Fatalf("Expected a single difference for extra, got %v", diffs)
+	}
+
+	var buf bytes.Buffer
+	if err := c.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	roundtrip, err := corpus.Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if roundtrip[0].Expected[0].Matcher != "prefix" || roundtrip[1].Expected[0].Literal != "llamas" {
+		t.Fatalf("Unexpected roundtrip %#v", roundtrip)
+	}
+}
@@ -1,17 +1,245 @@
 package bintest
 
-import "log"
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DebugEnvVar turns on Debug when it's set to true or 1, and also switches the default
+// logger to JSON lines when it's set to json. See NewJSONLogger
+const DebugEnvVar = "BINTEST_DEBUG"
 
 var (
-	Debug bool
+	// Debug enables debug output from the default logger, and compiles clients that send
+	// their own debug output to the server
+	Debug, debugJSON = debugFromEnv(os.Getenv(DebugEnvVar))
+
+	logger   Logger = defaultLoggerFor(debugJSON)
+	loggerMu sync.RWMutex
 )
 
-func debugf(pattern string, args ...interface{}) {
-	if Debug {
-		log.Printf(pattern, args...)
+func debugFromEnv(v string) (debug bool, json bool) {
+	if strings.EqualFold(v, "json") {
+		return true, true
+	}
+	debug, _ = strconv.ParseBool(v)
+	return debug, false
+}
+
+func defaultLoggerFor(json bool) Logger {
+	if json {
+		return NewJSONLogger(os.Stderr)
+	}
+	return defaultLogger{}
+}
+
+// LogLevel is the severity of a log message
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelError:
+		return "error"
+	}
+	return fmt.Sprintf("level(%d)", int(l))
+}
+
+// Logger receives the log output of servers, proxies and mocks
+type Logger interface {
+	Logf(level LogLevel, format string, args ...interface{})
+}
+
+// LoggerFunc adapts a func to a Logger
+type LoggerFunc func(level LogLevel, format string, args ...interface{})
+
+func (f LoggerFunc) Logf(level LogLevel, format string, args ...interface{}) {
+	f(level, format, args...)
+}
+
+// SetLogger replaces the package-wide logger, which is used by servers and mocks that don't
+// have their own. Passing nil restores the default, which uses the log package and only
+// shows debug messages when Debug is set, or logs JSON lines if BINTEST_DEBUG is json
+func SetLogger(l Logger) {
+	loggerMu.Lock()
+	defer loggerMu.Unlock()
+
+	if l == nil {
+		l = defaultLoggerFor(debugJSON)
+	}
+	logger = l
+}
+
+func currentLogger() Logger {
+	loggerMu.RLock()
+	defer loggerMu.RUnlock()
+	return logger
+}
+
+type defaultLogger struct{}
+
+func (defaultLogger) Logf(level LogLevel, format string, args ...interface{}) {
+	switch level {
+	case LevelDebug:
+		if Debug {
+			log.Printf(format, args...)
+		}
+	case LevelError:
+		if useColor(os.Environ(), isTerminal(os.Stderr)) {
+			log.Printf("\x1b[31;1m🚨 ERROR: "+format+"\x1b[0m", args...)
+		} else {
+			log.Printf("ERROR: "+format, args...)
+		}
+	default:
+		log.Printf(format, args...)
+	}
+}
+
+// NewTestLogger returns a Logger that writes messages of at least level to t.Logf, so that
+// they are interleaved with the output of the test. Messages after the test finishes are dropped
+func NewTestLogger(t TestingTB, level LogLevel) Logger {
+	tl := &testLogger{t: t, level: level}
+	t.Cleanup(func() {
+		tl.mu.Lock()
+		defer tl.mu.Unlock()
+		tl.finished = true
+	})
+	return tl
+}
+
+type testLogger struct {
+	t        TestingTB
+	level    LogLevel
+	mu       sync.Mutex
+	finished bool
+}
+
+func (tl *testLogger) Logf(level LogLevel, format string, args ...interface{}) {
+	if level < tl.level {
+		return
+	}
+
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	// logging after a test has finished panics
+	if tl.finished {
+		return
+	}
+	tl.t.Logf("[%s] "+format, append([]interface{}{level}, args...)...)
+}
+
+// NewJSONLogger returns a Logger that writes each message to w as a line of JSON, with the
+// phase, proxy name and call kept in their own fields so that the output of concurrent
+// calls can be filtered by machine. Debug messages are only written when Debug is set
+func NewJSONLogger(w io.Writer) Logger {
+	return &jsonLogger{enc: json.NewEncoder(w)}
+}
+
+// logFields are the structured parts of a log message
+type logFields struct {
+	// Phase is the part of bintest that logged the message, like server, mock or call
+	Phase string `json:"phase,omitempty"`
+	Proxy string `json:"proxy,omitempty"`
+
+	// Call is the sequence number of the call, see Call.Sequence
+	Call uint64 `json:"call,omitempty"`
+	PID  int    `json:"pid,omitempty"`
+}
+
+// fieldLogger is implemented by loggers that keep the fields of a message apart from it,
+// rather than as a prefix of it
+type fieldLogger interface {
+	logFields(level LogLevel, fields logFields, msg string)
+}
+
+type jsonLogger struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+type jsonLogLine struct {
+	Time  time.Time `json:"time"`
+	Level string    `json:"level"`
+	logFields
+	Msg string `json:"msg"`
+}
+
+// logPrefixRegex matches the [phase] or [phase pid] prefix of messages
+var logPrefixRegex = regexp.MustCompile(`^\[([a-z]+)(?: (\d+))?\] `)
+
+func (l *jsonLogger) Logf(level LogLevel, format string, args ...interface{}) {
+	l.logFields(level, logFields{}, fmt.Sprintf(format, args...))
+}
+
+func (l *jsonLogger) logFields(level LogLevel, fields logFields, msg string) {
+	if level == LevelDebug && !Debug {
+		return
 	}
+
+	// messages from clients and most of the server have their phase as a prefix
+	if m := logPrefixRegex.FindStringSubmatch(msg); m != nil {
+		msg = msg[len(m[0]):]
+		if fields.Phase == "" {
+			fields.Phase = m[1]
+		}
+		if pid, err := strconv.Atoi(m[2]); err == nil && fields.PID == 0 {
+			fields.PID = pid
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_ = l.enc.Encode(jsonLogLine{
+		Time:      time.Now().UTC(),
+		Level:     level.String(),
+		logFields: fields,
+		Msg:       msg,
+	})
+}
+
+// logTo logs to l, or the package-wide logger if l is nil
+func logTo(l Logger, level LogLevel, pattern string, args ...interface{}) {
+	logWith(l, level, logFields{}, pattern, args...)
+}
+
+// logWith logs to l with fields. Loggers that don't keep them apart only get the phase and
+// pid, as a [phase pid] prefix, as the rest is usually in the message already
+func logWith(l Logger, level LogLevel, fields logFields, pattern string, args ...interface{}) {
+	if l == nil {
+		l = currentLogger()
+	}
+	if fl, ok := l.(fieldLogger); ok {
+		fl.logFields(level, fields, fmt.Sprintf(pattern, args...))
+		return
+	}
+	if fields.PID != 0 {
+		pattern = fmt.Sprintf("[%s %d] %s", fields.Phase, fields.PID, pattern)
+	}
+	l.Logf(level, pattern, args...)
+}
+
+func debugf(pattern string, args ...interface{}) {
+	logTo(nil, LevelDebug, pattern, args...)
 }
 
 func errorf(pattern string, args ...interface{}) {
-	log.Printf("\x1b[31;1m🚨 ERROR: "+pattern+"\x1b[0m", args...)
+	logTo(nil, LevelError, pattern, args...)
 }
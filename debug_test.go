@@ -0,0 +1,80 @@
+package bintest
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestDebugFromEnv(t *testing.T) {
+	for _, tc := range []struct {
+		value       string
+		debug, json bool
+	}{
+		{"", false, false},
+		{"true", true, false},
+		{"1", true, false},
+		{"false", false, false},
+		{"json", true, true},
+		{"JSON", true, true},
+	} {
+		debug, json := debugFromEnv(tc.value)
+		if debug != tc.debug || json != tc.json {
+			t.Errorf("debugFromEnv(%q) = %v, %v, expected %v, %v", tc.value, debug, json, tc.debug, tc.json)
+		}
+	}
+}
+
+func TestJSONLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewJSONLogger(&buf)
+
+	logWith(l, LevelInfo, logFields{Phase: "call", Proxy: "llamas", Call: 3, PID: 1234}, "Exiting with %d", 1)
+	logTo(l, LevelError, "[client 42] Error from server: %s", "nope")
+	logTo(l, LevelInfo, "[server] Starting server on %s", "http://127.0.0.1")
+
+	var lines []jsonLogLine
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var line jsonLogLine
+		if err := dec.Decode(&line); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+
+	expected := []jsonLogLine{
+		{Level: "info", logFields: logFields{Phase: "call", Proxy: "llamas", Call: 3, PID: 1234}, Msg: "Exiting with 1"},
+		{Level: "error", logFields: logFields{Phase: "client", PID: 42}, Msg: "Error from server: nope"},
+		{Level: "info", logFields: logFields{Phase: "server"}, Msg: "Starting server on http://127.0.0.1"},
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %d lines, got %d: %+v", len(expected), len(lines), lines)
+	}
+	for i := range expected {
+		if lines[i].Time.IsZero() {
+			t.Errorf("Expected line %d to have a time", i)
+		}
+		lines[i].Time = expected[i].Time
+		if lines[i] != expected[i] {
+			t.Errorf("Line %d was %+v, expected %+v", i, lines[i], expected[i])
+		}
+	}
+}
+
+func TestLogWithPrefixesTextLoggers(t *testing.T) {
+	var got string
+	l := LoggerFunc(func(level LogLevel, format string, args ...interface{}) {
+		got = format
+	})
+
+	logWith(l, LevelDebug, logFields{Phase: "call", Proxy: "llamas", PID: 1234}, "Exiting")
+	if got != "[call 1234] Exiting" {
+		t.Errorf("Unexpected message %q", got)
+	}
+
+	logWith(l, LevelDebug, logFields{Phase: "mock", Proxy: "llamas"}, "Handling invocation")
+	if got != "Handling invocation" {
+		t.Errorf("Unexpected message %q", got)
+	}
+}
@@ -0,0 +1,58 @@
+package bintest
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Diff returns an argument-by-argument diff between the expectation and the actual
+// arguments, with expected arguments prefixed by "-" and actual arguments by "+"
+func (r ExpectationResult) Diff() string {
+	if r.Expectation == nil {
+		return ""
+	}
+
+	r.Expectation.RLock()
+	expected := r.Expectation.arguments
+	r.Expectation.RUnlock()
+
+	return diffArguments(expected, r.Arguments)
+}
+
+func diffArguments(expected Arguments, actual []string) string {
+	var b strings.Builder
+	var line = func(prefix string, idx int, s string) {
+		fmt.Fprintf(&b, "%s [%d] %s\n", prefix, idx, s)
+	}
+
+	for i := 0; i < len(expected) || i < len(actual); i++ {
+		switch {
+		case i >= len(actual):
+			line("-", i, FormatInterfaces(expected[i:i+1]))
+		case i >= len(expected):
+			line("+", i, fmt.Sprintf("%q", actual[i]))
+		case expected[i : i+1].Match(actual[i]).IsMatch:
+			line(" ", i, fmt.Sprintf("%q", actual[i]))
+		default:
+			line("-", i, FormatInterfaces(expected[i:i+1]))
+			line("+", i, fmt.Sprintf("%q", actual[i]))
+		}
+	}
+
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// diffStdin returns a diff of the expected and actual stdin, or an empty string if there
+// isn't a string expectation for stdin, it matches, or none was read
+func diffStdin(expected interface{}, actual []byte) string {
+	s, ok := expected.(string)
+	if !ok || len(actual) == 0 || s == string(actual) {
+		return ""
+	}
+
+	// if the stdin was very long, just report the size, not the content
+	if len(s) > 1024 || len(actual) > 1024 {
+		return fmt.Sprintf("- stdin %d bytes\n+ stdin %d bytes", len(s), len(actual))
+	}
+	return fmt.Sprintf("- stdin %q\n+ stdin %q", s, actual)
+}
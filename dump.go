@@ -0,0 +1,95 @@
+package bintest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Dump writes the state of the mock to w, which is each expectation with how many times
+// it's been called and every invocation in the order they were received
+func (m *Mock) Dump(w io.Writer) error {
+	_, err := io.WriteString(w, m.String())
+	return err
+}
+
+// String describes the state of the mock, see Dump
+func (m *Mock) String() string {
+	m.Lock()
+	defer m.Unlock()
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Mock %s at %s\n", m.Name, m.Path)
+
+	if m.sealed {
+		fmt.Fprintf(&buf, "No more interactions expected%s\n", m.sealedAt())
+	}
+
+	tw := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+
+	if len(m.expected) == 0 {
+		fmt.Fprintf(tw, "No expectations\n")
+	} else {
+		fmt.Fprintf(tw, "Expectations:\n")
+		for _, expected := range m.expected {
+			met := expected.Check(&messageCollector{})
+
+			expected.RLock()
+			status := "met"
+			if !met {
+				status = "NOT MET"
+			}
+			declared := ""
+			if expected.file != "" {
+				declared = fmt.Sprintf("%s:%d", filepath.Base(expected.file), expected.line)
+			}
+			fmt.Fprintf(tw, "  %s %s\tcalled %d, expected %s\t%s\t%s\n",
+				m.Name, expected.arguments.String(), expected.totalCalls,
+				callRange(expected.minCalls, expected.maxCalls), status, declared)
+			expected.RUnlock()
+		}
+	}
+
+	if len(m.invocations) == 0 {
+		fmt.Fprintf(tw, "No invocations\n")
+	} else {
+		fmt.Fprintf(tw, "Invocations:\n")
+		for _, i := range m.invocations {
+			command := i.Name
+			for _, arg := range i.Args {
+				command += " " + summaryArg(arg)
+			}
+			matched := "unexpected"
+			if m.afterSeal[i.Sequence] {
+				matched = "after ExpectNoMoreInteractions"
+			} else if i.Expectation != nil {
+				matched = "matched " + i.Expectation.arguments.String()
+			}
+			fmt.Fprintf(tw, "  #%d %s\texit %d\t%v\t%s\n",
+				i.Sequence, command, i.ExitCode, i.FinishedAt.Sub(i.StartedAt).Round(time.Millisecond), matched)
+		}
+	}
+	_ = tw.Flush()
+
+	return strings.TrimRight(buf.String(), "\n")
+}
+
+// callRange describes the number of times an expectation expects to be called
+func callRange(min, max int) string {
+	switch {
+	case max == InfiniteTimes && min == InfiniteTimes:
+		return "any"
+	case max == InfiniteTimes:
+		return strconv.Itoa(min) + "+"
+	case min == max:
+		return strconv.Itoa(min)
+	case min == InfiniteTimes:
+		return "at most " + strconv.Itoa(max)
+	}
+	return fmt.Sprintf("%d-%d", min, max)
+}
@@ -0,0 +1,65 @@
+package bintest_test
+
+import (
+	"bytes"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/bintest/v3"
+	"github.com/buildkite/bintest/v3/testutil"
+	"github.com/fortytw2/leaktest"
+)
+
+func TestMockDump(t *testing.T) {
+	defer leaktest.Check(t)()
+	m, close := mustMock(t, "llamas")
+	defer close()
+
+	m.Expect("eat", "grass").AndExitWith(3)
+	m.Expect("sleep").Min(2).Max(bintest.InfiniteTimes)
+
+	_ = exec.Command(m.Path, "eat", "grass").Run()
+	_ = exec.Command(m.Path, "spit", "at you").Run()
+
+	var buf bytes.Buffer
+	if err := m.Dump(&buf); err != nil {
+		t.Fatal(err)
+	}
+	dump := buf.String()
+
+	for _, s := range []string{
+		"Mock llamas at " + m.Path,
+		`llamas "eat", "grass"  called 1, expected 1`,
+		`llamas "sleep"         called 0, expected 2+`,
+		"NOT MET",
+		"dump_test.go:",
+		`llamas eat grass`,
+		`exit 3`,
+		`matched "eat", "grass"`,
+		`llamas spit "at you"`,
+		`unexpected`,
+	} {
+		if !strings.Contains(dump, s) {
+			t.Errorf("Expected dump to contain %q, got:\n%s", s, dump)
+		}
+	}
+
+	if m.String() != dump {
+		t.Errorf("Expected String to match Dump")
+	}
+
+	m.Check(&testutil.TestingT{})
+}
+
+func TestMockDumpWithoutExpectations(t *testing.T) {
+	m, err := bintest.NewMock("alpacas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	if s := m.String(); !strings.Contains(s, "No expectations\nNo invocations") {
+		t.Errorf("Unexpected dump:\n%s", s)
+	}
+}
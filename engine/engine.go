@@ -0,0 +1,76 @@
+// Package engine exposes the binary interception engine that powers bintest without the
+// Mock layer, for embedding in other testing frameworks that want to build their own
+// expectation DSLs. It deliberately exposes a small surface: a proxy binary, the calls
+// made to it and a handler to respond to them.
+package engine
+
+import (
+	"sync"
+
+	"github.com/buildkite/bintest/v3"
+)
+
+// Call is an invocation of the proxy binary. Handlers must finish every call with
+// Exit, Fatal or one of the Passthrough methods.
+type Call = bintest.Call
+
+// Handler responds to calls to a proxy binary
+type Handler interface {
+	HandleCall(c *Call)
+}
+
+// HandlerFunc adapts a function to a Handler
+type HandlerFunc func(c *Call)
+
+// HandleCall calls f(c)
+func (f HandlerFunc) HandleCall(c *Call) {
+	f(c)
+}
+
+// Engine is a proxy binary and the server that dispatches its calls
+type Engine struct {
+	proxy *bintest.Proxy
+	wg    sync.WaitGroup
+}
+
+// New compiles a proxy binary at path. If just a filename is provided a temp directory
+// is created for it.
+func New(path string) (*Engine, error) {
+	p, err := bintest.CompileProxy(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Engine{proxy: p}, nil
+}
+
+// Path returns the full path to the proxy binary
+func (e *Engine) Path() string {
+	return e.proxy.Path
+}
+
+// Environ returns environment variables required to invoke the proxy binary
+func (e *Engine) Environ() []string {
+	return e.proxy.Environ()
+}
+
+// Serve dispatches each call to h in its own goroutine until the engine is closed
+func (e *Engine) Serve(h Handler) {
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		for call := range e.proxy.Ch {
+			e.wg.Add(1)
+			go func(c *Call) {
+				defer e.wg.Done()
+				h.HandleCall(c)
+			}(call)
+		}
+	}()
+}
+
+// Close stops accepting calls, waits for handlers to finish and removes the proxy binary
+func (e *Engine) Close() error {
+	err := e.proxy.Close()
+	e.wg.Wait()
+	return err
+}
@@ -0,0 +1,33 @@
+package engine_test
+
+import (
+	"fmt"
+	"os/exec"
+	"testing"
+
+	"github.com/buildkite/bintest/v3/engine"
+)
+
+func TestEngineServe(t *testing.T) {
+	e, err := engine.New("llamas")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.Serve(engine.HandlerFunc(func(c *engine.Call) {
+		fmt.Fprintf(c.Stdout, "%v", c.Args[1:])
+		c.Exit(2)
+	}))
+
+	out, err := exec.Command(e.Path(), "rock", "on").Output()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 2 {
+		t.Fatalf("Expected exit code 2, got %v", err)
+	}
+	if expected := "[rock on]"; string(out) != expected {
+		t.Fatalf("Expected %q, got %q", expected, out)
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -2,37 +2,131 @@ package bintest
 
 import (
 	"fmt"
+	"runtime"
 	"strings"
-	"testing"
 )
 
 // ExpectEnv asserts that certain environment vars/values exist, otherwise
 // an error is reported to T and a matching error is returned (for Before)
-func ExpectEnv(t *testing.T, environ []string, expect ...string) error {
+func ExpectEnv(t TestingT, environ []string, expect ...string) error {
 	for _, e := range expect {
-		pair := strings.Split(e, "=")
-		actual, ok := GetEnv(pair[0], environ)
+		key, value := splitEnv(e)
+		actual, ok := GetEnv(key, environ)
 		if !ok {
-			err := fmt.Errorf("Expected %s, %s wasn't set in environment", e, pair[0])
-			t.Error(err)
+			err := fmt.Errorf("Expected %s, %s wasn't set in environment", e, key)
+			t.Errorf("%v", err)
 			return err
 		}
-		if actual != pair[1] {
+		if actual != value {
 			err := fmt.Errorf("Expected %s, got %q", e, actual)
-			t.Error(err)
+			t.Errorf("%v", err)
 			return err
 		}
 	}
 	return nil
 }
 
-// GetEnv returns the value for a given env in the invocation
+// ExpectNoEnv asserts that none of the environment vars are set, otherwise
+// an error is reported to T and a matching error is returned (for Before)
+func ExpectNoEnv(t TestingT, environ []string, keys ...string) error {
+	for _, key := range keys {
+		if _, ok := GetEnv(key, environ); ok {
+			err := fmt.Errorf("Expected %s to not be set in environment", key)
+			t.Errorf("%v", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// GetEnv returns the value for a given env in the invocation. Keys are case-insensitive
+// on windows, and if a key is set more than once the last value wins
 func GetEnv(key string, environ []string) (string, bool) {
+	value, found := "", false
+	for _, e := range environ {
+		k, v := splitEnv(e)
+		if envKeyEqual(k, key) {
+			value, found = v, true
+		}
+	}
+	return value, found
+}
+
+// EnvMap returns environ as a map of keys to values. On windows, where keys are
+// case-insensitive, the casing of the first occurrence of a key is used
+func EnvMap(environ []string) map[string]string {
+	m := make(map[string]string, len(environ))
+	keys := map[string]string{}
+	for _, e := range environ {
+		k, v := splitEnv(e)
+		if runtime.GOOS == "windows" {
+			if existing, ok := keys[strings.ToUpper(k)]; ok {
+				k = existing
+			} else {
+				keys[strings.ToUpper(k)] = k
+			}
+		}
+		m[k] = v
+	}
+	return m
+}
+
+// SetEnv returns a copy of environ with an environment variable in the form KEY=value
+// set, replacing any existing value
+func SetEnv(environ []string, kv string) []string {
+	key, _ := splitEnv(kv)
+	result := make([]string, 0, len(environ)+1)
 	for _, e := range environ {
-		pair := strings.Split(e, "=")
-		if strings.ToUpper(pair[0]) == strings.ToUpper(key) {
-			return pair[1], true
+		if k, _ := splitEnv(e); !envKeyEqual(k, key) {
+			result = append(result, e)
 		}
 	}
-	return "", false
+	return append(result, kv)
+}
+
+// internalEnvVars are the environment variables bintest uses to talk to proxies
+var internalEnvVars = []string{
+	ServerEnvVar,
+	TransportEnvVar,
+	StdinEnvVar,
+	FallbackEnvVar,
+	ExtraFilesEnvVar,
+	CombinedOutputEnvVar,
+	ParentCallEnvVar,
+	TokenEnvVar,
+	TLSEnvVar,
+}
+
+// StripInternalEnv returns a copy of environ without the environment variables that bintest
+// uses to talk to proxies
+func StripInternalEnv(environ []string) []string {
+	result := make([]string, 0, len(environ))
+	for _, e := range environ {
+		key, _ := splitEnv(e)
+		internal := false
+		for _, v := range internalEnvVars {
+			if envKeyEqual(key, v) {
+				internal = true
+				break
+			}
+		}
+		if !internal {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// splitEnv splits an environment variable in the form KEY=value, values can contain =
+func splitEnv(e string) (string, string) {
+	key, value, _ := strings.Cut(e, "=")
+	return key, value
+}
+
+// envKeyEqual compares environment variable names the way the OS does
+func envKeyEqual(a, b string) bool {
+	if runtime.GOOS == "windows" {
+		return strings.EqualFold(a, b)
+	}
+	return a == b
 }
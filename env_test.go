@@ -0,0 +1,100 @@
+package bintest_test
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"testing"
+
+	"github.com/buildkite/bintest/v3"
+	"github.com/fortytw2/leaktest"
+)
+
+func TestEnvValuesContainingEquals(t *testing.T) {
+	environ := []string{`LLAMAS=rock`, `OPTS=--foo=bar --baz=1`, `EMPTY=`}
+
+	if v, ok := bintest.GetEnv(`OPTS`, environ); !ok || v != `--foo=bar --baz=1` {
+		t.Fatalf("Expected full value for OPTS, got %q (%v)", v, ok)
+	}
+	if v, ok := bintest.GetEnv(`EMPTY`, environ); !ok || v != `` {
+		t.Fatalf("Expected EMPTY to be set and empty, got %q (%v)", v, ok)
+	}
+
+	i := bintest.Invocation{Env: environ}
+	if v, ok := i.EnvLookup(`OPTS`); !ok || v != `--foo=bar --baz=1` {
+		t.Fatalf("Expected full value for OPTS, got %q (%v)", v, ok)
+	}
+	if _, ok := i.EnvLookup(`NOPE`); ok {
+		t.Fatalf("Expected NOPE to not be set")
+	}
+
+	if err := bintest.ExpectEnv(t, environ, `OPTS=--foo=bar --baz=1`); err != nil {
+		t.Fatal(err)
+	}
+
+	environ = bintest.SetEnv(environ, `OPTS=a=b`)
+	m := bintest.EnvMap(environ)
+	if len(m) != 3 || m[`OPTS`] != `a=b` || m[`LLAMAS`] != `rock` {
+		t.Fatalf("Unexpected env map %#v", m)
+	}
+}
+
+func TestEnvKeyCase(t *testing.T) {
+	environ := []string{`Path=/usr/bin`, `llamas=rock`}
+
+	_, ok := bintest.GetEnv(`PATH`, environ)
+	if expected := runtime.GOOS == "windows"; ok != expected {
+		t.Fatalf("Expected case-insensitive match to be %v, got %v", expected, ok)
+	}
+
+	m := bintest.EnvMap(append(environ, `LLAMAS=party`))
+	if runtime.GOOS == "windows" {
+		if len(m) != 2 || m[`llamas`] != `party` {
+			t.Fatalf("Unexpected env map %#v", m)
+		}
+	} else if len(m) != 3 || m[`llamas`] != `rock` || m[`LLAMAS`] != `party` {
+		t.Fatalf("Unexpected env map %#v", m)
+	}
+}
+
+func TestMockStripsInternalEnv(t *testing.T) {
+	for _, keep := range []bool{false, true} {
+		t.Run(fmt.Sprintf("KeepInternalEnv=%v", keep), func(t *testing.T) {
+			defer leaktest.Check(t)()
+			m, err := bintest.NewMockWithOptions("llamas", bintest.MockOptions{KeepInternalEnv: keep})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				if err := m.Close(); err != nil {
+					t.Error(err)
+				}
+			}()
+
+			var env []string
+			m.Expect().AndCallFunc(func(c *bintest.Call) {
+				env = c.Env
+				c.Exit(0)
+			})
+
+			cmd := exec.Command(m.Path)
+			cmd.Env = append(os.Environ(), `LLAMAS_ROCK=absolutely`, bintest.StdinEnvVar+`=`+bintest.StdinNever,
+				bintest.ServerEnvVar+`=http://127.0.0.1:1`)
+			if err := cmd.Run(); err != nil {
+				t.Fatal(err)
+			}
+
+			m.Check(t)
+
+			if _, ok := bintest.GetEnv(`LLAMAS_ROCK`, env); !ok {
+				t.Errorf("Expected LLAMAS_ROCK in call env")
+			}
+			for _, key := range []string{bintest.ServerEnvVar, bintest.StdinEnvVar} {
+				if _, ok := bintest.GetEnv(key, env); ok != keep {
+					t.Errorf("Expected %s in call env to be %v, got %v", key, keep, ok)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package bintest
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// ErrorStyle is how mocks format the errors they write to the stderr of calls
+type ErrorStyle int
+
+const (
+	// ErrorStyleAuto uses color when the caller's stderr is a terminal, unless NO_COLOR is
+	// set or TERM is dumb
+	ErrorStyleAuto ErrorStyle = iota
+
+	// ErrorStyleColor always uses a red 🚨 banner
+	ErrorStyleColor
+
+	// ErrorStylePlain uses plain text prefixed with bintest:, for logs parsed by other tools
+	ErrorStylePlain
+)
+
+var (
+	errorStyle   ErrorStyle
+	errorStyleMu sync.RWMutex
+)
+
+// SetErrorStyle sets how mocks format the errors they write to the stderr of calls, and
+// how errors are logged by the default logger
+func SetErrorStyle(style ErrorStyle) {
+	errorStyleMu.Lock()
+	defer errorStyleMu.Unlock()
+	errorStyle = style
+}
+
+func currentErrorStyle() ErrorStyle {
+	errorStyleMu.RLock()
+	defer errorStyleMu.RUnlock()
+	return errorStyle
+}
+
+// useColor returns whether errors written to an output with environ should be colored
+func useColor(environ []string, isTerminal bool) bool {
+	switch currentErrorStyle() {
+	case ErrorStyleColor:
+		return true
+	case ErrorStylePlain:
+		return false
+	}
+	if v, ok := GetEnv("NO_COLOR", environ); ok && v != "" {
+		return false
+	}
+	if v, _ := GetEnv("TERM", environ); v == "dumb" {
+		return false
+	}
+	return isTerminal
+}
+
+// formatError returns an error message formatted for an output, with a trailing newline
+func formatError(color bool, format string, args ...interface{}) string {
+	if color {
+		return fmt.Sprintf("\033[31m🚨 "+format+"\033[0m\n", args...)
+	}
+	return fmt.Sprintf("bintest: "+format+"\n", args...)
+}
+
+// writeCallError writes an error to the stderr of a call in the style for its caller
+func writeCallError(c *Call, format string, args ...interface{}) {
+	_, _ = io.WriteString(c.Stderr, formatError(useColor(c.Env, c.StderrIsTerminal), format, args...))
+}
+
+// isTerminal returns whether f is likely to be a terminal, or a console on Windows. It's a
+// heuristic that treats any character device as a terminal, apart from the null device, so
+// other character devices like serial ports count as terminals too
+func isTerminal(f *os.File) bool {
+	if f == nil {
+		return false
+	}
+	fi, err := f.Stat()
+	if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	if null, err := os.Stat(os.DevNull); err == nil && os.SameFile(fi, null) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,51 @@
+package bintest
+
+import (
+	"os"
+	"testing"
+)
+
+func TestUseColor(t *testing.T) {
+	t.Cleanup(func() { SetErrorStyle(ErrorStyleAuto) })
+
+	for _, tc := range []struct {
+		style      ErrorStyle
+		environ    []string
+		isTerminal bool
+		expected   bool
+	}{
+		{ErrorStyleAuto, nil, true, true},
+		{ErrorStyleAuto, nil, false, false},
+		{ErrorStyleAuto, []string{"NO_COLOR=1"}, true, false},
+		{ErrorStyleAuto, []string{"NO_COLOR="}, true, true},
+		{ErrorStyleAuto, []string{"TERM=dumb"}, true, false},
+		{ErrorStyleColor, []string{"NO_COLOR=1"}, false, true},
+		{ErrorStylePlain, nil, true, false},
+	} {
+		SetErrorStyle(tc.style)
+		if actual := useColor(tc.environ, tc.isTerminal); actual != tc.expected {
+			t.Errorf("Expected useColor(%v, %v) with style %d to be %v", tc.environ, tc.isTerminal, tc.style, tc.expected)
+		}
+	}
+}
+
+func TestFormatError(t *testing.T) {
+	if actual := formatError(false, "Error: %s", "llamas"); actual != "bintest: Error: llamas\n" {
+		t.Fatalf("Unexpected plain error %q", actual)
+	}
+	if actual := formatError(true, "Error: %s", "llamas"); actual != "\033[31m🚨 Error: llamas\033[0m\n" {
+		t.Fatalf("Unexpected colored error %q", actual)
+	}
+}
+
+func TestIsTerminalIgnoresDevNull(t *testing.T) {
+	f, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if isTerminal(f) {
+		t.Fatalf("Expected %s to not be a terminal", os.DevNull)
+	}
+}
@@ -0,0 +1,30 @@
+package bintest_test
+
+import (
+	"bytes"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/fortytw2/leaktest"
+)
+
+func TestMockErrorsArePlainWhenStderrIsntATerminal(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	m, close := mustMock(t, "llamas")
+	defer close()
+
+	m.Expect("eat").Optionally()
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(m.Path, "sleep")
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err == nil {
+		t.Fatal("Expected an unexpected call to fail")
+	}
+
+	if !strings.HasPrefix(stderr.String(), "bintest: Error: ") || strings.Contains(stderr.String(), "\033") {
+		t.Fatalf("Expected a plain error, got %q", stderr.String())
+	}
+}
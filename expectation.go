@@ -5,8 +5,13 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 // Expectation is used for setting expectations
@@ -28,6 +33,12 @@ type Expectation struct {
 	// The command to execute and return the results of
 	passthroughPath string
 
+	// How long the passthrough command can run for, zero uses the mock's timeout
+	passthroughTimeout time.Duration
+
+	// The directory the passthrough command runs in, empty for the caller's directory
+	passthroughDir string
+
 	// The function to call when executed
 	callFunc func(*Call)
 
@@ -43,11 +54,31 @@ type Expectation struct {
 	// stdin expectation, as a string or a Matcher
 	stdin interface{}
 
+	// Whether to read all of stdin even without a stdin expectation
+	consumeStdin bool
+
 	// A copy of the stdin data read by the call
 	readStdin []byte
 
-	// Buffers to copy to stdout and stderr
-	writeStdout, writeStderr *bytes.Buffer
+	// Failures from AndInteract sessions
+	interactErrors []string
+
+	// Environment variables that calls must not have, and the ones they had anyway
+	withoutEnv, foundEnv []string
+
+	// Output to copy to stdout and stderr
+	writeStdout, writeStderr output
+
+	// A frozen time or an offset from the current time to advertise to the command
+	fakeTime       time.Time
+	fakeTimeOffset time.Duration
+
+	// Where the expectation was registered, outside of bintest
+	file string
+	line int
+
+	// An expectation that must have been called its minimum times before this one matches
+	after *Expectation
 }
 
 // Exactly expects exactly n invocations of this expectation
@@ -105,6 +136,33 @@ func (e *Expectation) WithStdin(match interface{}) *Expectation {
 	return e
 }
 
+// AndReadStdin makes the invoker read all of its stdin before responding, so it's recorded
+// on the Invocation without a stdin expectation. By default stdin is only read when it's
+// matched or the response reads it, and input that isn't read is left for the next reader
+func (e *Expectation) AndReadStdin() *Expectation {
+	e.Lock()
+	defer e.Unlock()
+	e.consumeStdin = true
+	return e
+}
+
+// WithStdinGolden expects the stdin received by the command to match the golden file at path.
+// When UpdateGoldenEnvVar is set, the golden file is written with the stdin instead
+func (e *Expectation) WithStdinGolden(t TestingT, path string) *Expectation {
+	if h, ok := t.(helper); ok {
+		h.Helper()
+	}
+
+	g := &goldenMatcher{path: path, update: updateGolden()}
+	if !g.update {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("Golden file %s can't be read, set %s=true to create it: %v", path, UpdateGoldenEnvVar, err)
+		}
+	}
+
+	return e.WithStdin(g)
+}
+
 // AndExitWith causes the invoker to finish with an exit code of code
 func (e *Expectation) AndExitWith(code int) *Expectation {
 	e.Lock()
@@ -118,7 +176,7 @@ func (e *Expectation) AndExitWith(code int) *Expectation {
 func (e *Expectation) AndWriteToStdout(s string) *Expectation {
 	e.Lock()
 	defer e.Unlock()
-	e.writeStdout.WriteString(s)
+	e.writeStdout.writeString(s)
 	e.passthroughPath = ""
 	return e
 }
@@ -127,7 +185,29 @@ func (e *Expectation) AndWriteToStdout(s string) *Expectation {
 func (e *Expectation) AndWriteToStderr(s string) *Expectation {
 	e.Lock()
 	defer e.Unlock()
-	e.writeStderr.WriteString(s)
+	e.writeStderr.writeString(s)
+	e.passthroughPath = ""
+	return e
+}
+
+// AndWriteToStdoutFromFile causes the invoker to output the contents of the file at path to
+// stdout. The file is streamed when the expectation is invoked rather than read into memory.
+// This resets any passthrough path set
+func (e *Expectation) AndWriteToStdoutFromFile(path string) *Expectation {
+	e.Lock()
+	defer e.Unlock()
+	e.writeStdout.writeFile(path)
+	e.passthroughPath = ""
+	return e
+}
+
+// AndWriteToStderrFromFile causes the invoker to output the contents of the file at path to
+// stderr. The file is streamed when the expectation is invoked rather than read into memory.
+// This resets any passthrough path set
+func (e *Expectation) AndWriteToStderrFromFile(path string) *Expectation {
+	e.Lock()
+	defer e.Unlock()
+	e.writeStderr.writeFile(path)
 	e.passthroughPath = ""
 	return e
 }
@@ -140,6 +220,25 @@ func (e *Expectation) AndPassthroughToLocalCommand(path string) *Expectation {
 	return e
 }
 
+// AndPassthroughWithTimeout causes the invoker to defer to a local command, which is killed
+// if it runs for longer than timeout
+func (e *Expectation) AndPassthroughWithTimeout(path string, timeout time.Duration) *Expectation {
+	e.Lock()
+	defer e.Unlock()
+	e.passthroughPath = path
+	e.passthroughTimeout = timeout
+	return e
+}
+
+// InDir runs passthrough commands for the expectation in dir rather than the directory
+// the mock was called from. Invocation.Dir is still the caller's directory
+func (e *Expectation) InDir(dir string) *Expectation {
+	e.Lock()
+	defer e.Unlock()
+	e.passthroughDir = dir
+	return e
+}
+
 // AndCallFunc causes a middleware function to be called before invocation
 func (e *Expectation) AndCallFunc(f func(*Call)) *Expectation {
 	e.Lock()
@@ -149,6 +248,105 @@ func (e *Expectation) AndCallFunc(f func(*Call)) *Expectation {
 	return e
 }
 
+// Responder responds to calls, see the responders package for ones that emulate common tools
+type Responder interface {
+	Respond(*Call)
+}
+
+// ResponderFunc adapts a func to a Responder
+type ResponderFunc func(*Call)
+
+func (f ResponderFunc) Respond(c *Call) {
+	f(c)
+}
+
+// Respond causes the invoker to be responded to by r
+func (e *Expectation) Respond(r Responder) *Expectation {
+	return e.AndCallFunc(r.Respond)
+}
+
+// AndCopyStdinToStdout causes the invoker to copy its stdin to stdout, like cat, and then exit
+// with the exit code set by AndExitWith
+func (e *Expectation) AndCopyStdinToStdout() *Expectation {
+	return e.AndCallFunc(func(c *Call) {
+		_, _ = io.Copy(c.Stdout, c.Stdin)
+		c.Exit(e.getExitCode())
+	})
+}
+
+// AndTransformStdin causes the invoker to read all of its stdin, and write the result of
+// passing it to f to stdout, and then exit with the exit code set by AndExitWith. Useful for
+// filters like tr, gzip or jq
+func (e *Expectation) AndTransformStdin(f func([]byte) []byte) *Expectation {
+	return e.AndCallFunc(func(c *Call) {
+		in, err := io.ReadAll(c.Stdin)
+		if err != nil {
+			c.ExitWithError(fmt.Errorf("Error reading stdin: %w", err))
+			return
+		}
+		_, _ = c.Stdout.Write(f(in))
+		c.Exit(e.getExitCode())
+	})
+}
+
+// AndFakeTime advertises a frozen time to the invoked command via the SOURCE_DATE_EPOCH
+// and FAKETIME environment variables. FAKETIME uses libfaketime's absolute format, so the
+// clock stays at t. This is visible to passthrough commands and call funcs
+func (e *Expectation) AndFakeTime(t time.Time) *Expectation {
+	e.Lock()
+	defer e.Unlock()
+	e.fakeTime = t
+	e.fakeTimeOffset = 0
+	return e
+}
+
+// AndFakeTimeOffset is like AndFakeTime, but advertises a time relative to when the command is
+// invoked. FAKETIME uses libfaketime's relative format, so the clock keeps ticking from there
+func (e *Expectation) AndFakeTimeOffset(d time.Duration) *Expectation {
+	e.Lock()
+	defer e.Unlock()
+	e.fakeTime = time.Time{}
+	e.fakeTimeOffset = d
+	return e
+}
+
+// fakeTimeEnv returns the environment variables that advertise the fake time, if any
+func (e *Expectation) fakeTimeEnv(now time.Time) []string {
+	e.RLock()
+	defer e.RUnlock()
+
+	var epoch int64
+	var faketime string
+
+	if !e.fakeTime.IsZero() {
+		epoch = e.fakeTime.Unix()
+		faketime = e.fakeTime.UTC().Format("2006-01-02 15:04:05")
+	} else if e.fakeTimeOffset != 0 {
+		epoch = now.Add(e.fakeTimeOffset).Unix()
+		faketime = formatFakeTimeOffset(e.fakeTimeOffset)
+	} else {
+		return nil
+	}
+
+	return []string{
+		fmt.Sprintf("SOURCE_DATE_EPOCH=%d", epoch),
+		"FAKETIME=" + faketime,
+	}
+}
+
+// formatFakeTimeOffset formats d as a libfaketime offset in seconds, like +90 or -0.5
+func formatFakeTimeOffset(d time.Duration) string {
+	sign := "+"
+	if d < 0 {
+		sign, d = "-", -d
+	}
+	offset := sign + strconv.FormatInt(int64(d/time.Second), 10)
+	if frac := d % time.Second; frac != 0 {
+		offset += strings.TrimRight(fmt.Sprintf(".%09d", int64(frac)), "0")
+	}
+	return offset
+}
+
 // AnyArguments is a helper function for matching any argument set in WithMatcherFunc
 func AnyArguments() func(arg ...string) ArgumentsMatchResult {
 	return func(arg ...string) ArgumentsMatchResult {
@@ -173,28 +371,113 @@ func (e *Expectation) WithAnyArguments() *Expectation {
 	return e.WithMatcherFunc(AnyArguments())
 }
 
+// CallSite returns the file and line that the expectation was declared on, or an empty
+// file if it isn't known
+func (e *Expectation) CallSite() (file string, line int) {
+	e.RLock()
+	defer e.RUnlock()
+	return e.file, e.line
+}
+
+// WithoutEnv expects that the command is called without any of the given environment variables
+func (e *Expectation) WithoutEnv(keys ...string) *Expectation {
+	e.Lock()
+	defer e.Unlock()
+	e.withoutEnv = append(e.withoutEnv, keys...)
+	return e
+}
+
+// recordEnv notes any environment variables in environ that the expectation forbids
+func (e *Expectation) recordEnv(environ []string) {
+	e.Lock()
+	defer e.Unlock()
+	for _, key := range e.withoutEnv {
+		if _, ok := GetEnv(key, environ); ok {
+			e.foundEnv = append(e.foundEnv, key)
+		}
+	}
+}
+
+// recordStdin keeps a copy of the stdin read by a call
+func (e *Expectation) recordStdin(stdin []byte) {
+	e.Lock()
+	defer e.Unlock()
+	e.readStdin = make([]byte, len(stdin))
+	copy(e.readStdin, stdin)
+}
+
+// recordCall counts a call that matched the expectation, returning the new total. It's
+// counted when it matches rather than when it finishes so that concurrent calls can't
+// exceed the maximum
+func (e *Expectation) recordCall() int {
+	e.Lock()
+	defer e.Unlock()
+	e.totalCalls++
+	return e.totalCalls
+}
+
+// getExitCode returns the exit code set by AndExitWith
+func (e *Expectation) getExitCode() int {
+	e.RLock()
+	defer e.RUnlock()
+	return e.exitCode
+}
+
+// declaredAt returns a suffix for failure messages that says where the expectation was declared
+func (e *Expectation) declaredAt() string {
+	if e.file == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (declared at %s:%d)", filepath.Base(e.file), e.line)
+}
+
 // Check evaluates the expectation and outputs failures to the provided testing.T object
 func (e *Expectation) Check(t TestingT) bool {
+	if h, ok := t.(helper); ok {
+		h.Helper()
+	}
+	e.RLock()
+	defer e.RUnlock()
 	okCallCount := e.checkCallCount(t)
 	okStdin := e.checkStdin(t)
-	return okCallCount && okStdin
+	okEnv := e.checkEnv(t)
+	okInteract := e.checkInteract(t)
+	return okCallCount && okStdin && okEnv && okInteract
+}
+
+func (e *Expectation) checkInteract(t TestingT) bool {
+	for _, err := range e.interactErrors {
+		t.Logf("Interaction with [%s %s] failed%s: %s",
+			e.name, e.arguments.String(), e.declaredAt(), err,
+		)
+	}
+	return len(e.interactErrors) == 0
 }
 
 func (e *Expectation) checkCallCount(t TestingT) bool {
 	if e.minCalls != InfiniteTimes && e.totalCalls < e.minCalls {
-		t.Logf("Expected [%s %s] to be called at least %d times, got %d",
-			e.name, e.arguments.String(), e.minCalls, e.totalCalls,
+		t.Logf("Expected [%s %s] to be called at least %d times, got %d%s",
+			e.name, e.arguments.String(), e.minCalls, e.totalCalls, e.declaredAt(),
 		)
 		return false
 	} else if e.maxCalls != InfiniteTimes && e.totalCalls > e.maxCalls {
-		t.Logf("Expected [%s %s] to be called at most %d times, got %d",
-			e.name, e.arguments.String(), e.maxCalls, e.totalCalls,
+		t.Logf("Expected [%s %s] to be called at most %d times, got %d%s",
+			e.name, e.arguments.String(), e.maxCalls, e.totalCalls, e.declaredAt(),
 		)
 		return false
 	}
 	return true
 }
 
+func (e *Expectation) checkEnv(t TestingT) bool {
+	for _, key := range e.foundEnv {
+		t.Logf("Expected [%s %s] to be called without %s in the environment%s",
+			e.name, e.arguments.String(), key, e.declaredAt(),
+		)
+	}
+	return len(e.foundEnv) == 0
+}
+
 func (e *Expectation) checkStdin(t TestingT) bool {
 	actual := string(e.readStdin)
 	switch expected := e.stdin.(type) {
@@ -202,15 +485,20 @@ func (e *Expectation) checkStdin(t TestingT) bool {
 		if expected != actual {
 			// if the stdin was very long, just report the size, not the content
 			if len(actual) <= 1024 {
-				t.Logf("Expected stdin %q, got %q", expected, actual)
+				t.Logf("Expected stdin %q, got %q%s", expected, actual, e.declaredAt())
 			} else {
-				t.Logf("Expected %d bytes stdin, got %d bytes", len(expected), len(e.readStdin))
+				t.Logf("Expected %d bytes stdin, got %d bytes%s", len(expected), len(e.readStdin), e.declaredAt())
 			}
 			return false
 		}
+	case stdinMatcher:
+		if msg := expected.describeStdinMismatch(e.readStdin); msg != "" {
+			t.Logf("Expected stdin to match %s%s: %s", expected, e.declaredAt(), msg)
+			return false
+		}
 	case Matcher:
 		if ok, msg := expected.Match(actual); !ok {
-			t.Logf("%s %s for stdin %q", expected, msg, actual)
+			t.Logf("%s %s for stdin %q%s", expected, msg, actual, e.declaredAt())
 			return false
 		}
 	case nil:
@@ -222,6 +510,8 @@ func (e *Expectation) checkStdin(t TestingT) bool {
 }
 
 func (e *Expectation) String() string {
+	e.RLock()
+	defer e.RUnlock()
 	var stringer = struct {
 		Name            string    `json:"name,omitempty"`
 		Sequence        int       `json:"sequence,omitempty"`
@@ -247,6 +537,14 @@ type ExpectationResult struct {
 	Expectation          *Expectation
 	ArgumentsMatchResult ArgumentsMatchResult
 	CallCountMatch       bool
+
+	// OutOfOrder is set if the expectation is in an ordered group and an earlier
+	// expectation in the group hasn't been called yet
+	OutOfOrder bool
+
+	// copies of the expectation's state when it was matched, for Explain
+	totalCalls, maxCalls int
+	after                string
 }
 
 // ExpectationResultSet is a collection of ExpectationResult
@@ -256,7 +554,7 @@ type ExpectationResultSet []ExpectationResult
 // or ErrNoExpectationsMatch if none match.
 func (r ExpectationResultSet) Match() (*Expectation, error) {
 	for _, row := range r {
-		if row.ArgumentsMatchResult.IsMatch && row.CallCountMatch {
+		if row.ArgumentsMatchResult.IsMatch && row.CallCountMatch && !row.OutOfOrder {
 			return row.Expectation, nil
 		}
 	}
@@ -292,7 +590,9 @@ func (r ExpectationResult) Explain() string {
 		return "No expectations matched call"
 	} else if r.ArgumentsMatchResult.IsMatch && !r.CallCountMatch {
 		return fmt.Sprintf("Arguments matched, but total calls of %d would exceed maxCalls of %d",
-			r.Expectation.totalCalls+1, r.Expectation.maxCalls)
+			r.totalCalls+1, r.maxCalls)
+	} else if r.ArgumentsMatchResult.IsMatch && r.OutOfOrder {
+		return fmt.Sprintf("Arguments matched, but %s is expected to be called before it", r.after)
 	} else if !r.ArgumentsMatchResult.IsMatch {
 		return r.ArgumentsMatchResult.Explanation
 	}
@@ -302,27 +602,42 @@ func (r ExpectationResult) Explain() string {
 // ExpectationSet is a set of expectations
 type ExpectationSet []*Expectation
 
-// ForArguments applies arguments to the expectations and returns the results
+// ForArguments applies arguments to the expectations and returns the results. Each
+// expectation is only locked long enough to copy what's needed, so matcher funcs run
+// without any locks held
 func (exp ExpectationSet) ForArguments(args ...string) (result ExpectationResultSet) {
 	for _, e := range exp {
 		e.RLock()
-		defer e.RUnlock()
+		matcherFunc, arguments := e.matcherFunc, e.arguments
+		totalCalls, maxCalls, after := e.totalCalls, e.maxCalls, e.after
+		e.RUnlock()
 
 		var argResult ArgumentsMatchResult
 
 		// If provided, use a custom function for matching
-		if e.matcherFunc != nil {
-			argResult = e.matcherFunc(args...)
+		if matcherFunc != nil {
+			argResult = matcherFunc(args...)
 		} else {
-			argResult = e.arguments.Match(args...)
+			argResult = arguments.Match(args...)
 		}
 
-		result = append(result, ExpectationResult{
+		row := ExpectationResult{
 			Arguments:            args,
 			Expectation:          e,
 			ArgumentsMatchResult: argResult,
-			CallCountMatch:       (e.maxCalls == InfiniteTimes || e.totalCalls < e.maxCalls),
-		})
+			CallCountMatch:       (maxCalls == InfiniteTimes || totalCalls < maxCalls),
+			totalCalls:           totalCalls,
+			maxCalls:             maxCalls,
+		}
+
+		if after != nil {
+			after.RLock()
+			row.OutOfOrder = after.totalCalls < after.minCalls
+			row.after = fmt.Sprintf("[%s %s]", after.name, after.arguments.String())
+			after.RUnlock()
+		}
+
+		result = append(result, row)
 	}
 
 	return
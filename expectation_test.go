@@ -3,6 +3,7 @@ package bintest
 import (
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/buildkite/bintest/v3/testutil"
 )
@@ -56,6 +57,24 @@ func TestExplainExpectationMatch(t *testing.T) {
 	}
 }
 
+func TestDiffExpectationMatch(t *testing.T) {
+	var exp = ExpectationSet{
+		{name: "blargh", arguments: Arguments{"alpacas"}, minCalls: 1, maxCalls: 5},
+		{name: "test", arguments: Arguments{"llamas", MatchPattern(`^r`), "--force"}, minCalls: 1, maxCalls: 5},
+	}
+
+	actual := exp.ForArguments("llamas", "rock", "--quiet", "extra").ClosestMatch().Diff()
+	expected := `  [0] "llamas"
+  [1] "rock"
+- [2] "--force"
++ [2] "--quiet"
++ [3] "extra"`
+
+	if actual != expected {
+		t.Fatalf("Wrong diff, got:\n%s\nwanted:\n%s", actual, expected)
+	}
+}
+
 func TestCheckIndividualExpectations(t *testing.T) {
 	var match = []*Expectation{
 		{name: "test", arguments: Arguments{"llamas", "rock"}, totalCalls: 1, minCalls: 1, maxCalls: 1},
@@ -114,3 +133,50 @@ func TestExpectionWithStdin(t *testing.T) {
 		})
 	}
 }
+
+func TestExpectationFakeTimeEnv(t *testing.T) {
+	now := time.Date(2018, time.March, 4, 12, 30, 0, 0, time.UTC)
+
+	testCases := []struct {
+		label    string
+		exp      *Expectation
+		expected []string
+	}{
+		{"none", &Expectation{}, nil},
+		{"frozen", (&Expectation{}).AndFakeTime(now.Add(-time.Hour)), []string{
+			"SOURCE_DATE_EPOCH=1520163000",
+			"FAKETIME=2018-03-04 11:30:00",
+		}},
+		{"ahead", (&Expectation{}).AndFakeTimeOffset(90 * time.Minute), []string{
+			"SOURCE_DATE_EPOCH=1520172000",
+			"FAKETIME=+5400",
+		}},
+		{"behind", (&Expectation{}).AndFakeTimeOffset(-time.Hour), []string{
+			"SOURCE_DATE_EPOCH=1520163000",
+			"FAKETIME=-3600",
+		}},
+		{"sub-second ahead", (&Expectation{}).AndFakeTimeOffset(1500 * time.Millisecond), []string{
+			"SOURCE_DATE_EPOCH=1520166601",
+			"FAKETIME=+1.5",
+		}},
+		{"sub-second behind", (&Expectation{}).AndFakeTimeOffset(-500 * time.Millisecond), []string{
+			"SOURCE_DATE_EPOCH=1520166599",
+			"FAKETIME=-0.5",
+		}},
+		{"nanoseconds", (&Expectation{}).AndFakeTimeOffset(time.Nanosecond), []string{
+			"SOURCE_DATE_EPOCH=1520166600",
+			"FAKETIME=+0.000000001",
+		}},
+		{"offset replaces frozen", (&Expectation{}).AndFakeTime(now).AndFakeTimeOffset(time.Minute), []string{
+			"SOURCE_DATE_EPOCH=1520166660",
+			"FAKETIME=+60",
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.label, func(t *testing.T) {
+			if env := tc.exp.fakeTimeEnv(now); !reflect.DeepEqual(env, tc.expected) {
+				t.Errorf("Expected %q, got %q", tc.expected, env)
+			}
+		})
+	}
+}
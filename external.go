@@ -0,0 +1,86 @@
+package bintest
+
+import (
+	"errors"
+	"net"
+	"strconv"
+)
+
+// ExternalServerOptions configure NewExternalServer
+type ExternalServerOptions struct {
+	// ListenAddr is the address to listen on, defaults to a random port on all interfaces
+	ListenAddr string
+
+	// AdvertiseHost is the host that proxies call the server on, like host.docker.internal
+	// or the address of the host on a VM's network. Defaults to the first non-loopback IPv4
+	// address of the host
+	AdvertiseHost string
+
+	// Token is the secret that proxies have to send with their calls, a random one is
+	// generated if it's empty
+	Token string
+}
+
+// NewExternalServer starts a dedicated server that proxies can call from other machines,
+// like containers and VMs, which don't share the host's loopback. Like other servers, only
+// proxies compiled by it are accepted, as they have its token compiled in.
+//
+// Copy the binaries of its proxies to where the code under test runs, compiling them for
+// that platform with SetCompilerOptions and GOOS or GOARCH in Env, and use Proxy.Alias to
+// tell the server about the path they're run from there
+func NewExternalServer(opts ExternalServerOptions) (*Server, error) {
+	listenAddr := opts.ListenAddr
+	if listenAddr == "" {
+		listenAddr = ":0"
+	}
+
+	host := opts.AdvertiseHost
+	if host == "" {
+		ip, err := externalIP()
+		if err != nil {
+			return nil, err
+		}
+		host = ip.String()
+	}
+
+	token := opts.Token
+	if token == "" {
+		token = randomToken()
+	}
+
+	l, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	usedAddrsMu.Lock()
+	usedAddrs[l.Addr().String()] = true
+	usedAddrsMu.Unlock()
+
+	return serve(l, net.JoinHostPort(host, strconv.Itoa(l.Addr().(*net.TCPAddr).Port)), token)
+}
+
+// Alias makes calls from a copy of the proxy at path go to this proxy, for instance once
+// its binary has been copied into a container
+func (p *Proxy) Alias(path string) {
+	p.Server.aliasProxy(path, p.Path)
+}
+
+// Alias makes calls from a copy of the mock's binary at path go to the mock, see Proxy.Alias
+func (m *Mock) Alias(path string) {
+	m.proxy.Alias(path)
+}
+
+// externalIP returns the first non-loopback IPv4 address of the host
+func externalIP() (net.IP, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+			return ipNet.IP, nil
+		}
+	}
+	return nil, errors.New("Failed to find a non-loopback address to advertise, set AdvertiseHost")
+}
@@ -0,0 +1,81 @@
+package bintest_test
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildkite/bintest/v3"
+)
+
+func TestExternalServer(t *testing.T) {
+	server, err := bintest.NewExternalServer(bintest.ExternalServerOptions{
+		ListenAddr:    "127.0.0.1:0",
+		AdvertiseHost: "127.0.0.1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	if server.Token() == "" {
+		t.Fatal("Expected the server to generate a token")
+	}
+
+	m, err := server.NewMock("llamas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.CheckAndClose(t)
+
+	transports := []string{bintest.TransportHTTP, bintest.TransportStream, bintest.TransportWebSocket}
+	m.Expect("eat").AndWriteToStdout("yum").Exactly(len(transports))
+
+	// copy the binary somewhere else, like into a container
+	b, err := os.ReadFile(m.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied := filepath.Join(t.TempDir(), "llamas")
+	if runtime.GOOS == "windows" {
+		copied += ".exe"
+	}
+	if err := os.WriteFile(copied, b, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	m.Alias(copied)
+
+	for _, transport := range transports {
+		cmd := exec.Command(copied, "eat")
+		cmd.Env = append(os.Environ(), bintest.TransportEnvVar+"="+transport)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("%s: %v: %s", transport, err, out)
+		}
+		if string(out) != "yum" {
+			t.Fatalf("%s: Unexpected output %q", transport, out)
+		}
+	}
+
+	// requests without the token are rejected
+	resp, err := http.Post(server.URL+"/calls/new", "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected a request without a token to be rejected, got %s", resp.Status)
+	}
+}
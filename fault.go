@@ -0,0 +1,76 @@
+package bintest
+
+import (
+	"context"
+	"time"
+)
+
+// Fault describes how the server misbehaves when a proxy is called, to test how
+// code reacts to the mocked binary itself malfunctioning. See Server.FaultFor
+type Fault struct {
+	// Delay is how long to wait before handling the call
+	Delay time.Duration
+
+	// Refuse responds to the call with an error rather than dispatching it
+	Refuse bool
+
+	// Drop closes the connection to the binary without responding
+	Drop bool
+
+	// Times is how many calls the fault applies to, zero means every call
+	Times int
+}
+
+// FaultFor makes the server misbehave when the proxy at path is called. A zero Fault
+// removes any fault for the path
+func (s *Server) FaultFor(path string, fault Fault) {
+	s.faultsMu.Lock()
+	defer s.faultsMu.Unlock()
+
+	if fault == (Fault{}) {
+		delete(s.faults, path)
+		return
+	}
+	if s.faults == nil {
+		s.faults = map[string]*Fault{}
+	}
+	s.faults[path] = &fault
+}
+
+// takeFault returns the fault for a call to the proxy at path, if there is one
+func (s *Server) takeFault(path string) (Fault, bool) {
+	s.faultsMu.Lock()
+	defer s.faultsMu.Unlock()
+
+	fault, ok := s.faults[path]
+	if !ok {
+		return Fault{}, false
+	}
+
+	if fault.Times > 0 {
+		fault.Times--
+		if fault.Times == 0 {
+			delete(s.faults, path)
+		}
+	}
+
+	debugf("[server] Applying fault %+v to call to %s", *fault, path)
+	return *fault, true
+}
+
+// wait sleeps for the fault's delay, returning false if ctx is done first
+func (f Fault) wait(ctx context.Context) bool {
+	if f.Delay == 0 {
+		return true
+	}
+
+	t := time.NewTimer(f.Delay)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
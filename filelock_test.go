@@ -0,0 +1,47 @@
+package bintest
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLockFileIsExclusive(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "llamas.lock")
+
+	unlock, err := lockFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	locked := make(chan func() error)
+	go func() {
+		unlock, err := lockFile(path)
+		if err != nil {
+			t.Error(err)
+		}
+		locked <- unlock
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("Expected the second lock to wait for the first to be released")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := unlock(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case unlock := <-locked:
+		if unlock == nil {
+			return
+		}
+		if err := unlock(); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the second lock")
+	}
+}
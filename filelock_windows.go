@@ -0,0 +1,74 @@
+//go:build windows
+
+package bintest
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	modkernel32      = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = modkernel32.NewProc("LockFileEx")
+	procUnlockFileEx = modkernel32.NewProc("UnlockFileEx")
+)
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+
+	errorLockViolation syscall.Errno = 33
+)
+
+// lockFile takes an exclusive advisory lock on the file at path, creating it if needed, and
+// blocks until the lock is acquired. The returned function releases the lock
+func lockFile(path string) (func() error, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	ol := new(syscall.Overlapped)
+	r, _, err := procLockFileEx.Call(f.Fd(), lockfileExclusiveLock, 0, 1, 0, uintptr(unsafe.Pointer(ol)))
+	if r == 0 {
+		_ = f.Close()
+		return nil, err
+	}
+
+	return func() error {
+		defer f.Close()
+		r, _, err := procUnlockFileEx.Call(f.Fd(), 0, 1, 0, uintptr(unsafe.Pointer(ol)))
+		if r == 0 {
+			return err
+		}
+		return nil
+	}, nil
+}
+
+// tryLockFile is like lockFile, but returns false rather than waiting if the lock is held
+func tryLockFile(path string) (func() error, bool, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, false, err
+	}
+
+	ol := new(syscall.Overlapped)
+	r, _, err := procLockFileEx.Call(f.Fd(), lockfileExclusiveLock|lockfileFailImmediately, 0, 1, 0, uintptr(unsafe.Pointer(ol)))
+	if r == 0 {
+		_ = f.Close()
+		if err == errorLockViolation {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+
+	return func() error {
+		defer f.Close()
+		r, _, err := procUnlockFileEx.Call(f.Fd(), 0, 1, 0, uintptr(unsafe.Pointer(ol)))
+		if r == 0 {
+			return err
+		}
+		return nil
+	}, true, nil
+}
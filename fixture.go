@@ -0,0 +1,64 @@
+package bintest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// ExpectationFixture is the declarative form of an Expectation, as read by LoadExpectations
+type ExpectationFixture struct {
+	Args     []string `json:"args"`
+	AnyArgs  bool     `json:"anyArgs,omitempty"`
+	Stdin    *string  `json:"stdin,omitempty"`
+	Stdout   string   `json:"stdout,omitempty"`
+	Stderr   string   `json:"stderr,omitempty"`
+	ExitCode int      `json:"exitCode,omitempty"`
+
+	// Times is shorthand for Exactly, otherwise Min and Max default to 1
+	Times *int `json:"times,omitempty"`
+	Min   *int `json:"min,omitempty"`
+	Max   *int `json:"max,omitempty"`
+}
+
+// LoadExpectations reads a JSON array of ExpectationFixture and registers an expectation
+// for each of them, so canned behaviours can be kept in fixture files
+func (m *Mock) LoadExpectations(r io.Reader) ([]*Expectation, error) {
+	var fixtures []ExpectationFixture
+	if err := json.NewDecoder(r).Decode(&fixtures); err != nil {
+		return nil, fmt.Errorf("Error parsing expectations for %s: %v", m.Name, err)
+	}
+
+	return m.loadFixtures(fixtures), nil
+}
+
+// loadFixtures registers an expectation for each of fixtures
+func (m *Mock) loadFixtures(fixtures []ExpectationFixture) []*Expectation {
+	expectations := make([]*Expectation, 0, len(fixtures))
+	for _, f := range fixtures {
+		ex := m.Expect(ArgumentsFromStrings(f.Args)...).
+			AndWriteToStdout(f.Stdout).
+			AndWriteToStderr(f.Stderr).
+			AndExitWith(f.ExitCode)
+
+		if f.AnyArgs {
+			ex.WithAnyArguments()
+		}
+		if f.Stdin != nil {
+			ex.WithStdin(*f.Stdin)
+		}
+		if f.Times != nil {
+			ex.Exactly(*f.Times)
+		}
+		if f.Min != nil {
+			ex.Min(*f.Min)
+		}
+		if f.Max != nil {
+			ex.Max(*f.Max)
+		}
+
+		expectations = append(expectations, ex)
+	}
+
+	return expectations
+}
@@ -0,0 +1,58 @@
+package bintest_test
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/bintest/v3/testutil"
+	"github.com/fortytw2/leaktest"
+)
+
+func TestMockLoadExpectations(t *testing.T) {
+	defer leaktest.Check(t)()
+	m, close := mustMock(t, "docker")
+	defer close()
+
+	expectations, err := m.LoadExpectations(strings.NewReader(`[
+		{"args": ["inspect", "llamas"], "stdout": "[{\"Id\": \"abc\"}]", "times": 2},
+		{"args": ["rm", "llamas"], "exitCode": 1, "stderr": "in use"},
+		{"anyArgs": true, "min": 0, "max": -1}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expectations) != 3 {
+		t.Fatalf("Expected 3 expectations, got %d", len(expectations))
+	}
+
+	for i := 0; i < 2; i++ {
+		out, err := exec.Command(m.Path, "inspect", "llamas").Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := `[{"Id": "abc"}]`; string(out) != expected {
+			t.Fatalf("Expected %q, got %q", expected, out)
+		}
+	}
+
+	out, err := exec.Command(m.Path, "rm", "llamas").CombinedOutput()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 1 {
+		t.Fatalf("Expected exit code 1, got %v", err)
+	}
+	if string(out) != "in use" {
+		t.Fatalf("Unexpected output %q", out)
+	}
+
+	_ = exec.Command(m.Path, "ps").Run()
+
+	mt := &testutil.TestingT{}
+	if m.Check(mt) == false {
+		t.Errorf("Assertions should have passed")
+	}
+	mt.Copy(t)
+
+	if _, err := m.LoadExpectations(strings.NewReader(`{`)); err == nil {
+		t.Fatal("Expected an error for invalid JSON")
+	}
+}
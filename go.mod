@@ -1,5 +1,5 @@
 module github.com/buildkite/bintest/v3
 
-go 1.22
+go 1.22.0
 
 require github.com/fortytw2/leaktest v1.3.0
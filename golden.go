@@ -0,0 +1,73 @@
+package bintest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// UpdateGoldenEnvVar makes golden file expectations write what they received to the golden
+// file rather than comparing against it, for instance BINTEST_UPDATE_GOLDEN=true go test ./...
+const UpdateGoldenEnvVar = `BINTEST_UPDATE_GOLDEN`
+
+func updateGolden() bool {
+	v := os.Getenv(UpdateGoldenEnvVar)
+	return v == "true" || v == "1"
+}
+
+// goldenMatcher matches content against a golden file, or updates the golden file
+type goldenMatcher struct {
+	path   string
+	update bool
+}
+
+func (g *goldenMatcher) Match(s string) (bool, string) {
+	if g.update {
+		if err := os.MkdirAll(filepath.Dir(g.path), 0o755); err != nil {
+			return false, fmt.Sprintf("Failed to update golden file: %v", err)
+		}
+		if err := os.WriteFile(g.path, []byte(s), 0o644); err != nil {
+			return false, fmt.Sprintf("Failed to update golden file: %v", err)
+		}
+		return true, ""
+	}
+
+	b, err := os.ReadFile(g.path)
+	if err != nil {
+		return false, fmt.Sprintf("Failed to read golden file: %v", err)
+	}
+	if expected := string(b); expected != s {
+		return false, diffLines(expected, s)
+	}
+	return true, ""
+}
+
+func (g *goldenMatcher) describeStdinMismatch(got []byte) string {
+	if ok, msg := g.Match(string(got)); !ok {
+		return msg
+	}
+	return ""
+}
+
+func (g *goldenMatcher) String() string {
+	return fmt.Sprintf("golden file %s", g.path)
+}
+
+// diffLines describes the first line that differs between expected and actual
+func diffLines(expected, actual string) string {
+	e, a := strings.Split(expected, "\n"), strings.Split(actual, "\n")
+	for i := 0; i < len(e) || i < len(a); i++ {
+		var el, al string
+		if i < len(e) {
+			el = e[i]
+		}
+		if i < len(a) {
+			al = a[i]
+		}
+		if i >= len(e) || i >= len(a) || el != al {
+			return fmt.Sprintf("First difference at line %d, expected %q, got %q", i+1, el, al)
+		}
+	}
+	return ""
+}
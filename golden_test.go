@@ -0,0 +1,83 @@
+package bintest_test
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/bintest/v3"
+	"github.com/buildkite/bintest/v3/testutil"
+	"github.com/fortytw2/leaktest"
+)
+
+func TestCallingMockWithStdinGolden(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	golden := filepath.Join(t.TempDir(), "testdata", "manifest.golden")
+	manifest := "apiVersion: v1\nkind: Pod\n"
+
+	run := func(m *bintest.Mock, stdin string) {
+		cmd := exec.Command(m.Path, "apply", "-f", "-")
+		cmd.Stdin = strings.NewReader(stdin)
+		if err := cmd.Run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("update", func(t *testing.T) {
+		t.Setenv(bintest.UpdateGoldenEnvVar, "true")
+
+		m, close := mustMock(t, "kubectl")
+		defer close()
+
+		m.Expect("apply", "-f", "-").WithStdinGolden(t, golden)
+		run(m, manifest)
+		m.Check(t)
+
+		b, err := os.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != manifest {
+			t.Fatalf("Expected golden file to be updated, got %q", b)
+		}
+	})
+
+	t.Run("matching", func(t *testing.T) {
+		m, close := mustMock(t, "kubectl")
+		defer close()
+
+		m.Expect("apply", "-f", "-").WithStdinGolden(t, golden)
+		run(m, manifest)
+		m.Check(t)
+	})
+
+	t.Run("different", func(t *testing.T) {
+		m, close := mustMock(t, "kubectl")
+		defer close()
+
+		mt := &testutil.TestingT{}
+		m.Expect("apply", "-f", "-").WithStdinGolden(mt, golden)
+		run(m, "apiVersion: v1\nkind: Deployment\n")
+
+		if m.Check(mt) {
+			t.Fatal("Expected the check to fail")
+		}
+		if expected := `First difference at line 2, expected "kind: Pod", got "kind: Deployment"`; !strings.Contains(strings.Join(mt.Logs, "\n"), expected) {
+			t.Fatalf("Expected logs to contain %q, got %q", expected, mt.Logs)
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		mt := &testutil.TestingT{}
+		m, close := mustMock(t, "kubectl")
+		defer close()
+
+		m.Expect("apply").Optionally().WithStdinGolden(mt, filepath.Join(t.TempDir(), "missing.golden"))
+		if len(mt.Errors) != 1 {
+			t.Fatalf("Expected an error for the missing golden file, got %q", mt.Errors)
+		}
+	})
+}
@@ -0,0 +1,359 @@
+// Package helpgen generates typed expectation builders for a command line tool from its
+// --help output, so that expectations for commonly mocked tools are checked at compile
+// time rather than written as loose strings:
+//
+//	gitexp.Fetch().Depth(1).Arg("origin").Expect(git).AndExitWith(0)
+//
+// Help output isn't standardised, so parsing is a best effort. It understands the
+// common layouts of GNU style tools, git and cobra/flag based Go programs.
+package helpgen
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"go/format"
+	"io"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"unicode"
+)
+
+// Flag is a long flag that a command accepts
+type Flag struct {
+	Name string
+
+	// TakesValue is whether the flag is followed by a value
+	TakesValue bool
+
+	// Joined is whether the value is joined to the flag with =, rather than being
+	// the following argument
+	Joined bool
+}
+
+// Spec is what was found in a command's help output
+type Spec struct {
+	// Name of the command, for instance git
+	Name string
+
+	Subcommands []string
+	Flags       []Flag
+}
+
+var (
+	// A long flag and how its value is described, if it has one
+	flagRegex = regexp.MustCompile(`(?:^|[\s,])--(\[no-\])?([A-Za-z0-9][A-Za-z0-9-]*)(=<|=[A-Za-z]|\[=|\s<|\s[A-Z][A-Z_-]*\b|\s(?:string|int|duration|strings|float)\b)?`)
+
+	// An indented subcommand followed by its description
+	subcommandRegex = regexp.MustCompile(`^(?:\t|\s{2,})\s*([a-z][a-z0-9-]*)(?:,\s*[a-z][a-z0-9-]*)*(?:\s+\S|:|$)`)
+)
+
+// Parse extracts subcommands and flags from the help output of the command name
+func Parse(name, help string) Spec {
+	spec := Spec{Name: name}
+	flags := map[string]Flag{}
+	subcommands := map[string]bool{}
+
+	var inCommands bool
+	for _, line := range strings.Split(help, "\n") {
+		line = strings.TrimRight(line, "\r")
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			continue
+		}
+
+		// Unindented lines are section headings, which say whether what follows are
+		// subcommands or options
+		if trimmed == line {
+			lower := strings.ToLower(line)
+			switch {
+			case strings.Contains(lower, "option") || strings.Contains(lower, "flag") || strings.Contains(lower, "topic"):
+				inCommands = false
+			case strings.Contains(lower, "command"):
+				inCommands = true
+			}
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "-") {
+			for _, m := range flagRegex.FindAllStringSubmatch(trimmed, -1) {
+				f := Flag{Name: m[2]}
+				if m[3] != "" && m[3] != "[=" {
+					f.TakesValue = true
+					f.Joined = strings.HasPrefix(m[3], "=")
+				}
+				flags[f.Name] = f
+				if m[1] != "" {
+					flags["no-"+f.Name] = Flag{Name: "no-" + f.Name}
+				}
+			}
+			continue
+		}
+
+		if inCommands {
+			if m := subcommandRegex.FindStringSubmatch(line); m != nil {
+				subcommands[m[1]] = true
+			}
+		}
+	}
+
+	for name := range subcommands {
+		spec.Subcommands = append(spec.Subcommands, name)
+	}
+	sort.Strings(spec.Subcommands)
+
+	for _, f := range flags {
+		spec.Flags = append(spec.Flags, f)
+	}
+	sort.Slice(spec.Flags, func(i, j int) bool {
+		return spec.Flags[i].Name < spec.Flags[j].Name
+	})
+
+	return spec
+}
+
+// Inspect runs the command at path with helpFlag and parses the output. If subcommands
+// is set, each subcommand's help is parsed for flags too
+func Inspect(ctx context.Context, path string, helpFlag string, subcommands bool) (Spec, error) {
+	help, err := runHelp(ctx, path, helpFlag)
+	if err != nil {
+		return Spec{}, err
+	}
+
+	name := strings.TrimSuffix(baseName(path), ".exe")
+	spec := Parse(name, help)
+
+	if subcommands {
+		for _, sub := range spec.Subcommands {
+			subHelp, err := runHelp(ctx, path, sub, helpFlag)
+			if err != nil {
+				continue
+			}
+			spec = merge(spec, Parse(name, subHelp))
+		}
+	}
+
+	return spec, nil
+}
+
+func runHelp(ctx context.Context, path string, args ...string) (string, error) {
+	var out bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	// Plenty of tools exit non-zero after printing help, so only fail if there wasn't any
+	if err := cmd.Run(); err != nil && out.Len() == 0 {
+		return "", fmt.Errorf("Error running %s %s: %v", path, strings.Join(args, " "), err)
+	}
+
+	return out.String(), nil
+}
+
+// merge adds the flags of b to a, keeping a's subcommands
+func merge(a, b Spec) Spec {
+	seen := map[string]bool{}
+	for _, f := range a.Flags {
+		seen[f.Name] = true
+	}
+	for _, f := range b.Flags {
+		if !seen[f.Name] {
+			a.Flags = append(a.Flags, f)
+			seen[f.Name] = true
+		}
+	}
+	sort.Slice(a.Flags, func(i, j int) bool {
+		return a.Flags[i].Name < a.Flags[j].Name
+	})
+	return a
+}
+
+func baseName(path string) string {
+	if idx := strings.LastIndexAny(path, `/\`); idx != -1 {
+		return path[idx+1:]
+	}
+	return path
+}
+
+// identifier converts a flag or subcommand name like dry-run into an exported Go identifier
+func identifier(s string) string {
+	var b strings.Builder
+	upper := true
+	for _, r := range s {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+type templateData struct {
+	Package     string
+	Name        string
+	Subcommands []templateIdent
+	Flags       []templateFlag
+}
+
+type templateIdent struct {
+	Ident string
+	Name  string
+}
+
+type templateFlag struct {
+	Ident string
+	Flag
+}
+
+// Generate writes Go source for a package of expectation builders for the spec
+func Generate(w io.Writer, pkg string, spec Spec) error {
+	if pkg == "" {
+		return errors.New("A package name is required")
+	}
+
+	data := templateData{Package: pkg, Name: spec.Name}
+
+	// identifiers that are already used by the generated code
+	funcs := map[string]bool{"New": true, "Args": true}
+	methods := map[string]bool{"Arg": true, "Expect": true}
+
+	unique := func(used map[string]bool, name, suffix string) string {
+		ident := identifier(name)
+		if ident == "" || !unicode.IsLetter([]rune(ident)[0]) || used[ident] {
+			ident = suffix + ident
+		}
+		for used[ident] {
+			ident += "_"
+		}
+		used[ident] = true
+		return ident
+	}
+
+	for _, sub := range spec.Subcommands {
+		data.Subcommands = append(data.Subcommands, templateIdent{
+			Ident: unique(funcs, sub, "Command"),
+			Name:  sub,
+		})
+	}
+
+	for _, f := range spec.Flags {
+		data.Flags = append(data.Flags, templateFlag{
+			Ident: unique(methods, f.Name, "Flag"),
+			Flag:  f,
+		})
+	}
+
+	var buf bytes.Buffer
+	if err := generatedTemplate.Execute(&buf, data); err != nil {
+		return err
+	}
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("Error formatting generated code: %v", err)
+	}
+
+	_, err = w.Write(src)
+	return err
+}
+
+var generatedTemplate = template.Must(template.New("").Parse(`// Code generated by bintest gen from {{.Name}} --help. DO NOT EDIT.
+
+// Package {{.Package}} builds bintest expectations for {{.Name}}
+package {{.Package}}
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/buildkite/bintest/v3"
+)
+
+// Args are the arguments of an expected call to {{.Name}}. Values can be strings or
+// bintest.Matchers
+type Args []interface{}
+
+// New returns arguments without a subcommand
+func New() Args {
+	return Args{}
+}
+{{range .Subcommands}}
+// {{.Ident}} returns arguments for {{$.Name}} {{.Name}}
+func {{.Ident}}() Args {
+	return Args{ {{printf "%q" .Name}} }
+}
+{{end}}
+{{- range .Flags}}
+{{- if .TakesValue}}
+// {{.Ident}} appends --{{.Name}} and its value
+func (a Args) {{.Ident}}(v interface{}) Args {
+{{- if .Joined}}
+	return a.with(joined({{printf "%q" (print "--" .Name "=")}}, v))
+{{- else}}
+	return a.with({{printf "%q" (print "--" .Name)}}, value(v))
+{{- end}}
+}
+{{else}}
+// {{.Ident}} appends --{{.Name}}
+func (a Args) {{.Ident}}() Args {
+	return a.with({{printf "%q" (print "--" .Name)}})
+}
+{{end}}
+{{- end}}
+// Arg appends arbitrary arguments
+func (a Args) Arg(args ...interface{}) Args {
+	return a.with(args...)
+}
+
+// Expect registers an expectation for the arguments with the mock
+func (a Args) Expect(m *bintest.Mock) *bintest.Expectation {
+	return m.Expect(a...)
+}
+
+// with returns a copy of the arguments with more appended, so that a shared prefix
+// can be extended in different ways
+func (a Args) with(args ...interface{}) Args {
+	return append(a[:len(a):len(a)], args...)
+}
+
+func value(v interface{}) interface{} {
+	if m, ok := v.(bintest.Matcher); ok {
+		return m
+	}
+	return fmt.Sprint(v)
+}
+
+func joined(prefix string, v interface{}) interface{} {
+	if m, ok := v.(bintest.Matcher); ok {
+		return prefixMatcher{prefix, m}
+	}
+	return prefix + fmt.Sprint(v)
+}
+
+// prefixMatcher matches an argument with a prefix, followed by a value that matches
+type prefixMatcher struct {
+	prefix  string
+	matcher bintest.Matcher
+}
+
+func (p prefixMatcher) Match(s string) (bool, string) {
+	if !strings.HasPrefix(s, p.prefix) {
+		return false, fmt.Sprintf("Expected prefix %q", p.prefix)
+	}
+	return p.matcher.Match(strings.TrimPrefix(s, p.prefix))
+}
+
+func (p prefixMatcher) String() string {
+	return fmt.Sprintf("%q + %s", p.prefix, p.matcher)
+}
+`))
@@ -0,0 +1,108 @@
+package helpgen_test
+
+import (
+	"bytes"
+	"go/parser"
+	"go/token"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/buildkite/bintest/v3/helpgen"
+)
+
+func mustParseFile(t *testing.T, name, path string) helpgen.Spec {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return helpgen.Parse(name, string(b))
+}
+
+func TestParseGitHelp(t *testing.T) {
+	spec := mustParseFile(t, "git", "testdata/git.txt")
+
+	expected := []string{"clone", "fetch", "init", "pull", "push"}
+	if !reflect.DeepEqual(spec.Subcommands, expected) {
+		t.Errorf("Unexpected subcommands %v", spec.Subcommands)
+	}
+
+	spec = mustParseFile(t, "git", "testdata/git-fetch.txt")
+
+	flags := map[string]helpgen.Flag{}
+	for _, f := range spec.Flags {
+		flags[f.Name] = f
+	}
+
+	for name, expected := range map[string]helpgen.Flag{
+		"depth":              {Name: "depth", TakesValue: true},
+		"dry-run":            {Name: "dry-run"},
+		"no-force":           {Name: "no-force"},
+		"recurse-submodules": {Name: "recurse-submodules"},
+	} {
+		if flags[name] != expected {
+			t.Errorf("Expected flag %+v, got %+v", expected, flags[name])
+		}
+	}
+}
+
+func TestParseCobraHelp(t *testing.T) {
+	spec := mustParseFile(t, "deployer", "testdata/cobra.txt")
+
+	expected := []string{"apply", "cherry-pick", "rollback"}
+	if !reflect.DeepEqual(spec.Subcommands, expected) {
+		t.Errorf("Unexpected subcommands %v", spec.Subcommands)
+	}
+
+	expectedFlags := []helpgen.Flag{
+		{Name: "help"},
+		{Name: "namespace", TakesValue: true},
+		{Name: "timeout", TakesValue: true, Joined: true},
+		{Name: "verbose"},
+	}
+	if !reflect.DeepEqual(spec.Flags, expectedFlags) {
+		t.Errorf("Unexpected flags %+v", spec.Flags)
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	spec := helpgen.Spec{
+		Name:        "deployer",
+		Subcommands: []string{"cherry-pick", "new"},
+		Flags: []helpgen.Flag{
+			{Name: "dry-run"},
+			{Name: "expect"},
+			{Name: "namespace", TakesValue: true},
+			{Name: "timeout", TakesValue: true, Joined: true},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := helpgen.Generate(&buf, "deployexp", spec); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := parser.ParseFile(token.NewFileSet(), "deployexp.go", buf.Bytes(), 0)
+	if err != nil {
+		t.Fatalf("Generated code doesn't parse: %v\n%s", err, buf.String())
+	}
+
+	var decls []string
+	for name := range f.Scope.Objects {
+		decls = append(decls, name)
+	}
+	sort.Strings(decls)
+
+	expected := []string{"Args", "CherryPick", "CommandNew", "New", "joined", "prefixMatcher", "value"}
+	if !reflect.DeepEqual(decls, expected) {
+		t.Errorf("Unexpected declarations %v", decls)
+	}
+
+	for _, method := range []string{"DryRun()", "FlagExpect()", "Namespace(v interface{})", `joined("--timeout=", v)`} {
+		if !bytes.Contains(buf.Bytes(), []byte(method)) {
+			t.Errorf("Expected generated code to contain %s", method)
+		}
+	}
+}
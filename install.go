@@ -0,0 +1,114 @@
+package bintest
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// InstallMock creates a mock for the command name and puts it at the front of the
+// process's PATH, so that commands run by the test find it rather than the real binary.
+// The real binary is remembered, so PassthroughToLocalCommand still runs it. PATH is
+// restored when the mock is closed, or with Restore
+func InstallMock(name string) (*Mock, error) {
+	m, err := NewMock(name)
+	if err != nil {
+		return nil, err
+	}
+
+	m.installLocalPath(os.Getenv("PATH"))
+
+	dir := filepath.Dir(m.Path)
+	if err := os.Setenv("PATH", prependPath(dir, os.Getenv("PATH"))); err != nil {
+		_ = m.Close()
+		return nil, err
+	}
+
+	m.Lock()
+	m.restoreFunc = func() {
+		_ = os.Setenv("PATH", removeFromPath(dir, os.Getenv("PATH")))
+	}
+	m.Unlock()
+
+	return m, nil
+}
+
+// InstallMockInEnv is like InstallMock, but rather than changing the process's PATH it
+// returns a copy of env with the mock at the front of its PATH, for use with exec.Cmd
+func InstallMockInEnv(name string, env []string) (*Mock, []string, error) {
+	m, err := NewMock(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	path, _ := GetEnv("PATH", env)
+	m.installLocalPath(path)
+
+	return m, SetEnv(env, "PATH="+prependPath(filepath.Dir(m.Path), path)), nil
+}
+
+// Restore undoes the PATH changes made by InstallMock. It's called when the mock is closed
+func (m *Mock) Restore() {
+	m.Lock()
+	restore := m.restoreFunc
+	m.restoreFunc = nil
+	m.Unlock()
+
+	if restore != nil {
+		restore()
+	}
+}
+
+// installLocalPath remembers where the real binary is in pathList, before the mock shadows it
+func (m *Mock) installLocalPath(pathList string) {
+	m.Lock()
+	defer m.Unlock()
+	m.installed = true
+	m.localPath = lookPathIn(m.Name, pathList)
+}
+
+// localCommand returns the real binary that the mock shadows
+func (m *Mock) localCommand() (string, error) {
+	if m.installed {
+		if m.localPath == "" {
+			return "", fmt.Errorf("%s wasn't found in PATH when the mock was installed", m.Name)
+		}
+		return m.localPath, nil
+	}
+	return exec.LookPath(m.Name)
+}
+
+// lookPathIn is like exec.LookPath, but searches the directories in pathList
+func lookPathIn(name, pathList string) string {
+	for _, dir := range filepath.SplitList(pathList) {
+		if dir == "" {
+			continue
+		}
+		if path, err := exec.LookPath(filepath.Join(dir, name)); err == nil {
+			if abs, err := filepath.Abs(path); err == nil {
+				return abs
+			}
+			return path
+		}
+	}
+	return ""
+}
+
+func prependPath(dir, pathList string) string {
+	if pathList == "" {
+		return dir
+	}
+	return dir + string(os.PathListSeparator) + pathList
+}
+
+func removeFromPath(dir, pathList string) string {
+	var kept []string
+	for _, p := range filepath.SplitList(pathList) {
+		if p != dir {
+			kept = append(kept, p)
+		}
+	}
+	return strings.Join(kept, string(os.PathListSeparator))
+}
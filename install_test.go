@@ -0,0 +1,79 @@
+package bintest_test
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/buildkite/bintest/v3"
+	"github.com/fortytw2/leaktest"
+)
+
+func TestInstallMockShadowsAndRestoresPath(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	realPath, err := exec.LookPath("echo")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	m, err := bintest.InstallMock("echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	if path, _ := exec.LookPath("echo"); path != m.Path {
+		t.Fatalf("Expected echo to resolve to the mock, got %s", path)
+	}
+
+	// passthrough finds the real binary, rather than the mock
+	m.PassthroughToLocalCommand()
+	m.Expect("llamas")
+
+	out, err := exec.Command("echo", "llamas").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "llamas\n" {
+		t.Fatalf("Unexpected output %q", out)
+	}
+
+	if err := m.CheckAndClose(t); err != nil {
+		t.Fatal(err)
+	}
+
+	if path, _ := exec.LookPath("echo"); path != realPath {
+		t.Fatalf("Expected echo to resolve to %s after restoring, got %s", realPath, path)
+	}
+}
+
+func TestInstallMockInEnv(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip(err)
+	}
+
+	path := os.Getenv("PATH")
+
+	m, env, err := bintest.InstallMockInEnv("llamas", os.Environ())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	if os.Getenv("PATH") != path {
+		t.Fatalf("Expected process PATH to be unchanged")
+	}
+
+	m.Expect("spit").AndExitWith(0)
+
+	cmd := exec.Command("sh", "-c", "llamas spit")
+	cmd.Env = env
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Running mock from PATH failed: %v %s", err, out)
+	}
+
+	m.Check(t)
+}
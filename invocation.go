@@ -0,0 +1,73 @@
+package bintest
+
+import (
+	"strings"
+	"time"
+)
+
+// InvocationSet is a list of invocations, in the order they were received
+type InvocationSet []Invocation
+
+// Matching returns the invocations whose arguments match args, which can be strings or
+// matchers like with Mock.Expect
+func (s InvocationSet) Matching(args ...interface{}) InvocationSet {
+	return s.filter(func(i Invocation) bool {
+		return Arguments(args).Match(i.Args...).IsMatch
+	})
+}
+
+// WithEnv returns the invocations whose environment has all of env, where each is either
+// KEY=value or just KEY to match any value
+func (s InvocationSet) WithEnv(env ...string) InvocationSet {
+	return s.filter(func(i Invocation) bool {
+		for _, e := range env {
+			key, value := splitEnv(e)
+			actual, ok := GetEnv(key, i.Env)
+			if !ok || (strings.Contains(e, "=") && actual != value) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// After returns the invocations that started after t
+func (s InvocationSet) After(t time.Time) InvocationSet {
+	return s.filter(func(i Invocation) bool {
+		return i.StartedAt.After(t)
+	})
+}
+
+// Before returns the invocations that started before t
+func (s InvocationSet) Before(t time.Time) InvocationSet {
+	return s.filter(func(i Invocation) bool {
+		return i.StartedAt.Before(t)
+	})
+}
+
+// CalledBy returns the invocations that were made by parent, see Invocation.ParentSequence
+func (s InvocationSet) CalledBy(parent Invocation) InvocationSet {
+	return s.filter(func(i Invocation) bool {
+		return i.ParentSequence != 0 && i.ParentSequence == parent.Sequence
+	})
+}
+
+func (s InvocationSet) filter(f func(i Invocation) bool) InvocationSet {
+	var result InvocationSet
+	for _, i := range s {
+		if f(i) {
+			result = append(result, i)
+		}
+	}
+	return result
+}
+
+// copy returns a copy of the invocation that doesn't share any slices with it
+func (i Invocation) copy() Invocation {
+	i.Args = append([]string(nil), i.Args...)
+	i.Env = append([]string(nil), i.Env...)
+	i.Stdin = append([]byte(nil), i.Stdin...)
+	i.Stdout = append([]byte(nil), i.Stdout...)
+	i.Stderr = append([]byte(nil), i.Stderr...)
+	return i
+}
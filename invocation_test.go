@@ -0,0 +1,142 @@
+package bintest_test
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildkite/bintest/v3"
+	"github.com/fortytw2/leaktest"
+)
+
+func TestInvocationSetFilters(t *testing.T) {
+	defer leaktest.Check(t)()
+	m, close := mustMock(t, "llamas")
+	defer close()
+
+	m.Expect("eat", bintest.MatchAny()).Exactly(2)
+	m.Expect("spit")
+
+	cmd := exec.Command(m.Path, "eat", "grass")
+	cmd.Env = append(os.Environ(), "LLAMA_MOOD=hungry")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	between := time.Now()
+
+	if err := exec.Command(m.Path, "eat", "hay").Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := exec.Command(m.Path, "spit").Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	invocations := m.Invocations()
+
+	if eat := invocations.Matching("eat", bintest.MatchAny()); len(eat) != 2 {
+		t.Errorf("Expected 2 invocations of eat, got %d", len(eat))
+	}
+	if hay := invocations.Matching("eat", "hay"); len(hay) != 1 || hay[0].Args[1] != "hay" {
+		t.Errorf("Expected 1 invocation of eat hay, got %v", hay)
+	}
+	if hungry := invocations.WithEnv("LLAMA_MOOD=hungry"); len(hungry) != 1 || hungry[0].Args[1] != "grass" {
+		t.Errorf("Expected 1 hungry invocation, got %v", hungry)
+	}
+	if moody := invocations.WithEnv("LLAMA_MOOD"); len(moody) != 1 {
+		t.Errorf("Expected 1 invocation with a mood, got %v", moody)
+	}
+	if sad := invocations.WithEnv("LLAMA_MOOD=sad"); len(sad) != 0 {
+		t.Errorf("Expected no sad invocations, got %v", sad)
+	}
+	if after := invocations.After(between); len(after) != 2 {
+		t.Errorf("Expected 2 invocations after, got %d", len(after))
+	}
+	if before := invocations.Before(between).Matching("eat", "grass"); len(before) != 1 {
+		t.Errorf("Expected 1 invocation before, got %d", len(before))
+	}
+
+	m.Check(t)
+}
+
+func TestInvocationsAreCopies(t *testing.T) {
+	defer leaktest.Check(t)()
+	m, close := mustMock(t, "llamas")
+	defer close()
+
+	m.Expect("eat")
+
+	if err := exec.Command(m.Path, "eat").Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	m.Invocations()[0].Args[0] = "spit"
+	m.Invocation(0).Args[0] = "spit"
+
+	if args := m.Invocation(0).Args; args[0] != "eat" {
+		t.Errorf("Expected the mock's invocations to be unchanged, got %v", args)
+	}
+
+	m.Check(t)
+}
+
+func TestMockInvocationsCaptureStdin(t *testing.T) {
+	defer leaktest.Check(t)()
+	m, close := mustMock(t, "llamas")
+	defer close()
+
+	m.CaptureStdinLimit(5)
+	m.Expect("eat").AndCallFunc(func(c *bintest.Call) {
+		_, _ = io.Copy(io.Discard, c.Stdin)
+		c.Exit(0)
+	})
+
+	cmd := exec.Command(m.Path, "eat")
+	cmd.Stdin = strings.NewReader("grass and hay")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	invocations := m.Invocations()
+	if len(invocations) != 1 {
+		t.Fatalf("Expected 1 invocation, got %d", len(invocations))
+	}
+	if expected := "grass"; string(invocations[0].Stdin) != expected {
+		t.Fatalf("Expected stdin %q, got %q", expected, invocations[0].Stdin)
+	}
+	if m.Check(t) == false {
+		t.Errorf("Assertions should have passed")
+	}
+}
+
+func TestMockInvocationsRecordParentProcess(t *testing.T) {
+	defer leaktest.Check(t)()
+	m, close := mustMock(t, "llamas")
+	defer close()
+
+	m.Expect("eat")
+
+	if err := exec.Command(m.Path, "eat").Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	invocation := m.Invocations()[0]
+	if invocation.ParentPID != os.Getpid() {
+		t.Errorf("Expected parent pid %d, got %d", os.Getpid(), invocation.ParentPID)
+	}
+
+	// the parent path is only available on systems with /proc
+	if runtime.GOOS == "linux" {
+		self, err := os.Executable()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if invocation.ParentPath != self {
+			t.Errorf("Expected parent path %q, got %q", self, invocation.ParentPath)
+		}
+	}
+}
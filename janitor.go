@@ -0,0 +1,203 @@
+package bintest
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultStaleAge is how old temp dirs must be before StartServer cleans them up
+const DefaultStaleAge = 24 * time.Hour
+
+var cleanupStaleOnce sync.Once
+
+// CleanupStale removes binproxy temp dirs and _bintest_ build dirs that crashed test runs
+// have left behind and that are older than olderThan. Dirs that still belong to a running
+// process are left alone, which is checked with the lock that the process holds. Dirs from
+// older versions of bintest have no owner to check, so they're removed too, but only by
+// calling CleanupStale, never by the cleanup that StartServer does
+func CleanupStale(olderThan time.Duration) error {
+	return cleanupStale(olderThan, true)
+}
+
+// cleanupStale is CleanupStale, only removing dirs without an owner if removeUnowned is set
+func cleanupStale(olderThan time.Duration, removeUnowned bool) error {
+	cutoff := time.Now().Add(-olderThan)
+	var errs []error
+
+	for _, base := range cleanupBases() {
+		if err := cleanupStaleProxyDirs(base, cutoff, removeUnowned); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if err := cleanupStaleBuildDirs(".", cutoff); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// cleanupStaleOnStart cleans up once per process, logging rather than failing. Dirs without
+// an owner are left alone, as they may belong to a running test of an older bintest
+func cleanupStaleOnStart() {
+	cleanupStaleOnce.Do(func() {
+		if err := cleanupStale(DefaultStaleAge, false); err != nil {
+			debugf("[janitor] Error cleaning up stale temp dirs: %v", err)
+		}
+	})
+}
+
+// cleanupBases returns the directories that temp dirs may have been created in
+func cleanupBases() []string {
+	tempDirBaseMu.Lock()
+	bases := []string{tempDirBase}
+	tempDirBaseMu.Unlock()
+
+	var unique []string
+	seen := map[string]bool{}
+	for _, dir := range append(bases, tempDirCandidates()...) {
+		if dir != "" && !seen[dir] {
+			seen[dir] = true
+			unique = append(unique, dir)
+		}
+	}
+	return unique
+}
+
+func cleanupStaleProxyDirs(base string, cutoff time.Time, removeUnowned bool) error {
+	entries, err := os.ReadDir(base)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, entry := range entries {
+		if pid, ok := ownerLockPID(entry.Name()); ok && pid != os.Getpid() && isOlderThan(entry, cutoff) {
+			lockPath := filepath.Join(base, entry.Name())
+			if err := removeIfUnlocked(lockPath, lockPath, false); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), "binproxy") || !isOlderThan(entry, cutoff) {
+			continue
+		}
+
+		path := filepath.Join(base, entry.Name())
+
+		// dirs from older versions have no pid, so there is nothing to check but the age
+		pid, ok := proxyDirPID(entry.Name())
+		if !ok {
+			if !removeUnowned {
+				continue
+			}
+			debugf("[janitor] Removing stale %s", path)
+			if err := os.RemoveAll(path); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+
+		if pid == os.Getpid() {
+			continue
+		}
+
+		// the owner's lock is only created by checking it if the owner has gone, so it's
+		// removed too rather than being left behind
+		if err := removeIfUnlocked(path, ownerLockPath(base, pid), true); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func cleanupStaleBuildDirs(dir string, cutoff time.Time) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), "_bintest_") || !isOlderThan(entry, cutoff) {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		if err := removeIfUnlocked(path, buildDirLockPath(path), false); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// removeIfUnlocked removes path if lockPath isn't locked by another process, and then
+// lockPath as well if removeLock is set
+func removeIfUnlocked(path, lockPath string, removeLock bool) error {
+	unlock, ok, err := tryLockFile(lockPath)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		debugf("[janitor] Skipping %s, it's in use", path)
+		return nil
+	}
+	defer func() {
+		_ = unlock()
+	}()
+
+	debugf("[janitor] Removing stale %s", path)
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+
+	// removed while it's still locked, so that nothing can lock it in between. That fails on
+	// windows, where the next cleanup removes it once it's stale
+	if removeLock {
+		_ = os.Remove(lockPath)
+	}
+	return nil
+}
+
+// proxyDirPID returns the pid in a dir name created by mkdirTemp, like binproxy-123-456789
+func proxyDirPID(name string) (int, bool) {
+	parts := strings.SplitN(name, "-", 3)
+	if len(parts) != 3 {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, false
+	}
+	return pid, true
+}
+
+// ownerLockPID returns the pid in the name of a lock file created by ownerLockPath
+func ownerLockPID(name string) (int, bool) {
+	if !strings.HasPrefix(name, "bintest-owner-") || !strings.HasSuffix(name, ".lock") {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "bintest-owner-"), ".lock"))
+	if err != nil {
+		return 0, false
+	}
+	return pid, true
+}
+
+func isOlderThan(entry os.DirEntry, cutoff time.Time) bool {
+	info, err := entry.Info()
+	if err != nil {
+		return false
+	}
+	return info.ModTime().Before(cutoff)
+}
@@ -0,0 +1,87 @@
+package bintest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCleanupStaleProxyDirs(t *testing.T) {
+	base := t.TempDir()
+	old := time.Now().Add(-48 * time.Hour)
+
+	mkdir := func(name string, mtime time.Time) string {
+		t.Helper()
+		dir := filepath.Join(base, name)
+		if err := os.Mkdir(dir, 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(dir, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		return dir
+	}
+
+	// a pid that isn't ours, whose owner lock is held as if it were still running
+	activePID := os.Getpid() + 1
+	unlock, err := lockFile(ownerLockPath(base, activePID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = unlock()
+	}()
+
+	crashedPID := os.Getpid() + 2
+	crashed := mkdir(fmt.Sprintf("binproxy-%d-1", crashedPID), old)
+	legacy := mkdir("binproxy123", old)
+	active := mkdir(fmt.Sprintf("binproxy-%d-1", activePID), old)
+	recent := mkdir(fmt.Sprintf("binproxy-%d-2", crashedPID), time.Now())
+	ours := mkdir(fmt.Sprintf("binproxy-%d-1", os.Getpid()), old)
+	other := mkdir("llamas", old)
+
+	// dirs without an owner might be in use by an older bintest, so they're only removed
+	// when asked to
+	if err := cleanupStaleProxyDirs(base, time.Now().Add(-DefaultStaleAge), false); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{crashed, ownerLockPath(base, crashedPID)} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed, got %v", path, err)
+		}
+	}
+	for _, path := range []string{legacy, active, recent, ours, other, ownerLockPath(base, activePID)} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("Expected %s to be kept, got %v", path, err)
+		}
+	}
+
+	if err := cleanupStaleProxyDirs(base, time.Now().Add(-DefaultStaleAge), true); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(legacy); !os.IsNotExist(err) {
+		t.Errorf("Expected %s to be removed, got %v", legacy, err)
+	}
+	for _, dir := range []string{active, recent, ours, other} {
+		if _, err := os.Stat(dir); err != nil {
+			t.Errorf("Expected %s to be kept, got %v", dir, err)
+		}
+	}
+}
+
+func TestProxyDirPID(t *testing.T) {
+	for name, expected := range map[string]int{
+		"binproxy-123-456789": 123,
+		"binproxy123456789":   0,
+		"binproxy-abc-456789": 0,
+	} {
+		pid, ok := proxyDirPID(name)
+		if pid != expected || ok != (expected != 0) {
+			t.Errorf("Expected %q to have pid %d, got %d (%v)", name, expected, pid, ok)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package bintest
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReplaceLinkFallsBack(t *testing.T) {
+	dir := t.TempDir()
+
+	src := filepath.Join(dir, "src")
+	if err := os.WriteFile(src, []byte("llamas"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	dest := filepath.Join(dir, "dest")
+	if err := os.WriteFile(dest, []byte("alpacas"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	unsupported := func(oldname, newname string) error {
+		return errors.New("Not supported")
+	}
+
+	defer func(strategies []linkStrategy, idx int) {
+		linkStrategies, linkStrategyIdx = strategies, idx
+	}(linkStrategies, linkStrategyIdx)
+
+	linkStrategies = []linkStrategy{
+		{"symlink", unsupported},
+		{"hardlink", unsupported},
+		{"copy", copyFile},
+	}
+	linkStrategyIdx = 0
+
+	if err := replaceLink(src, dest); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "llamas" {
+		t.Fatalf("Expected dest to be replaced, got %q", b)
+	}
+
+	if linkStrategyIdx != 2 {
+		t.Fatalf("Expected the copy strategy to be remembered, got %d", linkStrategyIdx)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected temp files to be cleaned up, got %d entries", len(entries))
+	}
+}
+
+func TestReplaceLinkFailsWhenNothingWorks(t *testing.T) {
+	defer func(strategies []linkStrategy, idx int) {
+		linkStrategies, linkStrategyIdx = strategies, idx
+	}(linkStrategies, linkStrategyIdx)
+
+	linkStrategies = []linkStrategy{
+		{"symlink", func(oldname, newname string) error { return errors.New("Not supported") }},
+	}
+	linkStrategyIdx = 0
+
+	if err := replaceLink("src", filepath.Join(t.TempDir(), "dest")); err == nil {
+		t.Fatal("Expected an error")
+	}
+}
@@ -0,0 +1,79 @@
+package bintest
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// dualListener accepts connections from several listeners, like the IPv4 and IPv6 loopback
+// listeners of a server. Addr is the address of the first one
+type dualListener struct {
+	listeners []net.Listener
+	accepted  chan acceptResult
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+func newDualListener(listeners ...net.Listener) *dualListener {
+	dl := &dualListener{
+		listeners: listeners,
+		accepted:  make(chan acceptResult),
+		closed:    make(chan struct{}),
+	}
+	for _, l := range listeners {
+		go dl.acceptFrom(l)
+	}
+	return dl
+}
+
+// acceptFrom passes connections and errors from l on to Accept until the listener is
+// closed. Errors like running out of file descriptors are passed on too, which http.Server
+// retries after a delay, so l keeps being accepted from
+func (dl *dualListener) acceptFrom(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		select {
+		case dl.accepted <- acceptResult{conn, err}:
+		case <-dl.closed:
+			if conn != nil {
+				_ = conn.Close()
+			}
+			return
+		}
+	}
+}
+
+func (dl *dualListener) Accept() (net.Conn, error) {
+	select {
+	case r := <-dl.accepted:
+		return r.conn, r.err
+	case <-dl.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (dl *dualListener) Close() error {
+	var err error
+	dl.closeOnce.Do(func() {
+		close(dl.closed)
+		for _, l := range dl.listeners {
+			if closeErr := l.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		}
+	})
+	return err
+}
+
+func (dl *dualListener) Addr() net.Addr {
+	return dl.listeners[0].Addr()
+}
@@ -0,0 +1,76 @@
+package bintest
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeListener returns the results it's sent from Accept, and net.ErrClosed once it's closed
+type fakeListener struct {
+	results chan acceptResult
+	closed  chan struct{}
+}
+
+func (l *fakeListener) Accept() (net.Conn, error) {
+	select {
+	case r := <-l.results:
+		return r.conn, r.err
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *fakeListener) Close() error {
+	close(l.closed)
+	return nil
+}
+
+func (l *fakeListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv6loopback}
+}
+
+func TestDualListenerKeepsAcceptingAfterErrors(t *testing.T) {
+	l4, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l6 := &fakeListener{results: make(chan acceptResult), closed: make(chan struct{})}
+
+	dl := newDualListener(l4, l6)
+	defer dl.Close()
+
+	accept := func() (net.Conn, error) {
+		t.Helper()
+		type result struct {
+			conn net.Conn
+			err  error
+		}
+		ch := make(chan result, 1)
+		go func() {
+			conn, err := dl.Accept()
+			ch <- result{conn, err}
+		}()
+		select {
+		case r := <-ch:
+			return r.conn, r.err
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for Accept")
+			return nil, nil
+		}
+	}
+
+	l6.results <- acceptResult{err: syscall.EMFILE}
+	if _, err := accept(); !errors.Is(err, syscall.EMFILE) {
+		t.Fatalf("Expected the error to be passed on, got %v", err)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	l6.results <- acceptResult{conn: server}
+	if conn, err := accept(); err != nil || conn != server {
+		t.Fatalf("Expected the listener to keep accepting after an error, got %v, %v", conn, err)
+	}
+}
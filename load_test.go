@@ -0,0 +1,96 @@
+package bintest_test
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildkite/bintest/v3"
+	"github.com/fortytw2/leaktest"
+)
+
+// loadCalls is how many concurrent calls the load tests make, set BINTEST_LOAD_CALLS to
+// run them with more
+func loadCalls(t testing.TB) int {
+	if n, err := strconv.Atoi(os.Getenv("BINTEST_LOAD_CALLS")); err == nil && n > 0 {
+		return n
+	}
+	if testing.Short() {
+		t.Skip("Skipping load test in short mode")
+	}
+	return 100
+}
+
+// runConcurrentCalls invokes the mock n times at once and returns the first failure
+func runConcurrentCalls(m *bintest.Mock, transport string, n int) error {
+	errs := make(chan error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cmd := exec.Command(m.Path, strconv.Itoa(i))
+			cmd.Env = append(os.Environ(), bintest.TransportEnvVar+"="+transport)
+			out, err := cmd.CombinedOutput()
+			if err != nil {
+				errs <- fmt.Errorf("Call %d failed: %v: %s", i, err, out)
+			} else if string(out) != strconv.Itoa(i) {
+				errs <- fmt.Errorf("Call %d got unexpected output %q", i, out)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+func TestServerUnderLoad(t *testing.T) {
+	n := loadCalls(t)
+
+	for _, transport := range []string{bintest.TransportHTTP, bintest.TransportStream} {
+		t.Run(transport, func(t *testing.T) {
+			// cleanups run last first, so this checks for leaks after the server shuts down
+			t.Cleanup(leaktest.CheckTimeout(t, 10*time.Second))
+
+			server := bintest.WithIsolatedServer(t)
+			server.SetMaxConcurrentCalls(20)
+
+			m, err := server.NewMock("loaded")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer m.CheckAndClose(t)
+
+			m.Expect().WithAnyArguments().Exactly(n).AndCallFunc(func(c *bintest.Call) {
+				fmt.Fprint(c.Stdout, c.Args[1])
+				c.Exit(0)
+			})
+
+			if err := runConcurrentCalls(m, transport, n); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func BenchmarkConcurrentCalls(b *testing.B) {
+	m, err := bintest.NewMock("benched")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer m.Close()
+
+	m.Expect().WithAnyArguments().AtLeastOnce().AndCallFunc(func(c *bintest.Call) {
+		fmt.Fprint(c.Stdout, c.Args[1])
+		c.Exit(0)
+	})
+
+	b.ResetTimer()
+	if err := runConcurrentCalls(m, bintest.TransportStream, b.N); err != nil {
+		b.Fatal(err)
+	}
+}
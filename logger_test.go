@@ -0,0 +1,141 @@
+package bintest_test
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/buildkite/bintest/v3"
+)
+
+type recordingLogger struct {
+	sync.Mutex
+	lines []string
+}
+
+func (l *recordingLogger) Logf(level bintest.LogLevel, format string, args ...interface{}) {
+	l.Lock()
+	defer l.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf("[%s] "+format, append([]interface{}{level}, args...)...))
+}
+
+func (l *recordingLogger) contains(s string) bool {
+	l.Lock()
+	defer l.Unlock()
+	for _, line := range l.lines {
+		if strings.Contains(line, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMockLogger(t *testing.T) {
+	logger := &recordingLogger{}
+
+	m, close := mustMock(t, "llamas")
+	defer close()
+
+	m.Logger(logger)
+
+	m.Expect("spit").AndExitWith(0)
+
+	if err := exec.Command(m.Path, "spit").Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	m.Check(t)
+
+	for _, expected := range []string{
+		"[debug] Handling invocation for llamas [spit]",
+		"Sending exit code 0 to server",
+	} {
+		if !logger.contains(expected) {
+			t.Errorf("Expected log to contain %q, got %q", expected, logger.lines)
+		}
+	}
+}
+
+func TestServerLogger(t *testing.T) {
+	logger := &recordingLogger{}
+
+	server := bintest.WithIsolatedServer(t)
+	server.SetLogger(logger)
+
+	m, err := server.NewMock("alpacas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.CheckAndClose(t)
+
+	m.Expect().AndExitWith(0)
+
+	if err := exec.Command(m.Path).Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !logger.contains("[debug] Handling invocation for alpacas") {
+		t.Errorf("Expected mock to log to the server's logger, got %q", logger.lines)
+	}
+	if !logger.contains("Found proxy for path") {
+		t.Errorf("Expected server to log to its logger, got %q", logger.lines)
+	}
+}
+
+// loggingTB records what is logged to it rather than logging it
+type loggingTB struct {
+	testing.TB
+	recordingLogger
+}
+
+func (l *loggingTB) Logf(format string, args ...interface{}) {
+	l.Lock()
+	defer l.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+}
+
+func TestMockLoggerToTest(t *testing.T) {
+	for _, tc := range []struct {
+		level bintest.LogLevel
+		debug bool
+	}{
+		{bintest.LevelDebug, true},
+		{bintest.LevelInfo, false},
+	} {
+		tb := &loggingTB{TB: t}
+
+		m, close := mustMock(t, "llamas")
+		m.Logger(bintest.NewTestLogger(tb, tc.level))
+		m.Expect().AndExitWith(0)
+
+		if err := exec.Command(m.Path).Run(); err != nil {
+			t.Fatal(err)
+		}
+		m.Check(t)
+		close()
+
+		if logged := tb.contains("[debug] Handling invocation for llamas"); logged != tc.debug {
+			t.Errorf("At level %s, expected debug lines to be logged: %v, got %q", tc.level, tc.debug, tb.lines)
+		}
+	}
+}
+
+func TestMockLoggerCanChangeWhileClosing(t *testing.T) {
+	m, closeMock := mustMock(t, "llamas")
+
+	started := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		close(started)
+		for i := 0; i < 1000; i++ {
+			m.Logger(&recordingLogger{})
+		}
+	}()
+
+	<-started
+	closeMock()
+	<-done
+}
@@ -51,6 +51,52 @@ func ExampleLinkTestBinaryAsProxy() {
 	// Output: Llama party! 🎉
 }
 
+func TestLinkTestBinaryAsProxies(t *testing.T) {
+	lp, err := bintest.LinkTestBinaryAsProxies("git", "ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := lp.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	for _, name := range []string{"git", "ssh"} {
+		if dir := filepath.Dir(lp.Get(name).Path); dir != lp.Dir {
+			t.Fatalf("Expected %s to be linked in %s, got %s", name, lp.Dir, dir)
+		}
+	}
+
+	for _, e := range lp.Environ() {
+		if strings.HasPrefix(e, "PATH=") {
+			t.Setenv("PATH", strings.TrimPrefix(e, "PATH="))
+		}
+	}
+
+	for _, name := range []string{"ssh", "git"} {
+		cmd := exec.Command(name, "llamas")
+		cmd.Env = append(os.Environ(), lp.Environ()...)
+
+		var out strings.Builder
+		cmd.Stdout = &out
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+
+		call := <-lp.Get(name).Ch
+		fmt.Fprintf(call.Stdout, "%s %s", strings.TrimSuffix(call.Name, ".exe"), call.Args[1])
+		call.Exit(0)
+
+		if err := cmd.Wait(); err != nil {
+			t.Fatal(err)
+		}
+		if expected := name + " llamas"; out.String() != expected {
+			t.Fatalf("Expected %q, got %q", expected, out.String())
+		}
+	}
+}
+
 func TestMain(m *testing.M) {
 	// flag.BoolVar(&proxy.Debug, "proxy.debug", false, "Whether to show proxy debug")
 	// flag.Parse()
@@ -59,9 +105,8 @@ func TestMain(m *testing.M) {
 		os.Exit(bintest.NewClientFromEnv().Run())
 	}
 
-	_, err := bintest.StartServer()
-	if err != nil {
-		fmt.Printf("Failed to start proxy server: %v", err)
+	if err := bintest.Precompile(); err != nil {
+		fmt.Printf("Failed to precompile proxy: %v", err)
 		os.Exit(1)
 	}
 
@@ -2,9 +2,13 @@ package bintest
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
@@ -14,14 +18,34 @@ import (
 
 const (
 	InfiniteTimes = -1
+
+	// DefaultStdinCaptureLimit is the default amount of stdin bytes recorded on an Invocation
+	DefaultStdinCaptureLimit = 64 * 1024
+
+	// DefaultPassthroughTimeout is how long passthrough commands can run before being killed
+	DefaultPassthroughTimeout = 10 * time.Second
 )
 
-// TestingT is an interface for *testing.T
+// TestingT is an interface for *testing.T. If the implementation also has Helper or
+// FailNow methods like *testing.T does, they are used too
 type TestingT interface {
 	Logf(format string, args ...interface{})
 	Errorf(format string, args ...interface{})
 }
 
+// helper is implemented by TestingTs that can report failures at the caller. Helper
+// marks the function that calls it, so it can't be wrapped
+type helper interface {
+	Helper()
+}
+
+// failNow calls t.FailNow if t has it
+func failNow(t TestingT) {
+	if f, ok := t.(interface{ FailNow() }); ok {
+		f.FailNow()
+	}
+}
+
 // Mock provides a wrapper around a Proxy for testing
 type Mock struct {
 	sync.Mutex
@@ -38,134 +62,361 @@ type Mock struct {
 	// The executions expected of the binary
 	expected ExpectationSet
 
-	// A list of middleware functions to call before invocation
-	before []func(i Invocation) error
+	// A list of middleware functions to call before invocation, and the errors they returned
+	// by the sequence of the invocation
+	before       []func(i Invocation) error
+	beforeErrors map[uint64]error
+
+	// A list of middleware functions to call after invocation, and the errors they returned
+	after       []func(i Invocation, result Result) error
+	afterErrors []error
 
 	// Whether to ignore unexpected calls
 	ignoreUnexpected bool
 
+	// A function to respond to unexpected calls with
+	unexpectedFunc func(*Call)
+
 	// The related proxy
 	proxy *Proxy
 
 	// A command to passthrough execution to
 	passthroughPath string
+
+	// How long passthrough commands can run for, unless an expectation overrides it
+	passthroughTimeout time.Duration
+
+	// Functions that customise passthrough commands before they start
+	configurePassthrough []func(*exec.Cmd)
+
+	// The maximum bytes of stdin to record on invocations
+	stdinCaptureLimit int
+
+	// The maximum bytes of stdout and stderr to record on invocations
+	outputCaptureLimit int
+
+	// Records or replays interactions with the real binary
+	cassette *cassette
+
+	// Where to report unexpected invocations as soon as they happen
+	failFast TestingT
+
+	// Whether the mock shadows a real binary in PATH, and where the real binary is
+	installed   bool
+	localPath   string
+	restoreFunc func()
+
+	// Where debug output for the mock goes, nil for the server's logger. It has its own lock
+	// as it's logged to with and without the mock locked
+	logger   Logger
+	loggerMu sync.RWMutex
+
+	// Whether bintest's own environment variables are left in call environments
+	keepInternalEnv bool
+
+	// Where ExpectNoMoreInteractions was called, and the sequences of invocations after it
+	sealedFile string
+	sealedLine int
+	sealed     bool
+	afterSeal  map[uint64]bool
+}
+
+// MockOptions configure a Mock built with NewMockWithOptions, Server.NewMockWithOptions or
+// NewMockFromTestMainWithOptions
+type MockOptions struct {
+	// KeepInternalEnv leaves bintest's own environment variables, like ServerEnvVar, in
+	// Call.Env, invocations and the environment of passthrough commands. By default
+	// they are removed
+	KeepInternalEnv bool
 }
 
 // NewMock builds a new Mock, or an error if the bintest fails to compile
 func NewMock(path string) (*Mock, error) {
-	m := &Mock{}
+	return NewMockWithOptions(path, MockOptions{})
+}
 
+// NewMockWithOptions builds a new Mock with options, or an error if the bintest fails to compile
+func NewMockWithOptions(path string, opts MockOptions) (*Mock, error) {
 	proxy, err := CompileProxy(path)
 	if err != nil {
 		return nil, err
 	}
 
-	m.Name = strings.TrimSuffix(filepath.Base(proxy.Path), `.exe`)
-	m.Path = proxy.Path
-	m.proxy = proxy
+	return newMock(proxy, strings.TrimSuffix(filepath.Base(proxy.Path), `.exe`), opts), nil
+}
 
-	go func() {
-		for call := range m.proxy.Ch {
-			m.invoke(call)
-		}
-	}()
-	return m, nil
+// NewMock builds a new Mock that uses this server rather than the shared one
+func (s *Server) NewMock(path string) (*Mock, error) {
+	return s.NewMockWithOptions(path, MockOptions{})
+}
+
+// NewMockWithOptions builds a new Mock with options that uses this server rather than the
+// shared one
+func (s *Server) NewMockWithOptions(path string, opts MockOptions) (*Mock, error) {
+	proxy, err := s.CompileProxy(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return newMock(proxy, strings.TrimSuffix(filepath.Base(proxy.Path), `.exe`), opts), nil
 }
 
 func NewMockFromTestMain(path string) (*Mock, error) {
-	m := &Mock{}
+	return NewMockFromTestMainWithOptions(path, MockOptions{})
+}
 
+// NewMockFromTestMainWithOptions is NewMockFromTestMain with options
+func NewMockFromTestMainWithOptions(path string, opts MockOptions) (*Mock, error) {
 	proxy, err := LinkTestBinaryAsProxy(path)
 	if err != nil {
 		return nil, err
 	}
 
-	m.Name = filepath.Base(proxy.Path)
-	m.Path = proxy.Path
-	m.proxy = proxy
+	return newMock(proxy, filepath.Base(proxy.Path), opts), nil
+}
+
+func newMock(proxy *Proxy, name string, opts MockOptions) *Mock {
+	m := &Mock{
+		Name:               name,
+		Path:               proxy.Path,
+		proxy:              proxy,
+		stdinCaptureLimit:  DefaultStdinCaptureLimit,
+		passthroughTimeout: DefaultPassthroughTimeout,
+		keepInternalEnv:    opts.KeepInternalEnv,
+	}
 
 	go func() {
 		for call := range m.proxy.Ch {
 			m.invoke(call)
 		}
 	}()
-	return m, nil
+	return m
 }
 
+// invoke handles a call in three steps. The call is matched and counted against its
+// expectation with the mock locked, then responded to without the lock so that slow or
+// interactive calls don't hold up Check and the other methods of the mock. The invocation
+// is recorded with the mock locked again as the call exits, before the caller gets the exit
+// code, so that it's there as soon as the command returns. After funcs then run unlocked, so
+// that they can use the mock too
 func (m *Mock) invoke(call *Call) {
+	respond, record := m.match(call)
+
+	var once sync.Once
+	recordOnce := func() {
+		once.Do(record)
+	}
+	call.onExit = recordOnce
+
+	respond()
+
+	// call funcs may return without exiting the call
+	recordOnce()
+}
+
+// match finds the expectation for a call, returning funcs that respond to the call and then
+// record the invocation, both of which are called with the mock unlocked
+func (m *Mock) match(call *Call) (respond func(), record func()) {
 	m.Lock()
 	defer m.Unlock()
 
-	debugf("Handling invocation for %s %v", m.Name, call.Args[1:])
+	if l := m.getLogger(); l != nil {
+		call.logger = l
+	}
+
+	m.debugf("Handling invocation for %s %v", m.Name, call.Args[1:])
+
+	if !m.keepInternalEnv {
+		call.Env = StripInternalEnv(call.Env)
+	}
 
 	var invocation = Invocation{
-		Args: call.Args[1:],
-		Env:  call.Env,
-		Dir:  call.Dir,
+		Name:           m.Name,
+		Sequence:       call.Sequence,
+		ParentSequence: call.ParentSequence,
+		Args:           call.Args[1:],
+		Env:            call.Env,
+		Dir:            call.Dir,
+		ParentPID:      call.ParentPID,
+		ParentPath:     call.ParentPath,
+		Caller:         call.Caller,
+		StartedAt:      time.Now(),
+	}
+
+	// Record whatever is read from stdin, up to the capture limit, and hash all of it
+	stdin := &stdinRecorder{capture: limitedBuffer{limit: m.stdinCaptureLimit}, hash: sha256.New()}
+	call.Stdin = struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(call.Stdin, stdin), call.Stdin}
+
+	// Count the output for the after funcs
+	stdout := &countingWriteCloser{WriteCloser: call.Stdout, capture: &limitedBuffer{limit: m.outputCaptureLimit}}
+	stderr := &countingWriteCloser{WriteCloser: call.Stderr, capture: &limitedBuffer{limit: m.outputCaptureLimit}}
+	call.Stdout = stdout
+	call.Stderr = stderr
+
+	record = func() {
+		invocation.Stdin, invocation.StdinBytes, invocation.StdinSHA256 = stdin.read()
+		invocation.ExitCode = call.exitCode
+		invocation.Err = call.err
+		invocation.Signal = call.Signal()
+		invocation.FinishedAt = time.Now()
+		invocation.StdoutBytes, invocation.Stdout = stdout.written()
+		invocation.StderrBytes, invocation.Stderr = stderr.written()
+
+		m.Lock()
+		m.invocations = append(m.invocations, invocation)
+		after := append([]func(Invocation, Result) error{}, m.after...)
+		m.Unlock()
+
+		result := Result{
+			ExitCode:    invocation.ExitCode,
+			Duration:    invocation.FinishedAt.Sub(invocation.StartedAt),
+			StdoutBytes: invocation.StdoutBytes,
+			StderrBytes: invocation.StderrBytes,
+		}
+
+		// after funcs run unlocked, so that they can use the mock
+		for _, afterFunc := range after {
+			if err := afterFunc(invocation.copy(), result); err != nil {
+				m.Lock()
+				m.afterErrors = append(m.afterErrors, err)
+				m.Unlock()
+			}
+		}
+	}
+
+	if m.sealed {
+		m.debugf("Failing invocation, no more interactions were expected")
+		if m.failFast != nil {
+			m.failFast.Errorf("Unexpected call to %s %s after ExpectNoMoreInteractions%s",
+				m.Name, FormatStrings(invocation.Args), m.sealedAt())
+		}
+		m.afterSeal[invocation.Sequence] = true
+		return func() {
+			writeCallError(call, "Error: Unexpected call to %s %s, no more interactions were expected", m.Name, FormatStrings(invocation.Args))
+			call.Exit(1)
+		}, record
 	}
 
 	// Before we execute any invocations, run the before funcs
 	for _, beforeFunc := range m.before {
 		if err := beforeFunc(invocation); err != nil {
-			fmt.Fprintf(call.Stderr, "\033[31m🚨 Error: %v\033[0m\n", err)
-			call.Exit(1)
-			return
+			m.debugf("Failing invocation, a before func failed: %v", err)
+			if m.beforeErrors == nil {
+				m.beforeErrors = map[uint64]error{}
+			}
+			m.beforeErrors[invocation.Sequence] = err
+			return func() {
+				writeCallError(call, "Error: %v", err)
+				call.err = err
+				call.Exit(1)
+			}, record
 		}
 	}
 
 	result := m.expected.ForArguments(call.Args[1:]...)
 	expected, err := result.Match()
 	if err != nil {
-		debugf("No match found for expectation: %v", err)
+		m.debugf("No match found for expectation: %v", err)
 
-		m.invocations = append(m.invocations, invocation)
-		if m.ignoreUnexpected {
-			debugf("Exiting silently, ignoreUnexpected is set")
-			call.Exit(0)
+		if m.unexpectedFunc != nil {
+			m.debugf("Responding with the unexpected invocation func")
+			return func() { m.unexpectedFunc(call) }, record
+		} else if m.ignoreUnexpected {
+			m.debugf("Exiting silently, ignoreUnexpected is set")
+			return func() { call.Exit(0) }, record
 		} else if err == ErrNoExpectationsMatch {
-			fmt.Fprintf(call.Stderr, "\033[31m🚨 Error: %s\033[0m\n", result.ClosestMatch().Explain())
-			call.Exit(1)
-		} else {
-			fmt.Fprintf(call.Stderr, "\033[31m🚨 Error: %v\033[0m\n", err)
-			call.Exit(1)
+			if m.failFast != nil {
+				m.failFast.Errorf("Unexpected call to %s %s%s\n%s",
+					m.Name, FormatStrings(invocation.Args), calledBy(invocation), m.diffClosest(invocation))
+			}
+			explanation := result.ClosestMatch().Explain()
+			return func() {
+				writeCallError(call, "Error: %s", explanation)
+				call.Exit(1)
+			}, record
 		}
-		return
+		return func() {
+			writeCallError(call, "Error: %v", err)
+			call.Exit(1)
+		}, record
 	}
 
-	debugf("Found expectation: %s", expected)
+	m.debugf("Found expectation: %s", expected)
 
 	invocation.Expectation = expected
 
-	if expected.stdin != nil {
-		// read all of stdin
-		buf, err := io.ReadAll(call.Stdin)
-		if err != nil {
-			fmt.Fprintf(call.Stderr, "\033[31m🚨 Error reading stdin: %v\033[0m\n", err)
-			call.Exit(1)
-		}
-		// copy to Expectation
-		expected.readStdin = make([]byte, len(buf))
-		copy(expected.readStdin, buf)
-		// restore original stdin
-		call.Stdin = io.NopCloser(bytes.NewReader(buf))
+	total := expected.recordCall()
+	m.debugf("Incremented total calls of expected to %d", total)
+
+	expected.recordEnv(call.Env)
+
+	for _, e := range expected.fakeTimeEnv(time.Now()) {
+		call.Env = SetEnv(call.Env, e)
+	}
+
+	for _, f := range m.configurePassthrough {
+		call.ConfigurePassthrough(f)
 	}
 
+	expected.RLock()
+	readStdin := expected.stdin != nil || expected.consumeStdin
+	passthroughDir := expected.passthroughDir
+	passthroughPath := expected.passthroughPath
+	passthroughTimeout := expected.passthroughTimeout
+	callFunc := expected.callFunc
+	exitCode := expected.exitCode
+	writeStdout, writeStderr := expected.writeStdout, expected.writeStderr
+	expected.RUnlock()
+
+	if passthroughDir != "" {
+		call.ConfigurePassthrough(func(cmd *exec.Cmd) {
+			cmd.Dir = passthroughDir
+		})
+	}
+
+	if passthroughTimeout == 0 {
+		passthroughTimeout = m.passthroughTimeout
+	}
+
+	cassette := m.cassette
 	if m.passthroughPath != "" {
-		call.PassthroughWithTimeout(m.passthroughPath, time.Second*10)
-	} else if expected.passthroughPath != "" {
-		call.PassthroughWithTimeout(expected.passthroughPath, time.Second*10)
-	} else if expected.callFunc != nil {
-		expected.callFunc(call)
-	} else {
-		_, _ = io.Copy(call.Stdout, expected.writeStdout)
-		_, _ = io.Copy(call.Stderr, expected.writeStderr)
-		call.Exit(expected.exitCode)
+		passthroughPath = m.passthroughPath
 	}
 
-	debugf("Incrementing total call of expected from %d to %d", expected.totalCalls, expected.totalCalls+1)
-	expected.totalCalls++
+	return func() {
+		if readStdin {
+			// read all of stdin
+			buf, err := io.ReadAll(call.Stdin)
+			if err != nil {
+				writeCallError(call, "Error reading stdin: %v", err)
+				call.Exit(1)
+			}
+			// copy to Expectation
+			expected.recordStdin(buf)
+			// restore original stdin
+			call.Stdin = io.NopCloser(bytes.NewReader(buf))
+		}
 
-	m.invocations = append(m.invocations, invocation)
+		if cassette != nil {
+			cassette.respond(call, passthroughTimeout)
+		} else if passthroughPath != "" {
+			call.PassthroughWithTimeout(passthroughPath, passthroughTimeout)
+		} else if callFunc != nil {
+			callFunc(call)
+		} else {
+			if err := writeStdout.copyTo(call.Stdout); err != nil {
+				writeCallError(call, "Error writing stdout: %v", err)
+				exitCode = 1
+			} else if err := writeStderr.copyTo(call.Stderr); err != nil {
+				writeCallError(call, "Error writing stderr: %v", err)
+				exitCode = 1
+			}
+			call.Exit(exitCode)
+		}
+	}, record
 }
 
 // PassthroughToLocalCommand executes the mock name as a local command (looked up in PATH) and then passes
@@ -174,8 +425,8 @@ func (m *Mock) invoke(call *Call) {
 func (m *Mock) PassthroughToLocalCommand() *Mock {
 	m.Lock()
 	defer m.Unlock()
-	debugf("[mock] Looking up %s in path", m.Name)
-	path, err := exec.LookPath(m.Name)
+	m.debugf("[mock] Looking up %s in path", m.Name)
+	path, err := m.localCommand()
 	if err != nil {
 		panic(err)
 	}
@@ -192,7 +443,82 @@ func (m *Mock) IgnoreUnexpectedInvocations() *Mock {
 	return m
 }
 
-// Before adds a middleware that is run before the Invocation is dispatched
+// ExpectNoMoreInteractions fails any further invocations of the mock, and Check reports
+// them even if IgnoreUnexpectedInvocations is set. It makes explicit that a test expects all
+// of the calls to have happened by this point
+func (m *Mock) ExpectNoMoreInteractions() *Mock {
+	m.Lock()
+	defer m.Unlock()
+	m.sealedFile, m.sealedLine = callSite()
+	m.sealed = true
+	if m.afterSeal == nil {
+		m.afterSeal = map[uint64]bool{}
+	}
+	return m
+}
+
+// sealedAt returns a suffix for failure messages that says where ExpectNoMoreInteractions was called
+func (m *Mock) sealedAt() string {
+	if m.sealedFile == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (at %s:%d)", filepath.Base(m.sealedFile), m.sealedLine)
+}
+
+// WhenUnexpected sets a function to respond to invocations that don't match any expectations.
+// The invocations are still reported as unexpected by Check, unless IgnoreUnexpectedInvocations is set
+func (m *Mock) WhenUnexpected(f func(*Call)) *Mock {
+	m.Lock()
+	defer m.Unlock()
+	m.unexpectedFunc = f
+	return m
+}
+
+// DefaultExit is a shortcut for responding to unexpected invocations with an exit code
+func (m *Mock) DefaultExit(code int) *Mock {
+	return m.WhenUnexpected(func(c *Call) {
+		c.Exit(code)
+	})
+}
+
+// PassthroughTimeout sets how long passthrough commands can run before they are killed,
+// defaults to DefaultPassthroughTimeout. Expectations can override it
+func (m *Mock) PassthroughTimeout(d time.Duration) *Mock {
+	m.Lock()
+	defer m.Unlock()
+	m.passthroughTimeout = d
+	return m
+}
+
+// ConfigurePassthrough adds a function that customises passthrough commands before they
+// start, see Call.ConfigurePassthrough
+func (m *Mock) ConfigurePassthrough(f func(*exec.Cmd)) *Mock {
+	m.Lock()
+	defer m.Unlock()
+	m.configurePassthrough = append(m.configurePassthrough, f)
+	return m
+}
+
+// CaptureStdinLimit sets the maximum number of stdin bytes recorded on each Invocation,
+// defaults to DefaultStdinCaptureLimit. A limit of 0 disables capturing
+func (m *Mock) CaptureStdinLimit(limit int) *Mock {
+	m.Lock()
+	defer m.Unlock()
+	m.stdinCaptureLimit = limit
+	return m
+}
+
+// CaptureOutputLimit sets the maximum bytes of stdout and stderr recorded on each Invocation.
+// Output isn't captured unless a limit is set, as it's kept for the life of the mock
+func (m *Mock) CaptureOutputLimit(limit int) *Mock {
+	m.Lock()
+	defer m.Unlock()
+	m.outputCaptureLimit = limit
+	return m
+}
+
+// Before adds a middleware that is run before the Invocation is dispatched. If it returns an
+// error the call fails, and the invocation is recorded with the error, which Check reports
 func (m *Mock) Before(f func(i Invocation) error) *Mock {
 	m.Lock()
 	defer m.Unlock()
@@ -204,6 +530,15 @@ func (m *Mock) Before(f func(i Invocation) error) *Mock {
 	return m
 }
 
+// After adds a middleware that is run after the Invocation has finished. Errors it returns
+// fail the mock's Check
+func (m *Mock) After(f func(i Invocation, result Result) error) *Mock {
+	m.Lock()
+	defer m.Unlock()
+	m.after = append(m.after, f)
+	return m
+}
+
 // Expect creates an expectation that the mock will be called with the provided args
 func (m *Mock) Expect(args ...interface{}) *Expectation {
 	m.Lock()
@@ -212,13 +547,12 @@ func (m *Mock) Expect(args ...interface{}) *Expectation {
 		name:            m.Name,
 		sequence:        len(m.expected) + 1,
 		arguments:       Arguments(args),
-		writeStderr:     &bytes.Buffer{},
-		writeStdout:     &bytes.Buffer{},
 		minCalls:        1,
 		maxCalls:        1,
 		passthroughPath: m.passthroughPath,
 	}
-	debugf("Creating expectation %s", ex)
+	ex.file, ex.line = callSite()
+	m.debugf("Creating expectation %s", ex)
 	m.expected = append(m.expected, ex)
 	return ex
 }
@@ -230,20 +564,98 @@ func (m *Mock) ExpectAll(argSlices [][]interface{}) {
 	}
 }
 
+// FailFast reports unexpected invocations to t as soon as they happen, rather than when
+// the mock is checked, and makes Check stop the test with FailNow if it fails. FailNow
+// can only be called from the test goroutine, so the test stops at the next Check
+func (m *Mock) FailFast(t TestingT) *Mock {
+	m.Lock()
+	defer m.Unlock()
+	m.failFast = t
+	return m
+}
+
+// Logger sends the debug output of the mock and its calls to l rather than the server's
+// logger. Use NewTestLogger to interleave it with the output of the test
+func (m *Mock) Logger(l Logger) *Mock {
+	m.loggerMu.Lock()
+	defer m.loggerMu.Unlock()
+	m.logger = l
+	return m
+}
+
+// getLogger returns the mock's logger, or nil if it uses the server's
+func (m *Mock) getLogger() Logger {
+	m.loggerMu.RLock()
+	defer m.loggerMu.RUnlock()
+	return m.logger
+}
+
+func (m *Mock) debugf(pattern string, args ...interface{}) {
+	l := m.getLogger()
+	if l == nil {
+		l = m.proxy.Server.getLogger()
+	}
+	logWith(l, LevelDebug, logFields{Phase: "mock", Proxy: m.Name}, pattern, args...)
+}
+
 // Check that all assertions are met and that there aren't invocations that don't match expectations
 func (m *Mock) Check(t TestingT) bool {
+	if h, ok := t.(helper); ok {
+		h.Helper()
+	}
+	return m.checkErr(t) == nil
+}
+
+// checkErr is Check, returning a *CheckError with each of the failures
+func (m *Mock) checkErr(t TestingT) error {
+	if h, ok := t.(helper); ok {
+		h.Helper()
+	}
+	failures := m.check(t)
+	m.report()
+
+	m.Lock()
+	failFast := m.failFast != nil
+	m.Unlock()
+
+	if len(failures) == 0 {
+		return nil
+	}
+	if failFast {
+		failNow(t)
+	}
+	return &CheckError{Name: m.Name, Failures: failures}
+}
+
+func (m *Mock) check(t TestingT) []error {
 	m.Lock()
 	defer m.Unlock()
 
-	if len(m.expected) == 0 {
-		return true
+	var failures []error
+
+	for _, invocation := range m.invocations {
+		if err, ok := m.beforeErrors[invocation.Sequence]; ok {
+			t.Errorf("Before middleware failed for %s %s: %v", m.Name, FormatStrings(invocation.Args), err)
+			failures = append(failures, fmt.Errorf("Before middleware failed for %s %s: %w", m.Name, FormatStrings(invocation.Args), err))
+		}
+	}
+
+	for _, err := range m.afterErrors {
+		t.Errorf("After middleware failed: %v", err)
+		failures = append(failures, fmt.Errorf("After middleware failed: %w", err))
+	}
+
+	if len(m.expected) == 0 && len(m.afterSeal) == 0 {
+		return failures
 	}
 
 	var failedExpectations, unexpectedInvocations int
 
 	// first check that everything we expect
 	for _, expected := range m.expected {
-		if !expected.Check(t) {
+		rt := &recordingT{TestingT: t}
+		if !expected.Check(rt) {
+			failures = append(failures, &UnmetExpectationError{Expectation: expected, Reasons: rt.logs})
 			failedExpectations++
 		}
 	}
@@ -255,44 +667,383 @@ func (m *Mock) Check(t TestingT) bool {
 	}
 
 	// next check if we have invocations without expectations
-	if !m.ignoreUnexpected {
-		for _, invocation := range m.invocations {
-			if invocation.Expectation == nil {
-				t.Logf("Unexpected call to %s %s",
-					m.Name, FormatStrings(invocation.Args))
-				unexpectedInvocations++
+	for _, invocation := range m.invocations {
+		if _, ok := m.beforeErrors[invocation.Sequence]; ok {
+			// reported as a before middleware failure above
+			continue
+		}
+		if m.afterSeal[invocation.Sequence] {
+			t.Logf("Unexpected call to %s %s after ExpectNoMoreInteractions%s",
+				m.Name, FormatStrings(invocation.Args), m.sealedAt())
+			failures = append(failures, &UnexpectedInvocationError{Invocation: invocation, AfterNoMoreInteractions: true})
+			unexpectedInvocations++
+		} else if invocation.Expectation == nil && !m.ignoreUnexpected && len(m.expected) > 0 {
+			t.Logf("Unexpected call to %s %s",
+				m.Name, FormatStrings(invocation.Args))
+			if invocation.Caller != "" {
+				t.Logf("Called by %s", invocation.Caller)
 			}
+			if diff := m.diffClosest(invocation); diff != "" {
+				t.Logf("Closest expectation:\n%s", diff)
+			}
+			failures = append(failures, &UnexpectedInvocationError{Invocation: invocation})
+			unexpectedInvocations++
 		}
+	}
 
-		if unexpectedInvocations > 0 {
-			t.Errorf("More invocations than expected (%d vs %d)",
-				unexpectedInvocations,
-				len(m.invocations))
-		}
+	if unexpectedInvocations > 0 {
+		t.Errorf("More invocations than expected (%d vs %d)",
+			unexpectedInvocations,
+			len(m.invocations))
 	}
 
-	return unexpectedInvocations == 0 && failedExpectations == 0
+	return failures
+}
+
+// recordingT passes logs through to a TestingT, keeping a copy of them
+type recordingT struct {
+	TestingT
+	logs []string
+}
+
+func (r *recordingT) Logf(format string, args ...interface{}) {
+	r.logs = append(r.logs, fmt.Sprintf(format, args...))
+	r.TestingT.Logf(format, args...)
+}
+
+// diffClosest returns a diff between an invocation and the expectation closest to it
+func (m *Mock) diffClosest(invocation Invocation) string {
+	closest := m.expected.ForArguments(invocation.Args...).ClosestMatch()
+	if closest.Expectation == nil {
+		return ""
+	}
+
+	diff := closest.Diff()
+
+	closest.Expectation.RLock()
+	stdinDiff := diffStdin(closest.Expectation.stdin, invocation.Stdin)
+	closest.Expectation.RUnlock()
+
+	if stdinDiff != "" {
+		diff += "\n" + stdinDiff
+	}
+	return diff
+}
+
+// Invocations returns a copy of the invocations that have occurred, which can be changed
+// without affecting the mock. See InvocationSet for ways to filter them
+func (m *Mock) Invocations() InvocationSet {
+	m.Lock()
+	defer m.Unlock()
+	invocations := make(InvocationSet, len(m.invocations))
+	for i, invocation := range m.invocations {
+		invocations[i] = invocation.copy()
+	}
+	return invocations
+}
+
+// Invocation returns a copy of the invocation at idx, in the order they were received, or
+// an empty Invocation if there isn't one
+func (m *Mock) Invocation(idx int) Invocation {
+	m.Lock()
+	defer m.Unlock()
+	if idx < 0 || idx >= len(m.invocations) {
+		return Invocation{}
+	}
+	return m.invocations[idx].copy()
+}
+
+// Reset clears the expectations and invocations of the mock without closing the proxy, so
+// that a mock can be reused across subtests with clean state
+func (m *Mock) Reset() {
+	m.Lock()
+	defer m.Unlock()
+	m.expected = nil
+	m.invocations = nil
+	m.beforeErrors = nil
+	m.afterErrors = nil
+	m.sealed = false
+	m.afterSeal = nil
 }
 
 func (m *Mock) CheckAndClose(t TestingT) error {
+	if h, ok := t.(helper); ok {
+		h.Helper()
+	}
+	m.Restore()
 	if err := m.proxy.Close(); err != nil {
 		return err
 	}
-	if !m.Check(t) {
-		return errors.New("Assertion checks failed")
+	return m.checkErr(t)
+}
+
+// CheckError is returned by CheckAndClose when a mock's checks fail. Failures has an error
+// for each failed check, like an *UnmetExpectationError or *UnexpectedInvocationError
+type CheckError struct {
+	Name     string
+	Failures []error
+}
+
+func (e *CheckError) Error() string {
+	lines := []string{fmt.Sprintf("Assertion checks failed for %s", e.Name)}
+	for _, f := range e.Failures {
+		lines = append(lines, f.Error())
 	}
-	return nil
+	return strings.Join(lines, "\n")
+}
+
+func (e *CheckError) Unwrap() []error {
+	return e.Failures
+}
+
+// UnmetExpectationError is an expectation that wasn't met, with the reasons why
+type UnmetExpectationError struct {
+	Expectation *Expectation
+	Reasons     []string
+}
+
+func (e *UnmetExpectationError) Error() string {
+	return strings.Join(e.Reasons, "\n")
+}
+
+// UnexpectedInvocationError is an invocation that didn't match any expectation, or that
+// happened after ExpectNoMoreInteractions
+type UnexpectedInvocationError struct {
+	Invocation              Invocation
+	AfterNoMoreInteractions bool
+}
+
+func (e *UnexpectedInvocationError) Error() string {
+	if e.AfterNoMoreInteractions {
+		return fmt.Sprintf("Unexpected call to %s %s after ExpectNoMoreInteractions", e.Invocation.Name, FormatStrings(e.Invocation.Args))
+	}
+	return fmt.Sprintf("Unexpected call to %s %s", e.Invocation.Name, FormatStrings(e.Invocation.Args))
 }
 
 func (m *Mock) Close() error {
-	debugf("Closing mock")
+	m.debugf("Closing mock")
+	m.Restore()
 	return m.proxy.Close()
 }
 
+// WithCallTimeout fails calls to the mock that aren't exited within d, for instance because
+// a CallFunc never returns. See Proxy.WithCallTimeout
+func (m *Mock) WithCallTimeout(d time.Duration) *Mock {
+	m.proxy.WithCallTimeout(d)
+	return m
+}
+
+// CloseAndExitPending is like Close, but calls that haven't been exited are exited with code
+// first. See Proxy.CloseAndExitPending
+func (m *Mock) CloseAndExitPending(code int) error {
+	m.debugf("Closing mock, exiting pending calls with %d", code)
+	m.Restore()
+	return m.proxy.CloseAndExitPending(code)
+}
+
+// CheckAll checks all of the mocks, so that every failure is reported rather than
+// stopping at the first mock that fails
+func CheckAll(t TestingT, mocks ...*Mock) bool {
+	if h, ok := t.(helper); ok {
+		h.Helper()
+	}
+	return len(checkAll(t, mocks)) == 0
+}
+
+// checkAll checks the mocks and returns the names of the ones that failed
+func checkAll(t TestingT, mocks []*Mock) []string {
+	if h, ok := t.(helper); ok {
+		h.Helper()
+	}
+	var failed []string
+	for _, m := range mocks {
+		if !m.Check(t) {
+			failed = append(failed, m.Name)
+		}
+	}
+	if len(failed) > 0 && len(mocks) > 1 {
+		t.Logf("Assertion checks failed for %d of %d mocks: %s", len(failed), len(mocks), strings.Join(failed, ", "))
+	}
+	return failed
+}
+
+// CloseAll closes all of the mocks, and returns the errors from any that failed to close
+func CloseAll(mocks ...*Mock) error {
+	var errs []error
+	for _, m := range mocks {
+		if err := m.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("Error closing %s: %w", m.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// CheckAndCloseAll closes and then checks all of the mocks, like CheckAndClose for each of
+// them, with a single error for all of the failures
+func CheckAndCloseAll(t TestingT, mocks ...*Mock) error {
+	if h, ok := t.(helper); ok {
+		h.Helper()
+	}
+
+	var errs []error
+	for _, m := range mocks {
+		m.Restore()
+		if err := m.proxy.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("Error closing %s: %w", m.Name, err))
+		}
+	}
+
+	if failed := checkAll(t, mocks); len(failed) > 0 {
+		errs = append(errs, fmt.Errorf("Assertion checks failed for %s", strings.Join(failed, ", ")))
+	}
+
+	return errors.Join(errs...)
+}
+
 // Invocation is a call to the binary
 type Invocation struct {
+	// Name of the binary that was invoked
+	Name string
+
+	// Sequence orders invocations across all mocks in the process, see Call.Sequence
+	Sequence uint64
+
+	// ParentSequence is the Sequence of the invocation that made this one, see
+	// Call.ParentSequence
+	ParentSequence uint64
+
 	Args        []string
 	Env         []string
 	Dir         string
 	Expectation *Expectation
+
+	// The process that invoked the binary, ParentPath is empty if it couldn't be determined
+	ParentPID  int
+	ParentPath string
+
+	// Caller is the command line of the process that invoked the binary, which helps to
+	// tell which code path made a call. It's empty if it couldn't be determined
+	Caller string
+
+	// Stdin is the data read from stdin during the call, truncated to the capture limit
+	Stdin []byte
+
+	// How many bytes were read from stdin, and the hex-encoded sha256 of all of them, which
+	// covers stdin past the capture limit. StdinSHA256 is empty if nothing was read
+	StdinBytes  int64
+	StdinSHA256 string
+
+	// ExitCode is the exit code the call finished with
+	ExitCode int
+
+	// How many bytes the call wrote to stdout and stderr
+	StdoutBytes, StderrBytes int64
+
+	// Stdout and Stderr are the output of the call, truncated to the capture limit
+	Stdout, Stderr []byte
+
+	// Err is the error the call was finished with by Call.ExitWithError or Call.Fatal
+	Err error
+
+	// Signal is the signal that terminated the call's passthrough command, if any, see
+	// Call.Signal
+	Signal os.Signal
+
+	// When the invocation was received and when it finished
+	StartedAt, FinishedAt time.Time
+}
+
+// calledBy returns a suffix for failure messages that says which process made an invocation
+func calledBy(i Invocation) string {
+	if i.Caller == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (called by %s)", i.Caller)
+}
+
+// EnvLookup returns the value of an environment variable in the invocation, and whether it was set
+func (i Invocation) EnvLookup(key string) (string, bool) {
+	return GetEnv(key, i.Env)
+}
+
+// Result is the outcome of an Invocation, passed to After middleware
+type Result struct {
+	ExitCode int
+
+	// How long the invocation took, from being received to finishing
+	Duration time.Duration
+
+	// The amount of output written by the invocation
+	StdoutBytes, StderrBytes int64
+}
+
+// countingWriteCloser counts the bytes written through it, and captures them. Calls can be
+// written to by a timeout as well as the response, so it's safe for concurrent use
+type countingWriteCloser struct {
+	io.WriteCloser
+	mu      sync.Mutex
+	n       int64
+	capture *limitedBuffer
+}
+
+func (c *countingWriteCloser) Write(p []byte) (int, error) {
+	n, err := c.WriteCloser.Write(p)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.n += int64(n)
+	_, _ = c.capture.Write(p[:n])
+	return n, err
+}
+
+// written returns the number of bytes written and a copy of those captured
+func (c *countingWriteCloser) written() (int64, []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.n, append([]byte(nil), c.capture.Bytes()...)
+}
+
+// stdinRecorder captures stdin up to a limit, and counts and hashes all of it. A timeout can
+// record the invocation while the response is still reading, so it's safe for concurrent use
+type stdinRecorder struct {
+	mu      sync.Mutex
+	capture limitedBuffer
+	n       int64
+	hash    hash.Hash
+}
+
+func (r *stdinRecorder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.n += int64(len(p))
+	_, _ = r.hash.Write(p)
+	return r.capture.Write(p)
+}
+
+// read returns a copy of the stdin captured, the number of bytes read and their sha256, or
+// an empty string if none were
+func (r *stdinRecorder) read() ([]byte, int64, string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	captured := append([]byte(nil), r.capture.Bytes()...)
+	if r.n == 0 {
+		return captured, 0, ""
+	}
+	return captured, r.n, hex.EncodeToString(r.hash.Sum(nil))
+}
+
+// limitedBuffer is a writer that keeps up to limit bytes and discards the rest
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if remaining := b.limit - b.Len(); remaining > 0 {
+		if len(p) > remaining {
+			_, _ = b.Buffer.Write(p[:remaining])
+		} else {
+			_, _ = b.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
 }
@@ -1,14 +1,19 @@
 package bintest_test
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"reflect"
+	"runtime"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/buildkite/bintest/v3"
 	"github.com/buildkite/bintest/v3/testutil"
@@ -40,6 +45,7 @@ func TestCallingMockWithStdinExpectedStringFailing(t *testing.T) {
 	m, close := mustMock(t, "test")
 	defer close()
 
+	_, _, line, _ := runtime.Caller(0)
 	m.Expect().WithStdin("the expected")
 
 	cmd := exec.Command(m.Path)
@@ -55,7 +61,8 @@ func TestCallingMockWithStdinExpectedStringFailing(t *testing.T) {
 	if s := strings.Join(mt.Errors, "\n"); s != `Not all expectations were met (0 out of 1)` {
 		t.Errorf("Errors: %q", s)
 	}
-	if s := strings.Join(mt.Logs, "\n"); s != `Expected stdin "the expected", got "the unexpected"` {
+	expected := fmt.Sprintf(`Expected stdin "the expected", got "the unexpected" (declared at mock_test.go:%d)`, line+1)
+	if s := strings.Join(mt.Logs, "\n"); s != expected {
 		t.Errorf("Logs: %q", s)
 	}
 }
@@ -210,6 +217,84 @@ func TestMockWithPassthroughToLocalCommand(t *testing.T) {
 	}
 }
 
+func TestMockWithPassthroughTimeout(t *testing.T) {
+	defer leaktest.Check(t)()
+	m, close := mustMock(t, "sleep")
+	defer close()
+
+	sleep, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	m.PassthroughTimeout(time.Minute)
+	m.Expect("10").AndPassthroughWithTimeout(sleep, 100*time.Millisecond)
+
+	start := time.Now()
+	if err := exec.Command(m.Path, "10").Run(); err == nil {
+		t.Fatalf("Expected the command to be killed")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Expected the command to be killed after the timeout, took %v", elapsed)
+	}
+}
+
+func TestMockConfigurePassthrough(t *testing.T) {
+	defer leaktest.Check(t)()
+	m, close := mustMock(t, "sh")
+	defer close()
+
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	m.ConfigurePassthrough(func(cmd *exec.Cmd) {
+		cmd.Env = append(cmd.Env, "LLAMA=configured")
+	})
+	m.Expect("-c", "echo $LLAMA").AndPassthroughToLocalCommand(sh)
+
+	out, err := exec.Command(m.Path, "-c", "echo $LLAMA").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "configured\n" {
+		t.Fatalf("Unexpected output %q", out)
+	}
+}
+
+func TestMockPassthroughInDir(t *testing.T) {
+	defer leaktest.Check(t)()
+	m, close := mustMock(t, "sh")
+	defer close()
+
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	sandbox := t.TempDir()
+	if err := os.WriteFile(filepath.Join(sandbox, "llamas.txt"), []byte("sandboxed\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	m.Expect("-c", "cat llamas.txt").AndPassthroughToLocalCommand(sh).InDir(sandbox)
+
+	cmd := exec.Command(m.Path, "-c", "cat llamas.txt")
+	cmd.Dir = t.TempDir()
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "sandboxed\n" {
+		t.Fatalf("Unexpected output %q", out)
+	}
+
+	if i := m.Invocation(0); i.Dir != cmd.Dir {
+		t.Fatalf("Expected invocation dir %s, got %s", cmd.Dir, i.Dir)
+	}
+}
+
 func TestCallingMockWithExpectationsOfNumberOfCalls(t *testing.T) {
 	var testCases = []struct {
 		label    string
@@ -387,6 +472,32 @@ func TestMockExpectWithMatcherFunc(t *testing.T) {
 	}
 }
 
+func TestMockExpectWithoutEnv(t *testing.T) {
+	defer leaktest.Check(t)()
+	m, close := mustMock(t, "git")
+	defer close()
+
+	_, _, line, _ := runtime.Caller(0)
+	m.Expect("push").WithoutEnv("GIT_DIR", "GIT_TOKEN").Exactly(2)
+
+	for _, env := range [][]string{{`GIT_WORK_TREE=/tmp`}, {`GIT_TOKEN=secret`}} {
+		cmd := exec.Command(m.Path, "push")
+		cmd.Env = append(os.Environ(), env...)
+		if err := cmd.Run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mt := &testutil.TestingT{}
+	if m.Check(mt) == true {
+		t.Error("Mock.Check() should have failed, but didn't")
+	}
+	expected := fmt.Sprintf(`Expected [git "push"] to be called without GIT_TOKEN in the environment (declared at mock_test.go:%d)`, line+1)
+	if s := strings.Join(mt.Logs, "\n"); s != expected {
+		t.Errorf("Logs: %q", s)
+	}
+}
+
 func TestMockExpectWithBefore(t *testing.T) {
 	defer leaktest.Check(t)()
 	m, close := mustMock(t, "true")
@@ -415,6 +526,70 @@ func TestMockExpectWithBefore(t *testing.T) {
 	}
 }
 
+func TestMockExpectNoEnvWithBefore(t *testing.T) {
+	defer leaktest.Check(t)()
+	m, close := mustMock(t, "true")
+	defer close()
+
+	m.PassthroughToLocalCommand().Before(func(i bintest.Invocation) error {
+		return bintest.ExpectNoEnv(t, i.Env, `LLAMAS_SUCK`)
+	})
+
+	m.Expect().AtLeastOnce().WithAnyArguments()
+
+	cmd := exec.Command(m.Path)
+	cmd.Env = append(os.Environ(), `LLAMAS_ROCK=absolutely`)
+	cmd.Stderr = os.Stderr
+	cmd.Stdout = os.Stdout
+
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Check(t) == false {
+		t.Errorf("Assertions should have passed")
+	}
+}
+
+func TestMockRecordsInvocationsFailedByBefore(t *testing.T) {
+	defer leaktest.Check(t)()
+	m, close := mustMock(t, "git")
+	defer close()
+
+	m.Before(func(i bintest.Invocation) error {
+		if len(i.Args) > 0 && i.Args[0] == "push" {
+			return errors.New("pushing isn't allowed")
+		}
+		return nil
+	})
+
+	m.Expect("fetch").Once()
+	m.Expect("push").Optionally()
+
+	if err := exec.Command(m.Path, "fetch").Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := exec.Command(m.Path, "push").Run(); err == nil {
+		t.Fatal("Expected the call to fail")
+	}
+
+	invocations := m.Invocations()
+	if len(invocations) != 2 {
+		t.Fatalf("Expected both invocations to be recorded, got %d", len(invocations))
+	}
+	if i := invocations[1]; i.ExitCode != 1 || i.Err == nil || i.Err.Error() != "pushing isn't allowed" {
+		t.Fatalf("Expected the push to be recorded with the failure, got exit code %d and %v", i.ExitCode, i.Err)
+	}
+
+	mt := &testutil.TestingT{}
+	if m.Check(mt) {
+		t.Fatal("Expected the check to fail")
+	}
+	if expected := []string{`Before middleware failed for git "push": pushing isn't allowed`}; !reflect.DeepEqual(mt.Errors, expected) {
+		t.Fatalf("Expected errors %q, got %q", expected, mt.Errors)
+	}
+}
+
 func TestMockParallelCommandsWithPassthrough(t *testing.T) {
 	defer leaktest.Check(t)()
 
@@ -478,6 +653,691 @@ func TestCallingMockWithRelativePath(t *testing.T) {
 	}
 }
 
+func TestMockWithFakeTime(t *testing.T) {
+	defer leaktest.Check(t)()
+	m, close := mustMock(t, "llamas")
+	defer close()
+
+	frozen := time.Date(2018, time.March, 4, 12, 30, 0, 0, time.UTC)
+
+	m.Expect("build").AndFakeTime(frozen).AndCallFunc(func(c *bintest.Call) {
+		fmt.Fprintf(c.Stdout, "%s %s", c.GetEnv("SOURCE_DATE_EPOCH"), c.GetEnv("FAKETIME"))
+		c.Exit(0)
+	})
+
+	cmd := exec.Command(m.Path, "build")
+	cmd.Env = append(os.Environ(), "SOURCE_DATE_EPOCH=1")
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Logf("Output: %s", out)
+		t.Fatal(err)
+	}
+
+	if expected := "1520166600 2018-03-04 12:30:00"; string(out) != expected {
+		t.Fatalf("Expected %q, got %q", expected, out)
+	}
+	if m.Check(t) == false {
+		t.Errorf("Assertions should have passed")
+	}
+}
+
+func TestMockWhenUnexpected(t *testing.T) {
+	defer leaktest.Check(t)()
+	m, close := mustMock(t, "llamas")
+	defer close()
+
+	m.Expect("first", "call")
+	m.WhenUnexpected(func(c *bintest.Call) {
+		fmt.Fprint(c.Stdout, "not today")
+		c.Exit(5)
+	})
+
+	_ = exec.Command(m.Path, "first", "call").Run()
+
+	out, err := exec.Command(m.Path, "second", "call").Output()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 5 {
+		t.Fatalf("Expected exit code 5, got %v", err)
+	}
+	if string(out) != "not today" {
+		t.Fatalf("Unexpected output %q", out)
+	}
+
+	mt := &testutil.TestingT{}
+	if m.Check(mt) == true {
+		t.Errorf("Assertions should have failed")
+	}
+	if s := strings.Join(mt.Errors, "\n"); s != `More invocations than expected (1 vs 2)` {
+		t.Errorf("Errors: %q", s)
+	}
+}
+
+func TestMockResetBetweenSubtests(t *testing.T) {
+	defer leaktest.Check(t)()
+	m, close := mustMock(t, "llamas")
+	defer close()
+
+	for _, arg := range []string{"first", "second"} {
+		t.Run(arg, func(t *testing.T) {
+			m.Reset()
+			m.Expect(arg).Once()
+
+			if err := exec.Command(m.Path, arg).Run(); err != nil {
+				t.Fatal(err)
+			}
+
+			if m.Check(t) == false {
+				t.Errorf("Assertions should have passed")
+			}
+			if n := len(m.Invocations()); n != 1 {
+				t.Errorf("Expected 1 invocation, got %d", n)
+			}
+		})
+	}
+}
+
+func TestMockLogsDiffForUnexpectedInvocations(t *testing.T) {
+	defer leaktest.Check(t)()
+	m, close := mustMock(t, "llamas")
+	defer close()
+
+	m.Expect("feed", "alpacas").WithStdin("hay")
+	m.WhenUnexpected(func(c *bintest.Call) {
+		_, _ = io.Copy(io.Discard, c.Stdin)
+		c.Exit(1)
+	})
+
+	cmd := exec.Command(m.Path, "feed", "llamas")
+	cmd.Stdin = strings.NewReader("grass")
+	_ = cmd.Run()
+
+	mt := &testutil.TestingT{}
+	if m.Check(mt) == true {
+		t.Errorf("Assertions should have failed")
+	}
+
+	expected := "Closest expectation:\n" +
+		"  [0] \"feed\"\n" +
+		"- [1] \"alpacas\"\n" +
+		"+ [1] \"llamas\"\n" +
+		"- stdin \"hay\"\n" +
+		"+ stdin \"grass\""
+
+	if s := strings.Join(mt.Logs, "\n"); !strings.Contains(s, expected) {
+		t.Errorf("Logs: %s", s)
+	}
+}
+
+func TestMockAfter(t *testing.T) {
+	defer leaktest.Check(t)()
+	m, close := mustMock(t, "llamas")
+	defer close()
+
+	var mu sync.Mutex
+	var results []bintest.Result
+	m.After(func(i bintest.Invocation, r bintest.Result) error {
+		mu.Lock()
+		defer mu.Unlock()
+		results = append(results, r)
+		if i.Args[0] == "spit" {
+			return fmt.Errorf("No spitting")
+		}
+		return nil
+	})
+
+	m.Expect("eat").AndWriteToStdout("yum").AndWriteToStderr("burp").AndExitWith(3)
+	m.Expect("spit")
+
+	_ = exec.Command(m.Path, "eat").Run()
+	_ = exec.Command(m.Path, "spit").Run()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 results, got %d", len(results))
+	}
+	if r := results[0]; r.ExitCode != 3 || r.StdoutBytes != 3 || r.StderrBytes != 4 || r.Duration <= 0 {
+		t.Errorf("Unexpected result %#v", r)
+	}
+
+	mt := &testutil.TestingT{}
+	if m.Check(mt) == true {
+		t.Errorf("Assertions should have failed")
+	}
+	if s := strings.Join(mt.Errors, "\n"); s != "After middleware failed: No spitting" {
+		t.Errorf("Errors: %q", s)
+	}
+}
+
+func TestMockAfterCanUseTheMock(t *testing.T) {
+	m, cleanup := mustMock(t, "llamas")
+	defer cleanup()
+
+	var mu sync.Mutex
+	var seen []int
+	m.After(func(i bintest.Invocation, r bintest.Result) error {
+		mu.Lock()
+		defer mu.Unlock()
+		seen = append(seen, len(m.Invocations()))
+		_ = m.String()
+		return nil
+	})
+
+	m.Expect("eat").Exactly(2)
+
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 2; i++ {
+			if err := exec.Command(m.Path, "eat").Run(); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out, the after func deadlocked the mock")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(seen) != 2 || seen[0] != 1 || seen[1] != 2 {
+		t.Errorf("Expected the after func to see each invocation, got %v", seen)
+	}
+
+	m.Check(t)
+}
+
+// failNowT records calls to FailNow rather than stopping the goroutine
+type failNowT struct {
+	testutil.TestingT
+	mu        sync.Mutex
+	failedNow bool
+}
+
+func (f *failNowT) Errorf(format string, args ...interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.TestingT.Errorf(format, args...)
+}
+
+func (f *failNowT) FailNow() {
+	f.failedNow = true
+}
+
+func TestMockFailFast(t *testing.T) {
+	defer leaktest.Check(t)()
+	m, close := mustMock(t, "llamas")
+	defer close()
+
+	mt := &failNowT{}
+	m.FailFast(mt)
+	m.Expect("eat", "grass")
+
+	_ = exec.Command(m.Path, "eat", "hay").Run()
+
+	// reported as soon as the call happens, before Check
+	mt.mu.Lock()
+	errs := strings.Join(mt.Errors, "\n")
+	mt.mu.Unlock()
+	if !strings.HasPrefix(errs, `Unexpected call to llamas "eat", "hay"`) {
+		t.Errorf("Errors: %q", errs)
+	}
+
+	if m.Check(mt) == true {
+		t.Errorf("Assertions should have failed")
+	}
+	if !mt.failedNow {
+		t.Errorf("Expected FailNow to be called")
+	}
+}
+
+func TestMockWithOutputFromFile(t *testing.T) {
+	defer leaktest.Check(t)()
+	m, close := mustMock(t, "docker")
+	defer close()
+
+	dir := t.TempDir()
+	stdoutPath := filepath.Join(dir, "inspect.json")
+	stderrPath := filepath.Join(dir, "warnings.txt")
+
+	inspect := strings.Repeat(`{"llamas":"alpacas"}`, 100000)
+	if err := os.WriteFile(stdoutPath, []byte(inspect), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(stderrPath, []byte("warning\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	m.Expect("inspect").
+		AndWriteToStdout("[").
+		AndWriteToStdoutFromFile(stdoutPath).
+		AndWriteToStdout("]").
+		AndWriteToStderrFromFile(stderrPath).
+		Exactly(2)
+
+	for i := 0; i < 2; i++ {
+		var stdout, stderr strings.Builder
+		cmd := exec.Command(m.Path, "inspect")
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			t.Fatal(err)
+		}
+		if stdout.String() != "["+inspect+"]" {
+			t.Fatalf("Unexpected stdout of %d bytes", stdout.Len())
+		}
+		if stderr.String() != "warning\n" {
+			t.Fatalf("Unexpected stderr %q", stderr.String())
+		}
+	}
+
+	m.Check(t)
+}
+
+func TestMockWithOutputFromMissingFile(t *testing.T) {
+	defer leaktest.Check(t)()
+	m, close := mustMock(t, "docker")
+	defer close()
+
+	m.Expect("inspect").AndWriteToStdoutFromFile(filepath.Join(t.TempDir(), "missing.json"))
+
+	out, err := exec.Command(m.Path, "inspect").CombinedOutput()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 1 {
+		t.Fatalf("Expected an exit code of 1, got %v", err)
+	}
+	if !strings.Contains(string(out), "Error writing stdout") {
+		t.Fatalf("Expected an error in the output, got %q", out)
+	}
+}
+
+func TestCallingMockWithExitWithError(t *testing.T) {
+	for _, tc := range []struct {
+		err      error
+		exitCode int
+	}{
+		{errors.New("llamas are angry"), 1},
+		{fmt.Errorf("finding docker: %w", exec.ErrNotFound), 127},
+		{fmt.Errorf("running docker: %w", os.ErrPermission), 126},
+	} {
+		t.Run(tc.err.Error(), func(t *testing.T) {
+			defer leaktest.Check(t)()
+			m, close := mustMock(t, "test")
+			defer close()
+
+			m.Expect().AndCallFunc(func(c *bintest.Call) {
+				c.ExitWithError(tc.err)
+			})
+
+			var stderr strings.Builder
+			cmd := exec.Command(m.Path)
+			cmd.Stderr = &stderr
+
+			err := cmd.Run()
+			if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != tc.exitCode {
+				t.Fatalf("Expected exit code %d, got %v", tc.exitCode, err)
+			}
+			if !strings.Contains(stderr.String(), tc.err.Error()) {
+				t.Fatalf("Expected stderr to contain %q, got %q", tc.err.Error(), stderr.String())
+			}
+
+			m.Check(t)
+
+			if invocationErr := m.Invocations()[0].Err; invocationErr != tc.err {
+				t.Fatalf("Expected the error to be recorded, got %v", invocationErr)
+			}
+		})
+	}
+}
+
+func TestCallingMockWithCopyStdinToStdout(t *testing.T) {
+	defer leaktest.Check(t)()
+	m, close := mustMock(t, "cat")
+	defer close()
+
+	m.Expect().AndCopyStdinToStdout()
+
+	cmd := exec.Command(m.Path)
+	cmd.Stdin = strings.NewReader("llamas\nalpacas\n")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "llamas\nalpacas\n" {
+		t.Fatalf("Unexpected output %q", out)
+	}
+
+	m.Check(t)
+}
+
+func TestCallingMockWithTransformStdin(t *testing.T) {
+	defer leaktest.Check(t)()
+	m, close := mustMock(t, "tr")
+	defer close()
+
+	m.Expect("a-z", "A-Z").AndTransformStdin(bytes.ToUpper).AndExitWith(3)
+
+	cmd := exec.Command(m.Path, "a-z", "A-Z")
+	cmd.Stdin = strings.NewReader("llamas")
+	out, err := cmd.Output()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 3 {
+		t.Fatalf("Expected exit code 3, got %v", err)
+	}
+	if string(out) != "LLAMAS" {
+		t.Fatalf("Unexpected output %q", out)
+	}
+
+	m.Check(t)
+}
+
+func TestCheckAndCloseAll(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	git, err := bintest.NewMock("git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	docker, err := bintest.NewMock("docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ssh, err := bintest.NewMock("ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	git.Expect("fetch").AndExitWith(0)
+	docker.Expect("build").AndExitWith(0)
+	ssh.Expect("connect").AndExitWith(0)
+
+	if err := exec.Command(git.Path, "fetch").Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	mt := &testutil.TestingT{}
+	err = bintest.CheckAndCloseAll(mt, git, docker, ssh)
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	if expected := "Assertion checks failed for docker, ssh"; err.Error() != expected {
+		t.Fatalf("Expected error %q, got %q", expected, err.Error())
+	}
+	if expected := "Assertion checks failed for 2 of 3 mocks: docker, ssh"; mt.Logs[len(mt.Logs)-1] != expected {
+		t.Fatalf("Expected a summary of %q, got %q", expected, mt.Logs)
+	}
+
+	if err := bintest.CloseAll(git, docker); err == nil {
+		t.Fatal("Expected closing closed mocks to fail")
+	}
+}
+
+func TestMockOptionsForOtherConstructors(t *testing.T) {
+	server := bintest.WithIsolatedServer(t)
+	shared, err := bintest.StartServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := bintest.MockOptions{KeepInternalEnv: true}
+
+	for name, tc := range map[string]struct {
+		newMock func() (*bintest.Mock, error)
+		env     []string
+	}{
+		"Server.NewMockWithOptions": {
+			newMock: func() (*bintest.Mock, error) { return server.NewMockWithOptions("llamas", opts) },
+		},
+		"NewMockFromTestMainWithOptions": {
+			newMock: func() (*bintest.Mock, error) { return bintest.NewMockFromTestMainWithOptions("alpacas", opts) },
+			// test binaries don't have the server compiled in
+			env: []string{bintest.ServerEnvVar + `=` + shared.URL, bintest.TokenEnvVar + `=` + shared.Token()},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			m, err := tc.newMock()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				if err := m.Close(); err != nil {
+					t.Error(err)
+				}
+			}()
+
+			var env []string
+			m.Expect().AndCallFunc(func(c *bintest.Call) {
+				env = c.Env
+				c.Exit(0)
+			})
+
+			cmd := exec.Command(m.Path)
+			cmd.Env = append(os.Environ(), bintest.StdinEnvVar+`=`+bintest.StdinNever)
+			cmd.Env = append(cmd.Env, tc.env...)
+			if err := cmd.Run(); err != nil {
+				t.Fatal(err)
+			}
+
+			m.Check(t)
+
+			if _, ok := bintest.GetEnv(bintest.StdinEnvVar, env); !ok {
+				t.Errorf("Expected %s to be kept in the call env", bintest.StdinEnvVar)
+			}
+		})
+	}
+}
+
+func TestCheckAndCloseReturnsEachFailure(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	m, err := bintest.NewMock("git")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.Expect("fetch").AndExitWith(0)
+	m.Expect("push").AndExitWith(0)
+
+	if err := exec.Command(m.Path, "fetch").Run(); err != nil {
+		t.Fatal(err)
+	}
+	_ = exec.Command(m.Path, "pull").Run()
+
+	err = m.CheckAndClose(&testutil.TestingT{})
+
+	var checkErr *bintest.CheckError
+	if !errors.As(err, &checkErr) {
+		t.Fatalf("Expected a *CheckError, got %#v", err)
+	}
+	if len(checkErr.Failures) != 2 {
+		t.Fatalf("Expected 2 failures, got %v", checkErr.Failures)
+	}
+
+	var unmet *bintest.UnmetExpectationError
+	if !errors.As(err, &unmet) {
+		t.Fatalf("Expected an *UnmetExpectationError in %v", err)
+	}
+	if expected := `Expected [git "push"] to be called at least 1 times, got 0`; !strings.HasPrefix(unmet.Error(), expected) {
+		t.Fatalf("Expected %q, got %q", expected, unmet.Error())
+	}
+
+	var unexpected *bintest.UnexpectedInvocationError
+	if !errors.As(err, &unexpected) {
+		t.Fatalf("Expected an *UnexpectedInvocationError in %v", err)
+	}
+	if expected := `Unexpected call to git "pull"`; unexpected.Error() != expected {
+		t.Fatalf("Expected %q, got %q", expected, unexpected.Error())
+	}
+
+	if !strings.HasPrefix(err.Error(), "Assertion checks failed for git\n") {
+		t.Fatalf("Unexpected error %q", err.Error())
+	}
+}
+
+func TestMockExpectNoMoreInteractions(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	m, close := mustMock(t, "git")
+	defer close()
+
+	m.IgnoreUnexpectedInvocations()
+	m.Expect("fetch").Once()
+
+	if err := exec.Command(m.Path, "fetch").Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	m.ExpectNoMoreInteractions()
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(m.Path, "push", "--force")
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err == nil {
+		t.Fatal("Expected a call after ExpectNoMoreInteractions to fail")
+	}
+	if !strings.Contains(stderr.String(), `Unexpected call to git "push", "--force", no more interactions were expected`) {
+		t.Fatalf("Unexpected stderr %q", stderr.String())
+	}
+
+	tt := &testutil.TestingT{}
+	if m.Check(tt) {
+		t.Fatal("Expected check to fail")
+	}
+	if len(tt.Logs) != 1 || !strings.HasPrefix(tt.Logs[0], `Unexpected call to git "push", "--force" after ExpectNoMoreInteractions (at mock_test.go:`) {
+		t.Fatalf("Unexpected logs %q", tt.Logs)
+	}
+	if expected := []string{"More invocations than expected (1 vs 2)"}; !reflect.DeepEqual(tt.Errors, expected) {
+		t.Fatalf("Expected errors %q, got %q", expected, tt.Errors)
+	}
+}
+
+func TestMockCanBeUsedFromCallFuncs(t *testing.T) {
+	defer leaktest.Check(t)()
+	m, close := mustMock(t, "llamas")
+	defer close()
+
+	m.Expect("first").AndExitWith(0)
+	m.Expect("second").AndCallFunc(func(c *bintest.Call) {
+		// the mock isn't locked while calls are responded to
+		fmt.Fprintf(c.Stdout, "%d", len(m.Invocations()))
+		c.Exit(0)
+	})
+
+	if err := exec.Command(m.Path, "first").Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := exec.Command(m.Path, "second").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "1" {
+		t.Errorf("Expected 1 invocation while responding, got %q", out)
+	}
+
+	// the invocation is recorded before the command exits
+	if n := len(m.Invocations()); n != 2 {
+		t.Errorf("Expected 2 invocations, got %d", n)
+	}
+
+	m.Check(t)
+}
+
+// TestMockCallTimeoutWhileWritingOutput is meant to be run with -race, the timeout writes
+// to stderr while the call func is still writing to it
+func TestMockCallTimeoutWhileWritingOutput(t *testing.T) {
+	defer leaktest.Check(t)()
+	m, cleanup := mustMock(t, "llamas")
+	defer cleanup()
+
+	m.WithCallTimeout(100 * time.Millisecond)
+
+	done := make(chan struct{})
+	m.Expect("chatter").AndCallFunc(func(c *bintest.Call) {
+		defer close(done)
+		for start := time.Now(); time.Since(start) < 300*time.Millisecond; {
+			_, _ = io.WriteString(c.Stderr, "llamas\n")
+			time.Sleep(time.Millisecond)
+		}
+	})
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(m.Path, "chatter")
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err == nil {
+		t.Fatal("Expected the call to time out")
+	}
+	if !strings.Contains(stderr.String(), "timed out after 100ms") {
+		t.Fatalf("Expected a timeout error, got %q", stderr.String())
+	}
+
+	<-done
+	if i := m.Invocation(0); i.ExitCode != bintest.CallTimeoutExitCode || i.StderrBytes == 0 {
+		t.Fatalf("Expected a timed out invocation with stderr, got exit code %d and %d bytes", i.ExitCode, i.StderrBytes)
+	}
+	m.Check(t)
+}
+
+func TestMockStressConcurrentCallsAndChecks(t *testing.T) {
+	defer leaktest.Check(t)()
+	m, cleanup := mustMock(t, "llamas")
+	defer cleanup()
+
+	const calls = 20
+
+	m.Expect("eat", bintest.MatchAny()).Exactly(calls).AndCallFunc(func(c *bintest.Call) {
+		c.Exit(0)
+	})
+	m.Expect("sleep").Max(calls).WithMatcherFunc(func(arg ...string) bintest.ArgumentsMatchResult {
+		return bintest.ArgumentsMatchResult{IsMatch: len(arg) == 1 && arg[0] == "sleep", MatchCount: len(arg)}
+	})
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+
+	// check and inspect the mock while it's being called
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			m.Check(&testutil.TestingT{})
+			_ = m.Invocations()
+			_ = m.Report()
+			_ = m.Transcript()
+		}
+	}()
+
+	var calledWg sync.WaitGroup
+	for i := 0; i < calls; i++ {
+		calledWg.Add(1)
+		go func(i int) {
+			defer calledWg.Done()
+			if err := exec.Command(m.Path, "eat", fmt.Sprintf("grass%d", i)).Run(); err != nil {
+				t.Error(err)
+			}
+			_ = exec.Command(m.Path, "sleep").Run()
+		}(i)
+	}
+
+	calledWg.Wait()
+	close(stop)
+	wg.Wait()
+
+	if n := len(m.Invocations()); n != calls*2 {
+		t.Errorf("Expected %d invocations, got %d", calls*2, n)
+	}
+	m.Check(t)
+}
+
 func mustMock(t *testing.T, name string) (*bintest.Mock, func()) {
 	m, err := bintest.NewMock(name)
 	if err != nil {
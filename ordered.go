@@ -0,0 +1,32 @@
+package bintest
+
+import "sync"
+
+// OrderedGroup is a set of expectations that must be called in the order they were
+// declared. Expectations outside of the group, or in other groups, can be called at
+// any point, so order only matters where it needs to
+type OrderedGroup struct {
+	sync.Mutex
+	mock *Mock
+	last *Expectation
+}
+
+// Ordered returns a group of expectations that must be called in order
+func (m *Mock) Ordered() *OrderedGroup {
+	return &OrderedGroup{mock: m}
+}
+
+// Expect creates an expectation that only matches once the previous expectation in the
+// group has been called its minimum number of times
+func (g *OrderedGroup) Expect(args ...interface{}) *Expectation {
+	g.Lock()
+	defer g.Unlock()
+
+	ex := g.mock.Expect(args...)
+	ex.Lock()
+	ex.after = g.last
+	ex.Unlock()
+
+	g.last = ex
+	return ex
+}
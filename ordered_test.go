@@ -0,0 +1,70 @@
+package bintest_test
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/bintest/v3/testutil"
+	"github.com/fortytw2/leaktest"
+)
+
+func TestMockOrderedGroups(t *testing.T) {
+	defer leaktest.Check(t)()
+	m, close := mustMock(t, "git")
+	defer close()
+
+	g1 := m.Ordered()
+	g1.Expect("fetch")
+	g1.Expect("checkout")
+
+	g2 := m.Ordered()
+	g2.Expect("submodule", "sync")
+	g2.Expect("submodule", "update")
+
+	// interleaving across groups is fine
+	for _, args := range [][]string{
+		{"submodule", "sync"},
+		{"fetch"},
+		{"submodule", "update"},
+		{"checkout"},
+	} {
+		if err := exec.Command(m.Path, args...).Run(); err != nil {
+			t.Fatalf("Calling %v failed: %v", args, err)
+		}
+	}
+
+	if m.Check(t) == false {
+		t.Errorf("Assertions should have passed")
+	}
+}
+
+func TestMockOrderedGroupOutOfOrder(t *testing.T) {
+	defer leaktest.Check(t)()
+	m, close := mustMock(t, "git")
+	defer close()
+
+	g := m.Ordered()
+	g.Expect("fetch")
+	g.Expect("checkout")
+
+	out, err := exec.Command(m.Path, "checkout").CombinedOutput()
+	if err == nil {
+		t.Fatalf("Expected checkout before fetch to fail")
+	}
+	if !strings.Contains(string(out), `Arguments matched, but [git "fetch"] is expected to be called before it`) {
+		t.Errorf("Unexpected output %q", out)
+	}
+
+	if err := exec.Command(m.Path, "fetch").Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := exec.Command(m.Path, "checkout").Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	mt := &testutil.TestingT{}
+	if m.Check(mt) == true {
+		t.Errorf("Assertions should have failed for the out of order call")
+	}
+}
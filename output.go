@@ -0,0 +1,56 @@
+package bintest
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// output is what an expectation writes to stdout or stderr, made up of strings and files that
+// are written in the order they were added
+type output struct {
+	parts []outputPart
+}
+
+// outputPart is either some data or the path of a file to stream
+type outputPart struct {
+	data []byte
+	path string
+}
+
+func (o *output) writeString(s string) {
+	// merge with a previous string, which is how it worked when it was a single buffer
+	if n := len(o.parts); n > 0 && o.parts[n-1].path == "" {
+		o.parts[n-1].data = append(o.parts[n-1].data, s...)
+		return
+	}
+	o.parts = append(o.parts, outputPart{data: []byte(s)})
+}
+
+func (o *output) writeFile(path string) {
+	o.parts = append(o.parts, outputPart{path: path})
+}
+
+// copyTo writes the output to w, files are opened and streamed each time so that repeated
+// calls get the same output
+func (o *output) copyTo(w io.Writer) error {
+	for _, part := range o.parts {
+		if part.path == "" {
+			if _, err := io.Copy(w, bytes.NewReader(part.data)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		f, err := os.Open(part.path)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, f)
+		_ = f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+//go:build !windows
+
+package bintest
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// processGroupAttr starts a process in its own process group, so that it and any
+// children it spawns can be killed together
+func processGroupAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setpgid: true}
+}
+
+// joinProcessGroup does nothing, processGroupAttr already put p in its own group
+func joinProcessGroup(p *os.Process) (release func()) {
+	return func() {}
+}
+
+// signalProcessGroup sends sig to the process group that p leads
+func signalProcessGroup(p *os.Process, sig syscall.Signal) error {
+	if err := syscall.Kill(-p.Pid, sig); err != nil {
+		return p.Signal(sig)
+	}
+	return nil
+}
+
+// killProcessGroup kills the process group that p leads
+func killProcessGroup(p *os.Process) error {
+	return signalProcessGroup(p, syscall.SIGKILL)
+}
+
+// processExecutable returns the path of the executable a process is running, which is
+// only possible on systems with /proc
+func processExecutable(pid int) string {
+	path, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		return ""
+	}
+	return path
+}
+
+// processCommandLine returns the command line of a process with its arguments separated by
+// spaces, which is only possible on systems with /proc
+func processCommandLine(pid int) string {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return ""
+	}
+	return strings.Join(strings.Split(strings.TrimSuffix(string(b), "\x00"), "\x00"), " ")
+}
+
+// inheritedFiles returns the n files the process inherited after stdin, stdout and stderr
+func inheritedFiles(n int) []*os.File {
+	files := make([]*os.File, n)
+	for i := range files {
+		files[i] = os.NewFile(uintptr(3+i), fmt.Sprintf("fd%d", 3+i))
+	}
+	return files
+}
+
+// isReadOnly returns whether a file was opened for reading only
+func isReadOnly(f *os.File) bool {
+	flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_GETFL, 0)
+	if errno != 0 {
+		return false
+	}
+	return flags&(syscall.O_WRONLY|syscall.O_RDWR) == 0
+}
@@ -0,0 +1,153 @@
+//go:build windows
+
+package bintest
+
+import (
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// processGroupAttr starts a process in a new process group
+func processGroupAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+var (
+	kernel32                     = syscall.NewLazyDLL("kernel32.dll")
+	procCreateJobObjectW         = kernel32.NewProc("CreateJobObjectW")
+	procSetInformationJobObject  = kernel32.NewProc("SetInformationJobObject")
+	procAssignProcessToJobObject = kernel32.NewProc("AssignProcessToJobObject")
+	procTerminateJobObject       = kernel32.NewProc("TerminateJobObject")
+
+	// job objects for processes started with joinProcessGroup, by pid
+	jobs sync.Map
+)
+
+const (
+	jobObjectExtendedLimitInformationClass = 9
+	jobObjectLimitKillOnJobClose           = 0x2000
+	processSetQuota                        = 0x0100
+)
+
+type jobObjectExtendedLimitInformation struct {
+	BasicLimitInformation struct {
+		PerProcessUserTimeLimit int64
+		PerJobUserTimeLimit     int64
+		LimitFlags              uint32
+		MinimumWorkingSetSize   uintptr
+		MaximumWorkingSetSize   uintptr
+		ActiveProcessLimit      uint32
+		Affinity                uintptr
+		PriorityClass           uint32
+		SchedulingClass         uint32
+	}
+	IoInfo                [6]uint64
+	ProcessMemoryLimit    uintptr
+	JobMemoryLimit        uintptr
+	PeakProcessMemoryUsed uintptr
+	PeakJobMemoryUsed     uintptr
+}
+
+// joinProcessGroup puts p in a job object, which Windows uses in place of process groups,
+// so that killProcessGroup kills the children it spawns too. Children spawned before it's
+// called aren't in the job. The returned func releases the job, killing anything left in it
+func joinProcessGroup(p *os.Process) (release func()) {
+	job, _, _ := procCreateJobObjectW.Call(0, 0)
+	if job == 0 {
+		return func() {}
+	}
+
+	var info jobObjectExtendedLimitInformation
+	info.BasicLimitInformation.LimitFlags = jobObjectLimitKillOnJobClose
+	_, _, _ = procSetInformationJobObject.Call(job, jobObjectExtendedLimitInformationClass,
+		uintptr(unsafe.Pointer(&info)), unsafe.Sizeof(info))
+
+	h, err := syscall.OpenProcess(processSetQuota|syscall.PROCESS_TERMINATE, false, uint32(p.Pid))
+	if err != nil {
+		_ = syscall.CloseHandle(syscall.Handle(job))
+		return func() {}
+	}
+	defer syscall.CloseHandle(h)
+
+	if r, _, _ := procAssignProcessToJobObject.Call(job, uintptr(h)); r == 0 {
+		_ = syscall.CloseHandle(syscall.Handle(job))
+		return func() {}
+	}
+
+	jobs.Store(p.Pid, job)
+	return func() {
+		jobs.Delete(p.Pid)
+		_ = syscall.CloseHandle(syscall.Handle(job))
+	}
+}
+
+// signalProcessGroup kills the process group, as Windows can't send it signals
+func signalProcessGroup(p *os.Process, sig syscall.Signal) error {
+	return killProcessGroup(p)
+}
+
+// killProcessGroup kills the job object that p is in, or just p if it isn't in one
+func killProcessGroup(p *os.Process) error {
+	if job, ok := jobs.Load(p.Pid); ok {
+		if r, _, err := procTerminateJobObject.Call(job.(uintptr), 1); r == 0 {
+			return err
+		}
+		return nil
+	}
+	return p.Kill()
+}
+
+// processExecutable isn't supported on Windows, so it always returns an empty string
+func processExecutable(pid int) string {
+	return ""
+}
+
+var procNtQueryInformationProcess = syscall.NewLazyDLL("ntdll.dll").NewProc("NtQueryInformationProcess")
+
+const (
+	// processCommandLineInformation is the PROCESSINFOCLASS for a process's command line
+	processCommandLineInformation = 60
+
+	processQueryLimitedInformation = 0x1000
+)
+
+// processCommandLine returns the command line of a process, or an empty string if it can't
+// be read
+func processCommandLine(pid int) string {
+	h, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(pid))
+	if err != nil {
+		return ""
+	}
+	defer syscall.CloseHandle(h)
+
+	// the result is a UNICODE_STRING followed by the string it points to
+	buf := make([]byte, 64*1024)
+	var n uint32
+	r, _, _ := procNtQueryInformationProcess.Call(uintptr(h), processCommandLineInformation,
+		uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)), uintptr(unsafe.Pointer(&n)))
+	if r != 0 {
+		return ""
+	}
+
+	us := (*struct {
+		Length        uint16
+		MaximumLength uint16
+		Buffer        *uint16
+	})(unsafe.Pointer(&buf[0]))
+	if us.Buffer == nil || us.Length == 0 {
+		return ""
+	}
+	return syscall.UTF16ToString(unsafe.Slice(us.Buffer, us.Length/2))
+}
+
+// inheritedFiles isn't supported on Windows, which doesn't pass extra files to children
+func inheritedFiles(n int) []*os.File {
+	return nil
+}
+
+// isReadOnly isn't supported on Windows, so it always returns false
+func isReadOnly(f *os.File) bool {
+	return false
+}
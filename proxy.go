@@ -5,10 +5,13 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -18,6 +21,11 @@ import (
 
 const (
 	ServerEnvVar = `BINTEST_PROXY_SERVER`
+
+	// ParentCallEnvVar is set to the Sequence of a call in the environment of its
+	// passthrough command and of commands from Call.Command, so that calls they make to
+	// proxies are linked to it, see Call.ParentSequence
+	ParentCallEnvVar = `BINTEST_PARENT_CALL`
 )
 
 // Proxy provides a way to programatically respond to invocations of a binary
@@ -28,6 +36,10 @@ type Proxy struct {
 	// Path is the full path to the compiled binproxy file
 	Path string
 
+	// ContentHash is the hex-encoded sha256 of the proxy binary. Binaries are built
+	// reproducibly, so this can be used to cache or distribute them
+	ContentHash string
+
 	// The server that the proxy uses to communicate with the binary
 	Server *Server
 
@@ -37,18 +49,50 @@ type Proxy struct {
 	// A temporary directory created for the binary
 	tempDir string
 
+	// Script wrappers written next to the binary
+	wrappers []string
+
+	// cancelled when the proxy is closed, which cancels any outstanding calls
+	ctx    context.Context
+	cancel context.CancelFunc
+
 	closedMu sync.RWMutex
 	closed   bool
+
+	// closed when Close starts, so dispatch stops waiting for calls to be received
+	closing     chan struct{}
+	closingOnce sync.Once
+
+	// calls that have been dispatched and haven't finished
+	callsMu sync.Mutex
+	calls   map[*Call]struct{}
+
+	// how long calls have to be exited before they are failed, zero for no limit
+	callTimeout int64
 }
 
+// CallTimeoutExitCode is the exit code of calls that time out, see Proxy.WithCallTimeout
+const CallTimeoutExitCode = 124
+
 // CompileProxy generates a mock binary at the provided path.
 // If just a filename is provided a temp directory is created.
 func CompileProxy(path string) (*Proxy, error) {
+	server, err := StartServer()
+	if err != nil {
+		return nil, err
+	}
+
+	return server.CompileProxy(path)
+}
+
+// CompileProxy generates a mock binary at the provided path that uses this server,
+// rather than the shared one
+func (s *Server) CompileProxy(path string) (*Proxy, error) {
 	var tempDir string
 
 	if !filepath.IsAbs(path) {
 		var err error
-		tempDir, err = os.MkdirTemp("", "binproxy")
+		tempDir, err = mkdirTemp("binproxy")
 		if err != nil {
 			return nil, fmt.Errorf("Error creating temp dir: %v", err)
 		}
@@ -59,31 +103,30 @@ func CompileProxy(path string) (*Proxy, error) {
 		path += ".exe"
 	}
 
-	server, err := StartServer()
+	hash, err := compileClient(path, s.clientVars())
 	if err != nil {
 		return nil, err
 	}
 
-	err = compileClient(path, []string{
-		"main.server=" + server.URL,
-	})
-	if err != nil {
-		return nil, err
-	}
+	ctx, cancel := context.WithCancel(context.Background())
 
 	p := &Proxy{
-		Path:    path,
-		Ch:      make(chan *Call),
-		Server:  server,
-		tempDir: tempDir,
+		Path:        path,
+		ContentHash: hash,
+		Ch:          make(chan *Call),
+		Server:      s,
+		tempDir:     tempDir,
+		ctx:         ctx,
+		cancel:      cancel,
+		closing:     make(chan struct{}),
 	}
 
-	server.registerProxy(p)
+	s.registerProxy(p)
 
 	// If the proxy is a symlink (for instance in a temp dir that is symlinked like macos)
 	// we register an alias for the actual underlying binary
 	if resolved, err := filepath.EvalSymlinks(path); err == nil && resolved != path {
-		server.aliasProxy(resolved, path)
+		s.aliasProxy(resolved, path)
 	}
 
 	return p, nil
@@ -104,7 +147,7 @@ func LinkTestBinaryAsProxy(path string) (*Proxy, error) {
 
 	if !filepath.IsAbs(path) {
 		var err error
-		tempDir, err = os.MkdirTemp("", "binproxy")
+		tempDir, err = mkdirTemp("binproxy")
 		if err != nil {
 			return nil, fmt.Errorf("Error creating temp dir: %v", err)
 		}
@@ -115,8 +158,14 @@ func LinkTestBinaryAsProxy(path string) (*Proxy, error) {
 		path += ".exe"
 	}
 
+	return linkTestBinary(path, tempDir)
+}
+
+// linkTestBinary links the current binary to path and registers a proxy for it with the
+// shared server. tempDir is removed when the proxy is closed, if it's set
+func linkTestBinary(path string, tempDir string) (*Proxy, error) {
 	debugf("[linker] Linking %s to %s", os.Args[0], path)
-	if err := os.Symlink(os.Args[0], path); err != nil {
+	if err := replaceLink(os.Args[0], path); err != nil {
 		return nil, err
 	}
 
@@ -125,11 +174,22 @@ func LinkTestBinaryAsProxy(path string) (*Proxy, error) {
 		return nil, err
 	}
 
+	hash, err := fileHash(path)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
 	p := &Proxy{
-		Path:    path,
-		Ch:      make(chan *Call),
-		Server:  server,
-		tempDir: tempDir,
+		Path:        path,
+		ContentHash: hash,
+		Ch:          make(chan *Call),
+		Server:      server,
+		tempDir:     tempDir,
+		ctx:         ctx,
+		cancel:      cancel,
+		closing:     make(chan struct{}),
 	}
 
 	server.registerProxy(p)
@@ -137,11 +197,96 @@ func LinkTestBinaryAsProxy(path string) (*Proxy, error) {
 	return p, nil
 }
 
+// LinkedProxies are proxies for several binaries that are linked to the current binary
+// in a single directory
+type LinkedProxies struct {
+	// Dir is the directory that the binaries are in
+	Dir string
+
+	// Proxies are keyed by the names they were linked as
+	Proxies map[string]*Proxy
+}
+
+// LinkTestBinaryAsProxies is like LinkTestBinaryAsProxy for several names at once. The binaries
+// are created in the same temp directory, and calls are dispatched to the proxy for the name
+// the binary was invoked as
+func LinkTestBinaryAsProxies(names ...string) (*LinkedProxies, error) {
+	tempDir, err := mkdirTemp("binproxy")
+	if err != nil {
+		return nil, fmt.Errorf("Error creating temp dir: %v", err)
+	}
+
+	lp := &LinkedProxies{
+		Dir:     tempDir,
+		Proxies: map[string]*Proxy{},
+	}
+
+	for _, name := range names {
+		if name != filepath.Base(name) {
+			_ = lp.Close()
+			return nil, fmt.Errorf("Expected a name rather than a path, got %q", name)
+		}
+
+		path := filepath.Join(tempDir, name)
+		if runtime.GOOS == "windows" && !strings.HasSuffix(path, ".exe") {
+			path += ".exe"
+		}
+
+		p, err := linkTestBinary(path, "")
+		if err != nil {
+			_ = lp.Close()
+			return nil, err
+		}
+		lp.Proxies[name] = p
+	}
+
+	return lp, nil
+}
+
+// Get returns the proxy for name, or nil if it wasn't linked
+func (lp *LinkedProxies) Get(name string) *Proxy {
+	return lp.Proxies[name]
+}
+
+// Environ returns environment variables required to invoke the proxies, including a PATH
+// with the directory of the proxies at the front
+func (lp *LinkedProxies) Environ() []string {
+	var env []string
+	for _, p := range lp.Proxies {
+		env = p.Environ()
+		break
+	}
+
+	return append(env, "PATH="+lp.Dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// Close closes all of the proxies and removes the directory they are in
+func (lp *LinkedProxies) Close() error {
+	var firstErr error
+	for _, p := range lp.Proxies {
+		if err := p.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if err := os.RemoveAll(lp.Dir); err != nil && firstErr == nil {
+		firstErr = err
+	}
+
+	return firstErr
+}
+
 // Environ returns environment variables required to invoke the proxy
 func (p *Proxy) Environ() []string {
 	env := []string{
 		ServerEnvVar + `=` + p.Server.URL,
 	}
+	if token := p.Server.Token(); token != "" {
+		env = append(env, TokenEnvVar+`=`+token)
+	}
+	if bundle := p.Server.clientTLSBundle(); bundle != "" {
+		env = append(env, TLSEnvVar+`=`+bundle)
+	}
 
 	// Windows requires certain env variables to be present for subprocesses 🤷🏼‍♂️
 	if runtime.GOOS == "windows" {
@@ -158,33 +303,150 @@ func (p *Proxy) Environ() []string {
 	return env
 }
 
+// callSequence is the sequence number of the last call to any proxy in the process
+var callSequence uint64
+
 func (p *Proxy) newCall(pid int, args []string, env []string, dir string) *Call {
 	atomic.AddInt64(&p.CallCount, 1)
 
-	return &Call{
-		PID:        pid,
-		Name:       filepath.Base(p.Path),
-		Args:       args,
-		Env:        env,
-		Dir:        dir,
-		exitCodeCh: make(chan int),
-		doneCh:     make(chan struct{}),
+	ctx, cancel := context.WithCancel(p.ctx)
+
+	parent, _ := GetEnv(ParentCallEnvVar, env)
+	parentSequence, _ := strconv.ParseUint(parent, 10, 64)
+
+	c := &Call{
+		PID:            pid,
+		ParentSequence: parentSequence,
+		Sequence:       atomic.AddUint64(&callSequence, 1),
+		Name:           filepath.Base(p.Path),
+		Args:           args,
+		Env:            env,
+		Dir:            dir,
+		exitCodeCh:     make(chan int),
+		doneCh:         make(chan struct{}),
+		ctx:            ctx,
+		cancel:         cancel,
+		logger:         p.Server.getLogger(),
+		startedAt:      time.Now(),
+	}
+
+	p.callsMu.Lock()
+	if p.calls == nil {
+		p.calls = map[*Call]struct{}{}
 	}
+	p.calls[c] = struct{}{}
+	p.callsMu.Unlock()
+
+	context.AfterFunc(ctx, func() {
+		p.callsMu.Lock()
+		delete(p.calls, c)
+		p.callsMu.Unlock()
+	})
+
+	return c
+}
+
+// pendingCalls returns the calls that haven't been exited, oldest first
+func (p *Proxy) pendingCalls() []*Call {
+	p.callsMu.Lock()
+	defer p.callsMu.Unlock()
+
+	var pending []*Call
+	for c := range p.calls {
+		if atomic.LoadUint32(&c.done) == 0 {
+			pending = append(pending, c)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].Sequence < pending[j].Sequence
+	})
+	return pending
+}
+
+// WithCallTimeout fails calls that aren't exited within d, which happens when nothing
+// receives them from Ch or the code handling them never calls Exit. The proxied binary gets
+// an error on stderr and exits with CallTimeoutExitCode rather than hanging. Zero disables it
+func (p *Proxy) WithCallTimeout(d time.Duration) *Proxy {
+	atomic.StoreInt64(&p.callTimeout, int64(d))
+	return p
 }
 
 func (p *Proxy) dispatch(c *Call) {
+	// closed if the call times out, the server needs dispatch to return to receive its exit code
+	expired := make(chan struct{})
+
+	if timeout := time.Duration(atomic.LoadInt64(&p.callTimeout)); timeout > 0 {
+		// handlers can change the call once they receive it, so describe it up front
+		args := c.Args
+		if len(args) > 0 {
+			args = args[1:]
+		}
+		desc := fmt.Sprintf("%s %s", c.Name, FormatStrings(args))
+		color := useColor(c.Env, c.StderrIsTerminal)
+		stdout, stderr := c.Stdout, c.Stderr
+
+		timer := time.AfterFunc(timeout, func() {
+			close(expired)
+			c.timeout(timeout, desc, color, stdout, stderr)
+		})
+		context.AfterFunc(c.ctx, func() {
+			timer.Stop()
+		})
+	}
+
 	// The server can be serving a request while the proxy is being closed,
 	// causing a data race between closing the channel and concurrently sending
 	// to it.
 	p.closedMu.RLock()
 	if !p.closed {
-		p.Ch <- c
+		select {
+		case p.Ch <- c:
+			atomic.StoreUint32(&c.received, 1)
+		case <-expired:
+			c.debugf("Call timed out before it was received from the proxy")
+		case <-c.ctx.Done():
+			c.debugf("Call finished before it was received from the proxy")
+		case <-p.closing:
+			c.debugf("Proxy was closed before the call was received")
+		}
 	}
 	p.closedMu.RUnlock()
 }
 
+// ServeContext dispatches calls from the proxy to handler, each in its own goroutine, until
+// ctx is done. Handlers can watch Call.Context to find out if the process that made the call
+// was killed, for instance by exec.CommandContext. Calls that handlers return from without
+// finishing are exited with code 1. Once ctx is done, calls are failed until the proxy is closed
+func ServeContext(ctx context.Context, p *Proxy, handler func(*Call)) error {
+	for {
+		select {
+		case call, ok := <-p.Ch:
+			if !ok {
+				return nil
+			}
+			go func() {
+				handler(call)
+				if !call.IsDone() {
+					call.debugf("Handler returned without finishing the call")
+					call.Exit(1)
+				}
+			}()
+		case <-ctx.Done():
+			go func() {
+				for call := range p.Ch {
+					call.Fatal(ctx.Err())
+				}
+			}()
+			return ctx.Err()
+		}
+	}
+}
+
 // Close the proxy and remove the temp directory.
 func (p *Proxy) Close() error {
+	// Stop dispatch waiting on calls that nothing will receive, it holds closedMu until then
+	p.closingOnce.Do(func() { close(p.closing) })
+
 	// Prevent the proxy from dispatching further calls.
 	p.closedMu.Lock()
 	if p.closed {
@@ -193,24 +455,128 @@ func (p *Proxy) Close() error {
 	}
 	close(p.Ch)
 	p.closed = true
+	wrappers := p.wrappers
 	p.closedMu.Unlock()
 
+	pendingErr := newPendingCallsError(p.pendingCalls())
+
+	// Cancel outstanding calls, which kills any passthrough processes
+	p.cancel()
+
 	p.Server.deregisterProxy(p)
 
+	for _, wrapper := range wrappers {
+		_ = os.Remove(wrapper)
+	}
+
 	if p.tempDir == "" {
+		return pendingErr
+	}
+	return errors.Join(pendingErr, os.RemoveAll(p.tempDir))
+}
+
+// CloseAndExitPending is like Close, but calls that haven't been exited are first exited
+// with code, so the proxied binaries finish with it rather than an error. It still returns
+// a *PendingCallsError for them
+func (p *Proxy) CloseAndExitPending(code int) error {
+	pending := p.pendingCalls()
+
+	var wg sync.WaitGroup
+	for _, c := range pending {
+		wg.Add(1)
+		go func(c *Call) {
+			defer wg.Done()
+			c.debugf("Exiting pending call with %d as the proxy is closing", code)
+			c.exit(code)
+		}(c)
+	}
+
+	// calls whose client has stopped listening are cancelled by Close instead
+	waited := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(pendingExitTimeout):
+	}
+
+	err := p.Close()
+	<-waited
+
+	// the calls were exited before Close looked for them, so report them here
+	return errors.Join(newPendingCallsError(pending), err)
+}
+
+// pendingExitTimeout is how long CloseAndExitPending waits for clients to get exit codes
+const pendingExitTimeout = 5 * time.Second
+
+// PendingCallsError is returned by Close when calls were still waiting for an exit code,
+// usually because the code handling them didn't call Exit
+type PendingCallsError struct {
+	Calls []PendingCall
+}
+
+// PendingCall is a call that hadn't been exited when its proxy was closed
+type PendingCall struct {
+	Name    string
+	Args    []string
+	Pending time.Duration
+}
+
+func newPendingCallsError(calls []*Call) error {
+	if len(calls) == 0 {
 		return nil
 	}
-	return os.RemoveAll(p.tempDir)
+	err := &PendingCallsError{}
+	for _, c := range calls {
+		err.Calls = append(err.Calls, PendingCall{
+			Name:    c.Name,
+			Args:    c.Args,
+			Pending: time.Since(c.startedAt).Round(time.Millisecond),
+		})
+	}
+	return err
+}
+
+func (e *PendingCallsError) Error() string {
+	lines := []string{fmt.Sprintf("%d calls hadn't been exited when the proxy was closed", len(e.Calls))}
+	for _, c := range e.Calls {
+		args := c.Args
+		if len(args) > 0 {
+			args = args[1:]
+		}
+		lines = append(lines, fmt.Sprintf("%s %s (pending for %v)", c.Name, FormatStrings(args), c.Pending))
+	}
+	return strings.Join(lines, "\n")
 }
 
 // Call is created for every call to the proxied binary
 type Call struct {
 	PID  int
 	Name string
+
+	// Sequence increases with every call to any proxy in the process, starting at 1, so it
+	// can be used to order calls to different binaries
+	Sequence uint64
+
+	// ParentSequence is the Sequence of the call whose passthrough command or Call.Command
+	// made this call, or zero if it wasn't made by one
+	ParentSequence uint64
+
 	Args []string
 	Env  []string
 	Dir  string
 
+	// The process that invoked the binary, ParentPath is empty if it couldn't be determined
+	ParentPID  int
+	ParentPath string
+
+	// Caller is the command line of the process that invoked the binary, empty if it
+	// couldn't be determined
+	Caller string
+
 	// Stdout is the output writer to send stdout to in the proxied binary
 	Stdout io.WriteCloser `json:"-"`
 
@@ -220,37 +586,151 @@ type Call struct {
 	// Stdin is the input reader for stdin from the proxied binary
 	Stdin io.ReadCloser `json:"-"`
 
+	// StderrIsTerminal is whether the stderr of the proxied binary is a terminal, which
+	// decides whether errors written to it are colored. See SetErrorStyle
+	StderrIsTerminal bool
+
+	// ExtraFiles are the files the proxied binary forwarded after stdio, ExtraFiles[0] is
+	// fd 3. Files the binary had open read-only can be read, others can be written to. They
+	// are closed when the call exits and are passed on to passthrough commands. See
+	// ExtraFilesEnvVar
+	ExtraFiles []*os.File `json:"-"`
+
 	exitCodeCh chan int
 	doneCh     chan struct{}
 	done       uint32
+	exitCode   int
+	err        error
+
+	// the signal that terminated a passthrough command, see Signal
+	signal syscall.Signal
+
+	// onExit is called when the call exits, before the exit code is sent
+	onExit func()
+
+	// cancelled when the process that made the call goes away
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// functions that customise passthrough commands before they start
+	configureCmd []func(*exec.Cmd)
+
+	// where debug output for the call goes, nil for the package-wide logger
+	logger Logger
+
+	// when the call was created
+	startedAt time.Time
+
+	// set when the call is received from Proxy.Ch, and when it times out
+	received uint32
+	timedOut uint32
+}
+
+// ConfigurePassthrough adds a function that can customise the command that Passthrough
+// runs before it starts, for instance to set SysProcAttr or ExtraFiles. Commands run in
+// their own process group by default, so that children are killed with them
+func (c *Call) ConfigurePassthrough(f func(*exec.Cmd)) {
+	c.configureCmd = append(c.configureCmd, f)
+}
+
+// Command returns a command that runs with the environment and directory of the call, for
+// call funcs that run other commands. Calls it makes to proxies are linked to this call, see
+// ParentSequence. It's killed if the call is cancelled
+func (c *Call) Command(name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(c.ctx, name, args...)
+	cmd.Env = c.childEnv()
+	cmd.Dir = c.Dir
+	return cmd
+}
+
+// childEnv returns the environment for commands run on behalf of the call
+func (c *Call) childEnv() []string {
+	return SetEnv(append([]string(nil), c.Env...), fmt.Sprintf("%s=%d", ParentCallEnvVar, c.Sequence))
+}
+
+// Context returns a context that is cancelled if the process that made the call goes
+// away before the call is finished, for instance if it's killed by exec.CommandContext,
+// or if the proxy is closed
+func (c *Call) Context() context.Context {
+	return c.ctx
 }
 
+// GetEnv returns the value of an environment variable in the call, or an empty string
 func (c *Call) GetEnv(key string) string {
-	for _, e := range c.Env {
-		pair := strings.Split(e, "=")
-		if strings.ToUpper(key) == strings.ToUpper(pair[0]) {
-			return pair[1]
-		}
-	}
-	return ""
+	value, _ := GetEnv(key, c.Env)
+	return value
+}
+
+// EnvMap returns the environment of the call as a map of keys to values
+func (c *Call) EnvMap() map[string]string {
+	return EnvMap(c.Env)
 }
 
 // Exit finishes the call and the proxied binary returns the exit code
 func (c *Call) Exit(code int) {
-	if !atomic.CompareAndSwapUint32(&c.done, 0, 1) {
+	if !c.exit(code) {
+		if atomic.LoadUint32(&c.timedOut) == 1 {
+			c.debugf("Ignoring exit code %d, the call already timed out", code)
+			return
+		}
 		panic("Can't call Exit() on a Call that is already finished")
 	}
+}
+
+// timeout fails the call if it hasn't been exited, see Proxy.WithCallTimeout. It runs
+// alongside the handler, so it uses the stdout and stderr the call was dispatched with rather
+// than the fields, which the handler may have replaced
+func (c *Call) timeout(d time.Duration, desc string, color bool, stdout, stderr io.WriteCloser) {
+	if atomic.LoadUint32(&c.done) == 1 {
+		return
+	}
+	atomic.StoreUint32(&c.timedOut, 1)
+
+	reason := "nothing received it from the proxy"
+	if atomic.LoadUint32(&c.received) == 1 {
+		reason = "it was received but never exited"
+	}
+
+	c.debugf("Timing out call after %v, %s", d, reason)
+	_, _ = io.WriteString(stderr, formatError(color, "Error: Call to %s timed out after %v, %s", desc, d, reason))
+	c.exitClosing(CallTimeoutExitCode, stdout, stderr)
+}
+
+// exit is Exit, returning false rather than panicking if the call is already finished
+func (c *Call) exit(code int) bool {
+	return c.exitClosing(code, c.Stdout, c.Stderr)
+}
+
+// exitClosing is exit, closing stdout and stderr rather than the call's fields
+func (c *Call) exitClosing(code int, stdout, stderr io.WriteCloser) bool {
+	if !atomic.CompareAndSwapUint32(&c.done, 0, 1) {
+		return false
+	}
 
 	c.debugf("Sending exit code %d to server", code)
+	c.exitCode = code
+
+	_ = stderr.Close()
+	_ = stdout.Close()
 
-	_ = c.Stderr.Close()
-	_ = c.Stdout.Close()
+	if c.onExit != nil {
+		c.onExit()
+	}
 
-	// send the exit code to the server
-	c.exitCodeCh <- code
+	// send the exit code to the server and wait for the client to get it, unless
+	// the client has gone away in the meantime
+	select {
+	case c.exitCodeCh <- code:
+		select {
+		case <-c.doneCh:
+		case <-c.ctx.Done():
+		}
+	case <-c.ctx.Done():
+		c.debugf("Client went away before receiving exit code")
+	}
 
-	// wait for the client to get it
-	<-c.doneCh
+	c.cancel()
+	return true
 }
 
 // Fatal exits the call and returns the passed error. If it's a exec.ExitError the exit code is used
@@ -258,30 +738,101 @@ func (c *Call) Fatal(err error) {
 	c.debugf("Fatal error: %v", err)
 	fmt.Fprintf(c.Stderr, "Fatal error: %v", err)
 
-	if exitError, ok := err.(*exec.ExitError); ok {
+	c.err = err
+	if sig, ok := exitSignal(err); ok {
+		c.signal = sig
+		c.Exit(128 + int(sig))
+	} else if exitError, ok := err.(*exec.ExitError); ok {
 		c.Exit(exitError.Sys().(syscall.WaitStatus).ExitStatus())
 	} else {
 		c.Exit(1)
 	}
 }
 
-// Passthrough invokes another local binary and returns the results
+// Signal returns the signal that terminated the passthrough command of the call, or nil
+// if it wasn't terminated by one. Calls whose command is terminated by a signal exit with
+// 128 plus the signal number, like a shell would
+func (c *Call) Signal() os.Signal {
+	if c.signal == 0 {
+		return nil
+	}
+	return c.signal
+}
+
+// exitSignal returns the signal that terminated the command that err is from, if any
+func exitSignal(err error) (syscall.Signal, bool) {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			return ws.Signal(), true
+		}
+	}
+	return 0, false
+}
+
+// ExitWithError writes err to stderr and exits the call with an exit code for it. Exit codes
+// are taken from a wrapped *exec.ExitError, commands that weren't found exit with 127 and ones
+// that couldn't be executed with 126, like a shell would. Anything else exits with 1. The
+// error is recorded on the Invocation. A nil err exits with 0
+func (c *Call) ExitWithError(err error) {
+	if err == nil {
+		c.Exit(0)
+		return
+	}
+
+	c.debugf("Exiting with error: %v", err)
+	fmt.Fprintf(c.Stderr, "%s: %v\n", c.Name, err)
+
+	c.err = err
+	c.Exit(exitCodeForError(err))
+}
+
+// Err returns the error the call was finished with by ExitWithError or Fatal, if any
+func (c *Call) Err() error {
+	return c.err
+}
+
+func exitCodeForError(err error) int {
+	var exitErr *exec.ExitError
+	if sig, ok := exitSignal(err); ok {
+		return 128 + int(sig)
+	}
+	switch {
+	case errors.As(err, &exitErr):
+		if code := exitErr.ExitCode(); code > 0 {
+			return code
+		}
+		return 1
+	case errors.Is(err, exec.ErrNotFound), errors.Is(err, fs.ErrNotExist):
+		return 127
+	case errors.Is(err, fs.ErrPermission):
+		return 126
+	}
+	return 1
+}
+
+// Passthrough invokes another local binary and returns the results. If the call is cancelled
+// first the command is sent SIGINT and the call exits with 130, see Signal
 func (c *Call) Passthrough(path string) {
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(c.ctx)
 	defer cancel()
 
 	c.passthrough(ctx, path, c.Args[1:]...)
 }
 
 // PassthroughWithTimeout invokes another local binary and returns the results, if execution doesn't finish
-// before the timeout the command is killed and an error is returned
+// before the timeout the command is sent SIGTERM and the call exits with 143, see Signal
 func (c *Call) PassthroughWithTimeout(path string, timeout time.Duration) {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	ctx, cancel := context.WithTimeout(c.ctx, timeout)
 	defer cancel()
 
 	c.passthrough(ctx, path, c.Args[1:]...)
 }
 
+// passthroughKillDelay is how long a passthrough command has to exit after it's sent SIGTERM
+// or SIGINT before its process group is killed
+var passthroughKillDelay = 5 * time.Second
+
 func (c *Call) passthrough(ctx context.Context, path string, args ...string) {
 	start := time.Now()
 	ticker := time.NewTicker(time.Second)
@@ -292,26 +843,64 @@ func (c *Call) passthrough(ctx context.Context, path string, args ...string) {
 	}()
 
 	c.debugf("Passing call through to %s %v", path, args)
-	cmd := exec.CommandContext(ctx, path, args...)
-	cmd.Env = c.Env
+	cmd := exec.Command(path, args...)
+	cmd.Env = c.childEnv()
 	cmd.Stdout = c.Stdout
 	cmd.Stderr = c.Stderr
 	cmd.Stdin = c.Stdin
 	cmd.Dir = c.Dir
+	cmd.ExtraFiles = c.ExtraFiles
+
+	// Run in a process group, so that any children of the command are killed with it
+	cmd.SysProcAttr = processGroupAttr()
+
+	for _, f := range c.configureCmd {
+		f(cmd)
+	}
 
 	if err := cmd.Start(); err != nil {
 		c.Fatal(err)
 		return
 	}
 
+	release := joinProcessGroup(cmd.Process)
+
+	// the signal the command was stopped with, if it was stopped
+	stopped := make(chan syscall.Signal, 2)
+	exited := make(chan struct{})
+
 	// Print progress on execution to make debugging easier. We need to check the context because
 	// stopping the ticker won't actually close the
 	go func() {
+		defer release()
 		for {
 			select {
 			case <-ctx.Done():
-				c.debugf("Context is done, gently killing process")
-				_ = cmd.Process.Kill()
+				select {
+				case <-exited:
+					c.debugf("Context is done, killing process group")
+					_ = killProcessGroup(cmd.Process)
+					return
+				default:
+				}
+
+				// stop the command like a shell would, SIGTERM for timeouts and SIGINT if
+				// the caller went away or the proxy was closed
+				sig := syscall.SIGINT
+				if ctx.Err() == context.DeadlineExceeded {
+					sig = syscall.SIGTERM
+				}
+				c.debugf("Context is done, sending %v to process group", sig)
+				stopped <- sig
+				_ = signalProcessGroup(cmd.Process, sig)
+
+				select {
+				case <-exited:
+				case <-time.After(passthroughKillDelay):
+					c.debugf("Process group didn't exit within %v, killing it", passthroughKillDelay)
+					stopped <- syscall.SIGKILL
+				}
+				_ = killProcessGroup(cmd.Process)
 				return
 			case <-ticker.C:
 				c.debugf("Passthrough %s %v has been running for %v", path, c.Args, time.Now().Sub(start))
@@ -320,17 +909,34 @@ func (c *Call) passthrough(ctx context.Context, path string, args ...string) {
 	}()
 
 	c.debugf("Waiting for command to finish")
-	if err := cmd.Wait(); err != nil {
-		if ctx.Err() == context.DeadlineExceeded {
-			c.debugf("Command exceeded deadline")
-			c.Fatal(errors.New("Command exceeded deadline and was killed"))
-			return
-		}
+	err := cmd.Wait()
+	close(exited)
+
+	var sig syscall.Signal
+	for len(stopped) > 0 {
+		sig = <-stopped
+	}
+
+	switch {
+	case sig != 0 && ctx.Err() == context.DeadlineExceeded:
+		c.debugf("Command exceeded deadline")
+		c.exitWithSignal(sig, fmt.Errorf("Command exceeded deadline and was stopped with %v", sig))
+	case sig != 0:
+		c.debugf("Command was cancelled")
+		c.exitWithSignal(sig, fmt.Errorf("Command was cancelled and stopped with %v", sig))
+	case err != nil:
 		c.Fatal(err)
-		return
+	default:
+		c.Exit(0)
 	}
+}
 
-	c.Exit(0)
+// exitWithSignal exits the call for a command that was stopped with sig
+func (c *Call) exitWithSignal(sig syscall.Signal, err error) {
+	fmt.Fprintf(c.Stderr, "Fatal error: %v", err)
+	c.err = err
+	c.signal = sig
+	c.Exit(128 + int(sig))
 }
 
 // IsDone is a non-blocking thread-safe checks whether the call is done.
@@ -339,5 +945,5 @@ func (c *Call) IsDone() bool {
 }
 
 func (c *Call) debugf(pattern string, args ...interface{}) {
-	debugf(fmt.Sprintf("[call %d] %s", c.PID, pattern), args...)
+	logWith(c.logger, LevelDebug, logFields{Phase: "call", Proxy: c.Name, Call: c.Sequence, PID: c.PID}, pattern, args...)
 }
@@ -1,15 +1,20 @@
 package bintest_test
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"os"
 	"os/exec"
 	"reflect"
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
@@ -353,9 +358,8 @@ func TestProxyGetsWorkingDirectoryFromClient(t *testing.T) {
 	}
 
 	call := <-proxy.Ch
-	dir := strings.TrimPrefix(call.Dir, "/private")
-	if dir != tempDir {
-		t.Fatalf("Expected call dir to be %q, got %q", tempDir, dir)
+	if ok, msg := bintest.MatchPath(tempDir).Match(call.Dir); !ok {
+		t.Fatalf("Expected call dir to be %q: %s", tempDir, msg)
 	}
 	call.Exit(0)
 
@@ -527,10 +531,225 @@ func TestProxyWithPassthroughWithTimeout(t *testing.T) {
 	}
 }
 
+func TestProxyWithTransports(t *testing.T) {
+	for _, transport := range []string{bintest.TransportHTTP, bintest.TransportStream, bintest.TransportWebSocket} {
+		t.Run(transport, func(t *testing.T) {
+			defer leaktest.Check(t)()
+
+			proxy, err := bintest.CompileProxy("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				if err := proxy.Close(); err != nil {
+					t.Error(err)
+				}
+			}()
+
+			outBuf := &bytes.Buffer{}
+			errBuf := &bytes.Buffer{}
+
+			cmd := exec.Command(proxy.Path, "test", "arguments")
+			cmd.Env = append(os.Environ(), bintest.TransportEnvVar+"="+transport)
+			cmd.Stdin = strings.NewReader("This is my stdin\n")
+			cmd.Stdout = outBuf
+			cmd.Stderr = errBuf
+
+			if err = cmd.Start(); err != nil {
+				t.Fatal(err)
+			}
+
+			call := <-proxy.Ch
+			if !reflect.DeepEqual(call.Args[1:], []string{"test", "arguments"}) {
+				t.Errorf("Unexpected args %v", call.Args)
+			}
+			fmt.Fprintln(call.Stderr, "Copied to stderr")
+			_, _ = io.Copy(call.Stdout, call.Stdin)
+			call.Exit(24)
+
+			err = cmd.Wait()
+			if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 24 {
+				t.Fatalf("Expected exit code 24, got %v", err)
+			}
+
+			if expected := "This is my stdin\n"; outBuf.String() != expected {
+				t.Fatalf("Expected stdout to be %q, got %q", expected, outBuf.String())
+			}
+			if expected := "Copied to stderr\n"; errBuf.String() != expected {
+				t.Fatalf("Expected stderr to be %q, got %q", expected, errBuf.String())
+			}
+		})
+	}
+}
+
+func TestProxyWithCombinedOutput(t *testing.T) {
+	for _, transport := range []string{bintest.TransportHTTP, bintest.TransportStream, bintest.TransportWebSocket} {
+		t.Run(transport, func(t *testing.T) {
+			defer leaktest.Check(t)()
+
+			proxy, err := bintest.CompileProxy("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				if err := proxy.Close(); err != nil {
+					t.Error(err)
+				}
+			}()
+
+			cmd := exec.Command(proxy.Path)
+			cmd.Env = append(os.Environ(),
+				bintest.TransportEnvVar+"="+transport,
+				bintest.CombinedOutputEnvVar+"=true",
+			)
+
+			var expected strings.Builder
+			go func() {
+				call := <-proxy.Ch
+				for i := 0; i < 50; i++ {
+					fmt.Fprintf(call.Stdout, "out %d\n", i)
+					fmt.Fprintf(call.Stderr, "err %d\n", i)
+				}
+				call.Exit(0)
+			}()
+			for i := 0; i < 50; i++ {
+				fmt.Fprintf(&expected, "out %d\nerr %d\n", i, i)
+			}
+
+			out, err := cmd.CombinedOutput()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != expected.String() {
+				t.Fatalf("Expected interleaved output, got %q", out)
+			}
+		})
+	}
+}
+
+// statusDLLNotFound is the NTSTATUS 0xC0000135 as an int32, which fits in an int on 32-bit
+// platforms too
+const statusDLLNotFound = -1073741515
+
+// exitCodeAsSeen is the exit code a parent sees when a process exits with code, windows
+// keeps all 32 bits and treats them as unsigned, other systems only keep the low 8 bits
+func exitCodeAsSeen(code int) int {
+	if runtime.GOOS == "windows" {
+		return int(uint32(code))
+	}
+	return code & 0xff
+}
+
+func TestProxyRoundTripsExitCodes(t *testing.T) {
+	for _, transport := range []string{bintest.TransportHTTP, bintest.TransportStream, bintest.TransportWebSocket} {
+		t.Run(transport, func(t *testing.T) {
+			defer leaktest.Check(t)()
+
+			proxy, err := bintest.CompileProxy("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				if err := proxy.Close(); err != nil {
+					t.Error(err)
+				}
+			}()
+
+			for _, code := range []int{255, 300, -1, statusDLLNotFound} {
+				cmd := exec.Command(proxy.Path)
+				cmd.Env = append(os.Environ(), bintest.TransportEnvVar+"="+transport)
+				if err = cmd.Start(); err != nil {
+					t.Fatal(err)
+				}
+
+				call := <-proxy.Ch
+				call.Exit(code)
+
+				err = cmd.Wait()
+				exitErr, ok := err.(*exec.ExitError)
+				if !ok {
+					t.Fatalf("Expected an exit error for %d, got %v", code, err)
+				}
+				if expected := exitCodeAsSeen(code); exitErr.ExitCode() != expected {
+					t.Errorf("Expected exit code %d for %d, got %d", expected, code, exitErr.ExitCode())
+				}
+			}
+		})
+	}
+}
+
+func TestProxyWithInteractiveStdin(t *testing.T) {
+	for _, transport := range []string{bintest.TransportHTTP, bintest.TransportStream, bintest.TransportWebSocket} {
+		t.Run(transport, func(t *testing.T) {
+			defer leaktest.Check(t)()
+
+			proxy, err := bintest.CompileProxy("git")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				if err := proxy.Close(); err != nil {
+					t.Error(err)
+				}
+			}()
+
+			cmd := exec.Command(proxy.Path, "credential", "fill")
+			cmd.Env = append(os.Environ(), bintest.TransportEnvVar+"="+transport)
+
+			stdin, err := cmd.StdinPipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			stdout, err := cmd.StdoutPipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err = cmd.Start(); err != nil {
+				t.Fatal(err)
+			}
+
+			go func() {
+				call := <-proxy.Ch
+				r := bufio.NewReader(call.Stdin)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						break
+					}
+					fmt.Fprintf(call.Stdout, "got %s", line)
+				}
+				call.Exit(0)
+			}()
+
+			// each line has to make it to the call and back before the next is written
+			out := bufio.NewReader(stdout)
+			for _, line := range []string{"protocol=https\n", "host=github.com\n"} {
+				if _, err := io.WriteString(stdin, line); err != nil {
+					t.Fatal(err)
+				}
+				response, err := out.ReadString('\n')
+				if err != nil {
+					t.Fatal(err)
+				}
+				if expected := "got " + line; response != expected {
+					t.Fatalf("Expected %q, got %q", expected, response)
+				}
+			}
+			_ = stdin.Close()
+
+			if err := cmd.Wait(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
 func TestProxyCallingInParallel(t *testing.T) {
 	defer leaktest.Check(t)()
 
 	var wg sync.WaitGroup
+	errs := make(chan error, 3)
 
 	for i := 0; i < 3; i++ {
 		wg.Add(1)
@@ -539,7 +758,8 @@ func TestProxyCallingInParallel(t *testing.T) {
 
 			proxy, err := bintest.LinkTestBinaryAsProxy(fmt.Sprintf("test%d", i))
 			if err != nil {
-				t.Fatal(err)
+				errs <- err
+				return
 			}
 
 			defer func() {
@@ -552,19 +772,25 @@ func TestProxyCallingInParallel(t *testing.T) {
 			cmd.Env = proxy.Environ()
 
 			if err = cmd.Start(); err != nil {
-				t.Fatal(err)
+				errs <- err
+				return
 			}
 
 			call := <-proxy.Ch
 			call.Exit(0)
 
-			if err = cmd.Wait(); err != nil {
-				t.Fatal(err)
-			}
+			errs <- cmd.Wait()
 		}(i)
 	}
 
 	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
 }
 
 func BenchmarkCreatingProxies(b *testing.B) {
@@ -617,3 +843,206 @@ func BenchmarkCallingProxies(b *testing.B) {
 		}
 	}
 }
+
+func ExampleServeContext() {
+	p, err := bintest.CompileProxy("sleep")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer p.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// handle calls until the proxy is closed, a slow call is cancelled when
+	// the process is killed
+	go func() {
+		_ = bintest.ServeContext(ctx, p, func(c *bintest.Call) {
+			select {
+			case <-c.Context().Done():
+			case <-time.After(time.Minute):
+				c.Exit(0)
+			}
+		})
+	}()
+
+	cmdCtx, cmdCancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cmdCancel()
+
+	// how the process is killed depends on the platform
+	err = exec.CommandContext(cmdCtx, p.Path, "60").Run()
+	fmt.Println("killed:", err != nil && cmdCtx.Err() != nil)
+
+	// Output: killed: true
+}
+
+func TestProxyCloseReportsPendingCalls(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	proxy, err := bintest.CompileProxy("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(proxy.Path, "llamas", "rock")
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the call is never exited
+	<-proxy.Ch
+
+	err = proxy.Close()
+
+	var pendingErr *bintest.PendingCallsError
+	if !errors.As(err, &pendingErr) {
+		t.Fatalf("Expected a *PendingCallsError, got %v", err)
+	}
+	if len(pendingErr.Calls) != 1 || !reflect.DeepEqual(pendingErr.Calls[0].Args[1:], []string{"llamas", "rock"}) {
+		t.Fatalf("Unexpected pending calls %#v", pendingErr.Calls)
+	}
+	if !strings.Contains(err.Error(), `test "llamas", "rock" (pending for`) {
+		t.Fatalf("Unexpected error %q", err.Error())
+	}
+
+	if err = cmd.Wait(); err == nil {
+		t.Fatal("Expected the command to fail when its call was cancelled")
+	}
+}
+
+func TestProxyCloseReportsUnreceivedCalls(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	proxy, err := bintest.CompileProxy("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(proxy.Path, "llamas")
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the call is dispatched, but nothing ever receives it from proxy.Ch
+	for atomic.LoadInt64(&proxy.CallCount) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- proxy.Close()
+	}()
+
+	select {
+	case err = <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for Close with a call that was never received")
+	}
+
+	var pendingErr *bintest.PendingCallsError
+	if !errors.As(err, &pendingErr) || len(pendingErr.Calls) != 1 {
+		t.Fatalf("Expected a *PendingCallsError with a call, got %v", err)
+	}
+
+	if err = cmd.Wait(); err == nil {
+		t.Fatal("Expected the command to fail when its call was cancelled")
+	}
+}
+
+func TestProxyCloseAndExitPending(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	proxy, err := bintest.CompileProxy("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(proxy.Path, "llamas")
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	<-proxy.Ch
+
+	var pendingErr *bintest.PendingCallsError
+	if err = proxy.CloseAndExitPending(3); !errors.As(err, &pendingErr) || len(pendingErr.Calls) != 1 {
+		t.Fatalf("Expected a *PendingCallsError with a call, got %v", err)
+	}
+
+	var exitErr *exec.ExitError
+	if err = cmd.Wait(); !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+		t.Fatalf("Expected the command to exit with 3, got %v", err)
+	}
+}
+
+func TestProxyWithCallTimeout(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	proxy, err := bintest.CompileProxy("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := proxy.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	proxy.WithCallTimeout(200 * time.Millisecond)
+
+	run := func(args ...string) (int, string) {
+		t.Helper()
+		var stderr bytes.Buffer
+		cmd := exec.Command(proxy.Path, args...)
+		cmd.Stderr = &stderr
+		err := cmd.Run()
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			t.Fatalf("Expected the command to exit with an error, got %v", err)
+		}
+		return exitErr.ExitCode(), stderr.String()
+	}
+
+	// nothing receives the call
+	code, stderr := run("unreceived")
+	if code != bintest.CallTimeoutExitCode || !strings.Contains(stderr, `Call to test "unreceived" timed out after 200ms, nothing received it`) {
+		t.Fatalf("Unexpected exit code %d and stderr %q", code, stderr)
+	}
+
+	// the call is received but not exited until after it has timed out
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		call := <-proxy.Ch
+		time.Sleep(400 * time.Millisecond)
+		call.Exit(0)
+	}()
+
+	code, stderr = run("unexited")
+	if code != bintest.CallTimeoutExitCode || !strings.Contains(stderr, "it was received but never exited") {
+		t.Fatalf("Unexpected exit code %d and stderr %q", code, stderr)
+	}
+	<-exited
+}
+
+func TestMockRoundTripsWindowsExitCodes(t *testing.T) {
+	defer leaktest.Check(t)()
+	m, close := mustMock(t, "llamas")
+	defer close()
+
+	m.Expect().AndExitWith(statusDLLNotFound)
+
+	err := exec.Command(m.Path).Run()
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		t.Fatalf("Expected an exit error, got %v", err)
+	}
+	if expected := exitCodeAsSeen(statusDLLNotFound); exitErr.ExitCode() != expected {
+		t.Fatalf("Expected exit code %d, got %d", expected, exitErr.ExitCode())
+	}
+	if i := m.Invocation(0); i.ExitCode != statusDLLNotFound {
+		t.Fatalf("Expected invocation exit code %d, got %d", statusDLLNotFound, i.ExitCode)
+	}
+
+	m.Check(t)
+}
@@ -0,0 +1,310 @@
+//go:build !windows
+
+package bintest_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/buildkite/bintest/v3"
+	"github.com/fortytw2/leaktest"
+)
+
+func TestProxyWithPassthroughWithTimeoutKillsChildren(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	proxy, err := bintest.CompileProxy("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := proxy.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	pidFile := filepath.Join(t.TempDir(), "pid")
+
+	cmd := exec.Command(proxy.Path, "-c", "sleep 100 & echo $! > "+pidFile+"; wait")
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	call := <-proxy.Ch
+	call.PassthroughWithTimeout(`/bin/sh`, time.Millisecond*500)
+
+	if err = cmd.Wait(); err == nil {
+		t.Fatalf("Expected an error!")
+	}
+
+	b, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the grandchild is a zombie until it's reaped by init, so poll for it to go away
+	for i := 0; i < 50; i++ {
+		if err := syscall.Kill(pid, 0); err != nil {
+			return
+		}
+		if stat, _ := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid)); strings.Contains(string(stat), ") Z ") {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("Expected grandchild process %d to be killed", pid)
+}
+
+func TestProxyFallsBackToRealBinaryWhenServerIsGone(t *testing.T) {
+	realPath, err := exec.LookPath("echo")
+	if err != nil {
+		t.Skip("No echo in PATH")
+	}
+
+	server := bintest.WithIsolatedServer(t)
+	proxy, err := server.CompileProxy("echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// keep a copy of the proxy around after the server has gone, like a fixture directory would
+	b, err := os.ReadFile(proxy.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixturePath := filepath.Join(t.TempDir(), "echo")
+	if err := os.WriteFile(fixturePath, b, 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(fixturePath, "llamas")
+	cmd.Env = append(os.Environ(),
+		bintest.FallbackEnvVar+"=true",
+		"PATH="+filepath.Dir(fixturePath)+string(os.PathListSeparator)+filepath.Dir(realPath),
+	)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("Expected the real echo to run, got %v: %s", err, out)
+	}
+	if string(out) != "llamas\n" {
+		t.Fatalf("Unexpected output %q", out)
+	}
+}
+
+func TestProxyForwardsExtraFiles(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	for _, passthrough := range []bool{false, true} {
+		t.Run(fmt.Sprintf("Passthrough=%v", passthrough), func(t *testing.T) {
+			proxy, err := bintest.CompileProxy("askpass")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				if err := proxy.Close(); err != nil {
+					t.Error(err)
+				}
+			}()
+
+			inR, inW, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			outR, outW, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cmd := exec.Command(proxy.Path)
+			cmd.Env = append(os.Environ(), bintest.ExtraFilesEnvVar+"=2")
+			cmd.ExtraFiles = []*os.File{inR, outW}
+			if err := cmd.Start(); err != nil {
+				t.Fatal(err)
+			}
+			_ = inR.Close()
+			_ = outW.Close()
+
+			fmt.Fprint(inW, "llamas")
+			_ = inW.Close()
+
+			call := <-proxy.Ch
+			if len(call.ExtraFiles) != 2 {
+				t.Fatalf("Expected 2 extra files, got %d", len(call.ExtraFiles))
+			}
+			if passthrough {
+				sh, err := exec.LookPath("sh")
+				if err != nil {
+					t.Skip(err)
+				}
+				call.Args = []string{call.Args[0], "-c", "tr a-z A-Z <&3 >&4"}
+				call.Passthrough(sh)
+			} else {
+				b, err := io.ReadAll(call.ExtraFiles[0])
+				if err != nil {
+					t.Fatal(err)
+				}
+				fmt.Fprint(call.ExtraFiles[1], strings.ToUpper(string(b)))
+				call.Exit(0)
+			}
+
+			out, err := io.ReadAll(outR)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := cmd.Wait(); err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != "LLAMAS" {
+				t.Fatalf("Expected LLAMAS on fd 4, got %q", out)
+			}
+		})
+	}
+}
+
+func TestMockLeavesUnreadStdinForTheNextReader(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	m, err := bintest.NewMock("llamas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := m.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	m.Expect("ignore").AndExitWith(0)
+	m.Expect("read").AndReadStdin().AndExitWith(0)
+
+	for _, tc := range []struct {
+		arg, expected string
+	}{
+		{"ignore", "line 1\nline 2\n"},
+		{"read", ""},
+	} {
+		// like a while read loop, the command after the mock reads what's left of stdin
+		script := fmt.Sprintf("printf 'line 1\\nline 2\\n' | { %q %s; cat; }", m.Path, tc.arg)
+		out, err := exec.Command("/bin/sh", "-c", script).Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != tc.expected {
+			t.Errorf("Expected %q to be left after %s, got %q", tc.expected, tc.arg, out)
+		}
+	}
+
+	invocations := m.Invocations()
+	if len(invocations) != 2 || len(invocations[0].Stdin) != 0 || string(invocations[1].Stdin) != "line 1\nline 2\n" {
+		t.Fatalf("Unexpected invocations %#v", invocations)
+	}
+	m.Check(t)
+}
+
+func TestMockRecordsCaller(t *testing.T) {
+	if _, err := os.Stat("/proc/self/cmdline"); err != nil {
+		t.Skip("Callers can only be determined with /proc")
+	}
+	defer leaktest.Check(t)()
+
+	m, err := bintest.NewMock("llamas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := m.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	m.Expect("eat").AndExitWith(0)
+
+	// the trailing command stops the shell from replacing itself with the mock
+	script := fmt.Sprintf("%q eat; true", m.Path)
+	if err := exec.Command("/bin/sh", "-c", script).Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	invocations := m.Invocations()
+	if expected := "/bin/sh -c " + script; len(invocations) != 1 || invocations[0].Caller != expected {
+		t.Fatalf("Expected the caller to be %q, got %#v", expected, invocations)
+	}
+	m.Check(t)
+}
+
+func TestProxyWithPassthroughWithTimeoutExitsWithSignal(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	m, err := bintest.NewMock("sleep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := m.CheckAndClose(t); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	m.Expect("100").AndPassthroughWithTimeout(`/bin/sleep`, 100*time.Millisecond)
+
+	var exitErr *exec.ExitError
+	if err := exec.Command(m.Path, "100").Run(); !errors.As(err, &exitErr) || exitErr.ExitCode() != 143 {
+		t.Fatalf("Expected an exit code of 143, got %v", err)
+	}
+
+	invocation := m.Invocation(0)
+	if invocation.ExitCode != 143 || invocation.Signal != syscall.SIGTERM {
+		t.Errorf("Expected the invocation to exit with 143 from SIGTERM, got %d from %v",
+			invocation.ExitCode, invocation.Signal)
+	}
+}
+
+func TestProxyPassthroughCancelledExitsWithSignal(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	proxy, err := bintest.CompileProxy("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(proxy.Path, "100")
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	call := <-proxy.Ch
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		call.Passthrough(`/bin/sleep`)
+	}()
+
+	// give the command time to start, then close the proxy, which cancels the call
+	time.Sleep(100 * time.Millisecond)
+	_ = proxy.Close()
+	<-done
+	_ = cmd.Wait()
+
+	if call.Signal() != syscall.SIGINT {
+		t.Errorf("Expected the command to be stopped with SIGINT, got %v", call.Signal())
+	}
+}
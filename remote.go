@@ -0,0 +1,354 @@
+package bintest
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// remote is the state of the remote expectation API, see Server.EnableRemote
+type remote struct {
+	token string
+	mocks map[string]*Mock
+
+	// the absolute paths that mocks were compiled to, which are the only existing files
+	// that mocks can be created over
+	created map[string]bool
+
+	// where the mocks and their expectations are saved, see Server.PersistRemote
+	statePath string
+	state     map[string]*remoteMockState
+}
+
+// remoteState is how Server.PersistRemote saves the server's token, its certificates and
+// the remote mocks
+type remoteState struct {
+	Token string                      `json:"token"`
+	TLS   *savedTLS                   `json:"tls,omitempty"`
+	Mocks map[string]*remoteMockState `json:"mocks"`
+}
+
+// remoteMockState is how a remote mock is saved by Server.PersistRemote
+type remoteMockState struct {
+	Path         string               `json:"path"`
+	Expectations []ExpectationFixture `json:"expectations,omitempty"`
+}
+
+// RemoteMock describes a mock created with the remote expectation API
+type RemoteMock struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+// RemoteCheck is the result of checking a mock with the remote expectation API
+type RemoteCheck struct {
+	Passed   bool     `json:"passed"`
+	Messages []string `json:"messages,omitempty"`
+	Report   Report   `json:"report"`
+}
+
+// EnableRemote exposes an API under /remote/ on the server for creating mocks and
+// registering expectations, so that a test harness in another language or container can
+// drive mocks. Requests need an "Authorization: Bearer <token>" header. The routes are:
+//
+//	POST   /remote/mocks                      {"path": "git"} creates a mock, see Server.NewMock
+//	POST   /remote/mocks/<name>/expectations  registers a JSON array of ExpectationFixture
+//	GET    /remote/mocks/<name>               returns the mock's Report, with its Transcript
+//	POST   /remote/mocks/<name>/check         checks the mock and returns a RemoteCheck
+//	POST   /remote/mocks/<name>/reset         clears the expectations and invocations
+//	DELETE /remote/mocks/<name>               closes the mock, removing it if it has an absolute path
+//
+// A mock's path is either a name, for a mock in a temp dir, or an absolute path. Mocks
+// aren't created over files that they didn't create, so that a harness can't replace
+// binaries on the host.
+//
+// Calling it with an empty token disables the API and closes the mocks it created
+func (s *Server) EnableRemote(token string) {
+	s.remoteMu.Lock()
+	defer s.remoteMu.Unlock()
+
+	if s.remote != nil {
+		for _, m := range s.remote.mocks {
+			_ = m.Close()
+		}
+	}
+
+	if token == "" {
+		s.remote = nil
+		return
+	}
+	s.remote = &remote{token: token, mocks: map[string]*Mock{}, created: map[string]bool{}, state: map[string]*remoteMockState{}}
+}
+
+// PersistRemote saves the server's token, its certificates if it uses MutualTLS, and the
+// mocks and expectations registered with the remote expectation API to a JSON file at path
+// whenever they change, after restoring any that are already saved there. A long-running
+// server can then be restarted without the harness registering them again, or proxies being
+// compiled again. Invocations and call counts aren't saved. The file holds secrets, so it's
+// only readable by its owner. EnableRemote must be called first
+func (s *Server) PersistRemote(path string) error {
+	s.remoteMu.Lock()
+	defer s.remoteMu.Unlock()
+
+	if s.remote == nil {
+		return errors.New("Remote API isn't enabled")
+	}
+	s.remote.statePath = path
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s.saveRemote()
+	} else if err != nil {
+		return err
+	}
+
+	var saved remoteState
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return fmt.Errorf("Error parsing %s: %v", path, err)
+	}
+
+	if saved.Token != "" {
+		s.setToken(saved.Token)
+	}
+	if saved.TLS != nil && s.tls != nil {
+		if err := s.tls.restore(saved.TLS); err != nil {
+			return fmt.Errorf("Error restoring certificates from %s: %v", path, err)
+		}
+	}
+
+	for _, state := range saved.Mocks {
+		// the mock was compiled there before the restart
+		if filepath.IsAbs(state.Path) {
+			s.remote.created[remoteMockBinary(state.Path)] = true
+		}
+		m, err := s.newRemoteMock(state.Path)
+		if err != nil {
+			return err
+		}
+		m.loadFixtures(state.Expectations)
+		s.remote.state[m.Name].Expectations = state.Expectations
+	}
+
+	return nil
+}
+
+// saveRemote writes the remote mocks to the state file, if there is one
+func (s *Server) saveRemote() error {
+	if s.remote.statePath == "" {
+		return nil
+	}
+
+	state := remoteState{Token: s.Token(), Mocks: s.remote.state}
+	if s.tls != nil {
+		saved, err := s.tls.save()
+		if err != nil {
+			return err
+		}
+		state.TLS = saved
+	}
+
+	b, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write a whole file or nothing, so a crash doesn't lose every mock
+	tmp := s.remote.statePath + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.remote.statePath)
+}
+
+var (
+	errRemoteMockExists = errors.New("A mock with that name already exists")
+	errRemoteMockPath   = errors.New("Can't create a mock at that path")
+)
+
+// newRemoteMock creates a mock for the remote API, failing if one of the same name exists
+func (s *Server) newRemoteMock(path string) (*Mock, error) {
+	// don't compile over a mock that's in use
+	name := strings.TrimSuffix(filepath.Base(path), `.exe`)
+	if _, exists := s.remote.mocks[name]; exists {
+		return nil, fmt.Errorf("%w: %s", errRemoteMockExists, name)
+	}
+
+	if !filepath.IsAbs(path) {
+		// a name, which mustn't lead out of the temp dir it's compiled in
+		if strings.ContainsAny(path, `/\`) || path == "." || path == ".." {
+			return nil, fmt.Errorf("%w: %s isn't a name or an absolute path", errRemoteMockPath, path)
+		}
+	} else if binary := remoteMockBinary(path); !s.remote.created[binary] {
+		if _, err := os.Lstat(binary); err == nil {
+			return nil, fmt.Errorf("%w: %s already exists", errRemoteMockPath, binary)
+		}
+	}
+
+	m, err := s.NewMock(path)
+	if err != nil {
+		return nil, err
+	}
+	if filepath.IsAbs(path) {
+		s.remote.created[remoteMockBinary(path)] = true
+	}
+	s.remote.mocks[m.Name] = m
+	s.remote.state[m.Name] = &remoteMockState{Path: path}
+	return m, nil
+}
+
+// closeRemoteMock closes a mock for the remote API, removing it if it was compiled to an
+// absolute path rather than a temp dir
+func (s *Server) closeRemoteMock(m *Mock) error {
+	err := m.Close()
+	if binary := remoteMockBinary(m.Path); s.remote.created[binary] {
+		delete(s.remote.created, binary)
+		if rmErr := os.Remove(binary); rmErr != nil && !errors.Is(rmErr, fs.ErrNotExist) {
+			err = errors.Join(err, rmErr)
+		}
+	}
+	return err
+}
+
+// remoteMockBinary returns the file that a mock with an absolute path is compiled to
+func remoteMockBinary(path string) string {
+	path = filepath.Clean(path)
+	if runtime.GOOS == "windows" && !strings.HasSuffix(path, ".exe") {
+		path += ".exe"
+	}
+	return path
+}
+
+func (s *Server) handleRemote(w http.ResponseWriter, r *http.Request) {
+	s.remoteMu.Lock()
+	defer s.remoteMu.Unlock()
+
+	if s.remote == nil {
+		http.Error(w, "Remote API isn't enabled", http.StatusNotFound)
+		return
+	}
+
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || subtle.ConstantTimeCompare([]byte(token), []byte(s.remote.token)) != 1 {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/remote/mocks"), "/"), "/")
+
+	switch {
+	case parts[0] == "" && r.Method == http.MethodPost:
+		s.remoteCreateMock(w, r)
+		return
+	case parts[0] == "":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	m, ok := s.remote.mocks[parts[0]]
+	if !ok {
+		http.Error(w, fmt.Sprintf("No mock named %q", parts[0]), http.StatusNotFound)
+		return
+	}
+
+	var action string
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		report := m.Report()
+		report.Transcript = m.Transcript()
+		writeJSON(w, http.StatusOK, report)
+	case action == "" && r.Method == http.MethodDelete:
+		delete(s.remote.mocks, m.Name)
+		delete(s.remote.state, m.Name)
+		if err := errors.Join(s.closeRemoteMock(m), s.saveRemote()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case action == "expectations" && r.Method == http.MethodPost:
+		var fixtures []ExpectationFixture
+		if err := json.NewDecoder(r.Body).Decode(&fixtures); err != nil {
+			http.Error(w, fmt.Sprintf("Error parsing expectations for %s: %v", m.Name, err), http.StatusBadRequest)
+			return
+		}
+		// they were declared by the remote harness rather than by a line of Go
+		for _, ex := range m.loadFixtures(fixtures) {
+			ex.Lock()
+			ex.file, ex.line = "", 0
+			ex.Unlock()
+		}
+		state := s.remote.state[m.Name]
+		state.Expectations = append(state.Expectations, fixtures...)
+		if err := s.saveRemote(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	case action == "check" && r.Method == http.MethodPost:
+		collector := &messageCollector{}
+		err := m.checkErr(collector)
+		writeJSON(w, http.StatusOK, RemoteCheck{
+			Passed:   err == nil,
+			Messages: collector.messages,
+			Report:   m.Report(),
+		})
+	case action == "reset" && r.Method == http.MethodPost:
+		m.Reset()
+		s.remote.state[m.Name].Expectations = nil
+		if err := s.saveRemote(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Unknown route "+r.Method+" "+r.URL.Path, http.StatusNotFound)
+	}
+}
+
+func (s *Server) remoteCreateMock(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Path string `json:"path"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Path == "" {
+		http.Error(w, "Expected a path", http.StatusBadRequest)
+		return
+	}
+
+	m, err := s.newRemoteMock(req.Path)
+	if errors.Is(err, errRemoteMockExists) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if errors.Is(err, errRemoteMockPath) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := s.saveRemote(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, RemoteMock{Name: m.Name, Path: m.Path})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
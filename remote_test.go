@@ -0,0 +1,246 @@
+package bintest_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildkite/bintest/v3"
+)
+
+func remoteRequest(t *testing.T, server *bintest.Server, token, method, path, body string, v interface{}) int {
+	t.Helper()
+
+	req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if v != nil && resp.StatusCode < 300 {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		_, _ = io.Copy(io.Discard, resp.Body)
+	}
+	return resp.StatusCode
+}
+
+func TestRemoteExpectations(t *testing.T) {
+	server := bintest.WithIsolatedServer(t)
+
+	if status := remoteRequest(t, server, "secret", "POST", "/remote/mocks", `{"path":"llamas"}`, nil); status != http.StatusNotFound {
+		t.Fatalf("Expected the remote API to be disabled, got %d", status)
+	}
+
+	server.EnableRemote("secret")
+	defer server.EnableRemote("")
+
+	if status := remoteRequest(t, server, "wrong", "POST", "/remote/mocks", `{"path":"llamas"}`, nil); status != http.StatusUnauthorized {
+		t.Fatalf("Expected a wrong token to be rejected, got %d", status)
+	}
+
+	var mock bintest.RemoteMock
+	if status := remoteRequest(t, server, "secret", "POST", "/remote/mocks", `{"path":"llamas"}`, &mock); status != http.StatusCreated {
+		t.Fatalf("Expected the mock to be created, got %d", status)
+	}
+	if mock.Name != "llamas" || mock.Path == "" {
+		t.Fatalf("Unexpected mock %+v", mock)
+	}
+	if status := remoteRequest(t, server, "secret", "POST", "/remote/mocks", `{"path":"llamas"}`, nil); status != http.StatusConflict {
+		t.Fatalf("Expected a second mock with the same name to conflict, got %d", status)
+	}
+
+	fixtures := `[{"args": ["eat", "grass"], "stdout": "yum"}, {"args": ["sleep"]}]`
+	if status := remoteRequest(t, server, "secret", "POST", "/remote/mocks/llamas/expectations", fixtures, nil); status != http.StatusCreated {
+		t.Fatalf("Expected the expectations to be created, got %d", status)
+	}
+
+	out, err := exec.Command(mock.Path, "eat", "grass").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "yum" {
+		t.Errorf("Unexpected output %q", out)
+	}
+
+	var check bintest.RemoteCheck
+	if status := remoteRequest(t, server, "secret", "POST", "/remote/mocks/llamas/check", "", &check); status != http.StatusOK {
+		t.Fatalf("Expected the check to succeed, got %d", status)
+	}
+	if check.Passed || len(check.Report.Expectations) != 2 || check.Report.Expectations[1].Passed {
+		t.Errorf("Expected the sleep expectation to fail, got %+v", check)
+	}
+	if len(check.Messages) == 0 || !strings.Contains(strings.Join(check.Messages, "\n"), `"sleep"`) {
+		t.Errorf("Expected a message about sleep, got %q", check.Messages)
+	}
+
+	if err := exec.Command(mock.Path, "sleep").Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := remoteRequest(t, server, "secret", "POST", "/remote/mocks/llamas/check", "", &check); status != http.StatusOK || !check.Passed {
+		t.Errorf("Expected the check to pass, got %d %+v", status, check)
+	}
+
+	var report bintest.Report
+	if status := remoteRequest(t, server, "secret", "GET", "/remote/mocks/llamas", "", &report); status != http.StatusOK || len(report.Transcript) != 2 {
+		t.Errorf("Expected a report with 2 invocations, got %d %+v", status, report)
+	}
+
+	if status := remoteRequest(t, server, "secret", "DELETE", "/remote/mocks/llamas", "", nil); status != http.StatusNoContent {
+		t.Errorf("Expected the mock to be closed, got %d", status)
+	}
+	if status := remoteRequest(t, server, "secret", "GET", "/remote/mocks/llamas", "", nil); status != http.StatusNotFound {
+		t.Errorf("Expected the mock to be gone, got %d", status)
+	}
+}
+
+func TestRemoteRefusesToReplaceFiles(t *testing.T) {
+	server := bintest.WithIsolatedServer(t)
+	server.EnableRemote("secret")
+	defer server.EnableRemote("")
+
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "git")
+	if err := os.WriteFile(existing, []byte("the real git"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{existing, "../../git", filepath.Join("bin", "git"), ".."} {
+		body, _ := json.Marshal(map[string]string{"path": path})
+		if status := remoteRequest(t, server, "secret", "POST", "/remote/mocks", string(body), nil); status != http.StatusForbidden {
+			t.Errorf("Expected a mock at %s to be refused, got %d", path, status)
+		}
+	}
+	if b, err := os.ReadFile(existing); err != nil || string(b) != "the real git" {
+		t.Fatalf("Expected %s to be left alone, got %q %v", existing, b, err)
+	}
+
+	// mocks can be created again where they were removed from
+	path := filepath.Join(dir, "llamas")
+	body, _ := json.Marshal(map[string]string{"path": path})
+	for i := 0; i < 2; i++ {
+		var mock bintest.RemoteMock
+		if status := remoteRequest(t, server, "secret", "POST", "/remote/mocks", string(body), &mock); status != http.StatusCreated {
+			t.Fatalf("Expected the mock to be created, got %d", status)
+		}
+		if status := remoteRequest(t, server, "secret", "DELETE", "/remote/mocks/llamas", "", nil); status != http.StatusNoContent {
+			t.Fatalf("Expected the mock to be closed, got %d", status)
+		}
+		if _, err := os.Stat(mock.Path); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("Expected the mock to be removed, got %v", err)
+		}
+	}
+}
+
+func TestRemotePersistsAcrossRestarts(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	mockPath := filepath.Join(t.TempDir(), "llamas")
+
+	first, err := bintest.NewServerOn("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := first.Addr().String()
+
+	first.EnableRemote("secret")
+	if err := first.PersistRemote(statePath); err != nil {
+		t.Fatal(err)
+	}
+
+	var mock bintest.RemoteMock
+	if status := remoteRequest(t, first, "secret", "POST", "/remote/mocks", `{"path":"`+filepath.ToSlash(mockPath)+`"}`, &mock); status != http.StatusCreated {
+		t.Fatalf("Expected the mock to be created, got %d", status)
+	}
+	if status := remoteRequest(t, first, "secret", "POST", "/remote/mocks/llamas/expectations", `[{"args": ["eat"], "stdout": "yum"}]`, nil); status != http.StatusCreated {
+		t.Fatalf("Expected the expectations to be created, got %d", status)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := first.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := bintest.NewServerOn(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := second.Shutdown(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	second.EnableRemote("secret")
+	if err := second.PersistRemote(statePath); err != nil {
+		t.Fatal(err)
+	}
+	if second.Token() != first.Token() {
+		t.Errorf("Expected the restarted server to restore its token")
+	}
+
+	out, err := exec.Command(mock.Path, "eat").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "yum" {
+		t.Errorf("Unexpected output %q", out)
+	}
+
+	var check bintest.RemoteCheck
+	if status := remoteRequest(t, second, "secret", "POST", "/remote/mocks/llamas/check", "", &check); status != http.StatusOK || !check.Passed {
+		t.Errorf("Expected the restored mock to pass, got %d %+v", status, check)
+	}
+}
+
+func TestRemoteRequiresTheBearerScheme(t *testing.T) {
+	server := bintest.WithIsolatedServer(t)
+	server.EnableRemote("secret")
+	defer server.EnableRemote("")
+
+	for _, header := range []string{"secret", "Basic secret", "Bearer", "Bearer wrong"} {
+		req, err := http.NewRequest("GET", server.URL+"/remote/mocks/llamas", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", header)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Expected %q to be rejected, got %s", header, resp.Status)
+		}
+	}
+}
+
+func TestRemoteOnlyServesItsOwnPaths(t *testing.T) {
+	server := bintest.WithIsolatedServer(t)
+	server.EnableRemote("secret")
+	defer server.EnableRemote("")
+
+	// the remote token isn't enough for the rest of the server
+	if status := remoteRequest(t, server, "secret", "GET", "/remote/mocksllamas", "", nil); status != http.StatusUnauthorized {
+		t.Errorf("Expected a path outside of the remote API to need the server's token, got %d", status)
+	}
+}
@@ -0,0 +1,144 @@
+package bintest
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+)
+
+var htmlReportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"argString": FormatStrings,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>bintest report</title>
+<style>
+body { font-family: sans-serif; }
+.failed { color: #b00; }
+.passed { color: #070; }
+pre { background: #f4f4f4; padding: 0.5em; overflow-x: auto; }
+td, th { text-align: left; padding: 0.2em 0.8em 0.2em 0; vertical-align: top; }
+</style>
+</head>
+<body>
+{{- range . }}
+<h2 class="{{ if .Failed }}failed{{ else }}passed{{ end }}">{{ .Name }}</h2>
+{{- if .Expectations }}
+<table>
+<tr><th>Expectation</th><th>Calls</th><th>Result</th></tr>
+{{- range .Expectations }}
+<tr><td><code>{{ .Args }}</code></td><td>{{ .TotalCalls }}</td><td class="{{ if .Passed }}passed{{ else }}failed{{ end }}">{{ if .Passed }}passed{{ else }}{{ range .Messages }}{{ . }}<br>{{ end }}{{ end }}</td></tr>
+{{- end }}
+</table>
+{{- end }}
+{{- range .UnexpectedInvocations }}
+<p class="failed">Unexpected call to <code>{{ argString .Args }}</code></p>
+{{- if .Diff }}
+<pre>{{ .Diff }}</pre>
+{{- end }}
+{{- end }}
+{{- range .Transcript }}
+<details>
+<summary><code>{{ .Name }} {{ argString .Args }}</code> exited {{ .ExitCode }}{{ if not .Expected }} (unexpected){{ end }}</summary>
+{{- if .Stdout }}
+<details><summary>stdout</summary><pre>{{ .Stdout }}</pre></details>
+{{- end }}
+{{- if .Stderr }}
+<details><summary>stderr</summary><pre>{{ .Stderr }}</pre></details>
+{{- end }}
+</details>
+{{- end }}
+{{- end }}
+</body>
+</html>
+`))
+
+// WriteHTML writes the reports to w as an HTML page, with the output of each invocation in
+// collapsible sections, for attaching to CI artifacts
+func WriteHTML(w io.Writer, reports ...Report) error {
+	return htmlReportTemplate.Execute(w, reports)
+}
+
+// WriteMarkdown writes the reports to w as GitHub flavored Markdown, with the output of each
+// invocation in collapsible sections, for job summaries and pull request comments
+func WriteMarkdown(w io.Writer, reports ...Report) error {
+	var b strings.Builder
+	for i, r := range reports {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		status := "✅"
+		if r.Failed() {
+			status = "❌"
+		}
+		fmt.Fprintf(&b, "## %s %s\n", status, r.Name)
+
+		if len(r.Expectations) > 0 {
+			b.WriteString("\n| Expectation | Calls | Result |\n| --- | --- | --- |\n")
+			for _, e := range r.Expectations {
+				result := "passed"
+				if !e.Passed {
+					result = strings.Join(e.Messages, "<br>")
+				}
+				fmt.Fprintf(&b, "| %s | %d | %s |\n", markdownCell(markdownInlineCode(e.Args)), e.TotalCalls, markdownCell(result))
+			}
+		}
+
+		for _, u := range r.UnexpectedInvocations {
+			fmt.Fprintf(&b, "\nUnexpected call to %s\n", markdownInlineCode(FormatStrings(u.Args)))
+			if u.Diff != "" {
+				fmt.Fprintf(&b, "\n%s", markdownCode(u.Diff))
+			}
+		}
+
+		for _, entry := range r.Transcript {
+			unexpected := ""
+			if !entry.Expected {
+				unexpected = " (unexpected)"
+			}
+			fmt.Fprintf(&b, "\n<details>\n<summary><code>%s %s</code> exited %d%s</summary>\n",
+				template.HTMLEscapeString(entry.Name), template.HTMLEscapeString(FormatStrings(entry.Args)), entry.ExitCode, unexpected)
+			if entry.Stdout != "" {
+				fmt.Fprintf(&b, "\nstdout:\n\n%s", markdownCode(entry.Stdout))
+			}
+			if entry.Stderr != "" {
+				fmt.Fprintf(&b, "\nstderr:\n\n%s", markdownCode(entry.Stderr))
+			}
+			b.WriteString("\n</details>\n")
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// markdownCell escapes s for a table cell
+func markdownCell(s string) string {
+	return strings.NewReplacer("|", `\|`, "\n", " ").Replace(s)
+}
+
+// markdownInlineCode returns s as a code span, delimited by more backticks than any run of
+// them in s
+func markdownInlineCode(s string) string {
+	fence := "`"
+	for strings.Contains(s, fence) {
+		fence += "`"
+	}
+	// a space is needed to separate backticks at the ends of s from the fence, and is
+	// stripped from both ends when rendering
+	if strings.HasPrefix(s, "`") || strings.HasSuffix(s, "`") {
+		s = " " + s + " "
+	}
+	return fence + s + fence
+}
+
+// markdownCode returns s as a fenced code block, with a fence longer than any in s
+func markdownCode(s string) string {
+	fence := "```"
+	for strings.Contains(s, fence) {
+		fence += "`"
+	}
+	return fmt.Sprintf("%s\n%s\n%s\n", fence, strings.TrimSuffix(s, "\n"), fence)
+}
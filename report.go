@@ -0,0 +1,196 @@
+package bintest
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Report is a machine-readable description of whether a mock's expectations were met,
+// for CI tooling to aggregate
+type Report struct {
+	Name                  string              `json:"name"`
+	Expectations          []ExpectationReport `json:"expectations"`
+	UnexpectedInvocations []InvocationReport  `json:"unexpectedInvocations,omitempty"`
+
+	// Transcript is every invocation of the mock if it captures output, see
+	// Mock.CaptureOutputLimit
+	Transcript Transcript `json:"transcript,omitempty"`
+}
+
+// ExpectationReport is the outcome of a single expectation
+type ExpectationReport struct {
+	Args       string   `json:"args"`
+	TotalCalls int      `json:"totalCalls"`
+	MinCalls   int      `json:"minCalls"`
+	MaxCalls   int      `json:"maxCalls"`
+	Passed     bool     `json:"passed"`
+	Messages   []string `json:"messages,omitempty"`
+
+	// Where the expectation was registered
+	File string `json:"file,omitempty"`
+	Line int    `json:"line,omitempty"`
+}
+
+// InvocationReport is an invocation that didn't match any expectation
+type InvocationReport struct {
+	Args []string `json:"args"`
+
+	// Diff against the closest expectation, if there is one
+	Diff string `json:"diff,omitempty"`
+}
+
+// Failed returns whether any expectations weren't met or there were unexpected invocations
+func (r Report) Failed() bool {
+	for _, e := range r.Expectations {
+		if !e.Passed {
+			return true
+		}
+	}
+	return len(r.UnexpectedInvocations) > 0
+}
+
+// WriteJSON writes the report to w as indented JSON
+func (r Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// Report describes the expectations of the mock and any unexpected invocations, following
+// the same rules as Check
+func (m *Mock) Report() Report {
+	m.Lock()
+	defer m.Unlock()
+
+	report := Report{Name: m.Name, Expectations: []ExpectationReport{}}
+	if m.outputCaptureLimit > 0 {
+		report.Transcript = m.transcript()
+	}
+
+	for _, expected := range m.expected {
+		collector := &messageCollector{}
+		passed := expected.Check(collector)
+
+		expected.RLock()
+		report.Expectations = append(report.Expectations, ExpectationReport{
+			Args:       expected.arguments.String(),
+			TotalCalls: expected.totalCalls,
+			MinCalls:   expected.minCalls,
+			MaxCalls:   expected.maxCalls,
+			Passed:     passed,
+			Messages:   collector.messages,
+			File:       expected.file,
+			Line:       expected.line,
+		})
+		expected.RUnlock()
+	}
+
+	// Check doesn't consider invocations unexpected if there weren't any expectations
+	if len(m.expected) > 0 && !m.ignoreUnexpected {
+		for _, invocation := range m.invocations {
+			if invocation.Expectation == nil {
+				report.UnexpectedInvocations = append(report.UnexpectedInvocations, InvocationReport{
+					Args: invocation.Args,
+					Diff: m.diffClosest(invocation),
+				})
+			}
+		}
+	}
+
+	return report
+}
+
+// messageCollector is a TestingT that collects messages rather than reporting them
+type messageCollector struct {
+	messages []string
+}
+
+func (c *messageCollector) Logf(format string, args ...interface{}) {
+	c.messages = append(c.messages, fmt.Sprintf(format, args...))
+}
+
+func (c *messageCollector) Errorf(format string, args ...interface{}) {
+	c.messages = append(c.messages, fmt.Sprintf(format, args...))
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	File      string        `xml:"file,attr,omitempty"`
+	Line      int           `xml:"line,attr,omitempty"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Body    string `xml:",chardata"`
+}
+
+// WriteJUnit writes the reports to w as JUnit XML, with a test suite for each mock and
+// a test case for each expectation and unexpected invocation
+func WriteJUnit(w io.Writer, reports ...Report) error {
+	suites := junitTestSuites{}
+
+	for _, r := range reports {
+		suite := junitTestSuite{Name: r.Name}
+
+		for _, e := range r.Expectations {
+			tc := junitTestCase{
+				Name:      fmt.Sprintf("%s %s", r.Name, e.Args),
+				Classname: r.Name,
+				File:      e.File,
+				Line:      e.Line,
+			}
+			if !e.Passed {
+				tc.Failure = &junitFailure{
+					Message: "Expectation not met",
+					Body:    strings.Join(e.Messages, "\n"),
+				}
+			}
+			suite.TestCases = append(suite.TestCases, tc)
+		}
+
+		for _, i := range r.UnexpectedInvocations {
+			suite.TestCases = append(suite.TestCases, junitTestCase{
+				Name:      fmt.Sprintf("%s %s", r.Name, FormatStrings(i.Args)),
+				Classname: r.Name,
+				Failure:   &junitFailure{Message: "Unexpected invocation", Body: i.Diff},
+			})
+		}
+
+		for _, tc := range suite.TestCases {
+			suite.Tests++
+			if tc.Failure != nil {
+				suite.Failures++
+			}
+		}
+
+		suites.Suites = append(suites.Suites, suite)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(suites); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,167 @@
+package bintest_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/bintest/v3"
+	"github.com/fortytw2/leaktest"
+)
+
+func TestMockReport(t *testing.T) {
+	defer leaktest.Check(t)()
+	m, close := mustMock(t, "llamas")
+	defer close()
+
+	m.Expect("eat", "grass").Once()
+	m.Expect("sleep").Once()
+
+	_ = exec.Command(m.Path, "eat", "grass").Run()
+	_ = exec.Command(m.Path, "eat", "hay").Run()
+
+	report := m.Report()
+	if !report.Failed() {
+		t.Fatalf("Expected report to fail")
+	}
+
+	if len(report.Expectations) != 2 {
+		t.Fatalf("Expected 2 expectations, got %d", len(report.Expectations))
+	}
+	if e := report.Expectations[0]; !e.Passed || e.TotalCalls != 1 {
+		t.Errorf("Unexpected expectation %#v", e)
+	}
+	if e := report.Expectations[1]; e.Passed || len(e.Messages) != 1 {
+		t.Errorf("Unexpected expectation %#v", e)
+	}
+
+	if len(report.UnexpectedInvocations) != 1 {
+		t.Fatalf("Expected 1 unexpected invocation, got %d", len(report.UnexpectedInvocations))
+	}
+	if args := report.UnexpectedInvocations[0].Args; !reflect.DeepEqual(args, []string{"eat", "hay"}) {
+		t.Errorf("Unexpected args %v", args)
+	}
+
+	var buf bytes.Buffer
+	if err := report.WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded bintest.Report
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, report) {
+		t.Errorf("Report didn't round trip: %#v", decoded)
+	}
+}
+
+func TestMockReportOnlyHasTranscriptWhenCapturingOutput(t *testing.T) {
+	m, close := mustMock(t, "llamas")
+	defer close()
+
+	m.Expect("eat").AndWriteToStdout("grass").Once()
+
+	if err := exec.Command(m.Path, "eat").Run(); err != nil {
+		t.Fatal(err)
+	}
+	if report := m.Report(); report.Transcript != nil {
+		t.Errorf("Expected no transcript without output capture, got %#v", report.Transcript)
+	}
+
+	m.CaptureOutputLimit(1024)
+	m.Expect("eat").AndWriteToStdout("hay").Once()
+
+	if err := exec.Command(m.Path, "eat").Run(); err != nil {
+		t.Fatal(err)
+	}
+	report := m.Report()
+	if len(report.Transcript) != 2 || report.Transcript[0].Stdout != "" || report.Transcript[1].Stdout != "hay" {
+		t.Errorf("Unexpected transcript %#v", report.Transcript)
+	}
+}
+
+func TestWriteJUnit(t *testing.T) {
+	report := bintest.Report{
+		Name: "llamas",
+		Expectations: []bintest.ExpectationReport{
+			{Args: `"eat"`, Passed: true},
+			{Args: `"sleep"`, Messages: []string{"Expected to be called"}},
+		},
+		UnexpectedInvocations: []bintest.InvocationReport{
+			{Args: []string{"spit"}},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := bintest.WriteJUnit(&buf, report); err != nil {
+		t.Fatal(err)
+	}
+
+	var suites struct {
+		Suites []struct {
+			Name     string `xml:"name,attr"`
+			Tests    int    `xml:"tests,attr"`
+			Failures int    `xml:"failures,attr"`
+		} `xml:"testsuite"`
+	}
+	if err := xml.Unmarshal(buf.Bytes(), &suites); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(suites.Suites) != 1 {
+		t.Fatalf("Expected 1 suite, got %d", len(suites.Suites))
+	}
+	if s := suites.Suites[0]; s.Name != "llamas" || s.Tests != 3 || s.Failures != 2 {
+		t.Errorf("Unexpected suite %+v", s)
+	}
+}
+
+func TestWriteHTMLAndMarkdown(t *testing.T) {
+	report := bintest.Report{
+		Name: "llamas",
+		Expectations: []bintest.ExpectationReport{
+			{Args: `"eat"`, TotalCalls: 1, Passed: true},
+		},
+		UnexpectedInvocations: []bintest.InvocationReport{
+			{Args: []string{"spit", "`hay`"}},
+		},
+		Transcript: bintest.Transcript{
+			{Name: "llamas", Args: []string{"eat"}, Stdout: "<grass>\n", Stderr: "```burp```", Expected: true},
+		},
+	}
+
+	var html bytes.Buffer
+	if err := bintest.WriteHTML(&html, report); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		`<summary><code>llamas &#34;eat&#34;</code> exited 0</summary>`,
+		`<details><summary>stdout</summary><pre>&lt;grass&gt;`,
+	} {
+		if !strings.Contains(html.String(), s) {
+			t.Errorf("Expected HTML to contain %q, got %s", s, html.String())
+		}
+	}
+
+	var md bytes.Buffer
+	if err := bintest.WriteMarkdown(&md, report); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"## ❌ llamas",
+		"| `\"eat\"` | 1 | passed |",
+		"Unexpected call to ``\"spit\", \"`hay`\"``\n",
+		"<summary><code>llamas &#34;eat&#34;</code> exited 0</summary>",
+		"stdout:\n\n```\n<grass>\n```\n",
+		"stderr:\n\n````\n```burp```\n````\n",
+	} {
+		if !strings.Contains(md.String(), s) {
+			t.Errorf("Expected Markdown to contain %q, got %s", s, md.String())
+		}
+	}
+}
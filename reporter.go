@@ -0,0 +1,210 @@
+package bintest
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// Reporter receives a Report each time a mock is checked, to surface failures to CI
+// systems in a structured way
+type Reporter interface {
+	Report(r Report) error
+}
+
+// registeredReporter gives each registration an identity, so it can be removed
+type registeredReporter struct {
+	Reporter
+}
+
+var (
+	reporters   []*registeredReporter
+	reportersMu sync.Mutex
+)
+
+// RegisterReporter adds a reporter that receives reports from every mock that is checked,
+// typically in TestMain. The returned function removes it again
+func RegisterReporter(r Reporter) func() {
+	reportersMu.Lock()
+	defer reportersMu.Unlock()
+
+	entry := &registeredReporter{r}
+	reporters = append(reporters, entry)
+
+	return func() {
+		reportersMu.Lock()
+		defer reportersMu.Unlock()
+		for idx, e := range reporters {
+			if e == entry {
+				reporters = append(reporters[:idx], reporters[idx+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// report sends the mock's report to the registered reporters
+func (m *Mock) report() {
+	reportersMu.Lock()
+	registered := make([]Reporter, len(reporters))
+	for idx, r := range reporters {
+		registered[idx] = r.Reporter
+	}
+	reportersMu.Unlock()
+
+	if len(registered) == 0 {
+		return
+	}
+
+	report := m.Report()
+	for _, r := range registered {
+		if err := r.Report(report); err != nil {
+			errorf("Reporter failed: %v", err)
+		}
+	}
+}
+
+// callSite returns the file and line of the first caller outside of bintest
+func callSite() (string, int) {
+	pcs := make([]uintptr, 16)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs)])
+	for {
+		frame, more := frames.Next()
+		if !strings.HasPrefix(frame.Function, "github.com/buildkite/bintest/v3.") {
+			return frame.File, frame.Line
+		}
+		if !more {
+			return "", 0
+		}
+	}
+}
+
+// CollectingReporter collects reports and writes them all with a write func when it's closed,
+// for formats that describe a whole test run
+type CollectingReporter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	write   func(io.Writer, ...Report) error
+	reports []Report
+}
+
+// NewCollectingReporter returns a reporter that writes the reports to w with write when it's
+// closed, like WriteJUnit
+func NewCollectingReporter(w io.Writer, write func(io.Writer, ...Report) error) *CollectingReporter {
+	return &CollectingReporter{w: w, write: write}
+}
+
+// NewJUnitReporter returns a reporter that writes JUnit XML to w when it's closed
+func NewJUnitReporter(w io.Writer) *CollectingReporter {
+	return NewCollectingReporter(w, WriteJUnit)
+}
+
+// NewHTMLReporter returns a reporter that writes an HTML page to w when it's closed, see
+// WriteHTML
+func NewHTMLReporter(w io.Writer) *CollectingReporter {
+	return NewCollectingReporter(w, WriteHTML)
+}
+
+// NewMarkdownReporter returns a reporter that writes Markdown to w when it's closed, see
+// WriteMarkdown
+func NewMarkdownReporter(w io.Writer) *CollectingReporter {
+	return NewCollectingReporter(w, WriteMarkdown)
+}
+
+// Report collects the report
+func (c *CollectingReporter) Report(r Report) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reports = append(c.reports, r)
+	return nil
+}
+
+// Close writes the collected reports
+func (c *CollectingReporter) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.write(c.w, c.reports...)
+}
+
+// GitHubReporter writes failures as GitHub Actions workflow commands, which show up as
+// annotations on the lines that registered the expectations
+type GitHubReporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewGitHubReporter returns a reporter that writes annotations to w, which should be the
+// stdout of the job
+func NewGitHubReporter(w io.Writer) *GitHubReporter {
+	return &GitHubReporter{w: w}
+}
+
+// Report writes an annotation for each failure in the report
+func (g *GitHubReporter) Report(r Report) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, e := range r.Expectations {
+		if e.Passed {
+			continue
+		}
+		err := g.annotate(e.File, e.Line,
+			fmt.Sprintf("Expectation not met: %s %s", r.Name, e.Args),
+			strings.Join(e.Messages, "\n"))
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, i := range r.UnexpectedInvocations {
+		err := g.annotate("", 0,
+			fmt.Sprintf("Unexpected invocation: %s %s", r.Name, FormatStrings(i.Args)),
+			i.Diff)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (g *GitHubReporter) annotate(file string, line int, title, message string) error {
+	var props []string
+	if file != "" {
+		// Annotations need paths relative to the repository
+		if ws := os.Getenv("GITHUB_WORKSPACE"); ws != "" {
+			if rel, err := filepath.Rel(ws, file); err == nil && !strings.HasPrefix(rel, "..") {
+				file = filepath.ToSlash(rel)
+			}
+		}
+		props = append(props, "file="+escapeAnnotationProperty(file))
+		if line > 0 {
+			props = append(props, fmt.Sprintf("line=%d", line))
+		}
+	}
+	props = append(props, "title="+escapeAnnotationProperty(title))
+
+	if message == "" {
+		message = title
+	}
+
+	_, err := fmt.Fprintf(g.w, "::error %s::%s\n", strings.Join(props, ","), escapeAnnotationData(message))
+	return err
+}
+
+var (
+	annotationDataEscaper = strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A")
+	annotationPropEscaper = strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C")
+)
+
+func escapeAnnotationData(s string) string {
+	return annotationDataEscaper.Replace(s)
+}
+
+func escapeAnnotationProperty(s string) string {
+	return annotationPropEscaper.Replace(s)
+}
@@ -0,0 +1,63 @@
+package bintest_test
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/bintest/v3"
+	"github.com/buildkite/bintest/v3/testutil"
+	"github.com/fortytw2/leaktest"
+)
+
+func TestGitHubReporterAnnotatesExpectCallSite(t *testing.T) {
+	defer leaktest.Check(t)()
+	m, close := mustMock(t, "llamas")
+	defer close()
+
+	// keep paths absolute when running in GitHub Actions
+	t.Setenv("GITHUB_WORKSPACE", "")
+
+	var buf bytes.Buffer
+	defer bintest.RegisterReporter(bintest.NewGitHubReporter(&buf))()
+
+	_, file, line, _ := runtime.Caller(0)
+	m.Expect("eat", "grass")
+
+	if m.Check(&testutil.TestingT{}) == true {
+		t.Fatalf("Assertions should have failed")
+	}
+
+	expected := fmt.Sprintf("::error file=%s,line=%d,title=Expectation not met%%3A llamas \"eat\"%%2C \"grass\"::",
+		file, line+1)
+	if !strings.HasPrefix(buf.String(), expected) {
+		t.Errorf("Unexpected annotation %q, expected prefix %q", buf.String(), expected)
+	}
+}
+
+func TestJUnitReporter(t *testing.T) {
+	defer leaktest.Check(t)()
+	m, close := mustMock(t, "llamas")
+	defer close()
+
+	var buf bytes.Buffer
+	junit := bintest.NewJUnitReporter(&buf)
+	defer bintest.RegisterReporter(junit)()
+
+	m.Expect("eat", "grass")
+	_ = exec.Command(m.Path, "eat", "grass").Run()
+
+	if m.Check(t) == false {
+		t.Fatalf("Assertions should have passed")
+	}
+
+	if err := junit.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `<testsuite name="llamas" tests="1" failures="0">`) {
+		t.Errorf("Unexpected JUnit output %s", buf.String())
+	}
+}
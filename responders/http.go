@@ -0,0 +1,344 @@
+package responders
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/buildkite/bintest/v3"
+)
+
+// HTTPHandler responds to curl and wget by serving their requests with h in the test process,
+// so scripts that download things can be tested without network access. The name the mock
+// was invoked as decides which of them is emulated. The common flags for methods, headers,
+// data, output files, failing and following redirects are supported
+func HTTPHandler(h http.Handler) bintest.Responder {
+	return bintest.ResponderFunc(func(c *bintest.Call) {
+		if strings.TrimSuffix(c.Name, ".exe") == "wget" {
+			respondWget(c, h)
+			return
+		}
+		respondCurl(c, h)
+	})
+}
+
+// HTTPServer is HTTPHandler with the handler of srv, which is called directly rather than
+// over the network
+func HTTPServer(srv *httptest.Server) bintest.Responder {
+	return HTTPHandler(srv.Config.Handler)
+}
+
+// HTTPFixtures is HTTPHandler with bodies keyed by URL, other URLs are not found
+func HTTPFixtures(fixtures map[string]string) bintest.Responder {
+	return HTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := fixtures[r.URL.String()]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = io.WriteString(w, body)
+	}))
+}
+
+// httpRequest is a request parsed from curl or wget arguments
+type httpRequest struct {
+	method  string
+	url     string
+	headers []string
+	data    string
+	hasData bool
+}
+
+// serve makes the request against h, following up to 10 redirects if follow is set
+func (hr httpRequest) serve(h http.Handler, follow bool) (*http.Response, []byte, error) {
+	target := hr.url
+	for redirects := 0; ; redirects++ {
+		var body io.Reader
+		method := hr.method
+		if hr.hasData {
+			body = strings.NewReader(hr.data)
+			if method == "" {
+				method = http.MethodPost
+			}
+		}
+		if method == "" {
+			method = http.MethodGet
+		}
+
+		req, err := http.NewRequest(method, target, body)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, header := range hr.headers {
+			if pair := strings.SplitN(header, ":", 2); len(pair) == 2 {
+				req.Header.Add(strings.TrimSpace(pair[0]), strings.TrimSpace(pair[1]))
+			}
+		}
+		if hr.hasData && req.Header.Get("Content-Type") == "" {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		resp := rec.Result()
+
+		location := resp.Header.Get("Location")
+		if follow && location != "" && resp.StatusCode >= 300 && resp.StatusCode < 400 && redirects < 10 {
+			next, err := req.URL.Parse(location)
+			if err != nil {
+				return nil, nil, err
+			}
+			target = next.String()
+			continue
+		}
+
+		return resp, rec.Body.Bytes(), nil
+	}
+}
+
+// remoteName is the file name that curl -O and wget save a URL as
+func remoteName(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil || path.Base(parsed.Path) == "/" || path.Base(parsed.Path) == "." {
+		return "index.html"
+	}
+	return path.Base(parsed.Path)
+}
+
+// writeOutput writes body to stdout if name is "-", otherwise to name relative to the call's dir
+func writeOutput(c *bintest.Call, name string, body []byte) error {
+	if name == "-" {
+		_, err := c.Stdout.Write(body)
+		return err
+	}
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(c.Dir, name)
+	}
+	return os.WriteFile(name, body, 0o644)
+}
+
+// curlLongValueFlags are the curl flags that take a value, either as the next argument or
+// after an =
+var curlLongValueFlags = map[string]bool{
+	"--request": true, "--header": true, "--data": true, "--data-raw": true,
+	"--data-binary": true, "--output": true, "--write-out": true, "--user": true,
+	"--user-agent": true, "--referer": true, "--max-time": true, "--connect-timeout": true,
+	"--retry": true, "--retry-delay": true,
+}
+
+// curlShortValueFlags are the short curl flags that take a value, and their long names
+var curlShortValueFlags = map[byte]string{
+	'X': "--request", 'H': "--header", 'd': "--data", 'o': "--output", 'w': "--write-out",
+	'u': "--user", 'A': "--user-agent", 'e': "--referer", 'm': "--max-time",
+}
+
+func respondCurl(c *bintest.Call, h http.Handler) {
+	var hr httpRequest
+	var output, writeOut string
+	var remoteOutput, fail, silent, showError, follow bool
+
+	setValue := func(flag, v string) {
+		switch flag {
+		case "--request":
+			hr.method = v
+		case "--header":
+			hr.headers = append(hr.headers, v)
+		case "--data", "--data-raw", "--data-binary":
+			hr.data, hr.hasData = v, true
+		case "--output":
+			output = v
+		case "--write-out":
+			writeOut = v
+		}
+	}
+
+	args := c.Args[1:]
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		value := func() string {
+			if i+1 < len(args) {
+				i++
+				return args[i]
+			}
+			return ""
+		}
+
+		switch {
+		case strings.HasPrefix(arg, "--"):
+			flag, v, hasValue := strings.Cut(arg, "=")
+			if curlLongValueFlags[flag] {
+				if !hasValue {
+					v = value()
+				}
+				setValue(flag, v)
+				continue
+			}
+			switch flag {
+			case "--remote-name":
+				remoteOutput = true
+			case "--fail":
+				fail = true
+			case "--silent":
+				silent = true
+			case "--show-error":
+				showError = true
+			case "--location":
+				follow = true
+			}
+
+		case strings.HasPrefix(arg, "-") && len(arg) > 1:
+			// a cluster of short flags like -fsSL, the first that takes a value takes the
+			// rest of the cluster, like -XPOST, or the next argument
+			for j := 1; j < len(arg); j++ {
+				if flag, ok := curlShortValueFlags[arg[j]]; ok {
+					v := arg[j+1:]
+					if v == "" {
+						v = value()
+					}
+					setValue(flag, v)
+					break
+				}
+				switch arg[j] {
+				case 'O':
+					remoteOutput = true
+				case 'f':
+					fail = true
+				case 's':
+					silent = true
+				case 'S':
+					showError = true
+				case 'L':
+					follow = true
+				}
+			}
+
+		default:
+			hr.url = arg
+		}
+	}
+
+	if hr.url == "" {
+		fmt.Fprintln(c.Stderr, "curl: no URL specified!")
+		c.Exit(2)
+		return
+	}
+
+	resp, body, err := hr.serve(h, follow)
+	if err != nil {
+		fmt.Fprintf(c.Stderr, "curl: (3) URL using bad/illegal format or missing URL: %v\n", err)
+		c.Exit(3)
+		return
+	}
+
+	if fail && resp.StatusCode >= 400 {
+		if !silent || showError {
+			fmt.Fprintf(c.Stderr, "curl: (22) The requested URL returned error: %d\n", resp.StatusCode)
+		}
+		c.Exit(22)
+		return
+	}
+
+	if output == "" {
+		output = "-"
+		if remoteOutput {
+			output = remoteName(hr.url)
+		}
+	}
+	if err := writeOutput(c, output, body); err != nil {
+		fmt.Fprintf(c.Stderr, "curl: (23) Failure writing output to destination: %v\n", err)
+		c.Exit(23)
+		return
+	}
+
+	if writeOut != "" {
+		fmt.Fprint(c.Stdout, strings.ReplaceAll(writeOut, "%{http_code}", fmt.Sprintf("%03d", resp.StatusCode)))
+	}
+	c.Exit(0)
+}
+
+func respondWget(c *bintest.Call, h http.Handler) {
+	var hr httpRequest
+	var output string
+	var quiet bool
+
+	args := c.Args[1:]
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		value := func() string {
+			if i+1 < len(args) {
+				i++
+				return args[i]
+			}
+			return ""
+		}
+
+		switch {
+		case arg == "-O" || arg == "--output-document":
+			output = value()
+		case strings.HasPrefix(arg, "--output-document="):
+			output = strings.TrimPrefix(arg, "--output-document=")
+		case arg == "--header":
+			hr.headers = append(hr.headers, value())
+		case strings.HasPrefix(arg, "--header="):
+			hr.headers = append(hr.headers, strings.TrimPrefix(arg, "--header="))
+		case arg == "--method":
+			hr.method = value()
+		case strings.HasPrefix(arg, "--method="):
+			hr.method = strings.TrimPrefix(arg, "--method=")
+		case arg == "--post-data":
+			hr.data, hr.hasData = value(), true
+		case strings.HasPrefix(arg, "--post-data="):
+			hr.data, hr.hasData = strings.TrimPrefix(arg, "--post-data="), true
+		case arg == "-q" || arg == "--quiet":
+			quiet = true
+		case strings.HasPrefix(arg, "--"):
+		case strings.HasPrefix(arg, "-"):
+			// short flags can be combined, like -qO- or -qO file
+			quiet = quiet || strings.ContainsRune(arg, 'q')
+			if idx := strings.IndexRune(arg, 'O'); idx >= 0 {
+				if output = arg[idx+1:]; output == "" {
+					output = value()
+				}
+			}
+		default:
+			hr.url = arg
+		}
+	}
+
+	if hr.url == "" {
+		fmt.Fprintln(c.Stderr, "wget: missing URL")
+		c.Exit(1)
+		return
+	}
+
+	resp, body, err := hr.serve(h, true)
+	if err != nil {
+		fmt.Fprintf(c.Stderr, "%s: Invalid URL: %v\n", hr.url, err)
+		c.Exit(1)
+		return
+	}
+
+	if resp.StatusCode >= 400 {
+		if !quiet {
+			fmt.Fprintf(c.Stderr, "ERROR %d: %s.\n", resp.StatusCode, http.StatusText(resp.StatusCode))
+		}
+		c.Exit(8)
+		return
+	}
+
+	if output == "" {
+		output = remoteName(hr.url)
+	}
+	if err := writeOutput(c, output, body); err != nil {
+		fmt.Fprintf(c.Stderr, "%s: %v\n", output, err)
+		c.Exit(3)
+		return
+	}
+	c.Exit(0)
+}
@@ -0,0 +1,119 @@
+package responders_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/bintest/v3"
+	"github.com/buildkite/bintest/v3/responders"
+)
+
+func TestHTTPServerWithCurl(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/artifact.tgz":
+			fmt.Fprintf(w, "artifact for %s", r.Header.Get("Authorization"))
+		case "/latest":
+			http.Redirect(w, r, "/artifact.tgz", http.StatusFound)
+		case "/upload":
+			b, _ := io.ReadAll(r.Body)
+			fmt.Fprintf(w, "%s %s", r.Method, b)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	m, err := bintest.NewMock("curl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.CheckAndClose(t)
+
+	m.Expect().WithAnyArguments().AtLeastOnce().Respond(responders.HTTPServer(srv))
+
+	if stdout, _, code := run(t, m, "-fsSL", "-H", "Authorization: llamas", "https://example.com/latest"); code != 0 || stdout != "artifact for llamas" {
+		t.Errorf("Unexpected exit code %d and stdout %q", code, stdout)
+	}
+
+	if stdout, _, code := run(t, m, "-X", "PUT", "-d", "alpacas", "https://example.com/upload"); code != 0 || stdout != "PUT alpacas" {
+		t.Errorf("Unexpected exit code %d and stdout %q", code, stdout)
+	}
+
+	if _, stderr, code := run(t, m, "-fsS", "https://example.com/missing"); code != 22 || stderr != "curl: (22) The requested URL returned error: 404\n" {
+		t.Errorf("Unexpected exit code %d and stderr %q", code, stderr)
+	}
+
+	// values attached to short flags, which aren't clusters of boolean flags
+	if stdout, _, code := run(t, m, "-XPOST", "-dfoo", "https://example.com/upload"); code != 0 || stdout != "POST foo" {
+		t.Errorf("Unexpected exit code %d and stdout %q", code, stdout)
+	}
+	if stdout, _, code := run(t, m, "-sHAuthorization: alpacas", "https://example.com/artifact.tgz"); code != 0 || stdout != "artifact for alpacas" {
+		t.Errorf("Unexpected exit code %d and stdout %q", code, stdout)
+	}
+	if stdout, _, code := run(t, m, "--request=PATCH", "--data=x", "https://example.com/upload"); code != 0 || stdout != "PATCH x" {
+		t.Errorf("Unexpected exit code %d and stdout %q", code, stdout)
+	}
+	if stdout, _, code := run(t, m, "-sw%{http_code}", "https://example.com/missing"); code != 0 || stdout != "404 page not found\n404" {
+		t.Errorf("Unexpected exit code %d and stdout %q", code, stdout)
+	}
+
+	output := filepath.Join(t.TempDir(), "out.tgz")
+	if _, _, code := run(t, m, "-s", "-o", output, "https://example.com/artifact.tgz"); code != 0 {
+		t.Errorf("Unexpected exit code %d", code)
+	}
+	if b, err := os.ReadFile(output); err != nil || string(b) != "artifact for " {
+		t.Errorf("Unexpected output file %q: %v", b, err)
+	}
+
+	for _, args := range [][]string{{"-o" + output}, {"--output=" + output}, {"-uuser:pass", "-o", output}} {
+		_ = os.Remove(output)
+		args = append(args, "-H", "Authorization: vicunas", "https://example.com/artifact.tgz")
+		if stdout, _, code := run(t, m, args...); code != 0 || stdout != "" {
+			t.Errorf("Unexpected exit code %d and stdout %q for %v", code, stdout, args)
+		}
+		if b, err := os.ReadFile(output); err != nil || string(b) != "artifact for vicunas" {
+			t.Errorf("Unexpected output file %q for %v: %v", b, args, err)
+		}
+	}
+}
+
+func TestHTTPFixturesWithWget(t *testing.T) {
+	m, err := bintest.NewMock("wget")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.CheckAndClose(t)
+
+	m.Expect().WithAnyArguments().AtLeastOnce().Respond(responders.HTTPFixtures(map[string]string{
+		"https://example.com/install.sh": "echo llamas",
+	}))
+
+	if stdout, _, code := run(t, m, "-qO-", "https://example.com/install.sh"); code != 0 || stdout != "echo llamas" {
+		t.Errorf("Unexpected exit code %d and stdout %q", code, stdout)
+	}
+
+	if stdout, _, code := run(t, m, "-q", "-O", "-", "https://example.com/install.sh"); code != 0 || stdout != "echo llamas" {
+		t.Errorf("Unexpected exit code %d and stdout %q", code, stdout)
+	}
+
+	dir := t.TempDir()
+	cmd := exec.Command(m.Path, "https://example.com/install.sh")
+	cmd.Dir = dir
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "install.sh")); err != nil || string(b) != "echo llamas" {
+		t.Errorf("Unexpected output file %q: %v", b, err)
+	}
+
+	if _, stderr, code := run(t, m, "https://example.com/missing"); code != 8 || stderr != "ERROR 404: Not Found.\n" {
+		t.Errorf("Unexpected exit code %d and stderr %q", code, stderr)
+	}
+}
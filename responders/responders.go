@@ -0,0 +1,149 @@
+// Package responders has canned responses that emulate common tools, for use with
+// Expectation.Respond
+package responders
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/buildkite/bintest/v3"
+)
+
+// GitRevParse responds to git rev-parse with sha
+func GitRevParse(sha string) bintest.Responder {
+	return bintest.ResponderFunc(func(c *bintest.Call) {
+		fmt.Fprintln(c.Stdout, sha)
+		c.Exit(0)
+	})
+}
+
+// GitLsRemote responds to git ls-remote with refs, which are a map of ref names to shas. Refs
+// are filtered by any patterns after the remote, which match the end of the ref name like git
+func GitLsRemote(refs map[string]string) bintest.Responder {
+	return bintest.ResponderFunc(func(c *bintest.Call) {
+		var patterns []string
+		for idx, arg := range positionalArgs(c.Args[1:]) {
+			// the first positional args are ls-remote and the remote
+			if idx > 1 {
+				patterns = append(patterns, arg)
+			}
+		}
+
+		names := make([]string, 0, len(refs))
+		for name := range refs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			if len(patterns) > 0 && !matchesAny(name, patterns) {
+				continue
+			}
+			fmt.Fprintf(c.Stdout, "%s\t%s\n", refs[name], name)
+		}
+		c.Exit(0)
+	})
+}
+
+// SSHPermissionDenied responds like ssh does when authentication fails
+func SSHPermissionDenied() bintest.Responder {
+	return bintest.ResponderFunc(func(c *bintest.Call) {
+		fmt.Fprintf(c.Stderr, "%s: Permission denied (publickey).\n", sshDestination(c.Args[1:]))
+		c.Exit(255)
+	})
+}
+
+// SSHConnectionRefused responds like ssh does when the host refuses the connection
+func SSHConnectionRefused() bintest.Responder {
+	return bintest.ResponderFunc(func(c *bintest.Call) {
+		host := sshDestination(c.Args[1:])
+		if idx := strings.LastIndex(host, "@"); idx >= 0 {
+			host = host[idx+1:]
+		}
+		fmt.Fprintf(c.Stderr, "ssh: connect to host %s port 22: Connection refused\n", host)
+		c.Exit(255)
+	})
+}
+
+// DockerVersion responds to docker version with version for both the client and server.
+// A --format of {{.Server.Version}} or {{.Client.Version}} outputs just the version
+func DockerVersion(version string) bintest.Responder {
+	return bintest.ResponderFunc(func(c *bintest.Call) {
+		if format, ok := flagValue(c.Args[1:], "--format", "-f"); ok {
+			if strings.Contains(format, ".Version") {
+				fmt.Fprintln(c.Stdout, version)
+				c.Exit(0)
+				return
+			}
+			fmt.Fprintf(c.Stderr, "template: :1: unsupported format %q\n", format)
+			c.Exit(1)
+			return
+		}
+
+		fmt.Fprintf(c.Stdout, "Client:\n Version:           %s\n\nServer:\n Engine:\n  Version:          %s\n", version, version)
+		c.Exit(0)
+	})
+}
+
+// Curl responds to curl with body as if the server returned status, see HTTPHandler for the
+// flags that are supported
+func Curl(status int, body string) bintest.Responder {
+	return HTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		_, _ = io.WriteString(w, body)
+	}))
+}
+
+// positionalArgs returns the args that aren't flags
+func positionalArgs(args []string) []string {
+	var positional []string
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") {
+			positional = append(positional, arg)
+		}
+	}
+	return positional
+}
+
+func matchesAny(ref string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ref == pattern || strings.HasSuffix(ref, "/"+pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// sshDestination returns the first arg that isn't a flag or a flag value
+func sshDestination(args []string) string {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if strings.HasPrefix(arg, "-") {
+			// flags that take a value
+			if len(arg) == 2 && strings.ContainsRune("BbcDEeFIiJLlmOoPpQRSWw", rune(arg[1])) {
+				i++
+			}
+			continue
+		}
+		return arg
+	}
+	return "ssh"
+}
+
+// flagValue returns the value of the first of flags, as either --flag value or --flag=value
+func flagValue(args []string, flags ...string) (string, bool) {
+	for i, arg := range args {
+		for _, flag := range flags {
+			if arg == flag && i+1 < len(args) {
+				return args[i+1], true
+			}
+			if strings.HasPrefix(arg, flag+"=") {
+				return strings.TrimPrefix(arg, flag+"="), true
+			}
+		}
+	}
+	return "", false
+}
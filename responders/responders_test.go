@@ -0,0 +1,115 @@
+package responders_test
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/bintest/v3"
+	"github.com/buildkite/bintest/v3/responders"
+)
+
+func run(t *testing.T, m *bintest.Mock, args ...string) (string, string, int) {
+	t.Helper()
+
+	var stdout, stderr strings.Builder
+	cmd := exec.Command(m.Path, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return stdout.String(), stderr.String(), exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return stdout.String(), stderr.String(), 0
+}
+
+func TestGit(t *testing.T) {
+	m, err := bintest.NewMock("git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.CheckAndClose(t)
+
+	m.Expect("rev-parse", "HEAD").Respond(responders.GitRevParse("abc123"))
+	m.Expect("ls-remote", "origin").Respond(responders.GitLsRemote(map[string]string{
+		"refs/heads/main":    "abc123",
+		"refs/heads/feature": "def456",
+		"refs/tags/v1.0.0":   "987fed",
+	}))
+	m.Expect("ls-remote", "origin", "main").Respond(responders.GitLsRemote(map[string]string{
+		"refs/heads/main":    "abc123",
+		"refs/heads/feature": "def456",
+	}))
+
+	if stdout, _, _ := run(t, m, "rev-parse", "HEAD"); stdout != "abc123\n" {
+		t.Errorf("Unexpected rev-parse output %q", stdout)
+	}
+
+	if stdout, _, _ := run(t, m, "ls-remote", "origin"); stdout != "def456\trefs/heads/feature\nabc123\trefs/heads/main\n987fed\trefs/tags/v1.0.0\n" {
+		t.Errorf("Unexpected ls-remote output %q", stdout)
+	}
+
+	if stdout, _, _ := run(t, m, "ls-remote", "origin", "main"); stdout != "abc123\trefs/heads/main\n" {
+		t.Errorf("Unexpected filtered ls-remote output %q", stdout)
+	}
+}
+
+func TestSSH(t *testing.T) {
+	m, err := bintest.NewMock("ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.CheckAndClose(t)
+
+	m.Expect("-p", "2222", "git@github.com", "whoami").Respond(responders.SSHPermissionDenied())
+	m.Expect("git@example.com").Respond(responders.SSHConnectionRefused())
+
+	if _, stderr, code := run(t, m, "-p", "2222", "git@github.com", "whoami"); code != 255 || stderr != "git@github.com: Permission denied (publickey).\n" {
+		t.Errorf("Unexpected exit code %d and stderr %q", code, stderr)
+	}
+
+	if _, stderr, code := run(t, m, "git@example.com"); code != 255 || stderr != "ssh: connect to host example.com port 22: Connection refused\n" {
+		t.Errorf("Unexpected exit code %d and stderr %q", code, stderr)
+	}
+}
+
+func TestDockerVersion(t *testing.T) {
+	m, err := bintest.NewMock("docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.CheckAndClose(t)
+
+	m.Expect("version", "--format", "{{.Server.Version}}").Respond(responders.DockerVersion("24.0.7"))
+	m.Expect("version").Respond(responders.DockerVersion("24.0.7"))
+
+	if stdout, _, _ := run(t, m, "version", "--format", "{{.Server.Version}}"); stdout != "24.0.7\n" {
+		t.Errorf("Unexpected output %q", stdout)
+	}
+
+	if stdout, _, _ := run(t, m, "version"); stdout == "" {
+		t.Errorf("Expected output")
+	}
+}
+
+func TestCurl(t *testing.T) {
+	m, err := bintest.NewMock("curl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.CheckAndClose(t)
+
+	m.Expect("-s", "-w", "%{http_code}", "https://example.com").Respond(responders.Curl(200, "llamas"))
+	m.Expect("-fsSL", "https://example.com/missing").Respond(responders.Curl(404, "not found"))
+
+	if stdout, _, code := run(t, m, "-s", "-w", "%{http_code}", "https://example.com"); code != 0 || stdout != "llamas200" {
+		t.Errorf("Unexpected exit code %d and stdout %q", code, stdout)
+	}
+
+	if _, stderr, code := run(t, m, "-fsSL", "https://example.com/missing"); code != 22 || stderr != "curl: (22) The requested URL returned error: 404\n" {
+		t.Errorf("Unexpected exit code %d and stderr %q", code, stderr)
+	}
+}
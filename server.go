@@ -1,15 +1,21 @@
 package bintest
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"os"
 	"path"
 	"regexp"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -27,71 +33,440 @@ func StartServer() (*Server, error) {
 	defer serverLock.Unlock()
 
 	if serverInstance == nil {
-		l, err := net.Listen("tcp", "127.0.0.1:0")
+		cleanupStaleOnStart()
+
+		s, err := newServer()
 		if err != nil {
 			return nil, err
 		}
+		serverInstance = s
+	}
+
+	return serverInstance, nil
+}
+
+// TestingTB is a TestingT that can also mark helpers and register cleanups, like
+// *testing.T and *testing.B
+type TestingTB interface {
+	TestingT
+	Helper()
+	Cleanup(func())
+}
+
+// WithIsolatedServer starts a dedicated server for a single test, which is shut down when
+// the test finishes. Use Server.CompileProxy or Server.NewMock to create binaries that use it.
+// If the server can't start, the test fails and nil is returned if t has no FailNow
+func WithIsolatedServer(t TestingTB) *Server {
+	t.Helper()
+
+	s, err := newServer()
+	if err != nil {
+		t.Errorf("Failed to start isolated server: %v", err)
+		failNow(t)
+		return nil
+	}
 
-		s := &Server{
-			Listener: l,
-			URL:      "http://" + l.Addr().String(),
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			t.Errorf("Failed to shut down isolated server: %v", err)
 		}
+	})
 
-		debugf("[server] Starting server on %s", s.URL)
-		go func() {
-			err = http.Serve(l, s)
-			debugf("[server] Server on %s finished: %v", s.URL, err)
-		}()
+	return s
+}
 
-		serverInstance = s
+var (
+	// addresses that servers have listened on, so that a new server doesn't pick up
+	// calls from binaries compiled for an old one
+	usedAddrs   = map[string]bool{}
+	usedAddrsMu sync.Mutex
+)
+
+// ListenAddr is the address that servers started by StartServer and WithIsolatedServer
+// listen on, like "[::1]:0" or "0.0.0.0:0". It must be set before they're started. Empty
+// listens on a random port of both 127.0.0.1 and ::1, so that proxies can reach it whichever
+// one localhost resolves to
+var ListenAddr string
+
+// listen listens on ListenAddr, or on a loopback port, that hasn't been used by a server before
+func listen() (net.Listener, error) {
+	usedAddrsMu.Lock()
+	defer usedAddrsMu.Unlock()
+
+	var rejected []net.Listener
+	defer func() {
+		for _, l := range rejected {
+			_ = l.Close()
+		}
+	}()
+
+	for attempt := 0; attempt < 10; attempt++ {
+		l, err := listenOnce()
+		if err != nil {
+			return nil, err
+		}
+		if addr := l.Addr().String(); !usedAddrs[addr] {
+			usedAddrs[addr] = true
+			return l, nil
+		}
+		// keep it open so the next attempt gets a different port
+		rejected = append(rejected, l)
 	}
 
-	return serverInstance, nil
+	return nil, errors.New("Failed to find an unused port to listen on")
+}
+
+// listenOnce listens on ListenAddr, or on the same random port of both loopback addresses.
+// If only one of them is available, it listens on just that one
+func listenOnce() (net.Listener, error) {
+	if ListenAddr != "" {
+		return net.Listen("tcp", ListenAddr)
+	}
+
+	l4, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return net.Listen("tcp", "[::1]:0")
+	}
+
+	port := l4.Addr().(*net.TCPAddr).Port
+	l6, err := net.Listen("tcp", net.JoinHostPort("::1", strconv.Itoa(port)))
+	if err != nil {
+		return l4, nil
+	}
+
+	return newDualListener(l4, l6), nil
 }
 
-// StopServer stops the shared http server instance
+func newServer() (*Server, error) {
+	l, err := listen()
+	if err != nil {
+		return nil, err
+	}
+
+	host := l.Addr().String()
+	if _, ok := l.(*dualListener); ok {
+		host = "localhost:" + strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	}
+
+	return serve(l, host, randomToken())
+}
+
+// NewServerOn starts a dedicated server that listens on addr, like 127.0.0.1:7357, rather
+// than on a random port. Binaries compiled for it work with any server on that address with
+// the same token and certificates, so a long-running server that restores them with
+// PersistRemote can be restarted without them being compiled again
+func NewServerOn(addr string) (*Server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	usedAddrsMu.Lock()
+	usedAddrs[l.Addr().String()] = true
+	usedAddrsMu.Unlock()
+
+	return serve(l, l.Addr().String(), randomToken())
+}
+
+// serve starts a server that serves on l, which proxies reach at host. Requests have to send
+// token, and use TLS with client certificates if MutualTLS is set
+func serve(l net.Listener, host string, token string) (*Server, error) {
+	s := &Server{
+		Listener: l,
+		URL:      "http://" + host,
+		token:    token,
+		served:   make(chan struct{}),
+	}
+
+	if MutualTLS {
+		if err := s.enableMutualTLS(host); err != nil {
+			_ = l.Close()
+			return nil, err
+		}
+	}
+
+	s.http = &http.Server{Handler: s}
+
+	s.debugf("[server] Starting server on %s", s.URL)
+	go func() {
+		defer close(s.served)
+		err := s.http.Serve(s.Listener)
+		s.debugf("[server] Server on %s finished: %v", s.URL, err)
+	}()
+
+	return s, nil
+}
+
+// DefaultDrainTimeout is how long StopServer waits for in-flight calls to finish
+const DefaultDrainTimeout = 5 * time.Second
+
+// StopServer stops the shared http server instance. Calls that are in-flight are given
+// DefaultDrainTimeout to send their exit codes before the listener is closed
 func StopServer() error {
 	serverLock.Lock()
 	defer serverLock.Unlock()
 
-	if serverInstance != nil {
-		debugf("[server] Stopping server on %s", serverInstance.URL)
-		_ = serverInstance.Close()
-		serverInstance = nil
+	if serverInstance == nil {
+		return nil
 	}
 
-	return nil
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultDrainTimeout)
+	defer cancel()
+
+	drainErr := serverInstance.Drain(ctx)
+
+	serverInstance.debugf("[server] Stopping server on %s", serverInstance.URL)
+	_ = serverInstance.Close()
+	serverInstance = nil
+
+	return drainErr
+}
+
+// ShutdownAll closes every proxy and stops the shared server, then waits for all of the
+// goroutines that serve calls to finish, or for ctx to be done. Use it before checking for
+// goroutine leaks, for instance in TestMain
+func ShutdownAll(ctx context.Context) error {
+	serverLock.Lock()
+	s := serverInstance
+	serverInstance = nil
+	serverLock.Unlock()
+
+	if s == nil {
+		return nil
+	}
+
+	return s.Shutdown(ctx)
 }
 
 type Server struct {
 	net.Listener
 	URL string
 
+	http   *http.Server
+	served chan struct{}
+
+	// streams tracks hijacked connections, which http.Server doesn't
+	streams sync.WaitGroup
+
+	// inflight is the number of calls that haven't finished yet
+	inflight int64
+
+	// callSlots limits how many calls run at once, nil for no limit
+	callSlots   chan struct{}
+	callSlotsMu sync.RWMutex
+
 	aliases      sync.Map
-	proxies      sync.Map
 	callHandlers sync.Map
+
+	// proxies are stacks keyed by path, so that a proxy for a path can be shadowed by
+	// another one and then re-activated when that one is closed
+	proxies   map[string][]*Proxy
+	proxiesMu sync.RWMutex
+
+	faults   map[string]*Fault
+	faultsMu sync.Mutex
+
+	logger   Logger
+	loggerMu sync.RWMutex
+
+	// the remote expectation API, nil unless it's enabled
+	remote   *remote
+	remoteMu sync.Mutex
+
+	// the token that requests have to send, see Server.Token
+	token   string
+	tokenMu sync.RWMutex
+
+	// the certificates of servers with MutualTLS, nil otherwise
+	tls *serverTLS
+}
+
+// SetLogger overrides the package-wide logger for the server and the calls it serves.
+// Passing nil goes back to the package-wide logger
+func (s *Server) SetLogger(l Logger) {
+	s.loggerMu.Lock()
+	defer s.loggerMu.Unlock()
+	s.logger = l
+}
+
+// getLogger returns the server's logger, or nil if it uses the package-wide one
+func (s *Server) getLogger() Logger {
+	s.loggerMu.RLock()
+	defer s.loggerMu.RUnlock()
+	return s.logger
+}
+
+func (s *Server) debugf(pattern string, args ...interface{}) {
+	logTo(s.getLogger(), LevelDebug, pattern, args...)
+}
+
+func (s *Server) errorf(pattern string, args ...interface{}) {
+	logTo(s.getLogger(), LevelError, pattern, args...)
+}
+
+// Shutdown closes the proxies registered with the server and stops it, then waits for all
+// of the goroutines that serve calls to finish, or for ctx to be done
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.debugf("[server] Shutting down server on %s", s.URL)
+
+	// Closing proxies cancels any calls that are still outstanding
+	var proxies []*Proxy
+	s.proxiesMu.RLock()
+	for _, stack := range s.proxies {
+		proxies = append(proxies, stack...)
+	}
+	s.proxiesMu.RUnlock()
+
+	for _, p := range proxies {
+		_ = p.Close()
+	}
+
+	if err := s.http.Shutdown(ctx); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		<-s.served
+		s.streams.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("Timed out waiting for server on %s to shut down: %v", s.URL, ctx.Err())
+	}
+}
+
+// Drain waits for calls that are in-flight to send their exit codes to the proxied binaries,
+// or for ctx to be done. New calls are still accepted while draining
+func (s *Server) Drain(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		n := atomic.LoadInt64(&s.inflight)
+		if n == 0 {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("Timed out waiting for %d in-flight calls on %s: %v", n, s.URL, ctx.Err())
+		}
+	}
+}
+
+// SetMaxConcurrentCalls limits how many calls the server runs at once, further calls wait
+// for one to finish before they are dispatched. Zero or less removes the limit. Calls that
+// are already running or waiting keep the limit they started with
+func (s *Server) SetMaxConcurrentCalls(n int) {
+	s.callSlotsMu.Lock()
+	defer s.callSlotsMu.Unlock()
+	if n <= 0 {
+		s.callSlots = nil
+	} else {
+		s.callSlots = make(chan struct{}, n)
+	}
+}
+
+// acquireCallSlot waits for the concurrent call limit to allow another call, and returns a
+// function that releases the slot. It returns false if ctx is done first
+func (s *Server) acquireCallSlot(ctx context.Context) (func(), bool) {
+	s.callSlotsMu.RLock()
+	slots := s.callSlots
+	s.callSlotsMu.RUnlock()
+
+	if slots == nil {
+		return func() {}, true
+	}
+
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, true
+	default:
+	}
+
+	s.debugf("[server] Waiting for one of %d concurrent calls to finish", cap(slots))
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, true
+	case <-ctx.Done():
+		return nil, false
+	}
+}
+
+// trackCall counts call as in-flight until it's finished or cancelled, and then runs the
+// cleanup functions, which release the resources the call held
+func (s *Server) trackCall(call *Call, cleanup ...func()) {
+	atomic.AddInt64(&s.inflight, 1)
+	go func() {
+		<-call.ctx.Done()
+		for _, f := range cleanup {
+			f()
+		}
+		atomic.AddInt64(&s.inflight, -1)
+	}()
 }
 
 func (s *Server) registerProxy(p *Proxy) {
-	debugf("[server] Registering proxy %s", p.Path)
-	s.proxies.Store(p.Path, p)
+	s.debugf("[server] Registering proxy %s", p.Path)
+	s.proxiesMu.Lock()
+	if s.proxies == nil {
+		s.proxies = map[string][]*Proxy{}
+	}
+	s.proxies[p.Path] = append(s.proxies[p.Path], p)
+	s.proxiesMu.Unlock()
 	s.unaliasProxy(p.Path)
 }
 
 func (s *Server) deregisterProxy(p *Proxy) {
-	debugf("[server] Deregistering proxy %s", p.Path)
-	s.proxies.Delete(p.Path)
-	s.unaliasProxy(p.Path)
+	s.debugf("[server] Deregistering proxy %s", p.Path)
+	s.proxiesMu.Lock()
+	stack := s.proxies[p.Path]
+	for idx := range stack {
+		if stack[idx] == p {
+			stack = append(stack[:idx:idx], stack[idx+1:]...)
+			break
+		}
+	}
+	if len(stack) == 0 {
+		delete(s.proxies, p.Path)
+	} else {
+		s.proxies[p.Path] = stack
+	}
+	s.proxiesMu.Unlock()
+
+	// aliases are only removed once nothing is registered for the path
+	if len(stack) == 0 {
+		s.unaliasProxy(p.Path)
+	}
+}
+
+// activeProxy returns the most recently registered proxy for a path
+func (s *Server) activeProxy(path string) (*Proxy, bool) {
+	s.proxiesMu.RLock()
+	defer s.proxiesMu.RUnlock()
+	stack := s.proxies[path]
+	if len(stack) == 0 {
+		return nil, false
+	}
+	return stack[len(stack)-1], true
 }
 
 func (s *Server) aliasProxy(from, to string) {
-	debugf("[server] Aliasing proxy %s to %s", to, from)
+	s.debugf("[server] Aliasing proxy %s to %s", to, from)
 	s.aliases.Store(from, to)
 }
 
 func (s *Server) unaliasProxy(path string) {
 	s.aliases.Range(func(key, value interface{}) bool {
-		if key.(string) == path {
+		if key.(string) == path || value.(string) == path {
 			s.aliases.Delete(key)
 		}
 		return true
@@ -101,11 +476,11 @@ func (s *Server) unaliasProxy(path string) {
 func (s *Server) lookupProxy(path string) (*Proxy, error) {
 	var aliases []string
 
-	proxy, ok := s.proxies.Load(path)
+	proxy, ok := s.activeProxy(path)
 	if !ok {
 		// Build a list of possible aliases
 		s.aliases.Range(func(key, value interface{}) bool {
-			debugf("Looking at %v, %v", key, value)
+			s.debugf("Looking at %v, %v", key, value)
 			if key.(string) == path {
 				aliases = append(aliases, value.(string))
 			}
@@ -114,38 +489,60 @@ func (s *Server) lookupProxy(path string) (*Proxy, error) {
 
 		// Check if any of the aliases have proxies registered
 		for _, alias := range aliases {
-			proxy, ok = s.proxies.Load(alias)
+			proxy, ok = s.activeProxy(alias)
 			if ok {
-				return proxy.(*Proxy), nil
+				return proxy, nil
 			}
 		}
 
 		return nil, fmt.Errorf("Failed to find a proxy for path %s", path)
 	}
 
-	return proxy.(*Proxy), nil
+	return proxy, nil
 }
 
 var (
-	callRouteRegex = regexp.MustCompile(`^/calls/(\d+)/(stdout|stderr|stdin|exitcode)$`)
+	callRouteRegex = regexp.MustCompile(`^/calls/(\d+)/(stdout|stderr|output|stdin|exitcode)$`)
 )
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// the remote API has its own token
+	if r.URL.Path == `/remote/mocks` || strings.HasPrefix(r.URL.Path, `/remote/mocks/`) {
+		s.handleRemote(w, r)
+		return
+	}
+
+	if !s.authorized(r) {
+		s.errorf("[server] Rejected %s %s without the server's token", r.Method, r.URL.Path)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
 	if r.URL.Path == "/debug" {
 		body, _ := io.ReadAll(r.Body)
 		_ = r.Body.Close()
-		debugf("%s", body)
+		s.debugf("%s", body)
 		return
 	}
 
 	start := time.Now()
-	debugf("[server] %s %s", r.Method, r.URL.Path)
+	s.debugf("[server] %s %s", r.Method, r.URL.Path)
 
 	if r.URL.Path == `/calls/new` {
 		s.handleNewCall(w, r)
 		return
 	}
 
+	if r.URL.Path == `/calls/stream` {
+		s.handleStreamCall(w, r)
+		return
+	}
+
+	if r.URL.Path == `/calls/websocket` {
+		s.handleWebSocketCall(w, r)
+		return
+	}
+
 	matches := callRouteRegex.FindStringSubmatch(r.URL.Path)
 
 	if len(matches) == 0 {
@@ -153,32 +550,54 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	pid, err := strconv.ParseInt(matches[1], 10, 64)
+	id, err := strconv.ParseUint(matches[1], 10, 64)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	// dispatch the request to a handler with the given id
-	handler, ok := s.callHandlers.Load(int(pid))
+	handler, ok := s.callHandlers.Load(id)
 	if !ok {
-		errorf("No call handler found for pid %d", pid)
+		s.errorf("No call handler found for call %d", id)
 		http.Error(w, "Unknown handler", http.StatusNotFound)
 		return
 	}
 
-	debugf("[server] Found handler for %v", handler.(*callHandler).call.Args)
+	s.debugf("[server] Found handler for %v", handler.(*callHandler).call.Args)
 
 	handler.(*callHandler).ServeHTTP(w, r)
-	debugf("[server] END %s (%v)", r.URL.Path, time.Now().Sub(start))
+	s.debugf("[server] END %s (%v)", r.URL.Path, time.Now().Sub(start))
 }
 
 type callRequest struct {
-	PID      int
-	Args     []string
-	Env      []string
-	Dir      string
-	HasStdin bool
+	PID        int
+	ParentPID  int
+	ParentPath string
+	Caller     string
+	Args       []string
+	Env        []string
+	Dir        string
+	HasStdin   bool
+
+	// Whether the stderr of the client is a terminal
+	StderrIsTerminal bool
+
+	// Whether the client waits for a frameStdinRequest before sending stdin, only the
+	// stream transports support it
+	LazyStdin bool
+
+	// Whether each of the extra files is read-only, only the stream transports forward them
+	ExtraFilesReadOnly []bool
+
+	// Whether stdout and stderr are sent as frames in the order they were written, over
+	// the connection for the stream transports or /calls/<pid>/output for http
+	CombinedOutput bool
+}
+
+// callResponse is the response to /calls/new, ID is used in the routes for the rest of the call
+type callResponse struct {
+	ID uint64
 }
 
 func (s *Server) handleNewCall(w http.ResponseWriter, r *http.Request) {
@@ -190,15 +609,38 @@ func (s *Server) handleNewCall(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if len(req.Args) == 0 {
+		http.Error(w, "Expected the call to have args", http.StatusBadRequest)
+		return
+	}
+
 	// find the proxy instance in the server for the given path
 	proxy, err := s.lookupProxy(req.Args[0])
 	if err != nil {
-		errorf(err.Error())
+		s.errorf(err.Error())
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 
-	debugf("[server] Found proxy for path %s", req.Args[0])
+	s.debugf("[server] Found proxy for path %s", req.Args[0])
+
+	if fault, ok := s.takeFault(proxy.Path); ok {
+		if !fault.wait(r.Context()) {
+			return
+		}
+		if fault.Drop {
+			panic(http.ErrAbortHandler)
+		}
+		if fault.Refuse {
+			http.Error(w, "Call refused by fault", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	release, ok := s.acquireCallSlot(r.Context())
+	if !ok {
+		return
+	}
 
 	// these pipes connect the call to the various http request/responses
 	outR, outW := io.Pipe()
@@ -207,6 +649,10 @@ func (s *Server) handleNewCall(w http.ResponseWriter, r *http.Request) {
 
 	// create a custom handler with the id for subsequent requests to hit
 	call := proxy.newCall(req.PID, req.Args, req.Env, req.Dir)
+	call.ParentPID = req.ParentPID
+	call.ParentPath = req.ParentPath
+	call.Caller = req.Caller
+	call.StderrIsTerminal = req.StderrIsTerminal
 	call.Stdout = outW
 	call.Stderr = errW
 	call.Stdin = inR
@@ -216,53 +662,471 @@ func (s *Server) handleNewCall(w http.ResponseWriter, r *http.Request) {
 		_ = inW.Close()
 	}
 
-	// save the handler for subsequent requests
-	s.callHandlers.Store(int(call.PID), &callHandler{
+	// save the handler for subsequent requests, the exit code isn't sent until both
+	// stdout and stderr have been copied to the client
+	handler := &callHandler{
 		call:   call,
 		stdout: outR,
 		stderr: errR,
 		stdin:  inW,
+		logger: s.getLogger(),
+	}
+	handler.Add(2)
+
+	// with combined output, stdout and stderr are framed in order onto a single pipe
+	if req.CombinedOutput {
+		mux := newOutputMux(func(t byte, payload []byte) error {
+			return writeFrame(outW, t, payload)
+		}, func() {
+			_ = outW.Close()
+		})
+		call.Stdout = mux.writer(frameStdout)
+		call.Stderr = mux.writer(frameStderr)
+		handler.output = outR
+		handler.Done()
+	}
+
+	// handlers are keyed by the call's sequence rather than the pid of the client, which
+	// can be reused by the OS or clash between containers
+	s.callHandlers.Store(call.Sequence, handler)
+
+	s.debugf("[server] Registered call handler %d for pid %d", call.Sequence, call.PID)
+
+	// once the call is done the handler is removed, unread stdin is discarded so that the
+	// request sending it finishes, and the output pipes are closed in case they were never
+	// requested
+	s.trackCall(call, release, func() {
+		s.callHandlers.Delete(call.Sequence)
+		_ = inR.CloseWithError(errors.New("Call has finished"))
+		_ = outR.Close()
+		_ = errR.Close()
+		s.debugf("[server] Removed call handler %d", call.Sequence)
 	})
 
-	debugf("[server] Registered call handler for pid %d", call.PID)
+	// the client uses the id for the rest of the call's routes
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(callResponse{ID: call.Sequence})
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
 
 	proxy.dispatch(call)
 }
 
+// handleStreamCall upgrades the connection and runs the whole call over it as frames
+func (s *Server) handleStreamCall(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Upgrade") != streamUpgrade {
+		http.Error(w, "Expected upgrade to "+streamUpgrade, http.StatusBadRequest)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Connection can't be upgraded", http.StatusInternalServerError)
+		return
+	}
+
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		s.errorf("Failed to hijack connection: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	s.streams.Add(1)
+	defer s.streams.Done()
+
+	_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Upgrade: " + streamUpgrade + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		return
+	}
+
+	s.serveStream(rw.Reader, rw.Writer)
+}
+
+// handleWebSocketCall upgrades the connection to a websocket and runs the call over it
+func (s *Server) handleWebSocketCall(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || key == "" {
+		http.Error(w, "Expected a websocket upgrade", http.StatusBadRequest)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Connection can't be upgraded", http.StatusInternalServerError)
+		return
+	}
+
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		s.errorf("Failed to hijack connection: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	s.streams.Add(1)
+	defer s.streams.Done()
+
+	_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Sec-WebSocket-Accept: " + websocketAccept(key) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		return
+	}
+
+	s.serveStream(&wsReader{r: rw.Reader}, bufio.NewWriter(&wsWriter{w: rw.Writer}))
+}
+
+// serveStream runs a call over a connection as frames, see stream.go
+func (s *Server) serveStream(r io.Reader, w *bufio.Writer) {
+	var writeMu sync.Mutex
+	send := func(t byte, payload []byte) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		if err := writeFrame(w, t, payload); err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+
+	t, payload, err := readFrame(r)
+	if err != nil || t != frameCall {
+		s.errorf("Expected a call frame: %v", err)
+		return
+	}
+
+	var req callRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		s.errorf("Failed to parse call: %v", err)
+		return
+	}
+
+	if len(req.Args) == 0 {
+		s.errorf("Expected the call to have args")
+		_ = send(frameStderr, []byte("Expected the call to have args\n"))
+		_ = send(frameExit, exitFramePayload(1))
+		return
+	}
+
+	proxy, err := s.lookupProxy(req.Args[0])
+	if err != nil {
+		s.errorf(err.Error())
+		_ = send(frameStderr, []byte(err.Error()+"\n"))
+		_ = send(frameExit, exitFramePayload(1))
+		return
+	}
+
+	s.debugf("[server] Found proxy for path %s", req.Args[0])
+
+	if fault, ok := s.takeFault(proxy.Path); ok {
+		if !fault.wait(proxy.ctx) || fault.Drop {
+			return
+		}
+		if fault.Refuse {
+			_ = send(frameStderr, []byte("Call refused by fault\n"))
+			_ = send(frameExit, exitFramePayload(1))
+			return
+		}
+	}
+
+	release, ok := s.acquireCallSlot(proxy.ctx)
+	if !ok {
+		return
+	}
+
+	// the slot is released when the call is done, or here if it never starts
+	started := false
+	defer func() {
+		if !started {
+			release()
+		}
+	}()
+
+	if len(req.ExtraFilesReadOnly) > maxExtraFiles {
+		_ = send(frameStderr, []byte(fmt.Sprintf("Can't forward more than %d extra files\n", maxExtraFiles)))
+		_ = send(frameExit, exitFramePayload(1))
+		return
+	}
+
+	// the call gets one end of a pipe for each extra file, the other end is copied to or
+	// from the connection
+	var extraFiles, fileOutputs []*os.File
+	var fileInputs = map[byte]*os.File{}
+	defer func() {
+		for _, f := range extraFiles {
+			_ = f.Close()
+		}
+		for _, f := range fileInputs {
+			_ = f.Close()
+		}
+	}()
+	for i, readOnly := range req.ExtraFilesReadOnly {
+		pr, pw, err := os.Pipe()
+		if err != nil {
+			s.errorf("Failed to create pipe for extra file %d: %v", i, err)
+			_ = send(frameStderr, []byte(err.Error()+"\n"))
+			_ = send(frameExit, exitFramePayload(1))
+			return
+		}
+		if readOnly {
+			extraFiles = append(extraFiles, pr)
+			fileInputs[byte(i)] = pw
+		} else {
+			extraFiles = append(extraFiles, pw)
+			fileOutputs = append(fileOutputs, pr)
+		}
+	}
+
+	outR, outW := io.Pipe()
+	errR, errW := io.Pipe()
+	inR, inW := io.Pipe()
+
+	call := proxy.newCall(req.PID, req.Args, req.Env, req.Dir)
+	call.ParentPID = req.ParentPID
+	call.ParentPath = req.ParentPath
+	call.Caller = req.Caller
+	call.StderrIsTerminal = req.StderrIsTerminal
+	call.Stdout = outW
+	call.Stderr = errW
+	call.Stdin = inR
+	call.ExtraFiles = extraFiles
+	s.trackCall(call, release)
+	started = true
+
+	// with combined output, writes are sent as frames as they happen rather than pumped
+	// from pipes, so the order of stdout and stderr is kept
+	var mux *outputMux
+	if req.CombinedOutput {
+		mux = newOutputMux(send, nil)
+		call.Stdout = mux.writer(frameStdout)
+		call.Stderr = mux.writer(frameStderr)
+	}
+
+	if !req.HasStdin {
+		_ = inW.Close()
+	} else if req.LazyStdin {
+		call.Stdin = &lazyReader{ReadCloser: inR, onRead: func() {
+			s.debugf("[server] Requesting stdin from the client")
+			_ = send(frameStdinRequest, nil)
+		}}
+	}
+
+	// read stdin frames until the connection closes, which before the call
+	// finishes means the client went away
+	s.streams.Add(1)
+	go func() {
+		defer s.streams.Done()
+		for {
+			t, payload, err := readFrame(r)
+			if err != nil {
+				if !call.IsDone() {
+					s.debugf("[server] Client went away, cancelling call")
+				}
+				call.cancel()
+				_ = inW.CloseWithError(err)
+				_ = outR.CloseWithError(err)
+				_ = errR.CloseWithError(err)
+				if mux != nil {
+					mux.closeWithError(err)
+				}
+				return
+			}
+			if t == frameFile && len(payload) > 0 {
+				if f, ok := fileInputs[payload[0]]; ok {
+					if len(payload) == 1 {
+						_ = f.Close()
+					} else {
+						_, _ = f.Write(payload[1:])
+					}
+				}
+				continue
+			}
+			if t != frameStdin {
+				continue
+			}
+			if len(payload) == 0 {
+				_ = inW.Close()
+			} else {
+				_, _ = inW.Write(payload)
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	pump := func(t byte, pr *io.PipeReader) {
+		defer s.streams.Done()
+		defer wg.Done()
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := pr.Read(buf)
+			if n > 0 {
+				if werr := send(t, buf[:n]); werr != nil {
+					_ = pr.CloseWithError(werr)
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	// pumpFile copies an extra file to the connection until every write end is closed
+	pumpFile := func(idx int, f *os.File) {
+		defer s.streams.Done()
+		defer wg.Done()
+		defer f.Close()
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := f.Read(buf[1:])
+			if n > 0 {
+				buf[0] = byte(idx)
+				if werr := send(frameFile, buf[:n+1]); werr != nil {
+					return
+				}
+			}
+			if err != nil {
+				_ = send(frameFile, []byte{byte(idx)})
+				return
+			}
+		}
+	}
+
+	if mux == nil {
+		wg.Add(2)
+		s.streams.Add(2)
+		go pump(frameStdout, outR)
+		go pump(frameStderr, errR)
+	}
+
+	outputIdx := 0
+	for i, readOnly := range req.ExtraFilesReadOnly {
+		if !readOnly {
+			wg.Add(1)
+			s.streams.Add(1)
+			go pumpFile(i, fileOutputs[outputIdx])
+			outputIdx++
+		}
+	}
+
+	proxy.dispatch(call)
+
+	var exitCode int
+	select {
+	case exitCode = <-call.exitCodeCh:
+	case <-call.ctx.Done():
+		for _, f := range fileOutputs {
+			_ = f.Close()
+		}
+		return
+	}
+
+	// the call is finished with the extra files, closing them lets the pumps finish
+	for _, f := range extraFiles {
+		_ = f.Close()
+	}
+
+	wg.Wait()
+	s.debugf("[server] Sending exit code %d to proxy", exitCode)
+	_ = send(frameExit, exitFramePayload(exitCode))
+
+	select {
+	case call.doneCh <- struct{}{}:
+	case <-call.ctx.Done():
+	}
+}
+
 type callHandler struct {
 	sync.WaitGroup
 	call           *Call
 	stdout, stderr *io.PipeReader
 	stdin          *io.PipeWriter
+	logger         Logger
+
+	// stdout and stderr as frames, for calls with combined output
+	output *io.PipeReader
+}
+
+func (ch *callHandler) debugf(pattern string, args ...interface{}) {
+	logWith(ch.logger, LevelDebug, logFields{Proxy: ch.call.Name, Call: ch.call.Sequence}, pattern, args...)
 }
 
 func (ch *callHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	switch path.Base(r.URL.Path) {
 	case "stdout":
-		debugf("[server] Starting copy of stdout")
-		copyPipeWithFlush(w, ch.stdout)
-		debugf("[server] Finished copy of stdout")
+		ch.debugf("[server] Starting copy of stdout")
+		ch.copyStream(w, r, ch.stdout)
+		ch.Done()
+		ch.debugf("[server] Finished copy of stdout")
 
 	case "stderr":
-		debugf("[server] Starting copy of stderr")
-		copyPipeWithFlush(w, ch.stderr)
-		debugf("[server] Finished copy of stderr")
+		ch.debugf("[server] Starting copy of stderr")
+		ch.copyStream(w, r, ch.stderr)
+		ch.Done()
+		ch.debugf("[server] Finished copy of stderr")
+
+	case "output":
+		if ch.output == nil {
+			http.Error(w, "Call doesn't have combined output", http.StatusBadRequest)
+			return
+		}
+		ch.debugf("[server] Starting copy of combined output")
+		ch.copyStream(w, r, ch.output)
+		ch.Done()
+		ch.debugf("[server] Finished copy of combined output")
 
 	case "stdin":
-		debugf("[server] Starting copy of stdin")
+		ch.debugf("[server] Starting copy of stdin")
 		_, _ = io.Copy(ch.stdin, r.Body)
 		_ = r.Body.Close()
 		_ = ch.stdin.Close()
-		debugf("[server] Finished copy of stdin")
+		ch.debugf("[server] Finished copy of stdin")
 
 	case "exitcode":
-		debugf("[server] Blocking on call for exitcode")
-		exitCode := <-ch.call.exitCodeCh
+		ch.debugf("[server] Blocking on call for exitcode")
+		var exitCode int
+		select {
+		case exitCode = <-ch.call.exitCodeCh:
+		case <-r.Context().Done():
+			ch.debugf("[server] Client went away waiting for exit code")
+			ch.call.cancel()
+			return
+		case <-ch.call.ctx.Done():
+			ch.debugf("[server] Call was cancelled waiting for exit code")
+			return
+		}
+
+		// don't send the exit code until the output has been flushed to the client, or
+		// it might see the exit before the last of the output
+		ch.debugf("[server] Waiting for stdout and stderr to be flushed")
+		flushed := make(chan struct{})
+		go func() {
+			ch.Wait()
+			close(flushed)
+		}()
+		select {
+		case <-flushed:
+		case <-r.Context().Done():
+			ch.debugf("[server] Client went away waiting for output to be flushed")
+			ch.call.cancel()
+			return
+		case <-ch.call.ctx.Done():
+			ch.debugf("[server] Call was cancelled waiting for output to be flushed")
+			return
+		}
+
 		w.Header().Add("Content-Type", "application/json; charset=utf-8")
 		_ = json.NewEncoder(w).Encode(&exitCode)
 		w.(http.Flusher).Flush()
-		debugf("[server] Sending exit code %d to proxy", exitCode)
-		ch.call.doneCh <- struct{}{}
+		ch.debugf("[server] Sending exit code %d to proxy", exitCode)
+		select {
+		case ch.call.doneCh <- struct{}{}:
+		case <-ch.call.ctx.Done():
+		}
 
 	default:
 		http.Error(w, "Unhandled request", http.StatusNotFound)
@@ -270,6 +1134,39 @@ func (ch *callHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// copyStream copies an output pipe to the response. If the client goes away before the
+// pipe is closed, the call is cancelled and further writes to the pipe fail
+func (ch *callHandler) copyStream(w http.ResponseWriter, r *http.Request, pipeReader *io.PipeReader) {
+	finished := make(chan struct{})
+	defer close(finished)
+
+	go func() {
+		select {
+		case <-finished:
+		case <-ch.call.ctx.Done():
+			// the call is cancelled once it's finished, which is after finished is closed
+			select {
+			case <-finished:
+			default:
+				ch.debugf("[server] Call was cancelled, closing stream")
+				_ = pipeReader.CloseWithError(errors.New("Call was cancelled"))
+			}
+		case <-r.Context().Done():
+			// the request context is also cancelled once the handler returns, which
+			// is after finished is closed
+			select {
+			case <-finished:
+			default:
+				ch.debugf("[server] Client went away, cancelling call")
+				ch.call.cancel()
+				_ = pipeReader.CloseWithError(errors.New("Client went away"))
+			}
+		}
+	}()
+
+	copyPipeWithFlush(w, pipeReader)
+}
+
 func copyPipeWithFlush(res http.ResponseWriter, pipeReader *io.PipeReader) {
 	buffer := make([]byte, 1024)
 	for {
@@ -0,0 +1,638 @@
+package bintest_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildkite/bintest/v3"
+	"github.com/buildkite/bintest/v3/testutil"
+	"github.com/fortytw2/leaktest"
+)
+
+func TestShutdownAllWithOutstandingCall(t *testing.T) {
+	// other tests expect the server that TestMain starts, so restart it after
+	// checking for leaks
+	defer func() {
+		if _, err := bintest.StartServer(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	defer leaktest.Check(t)()
+
+	proxy, err := bintest.CompileProxy("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(proxy.Path, "never", "finishes")
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// receive the call, but never exit it
+	<-proxy.Ch
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := bintest.ShutdownAll(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cmd.Wait(); err == nil {
+		t.Fatal("Expected the command to fail")
+	}
+}
+
+func TestIsolatedServer(t *testing.T) {
+	shared, err := bintest.StartServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := bintest.WithIsolatedServer(t)
+	if server.URL == shared.URL {
+		t.Fatalf("Expected isolated server to use a different address to %s", shared.URL)
+	}
+
+	m, err := server.NewMock("isolated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.CheckAndClose(t)
+
+	m.Expect("hello").AndWriteToStdout("world")
+
+	out, err := exec.Command(m.Path, "hello").CombinedOutput()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "world" {
+		t.Fatalf("Unexpected output %q", out)
+	}
+}
+
+// cleanupT is a TestingTB for harnesses that aren't the testing package
+type cleanupT struct {
+	testutil.TestingT
+	cleanups []func()
+}
+
+func (t *cleanupT) Helper() {}
+
+func (t *cleanupT) Cleanup(f func()) {
+	t.cleanups = append(t.cleanups, f)
+}
+
+func TestIsolatedServerWithOtherHarnesses(t *testing.T) {
+	ct := &cleanupT{}
+	server := bintest.WithIsolatedServer(ct)
+	if server == nil {
+		t.Fatalf("Expected a server, got errors %q", ct.Errors)
+	}
+
+	m, err := server.NewMock("harnessed")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.Expect().AndExitWith(0)
+
+	if err := exec.Command(m.Path).Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.CheckAndClose(t); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ct.cleanups) != 1 {
+		t.Fatalf("Expected a cleanup to shut the server down, got %d", len(ct.cleanups))
+	}
+	ct.cleanups[0]()
+	if len(ct.Errors) > 0 {
+		t.Fatalf("Unexpected errors %q", ct.Errors)
+	}
+	if _, err := http.Get(server.URL); err == nil {
+		t.Fatal("Expected the server to be shut down")
+	}
+}
+
+func TestIsolatedServerListensOnBothLoopbackAddresses(t *testing.T) {
+	if l, err := net.Listen("tcp", "[::1]:0"); err != nil {
+		t.Skipf("IPv6 loopback isn't available: %v", err)
+	} else {
+		_ = l.Close()
+	}
+
+	server := bintest.WithIsolatedServer(t)
+	if !strings.HasPrefix(server.URL, "http://localhost:") {
+		t.Fatalf("Expected the server to be advertised on localhost, got %s", server.URL)
+	}
+
+	port := strings.TrimPrefix(server.URL, "http://localhost:")
+	for _, host := range []string{"127.0.0.1", "::1"} {
+		conn, err := net.Dial("tcp", net.JoinHostPort(host, port))
+		if err != nil {
+			t.Fatalf("Expected the server to listen on %s: %v", host, err)
+		}
+		_ = conn.Close()
+	}
+
+	m, err := server.NewMock("dualstack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.CheckAndClose(t)
+
+	m.Expect().AndExitWith(0)
+
+	if err := exec.Command(m.Path).Run(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListenAddr(t *testing.T) {
+	if l, err := net.Listen("tcp", "[::1]:0"); err != nil {
+		t.Skipf("IPv6 loopback isn't available: %v", err)
+	} else {
+		_ = l.Close()
+	}
+
+	bintest.ListenAddr = "[::1]:0"
+	defer func() {
+		bintest.ListenAddr = ""
+	}()
+
+	server := bintest.WithIsolatedServer(t)
+	if !strings.HasPrefix(server.URL, "http://[::1]:") {
+		t.Fatalf("Expected the server to listen on ::1, got %s", server.URL)
+	}
+
+	m, err := server.NewMock("ipv6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.CheckAndClose(t)
+
+	m.Expect().AndExitWith(0)
+
+	if err := exec.Command(m.Path).Run(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIsolatedServerShutdownDoesNotAffectSharedServer(t *testing.T) {
+	t.Run("isolated", func(t *testing.T) {
+		server := bintest.WithIsolatedServer(t)
+		if _, err := server.CompileProxy("isolated"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	m, err := bintest.NewMock("shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.CheckAndClose(t)
+
+	m.Expect().AndExitWith(0)
+
+	if err := exec.Command(m.Path).Run(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerFaults(t *testing.T) {
+	for _, transport := range []string{bintest.TransportHTTP, bintest.TransportStream} {
+		t.Run(transport, func(t *testing.T) {
+			server := bintest.WithIsolatedServer(t)
+
+			m, err := server.NewMock("faulty")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer m.CheckAndClose(t)
+
+			m.Expect().AndExitWith(0).Once()
+
+			run := func() error {
+				cmd := exec.Command(m.Path)
+				cmd.Env = append(os.Environ(), bintest.TransportEnvVar+"="+transport)
+				return cmd.Run()
+			}
+
+			server.FaultFor(m.Path, bintest.Fault{Refuse: true, Times: 1})
+			if err := run(); err == nil {
+				t.Fatal("Expected refused call to fail")
+			}
+
+			server.FaultFor(m.Path, bintest.Fault{Drop: true})
+			if err := run(); err == nil {
+				t.Fatal("Expected dropped call to fail")
+			}
+
+			server.FaultFor(m.Path, bintest.Fault{Delay: 200 * time.Millisecond})
+			start := time.Now()
+			if err := run(); err != nil {
+				t.Fatal(err)
+			}
+			if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+				t.Fatalf("Expected call to be delayed, took %v", elapsed)
+			}
+		})
+	}
+}
+
+func TestServerDrainWaitsForInflightCalls(t *testing.T) {
+	server := bintest.WithIsolatedServer(t)
+
+	proxy, err := server.CompileProxy("draining")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+
+	cmd := exec.Command(proxy.Path)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	call := <-proxy.Ch
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		_, _ = io.WriteString(call.Stdout, "llamas")
+		call.Exit(0)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := server.Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cmd.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "llamas" {
+		t.Fatalf("Unexpected output %q", out.String())
+	}
+}
+
+func TestServerDrainTimesOut(t *testing.T) {
+	server := bintest.WithIsolatedServer(t)
+
+	proxy, err := server.CompileProxy("draining")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(proxy.Path)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// receive the call, but never exit it
+	<-proxy.Ch
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if err := server.Drain(ctx); err == nil {
+		t.Fatal("Expected draining to time out")
+	}
+
+	_ = proxy.Close()
+	_ = cmd.Wait()
+}
+
+func TestServerSendsExitCodeAfterOutputIsFlushed(t *testing.T) {
+	server := bintest.WithIsolatedServer(t)
+
+	proxy, err := server.CompileProxy("flushing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+
+	// the call exits with no output, but stdout and stderr aren't fetched yet
+	go func() {
+		call := <-proxy.Ch
+		call.Exit(3)
+	}()
+
+	callURL := newHTTPCall(t, server, proxy.Path, 424242)
+
+	exitCode := make(chan string)
+	go func() {
+		resp, err := serverRequest(server, "GET", callURL+"/exitcode", nil)
+		if err != nil {
+			exitCode <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		exitCode <- strings.TrimSpace(string(b))
+	}()
+
+	select {
+	case code := <-exitCode:
+		t.Fatalf("Expected exit code to wait for stdout and stderr, got %s", code)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	for _, stream := range []string{"stdout", "stderr"} {
+		resp, err := serverRequest(server, "GET", callURL+"/"+stream, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}
+
+	if code := <-exitCode; code != "3" {
+		t.Fatalf("Expected exit code 3, got %s", code)
+	}
+}
+
+func TestServerMaxConcurrentCalls(t *testing.T) {
+	server := bintest.WithIsolatedServer(t)
+	server.SetMaxConcurrentCalls(2)
+
+	proxy, err := server.CompileProxy("limited")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+
+	var cmds []*exec.Cmd
+	for i := 0; i < 3; i++ {
+		cmd := exec.Command(proxy.Path)
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		cmds = append(cmds, cmd)
+	}
+
+	first, second := <-proxy.Ch, <-proxy.Ch
+
+	select {
+	case call := <-proxy.Ch:
+		call.Exit(0)
+		t.Fatal("Expected the third call to wait for one of the others to finish")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	first.Exit(0)
+	third := <-proxy.Ch
+	second.Exit(0)
+	third.Exit(0)
+
+	for _, cmd := range cmds {
+		if err := cmd.Wait(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestServerRemovesCallHandlersWhenCallsFinish(t *testing.T) {
+	server := bintest.WithIsolatedServer(t)
+
+	proxy, err := server.CompileProxy("forgetful")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+
+	cmd := exec.Command(proxy.Path)
+	cmd.Env = append(os.Environ(), bintest.TransportEnvVar+"="+bintest.TransportHTTP)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	call := <-proxy.Ch
+	call.Exit(0)
+
+	if err := cmd.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the handler is removed in the background once the call is done
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := serverRequest(server, "GET", fmt.Sprintf("%s/calls/%d/exitcode", server.URL, call.Sequence), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the call handler to be removed, got %s", resp.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerCallsWithTheSamePIDDontClash(t *testing.T) {
+	server := bintest.WithIsolatedServer(t)
+
+	proxy, err := server.CompileProxy("clashing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+
+	go func() {
+		for i := 0; i < 2; i++ {
+			call := <-proxy.Ch
+			go func(i int) {
+				fmt.Fprintf(call.Stdout, "call %d", i)
+				call.Exit(i)
+			}(i)
+		}
+	}()
+
+	first := newHTTPCall(t, server, proxy.Path, 1234)
+	second := newHTTPCall(t, server, proxy.Path, 1234)
+	if first == second {
+		t.Fatalf("Expected calls with the same pid to get different ids, both got %s", first)
+	}
+
+	for i, callURL := range []string{first, second} {
+		for _, route := range []string{"stdout", "stderr", "exitcode"} {
+			resp, err := serverRequest(server, "GET", callURL+"/"+route, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			if route == "stdout" && string(b) != fmt.Sprintf("call %d", i) {
+				t.Fatalf("Expected stdout from call %d, got %q", i, b)
+			}
+			if route == "exitcode" && strings.TrimSpace(string(b)) != fmt.Sprint(i) {
+				t.Fatalf("Expected exit code %d, got %q", i, b)
+			}
+		}
+	}
+}
+
+func TestServerRejectsRequestsWithoutItsToken(t *testing.T) {
+	server := bintest.WithIsolatedServer(t)
+	if server.Token() == "" {
+		t.Fatal("Expected the server to generate a token")
+	}
+
+	proxy, err := server.CompileProxy("guarded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+
+	body := fmt.Sprintf(`{"PID": 1234, "Args": [%q]}`, proxy.Path)
+	for _, token := range []string{"", "llamas"} {
+		for _, route := range []string{"/calls/new", "/debug"} {
+			req, err := http.NewRequest("POST", server.URL+route, strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token != "" {
+				req.Header.Set(bintest.TokenHeader, token)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = resp.Body.Close()
+			if resp.StatusCode != http.StatusUnauthorized {
+				t.Fatalf("Expected %s with token %q to be rejected, got %s", route, token, resp.Status)
+			}
+		}
+	}
+
+	select {
+	case call := <-proxy.Ch:
+		call.Exit(0)
+		t.Fatal("Expected no calls to be dispatched")
+	default:
+	}
+}
+
+func TestServerTokensAreCompiledIntoEachServersProxies(t *testing.T) {
+	first := bintest.WithIsolatedServer(t)
+	second := bintest.WithIsolatedServer(t)
+	if first.Token() == second.Token() {
+		t.Fatal("Expected each server to have its own token")
+	}
+	if token := os.Getenv(bintest.TokenEnvVar); token != "" {
+		t.Fatalf("Expected %s not to be set in the test process, got %q", bintest.TokenEnvVar, token)
+	}
+
+	proxy, err := second.CompileProxy("compiled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+
+	go func() {
+		call := <-proxy.Ch
+		call.Exit(0)
+	}()
+
+	// the proxy needs nothing from the environment to reach its server
+	cmd := exec.Command(proxy.Path)
+	cmd.Env = []string{}
+	if runtime.GOOS == "windows" {
+		cmd.Env = []string{"SystemRoot=" + os.Getenv("SystemRoot")}
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Expected the proxy to run with an empty environment: %v: %s", err, out)
+	}
+}
+
+// newHTTPCall starts a call the way the http transport does and returns the base URL
+// for the rest of its routes
+func newHTTPCall(t *testing.T, server *bintest.Server, path string, pid int) string {
+	t.Helper()
+
+	body := fmt.Sprintf(`{"PID": %d, "Args": [%q]}`, pid, path)
+	resp, err := serverRequest(server, "POST", server.URL+"/calls/new", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var call struct{ ID uint64 }
+	if err := json.NewDecoder(resp.Body).Decode(&call); err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("%s/calls/%d", server.URL, call.ID)
+}
+
+// serverRequest makes a request to the server with its token
+func serverRequest(server *bintest.Server, method, url string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(bintest.TokenHeader, server.Token())
+	return http.DefaultClient.Do(req)
+}
+
+func TestStackedMocksForTheSamePath(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "git")
+
+	outer, err := bintest.NewMock(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outer.CheckAndClose(t)
+
+	outer.Expect("fetch").AndWriteToStdout("outer")
+
+	inner, err := bintest.NewMock(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner.Expect("fetch").AndWriteToStdout("inner")
+
+	out, err := exec.Command(inner.Path, "fetch").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "inner" {
+		t.Fatalf("Expected the inner mock to handle the call, got %q", out)
+	}
+
+	// closing the inner mock re-activates the outer one
+	if err := inner.CheckAndClose(t); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err = exec.Command(outer.Path, "fetch").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "outer" {
+		t.Fatalf("Expected the outer mock to handle the call, got %q", out)
+	}
+}
@@ -0,0 +1,151 @@
+package bintest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// DefaultSessionTimeout is how long Session.ExpectLine waits for a line by default
+const DefaultSessionTimeout = 10 * time.Second
+
+// Session scripts an interactive call, like an expect script in reverse. The mock plays the
+// interactive command, writing prompts with Send and SendLine and reading the answers of the
+// command under test with ExpectLine
+type Session struct {
+	// Call is the call being scripted
+	Call *Call
+
+	timeout time.Duration
+	lines   chan sessionLine
+	done    chan struct{}
+	err     error
+}
+
+type sessionLine struct {
+	line string
+	err  error
+}
+
+// AndInteract causes the invoker to be scripted by f. When f returns the call exits with the
+// exit code set by AndExitWith, or 1 if the session failed, in which case Check fails too
+func (e *Expectation) AndInteract(f func(s *Session)) *Expectation {
+	return e.AndCallFunc(func(c *Call) {
+		s := &Session{Call: c, timeout: DefaultSessionTimeout, done: make(chan struct{})}
+		f(s)
+		close(s.done)
+
+		// stop the reader, which may be waiting for a line that will never come
+		_ = c.Stdin.Close()
+
+		if s.err != nil {
+			e.Lock()
+			e.interactErrors = append(e.interactErrors, s.err.Error())
+			e.Unlock()
+			writeCallError(c, "Error: %v", s.err)
+			c.Exit(1)
+			return
+		}
+		c.Exit(e.getExitCode())
+	})
+}
+
+// SetTimeout sets how long ExpectLine waits for a line
+func (s *Session) SetTimeout(d time.Duration) {
+	s.timeout = d
+}
+
+// Err returns the first failure in the session, after which Send, SendLine and ExpectLine
+// do nothing
+func (s *Session) Err() error {
+	return s.err
+}
+
+// Send writes str to stdout, like a prompt without a newline
+func (s *Session) Send(str string) {
+	if s.err != nil {
+		return
+	}
+	if _, err := io.WriteString(s.Call.Stdout, str); err != nil {
+		s.err = fmt.Errorf("Failed to send %q: %w", str, err)
+	}
+}
+
+// SendLine writes str and a newline to stdout
+func (s *Session) SendLine(str string) {
+	s.Send(str + "\n")
+}
+
+// ExpectLine reads the next line from stdin and checks it matches match, a string or a
+// Matcher. The line is returned without its line ending
+func (s *Session) ExpectLine(match interface{}) string {
+	if s.err != nil {
+		return ""
+	}
+
+	if s.lines == nil {
+		s.lines = make(chan sessionLine)
+		go s.readLines()
+	}
+
+	var l sessionLine
+	select {
+	case l = <-s.lines:
+	case <-time.After(s.timeout):
+		s.err = fmt.Errorf("Timed out after %v waiting for a line matching %s", s.timeout, describeMatch(match))
+		return ""
+	}
+
+	if l.err != nil {
+		s.err = fmt.Errorf("Expected a line matching %s, got %v", describeMatch(match), l.err)
+		return ""
+	}
+
+	switch m := match.(type) {
+	case string:
+		if l.line != m {
+			s.err = fmt.Errorf("Expected line %q, got %q", m, l.line)
+		}
+	case Matcher:
+		if ok, msg := m.Match(l.line); !ok {
+			s.err = fmt.Errorf("Expected line to match %s, got %q: %s", m, l.line, msg)
+		}
+	default:
+		panic(fmt.Sprintf("Unhandled line matcher type %T", match))
+	}
+	return l.line
+}
+
+// readLines sends lines from stdin to s.lines until the session is done, and then the error
+// that stopped it for any further reads
+func (s *Session) readLines() {
+	r := bufio.NewReader(s.Call.Stdin)
+	for {
+		line, err := r.ReadString('\n')
+		if line != "" {
+			select {
+			case s.lines <- sessionLine{line: strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")}:
+			case <-s.done:
+				return
+			}
+		}
+		if err != nil {
+			for {
+				select {
+				case s.lines <- sessionLine{err: err}:
+				case <-s.done:
+					return
+				}
+			}
+		}
+	}
+}
+
+func describeMatch(match interface{}) string {
+	if str, ok := match.(string); ok {
+		return fmt.Sprintf("%q", str)
+	}
+	return fmt.Sprintf("%v", match)
+}
@@ -0,0 +1,108 @@
+package bintest_test
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildkite/bintest/v3"
+	"github.com/buildkite/bintest/v3/testutil"
+	"github.com/fortytw2/leaktest"
+)
+
+func TestMockAndInteract(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	m, close := mustMock(t, "login")
+	defer close()
+
+	m.Expect().AndInteract(func(s *bintest.Session) {
+		s.Send("Username: ")
+		user := s.ExpectLine("llama")
+		s.Send("Password: ")
+		s.ExpectLine(bintest.MatchPattern("^hunter"))
+		s.SendLine("Welcome " + user)
+	})
+
+	cmd := exec.Command(m.Path)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(stdout)
+	expectPrompt := func(prompt string) {
+		t.Helper()
+		buf := make([]byte, len(prompt))
+		if _, err := io.ReadFull(r, buf); err != nil || string(buf) != prompt {
+			t.Fatalf("Expected prompt %q, got %q (%v)", prompt, buf, err)
+		}
+	}
+
+	expectPrompt("Username: ")
+	fmt.Fprintln(stdin, "llama")
+	expectPrompt("Password: ")
+	fmt.Fprintln(stdin, "hunter2")
+	expectPrompt("Welcome llama\n")
+
+	if err := cmd.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	m.Check(t)
+}
+
+func TestMockAndInteractTimesOut(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	m, close := mustMock(t, "sudo")
+	defer close()
+
+	m.Expect("true").AndInteract(func(s *bintest.Session) {
+		s.SetTimeout(100 * time.Millisecond)
+		s.Send("[sudo] password for llama: ")
+		s.ExpectLine("hunter2")
+		s.SendLine("never sent")
+	})
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(m.Path, "true")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	// stdin is left open, but nothing is written to it
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+
+	if err := cmd.Run(); err == nil {
+		t.Fatal("Expected the call to fail")
+	}
+	if stdout.String() != "[sudo] password for llama: " {
+		t.Fatalf("Unexpected stdout %q", stdout.String())
+	}
+	if expected := `Timed out after 100ms waiting for a line matching "hunter2"`; !strings.Contains(stderr.String(), expected) {
+		t.Fatalf("Expected stderr to contain %q, got %q", expected, stderr.String())
+	}
+
+	mt := &testutil.TestingT{}
+	if m.Check(mt) {
+		t.Fatal("Expected the check to fail")
+	}
+	if len(mt.Logs) != 1 || !strings.HasPrefix(mt.Logs[0], `Interaction with [sudo "true"] failed (declared at session_test.go:`) {
+		t.Fatalf("Unexpected logs %q", mt.Logs)
+	}
+}
@@ -0,0 +1,109 @@
+package bintest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Snapshot compares the invocations of mocks, in the order they were started, to the
+// snapshot stored in testdata/<test name>.snapshot. When UpdateGoldenEnvVar is set the
+// snapshot is written instead. Timestamps aren't included, and the working directory is
+// relative to the test's. Invocations that run concurrently are ordered by when they started,
+// so they may not be deterministic. The test name comes from t's Name method, like the one
+// *testing.T has
+func Snapshot(t TestingT, mocks ...*Mock) {
+	if h, ok := t.(helper); ok {
+		h.Helper()
+	}
+
+	named, ok := t.(interface{ Name() string })
+	if !ok {
+		t.Errorf("Snapshot needs a Name method on %T to name the snapshot", t)
+		failNow(t)
+		return
+	}
+
+	var transcript Transcript
+	for _, m := range mocks {
+		transcript = append(transcript, m.Transcript()...)
+	}
+	sort.SliceStable(transcript, func(i, j int) bool {
+		return transcript[i].StartedAt.Before(transcript[j].StartedAt)
+	})
+
+	actual := formatSnapshot(transcript)
+	path := filepath.Join("testdata", snapshotName(named.Name())+".snapshot")
+
+	if updateGolden() {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Errorf("Failed to update snapshot: %v", err)
+			failNow(t)
+			return
+		}
+		if err := os.WriteFile(path, []byte(actual), 0o644); err != nil {
+			t.Errorf("Failed to update snapshot: %v", err)
+			failNow(t)
+		}
+		return
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Errorf("Snapshot %s can't be read, set %s=true to create it: %v", path, UpdateGoldenEnvVar, err)
+		return
+	}
+
+	if expected := string(b); expected != actual {
+		t.Errorf("Invocations didn't match snapshot %s: %s\n\nGot:\n%s", path, diffLines(expected, actual), actual)
+	}
+}
+
+var snapshotNameRegex = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// snapshotName makes a test name safe to use as a file name
+func snapshotName(name string) string {
+	return snapshotNameRegex.ReplaceAllString(name, "_")
+}
+
+func formatSnapshot(transcript Transcript) string {
+	wd, _ := os.Getwd()
+
+	var b strings.Builder
+	for _, entry := range transcript {
+		b.WriteString(entry.Name)
+		for _, arg := range entry.Args {
+			b.WriteString(" " + quoteArg(arg))
+		}
+		b.WriteString("\n")
+
+		if rel, err := filepath.Rel(wd, entry.Dir); err == nil && entry.Dir != "" {
+			if rel != "." {
+				fmt.Fprintf(&b, "  dir %s\n", filepath.ToSlash(rel))
+			}
+		}
+		for _, e := range entry.Env {
+			fmt.Fprintf(&b, "  env %s\n", quoteArg(e))
+		}
+		if entry.StdinSHA256 != "" {
+			fmt.Fprintf(&b, "  stdin sha256:%s\n", entry.StdinSHA256)
+		}
+		if !entry.Expected {
+			b.WriteString("  unexpected\n")
+		}
+		fmt.Fprintf(&b, "  exit %d\n", entry.ExitCode)
+	}
+	return b.String()
+}
+
+// quoteArg quotes s if it's empty or has characters that would make it ambiguous
+func quoteArg(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\n\"'\\") {
+		return strconv.Quote(s)
+	}
+	return s
+}
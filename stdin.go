@@ -0,0 +1,257 @@
+package bintest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// WithStdinBytes expects the stdin received by the command to be exactly b. Mismatches are
+// reported by size and offset rather than content, so it suits large or binary stdin
+func (e *Expectation) WithStdinBytes(b []byte) *Expectation {
+	return e.WithStdin(&stdinBytesMatcher{expected: append([]byte(nil), b...)})
+}
+
+// WithStdinSHA256 expects the hex-encoded sha256 of the stdin received by the command to be
+// hash, so large payloads can be asserted without keeping a copy in the test
+func (e *Expectation) WithStdinSHA256(hash string) *Expectation {
+	return e.WithStdin(&stdinSHA256Matcher{expected: strings.ToLower(hash)})
+}
+
+// WithStdinJSON expects the stdin received by the command to be JSON that is structurally
+// equal to expected, which can be a string or []byte of JSON or a value to marshal. Whitespace
+// and the order of object keys don't matter
+func (e *Expectation) WithStdinJSON(expected interface{}) *Expectation {
+	var raw []byte
+	switch v := expected.(type) {
+	case string:
+		raw = []byte(v)
+	case []byte:
+		raw = v
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			panic(fmt.Sprintf("Can't marshal expected stdin JSON: %v", err))
+		}
+		raw = b
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		panic(fmt.Sprintf("Expected stdin isn't valid JSON: %v", err))
+	}
+	return e.WithStdin(&stdinJSONMatcher{expected: value, raw: string(raw)})
+}
+
+// stdinJSONMatcher matches stdin that is structurally equal JSON
+type stdinJSONMatcher struct {
+	expected interface{}
+	raw      string
+}
+
+func (m *stdinJSONMatcher) Match(s string) (bool, string) {
+	var actual interface{}
+	if err := json.Unmarshal([]byte(s), &actual); err != nil {
+		return false, fmt.Sprintf("Stdin isn't valid JSON: %v", err)
+	}
+	if diff := diffJSON("$", m.expected, actual); diff != "" {
+		return false, diff
+	}
+	return true, ""
+}
+
+func (m *stdinJSONMatcher) describeStdinMismatch(got []byte) string {
+	if ok, msg := m.Match(string(got)); !ok {
+		return msg
+	}
+	return ""
+}
+
+func (m *stdinJSONMatcher) String() string {
+	return fmt.Sprintf("JSON %s", shortenJSON(m.raw))
+}
+
+// diffJSON describes the first difference between two unmarshalled JSON values, or returns
+// an empty string if they are equal. path is where the values are, like $.metadata.name
+func diffJSON(path string, expected, actual interface{}) string {
+	switch e := expected.(type) {
+	case map[string]interface{}:
+		a, ok := actual.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(e)+len(a))
+		for k := range e {
+			keys = append(keys, k)
+		}
+		for k := range a {
+			if _, ok := e[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			ev, eok := e[k]
+			av, aok := a[k]
+			switch {
+			case !aok:
+				return fmt.Sprintf("Expected %s.%s to be set", path, k)
+			case !eok:
+				return fmt.Sprintf("Expected %s.%s to not be set", path, k)
+			}
+			if diff := diffJSON(path+"."+k, ev, av); diff != "" {
+				return diff
+			}
+		}
+		return ""
+	case []interface{}:
+		a, ok := actual.([]interface{})
+		if !ok {
+			break
+		}
+		if len(e) != len(a) {
+			return fmt.Sprintf("Expected %s to have %d items, got %d", path, len(e), len(a))
+		}
+		for i := range e {
+			if diff := diffJSON(fmt.Sprintf("%s[%d]", path, i), e[i], a[i]); diff != "" {
+				return diff
+			}
+		}
+		return ""
+	}
+
+	if reflect.DeepEqual(expected, actual) {
+		return ""
+	}
+	eb, _ := json.Marshal(expected)
+	ab, _ := json.Marshal(actual)
+	return fmt.Sprintf("Expected %s to be %s, got %s", path, shortenJSON(string(eb)), shortenJSON(string(ab)))
+}
+
+// shortenJSON truncates JSON for failure messages, it's usually too long to print whole
+func shortenJSON(s string) string {
+	if len(s) > 80 {
+		return s[:80] + "…"
+	}
+	return s
+}
+
+// WithStdinLines expects each line of the stdin received by the command to match the
+// corresponding matcher, either a string or a Matcher, and that there are as many lines as
+// matchers. The first line that doesn't match is reported. Line endings aren't included
+func (e *Expectation) WithStdinLines(matchers ...interface{}) *Expectation {
+	for _, m := range matchers {
+		switch m.(type) {
+		case string, Matcher:
+		default:
+			panic(fmt.Sprintf("Unhandled stdin line matcher type %T", m))
+		}
+	}
+	return e.WithStdin(&stdinLinesMatcher{matchers: matchers})
+}
+
+// stdinLinesMatcher matches stdin line by line
+type stdinLinesMatcher struct {
+	matchers []interface{}
+}
+
+func (m *stdinLinesMatcher) Match(s string) (bool, string) {
+	lines := strings.Split(s, "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	for i, line := range lines {
+		if i >= len(m.matchers) {
+			break
+		}
+		line = strings.TrimSuffix(line, "\r")
+		switch matcher := m.matchers[i].(type) {
+		case string:
+			if line != matcher {
+				return false, fmt.Sprintf("Expected line %d to be %q, got %q", i+1, matcher, line)
+			}
+		case Matcher:
+			if ok, msg := matcher.Match(line); !ok {
+				return false, fmt.Sprintf("Expected line %d to match %s, got %q: %s", i+1, matcher, line, msg)
+			}
+		}
+	}
+
+	if len(lines) != len(m.matchers) {
+		return false, fmt.Sprintf("Expected %d lines, got %d", len(m.matchers), len(lines))
+	}
+	return true, ""
+}
+
+func (m *stdinLinesMatcher) describeStdinMismatch(got []byte) string {
+	if ok, msg := m.Match(string(got)); !ok {
+		return msg
+	}
+	return ""
+}
+
+func (m *stdinLinesMatcher) String() string {
+	return fmt.Sprintf("lines %s", FormatInterfaces(m.matchers))
+}
+
+// stdinMatcher is implemented by stdin matchers that describe mismatches themselves, as
+// stdin may be too large or binary to print
+type stdinMatcher interface {
+	Matcher
+
+	// describeStdinMismatch returns why got doesn't match, or an empty string if it does
+	describeStdinMismatch(got []byte) string
+}
+
+// stdinBytesMatcher matches stdin byte for byte
+type stdinBytesMatcher struct {
+	expected []byte
+}
+
+func (m *stdinBytesMatcher) Match(s string) (bool, string) {
+	msg := m.describeStdinMismatch([]byte(s))
+	return msg == "", msg
+}
+
+func (m *stdinBytesMatcher) describeStdinMismatch(got []byte) string {
+	if bytes.Equal(m.expected, got) {
+		return ""
+	}
+	i := 0
+	for i < len(m.expected) && i < len(got) && m.expected[i] == got[i] {
+		i++
+	}
+	return fmt.Sprintf("Got %d bytes, first difference at byte %d", len(got), i)
+}
+
+func (m *stdinBytesMatcher) String() string {
+	return fmt.Sprintf("%d bytes", len(m.expected))
+}
+
+// stdinSHA256Matcher matches the sha256 of stdin
+type stdinSHA256Matcher struct {
+	expected string
+}
+
+func (m *stdinSHA256Matcher) Match(s string) (bool, string) {
+	msg := m.describeStdinMismatch([]byte(s))
+	return msg == "", msg
+}
+
+func (m *stdinSHA256Matcher) describeStdinMismatch(got []byte) string {
+	sum := sha256.Sum256(got)
+	if actual := hex.EncodeToString(sum[:]); actual != m.expected {
+		return fmt.Sprintf("Got sha256 %s of %d bytes", actual, len(got))
+	}
+	return ""
+}
+
+func (m *stdinSHA256Matcher) String() string {
+	return fmt.Sprintf("sha256 %s", m.expected)
+}
@@ -0,0 +1,112 @@
+package bintest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/bintest/v3/testutil"
+)
+
+func TestDiffJSON(t *testing.T) {
+	var testCases = []struct {
+		expected, actual string
+		diff             string
+	}{
+		{`{"a": 1, "b": [1, 2]}`, `{"b":[1,2],"a":1}`, ``},
+		{`{"a": 1}`, `{"a": 2}`, `Expected $.a to be 1, got 2`},
+		{`{"a": 1}`, `{}`, `Expected $.a to be set`},
+		{`{}`, `{"b": true}`, `Expected $.b to not be set`},
+		{`{"a": [1, 2]}`, `{"a": [1]}`, `Expected $.a to have 2 items, got 1`},
+		{`[{"name": "llama"}]`, `[{"name": "alpaca"}]`, `Expected $[0].name to be "llama", got "alpaca"`},
+		{`{"a": {"b": 1}}`, `{"a": "b"}`, `Expected $.a to be {"b":1}, got "b"`},
+	}
+
+	for _, test := range testCases {
+		var expected, actual interface{}
+		if err := json.Unmarshal([]byte(test.expected), &expected); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal([]byte(test.actual), &actual); err != nil {
+			t.Fatal(err)
+		}
+		if diff := diffJSON("$", expected, actual); diff != test.diff {
+			t.Errorf("Expected diff of %s and %s to be %q, got %q", test.expected, test.actual, test.diff, diff)
+		}
+	}
+}
+
+func TestStdinLinesMatcher(t *testing.T) {
+	m := &stdinLinesMatcher{matchers: []interface{}{"protocol=https", MatchPattern(`^host=`), MatchAny()}}
+
+	var testCases = []struct {
+		stdin string
+		msg   string
+	}{
+		{"protocol=https\nhost=github.com\npath=x\n", ""},
+		{"protocol=https\r\nhost=github.com\r\npath=x", ""},
+		{"protocol=http\nhost=github.com\npath=x\n", `Expected line 1 to be "protocol=https", got "protocol=http"`},
+		{"protocol=https\nusername=llama\npath=x\n", `Expected line 2 to match bintest.MatchPattern("^host="), got "username=llama": Didn't match pattern ^host=`},
+		{"protocol=https\nhost=github.com\n", `Expected 3 lines, got 2`},
+		{"protocol=https\nhost=github.com\npath=x\n\n", `Expected 3 lines, got 4`},
+	}
+
+	for _, test := range testCases {
+		ok, msg := m.Match(test.stdin)
+		if ok != (test.msg == "") || msg != test.msg {
+			t.Errorf("Expected %q to give %q, got %v and %q", test.stdin, test.msg, ok, msg)
+		}
+	}
+}
+
+// prefixStdinMatcher is a stdinMatcher that isn't known to Expectation
+type prefixStdinMatcher struct {
+	prefix string
+}
+
+func (m *prefixStdinMatcher) Match(s string) (bool, string) {
+	msg := m.describeStdinMismatch([]byte(s))
+	return msg == "", msg
+}
+
+func (m *prefixStdinMatcher) describeStdinMismatch(got []byte) string {
+	if !bytes.HasPrefix(got, []byte(m.prefix)) {
+		return fmt.Sprintf("Got %d bytes without the prefix", len(got))
+	}
+	return ""
+}
+
+func (m *prefixStdinMatcher) String() string {
+	return fmt.Sprintf("prefix %q", m.prefix)
+}
+
+func TestCheckStdinLetsStdinMatchersDescribeMismatches(t *testing.T) {
+	binary := []byte{0xff, 0x00, '\n', 'l', 'l', 'a', 'm', 'a'}
+
+	var testCases = []struct {
+		stdin interface{}
+		log   string
+	}{
+		{&stdinBytesMatcher{expected: []byte("llama")}, "Expected stdin to match 5 bytes: Got 8 bytes, first difference at byte 0"},
+		{&stdinSHA256Matcher{expected: "abc"}, "Expected stdin to match sha256 abc: Got sha256 "},
+		{&stdinJSONMatcher{expected: map[string]interface{}{}, raw: `{}`}, "Expected stdin to match JSON {}: Stdin isn't valid JSON: "},
+		{&stdinLinesMatcher{matchers: []interface{}{"llama"}}, `Expected stdin to match lines "llama": Expected line 1 to be "llama", got `},
+		{&prefixStdinMatcher{prefix: "llama"}, `Expected stdin to match prefix "llama": Got 8 bytes without the prefix`},
+	}
+
+	for _, test := range testCases {
+		exp := Expectation{stdin: test.stdin, readStdin: binary}
+		fakeT := &testutil.TestingT{}
+		if exp.checkStdin(fakeT) {
+			t.Fatalf("Expected %s not to match", test.stdin)
+		}
+		if len(fakeT.Logs) != 1 || !strings.HasPrefix(fakeT.Logs[0], test.log) {
+			t.Errorf("Expected a log starting with %q, got %q", test.log, fakeT.Logs)
+		}
+		if strings.Contains(fakeT.Logs[0], fmt.Sprintf("%q", binary)) {
+			t.Errorf("Expected stdin not to be printed, got %q", fakeT.Logs[0])
+		}
+	}
+}
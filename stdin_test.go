@@ -0,0 +1,121 @@
+package bintest_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/bintest/v3"
+	"github.com/buildkite/bintest/v3/testutil"
+	"github.com/fortytw2/leaktest"
+)
+
+func TestCallingMockWithStdinBytesAndSHA256(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	payload := bytes.Repeat([]byte{0x00, 0xff, 0x1f, 0x8b}, 256*1024)
+	sum := sha256.Sum256(payload)
+
+	run := func(m *bintest.Mock, stdin []byte) {
+		cmd := exec.Command(m.Path, "load")
+		cmd.Stdin = bytes.NewReader(stdin)
+		if err := cmd.Run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("matching", func(t *testing.T) {
+		m, close := mustMock(t, "docker")
+		defer close()
+
+		m.Expect("load").WithStdinBytes(payload)
+		m.Expect("load").WithStdinSHA256(hex.EncodeToString(sum[:]))
+		run(m, payload)
+		run(m, payload)
+		m.Check(t)
+	})
+
+	t.Run("different", func(t *testing.T) {
+		m, close := mustMock(t, "docker")
+		defer close()
+
+		different := append([]byte(nil), payload...)
+		different[10] = 'x'
+
+		m.Expect("load").WithStdinBytes(payload)
+		m.Expect("load").WithStdinSHA256(hex.EncodeToString(sum[:]))
+		run(m, different)
+		run(m, different)
+
+		mt := &testutil.TestingT{}
+		if m.Check(mt) {
+			t.Fatal("Expected the check to fail")
+		}
+		logs := strings.Join(mt.Logs, "\n")
+		if expected := "Expected stdin to match 1048576 bytes"; !strings.Contains(logs, expected) || !strings.Contains(logs, "Got 1048576 bytes, first difference at byte 10") {
+			t.Fatalf("Expected logs to describe the difference, got %q", mt.Logs)
+		}
+		if expected := "Expected stdin to match sha256 " + hex.EncodeToString(sum[:]); !strings.Contains(logs, expected) {
+			t.Fatalf("Expected logs to contain %q, got %q", expected, mt.Logs)
+		}
+		if len(logs) > 4096 {
+			t.Fatalf("Expected stdin to not be logged, got %d bytes of logs", len(logs))
+		}
+	})
+}
+
+func TestCallingMockWithStdinJSON(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	m, close := mustMock(t, "kubectl")
+	defer close()
+
+	m.Expect("apply", "-f", "-").WithStdinJSON(map[string]interface{}{
+		"kind":     "Pod",
+		"metadata": map[string]string{"name": "llama"},
+	})
+	m.Expect("apply", "-f", "-").WithStdinJSON(`{"kind": "Deployment"}`)
+
+	for _, stdin := range []string{
+		"{\n  \"metadata\": {\"name\": \"llama\"},\n  \"kind\": \"Pod\"\n}\n",
+		`{"kind": "Service"}`,
+	} {
+		cmd := exec.Command(m.Path, "apply", "-f", "-")
+		cmd.Stdin = strings.NewReader(stdin)
+		if err := cmd.Run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mt := &testutil.TestingT{}
+	if m.Check(mt) {
+		t.Fatal("Expected the check to fail")
+	}
+	if len(mt.Logs) != 1 || !strings.HasPrefix(mt.Logs[0], `Expected stdin to match JSON {"kind": "Deployment"}`) ||
+		!strings.HasSuffix(mt.Logs[0], `Expected $.kind to be "Deployment", got "Service"`) {
+		t.Fatalf("Unexpected logs %q", mt.Logs)
+	}
+}
+
+func TestCallingMockWithStdinLines(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	m, close := mustMock(t, "git-credential-helper")
+	defer close()
+
+	m.Expect("get").WithStdinLines("protocol=https", bintest.MatchPattern(`^host=`)).AndWriteToStdout("password=llamas\n")
+
+	cmd := exec.Command(m.Path, "get")
+	cmd.Stdin = strings.NewReader("protocol=https\nhost=github.com\n")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "password=llamas\n" {
+		t.Fatalf("Unexpected output %q", out)
+	}
+	m.Check(t)
+}
@@ -0,0 +1,167 @@
+package bintest
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// The stream transport runs a whole call over a single connection, with the
+// streams multiplexed as frames of a type byte, a big-endian uint32 length and
+// then the payload.
+const (
+	// frameCall is the JSON encoded callRequest, sent first by the client
+	frameCall byte = 'c'
+
+	// frameStdin is a chunk of stdin from the client, an empty frame is EOF
+	frameStdin byte = 'i'
+
+	// frameStdinRequest is sent by the server the first time the call reads stdin, clients
+	// that sent LazyStdin don't read their stdin until they receive it
+	frameStdinRequest byte = 'r'
+
+	// frameStdout and frameStderr are chunks of output from the server
+	frameStdout byte = 'o'
+	frameStderr byte = 'e'
+
+	// frameFile is a chunk of one of the call's extra files, the first byte of the payload
+	// is the index of the file. Clients send it for read-only files and servers for the
+	// rest, a frame with no data after the index is EOF
+	frameFile byte = 'f'
+
+	// frameExit is the exit code as a big-endian int64, sent last by the server
+	frameExit byte = 'x'
+
+	// maxFrameSize is the largest payload that will be read
+	maxFrameSize = 1 << 20
+
+	// maxExtraFiles is the most extra files that can be forwarded, so an index fits in a byte
+	maxExtraFiles = 256
+
+	// streamUpgrade is the protocol the connection is upgraded to
+	streamUpgrade = `bintest-stream`
+)
+
+func writeFrame(w io.Writer, t byte, payload []byte) error {
+	frame := make([]byte, 5+len(payload))
+	frame[0] = t
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+	copy(frame[5:], payload)
+	_, err := w.Write(frame)
+	return err
+}
+
+func readFrame(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxFrameSize {
+		return 0, nil, fmt.Errorf("Frame of %d bytes exceeds maximum of %d", size, maxFrameSize)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+func exitFramePayload(code int) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(int64(code)))
+	return b
+}
+
+func exitCodeFromFrame(payload []byte) (int, error) {
+	if len(payload) != 8 {
+		return 0, fmt.Errorf("Invalid exit frame of %d bytes", len(payload))
+	}
+	return int(int64(binary.BigEndian.Uint64(payload))), nil
+}
+
+// outputMux sequences writes to stdout and stderr as frames through a single send function,
+// so that the order they were written in is kept when they are demultiplexed
+type outputMux struct {
+	mu      sync.Mutex
+	send    func(t byte, payload []byte) error
+	open    int
+	err     error
+	onClose func()
+}
+
+// newOutputMux returns a mux that sends frames with send, and calls onClose once both the
+// stdout and stderr writers are closed
+func newOutputMux(send func(t byte, payload []byte) error, onClose func()) *outputMux {
+	return &outputMux{send: send, open: 2, onClose: onClose}
+}
+
+// writer returns a writer that sends what is written to it as frames of type t
+func (m *outputMux) writer(t byte) io.WriteCloser {
+	return &muxWriter{mux: m, t: t}
+}
+
+// closeWithError makes further writes fail with err
+func (m *outputMux) closeWithError(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err == nil {
+		m.err = err
+	}
+}
+
+type muxWriter struct {
+	mux    *outputMux
+	t      byte
+	closed bool
+}
+
+func (w *muxWriter) Write(p []byte) (int, error) {
+	w.mux.mu.Lock()
+	defer w.mux.mu.Unlock()
+	if w.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if w.mux.err != nil {
+		return 0, w.mux.err
+	}
+	for written := 0; written < len(p); {
+		chunk := p[written:]
+		if len(chunk) > 32*1024 {
+			chunk = chunk[:32*1024]
+		}
+		if err := w.mux.send(w.t, chunk); err != nil {
+			w.mux.err = err
+			return written, err
+		}
+		written += len(chunk)
+	}
+	return len(p), nil
+}
+
+func (w *muxWriter) Close() error {
+	w.mux.mu.Lock()
+	defer w.mux.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if w.mux.open--; w.mux.open == 0 && w.mux.onClose != nil {
+		w.mux.onClose()
+	}
+	return nil
+}
+
+// lazyReader calls onRead before the first read from the underlying reader, so that stdin
+// is only requested from the client when a call reads it
+type lazyReader struct {
+	io.ReadCloser
+	once   sync.Once
+	onRead func()
+}
+
+func (l *lazyReader) Read(p []byte) (int, error) {
+	l.once.Do(l.onRead)
+	return l.ReadCloser.Read(p)
+}
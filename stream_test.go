@@ -0,0 +1,55 @@
+package bintest
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestExitFrameRoundTripsFullWidthCodes(t *testing.T) {
+	// -1073741515 is the NTSTATUS 0xC0000135 as windows reports it in an int32
+	for _, code := range []int{0, 1, 255, 300, -1, -1073741515} {
+		actual, err := exitCodeFromFrame(exitFramePayload(code))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual != code {
+			t.Errorf("Expected exit code %d, got %d", code, actual)
+		}
+	}
+}
+
+func TestServeStreamRejectsCallsWithoutArgs(t *testing.T) {
+	var in, out bytes.Buffer
+	if err := writeFrame(&in, frameCall, []byte(`{"Args":[]}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	var logged []string
+	s := &Server{}
+	s.SetLogger(LoggerFunc(func(level LogLevel, format string, args ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, args...))
+	}))
+	s.serveStream(&in, bufio.NewWriter(&out))
+
+	var frames []byte
+	for {
+		typ, payload, err := readFrame(&out)
+		if err != nil {
+			break
+		}
+		frames = append(frames, typ)
+		if typ == frameExit {
+			if code, _ := exitCodeFromFrame(payload); code != 1 {
+				t.Errorf("Expected exit code 1, got %d", code)
+			}
+		}
+	}
+	if string(frames) != string([]byte{frameStderr, frameExit}) {
+		t.Fatalf("Expected a stderr and exit frame, got %q", frames)
+	}
+	if len(logged) != 1 || logged[0] != "Expected the call to have args" {
+		t.Errorf("Unexpected logs %q", logged)
+	}
+}
@@ -0,0 +1,67 @@
+package bintest
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Summarize logs a table of every invocation of the mocks to t, in the order they were
+// received, to show what a test actually ran. Call it at the end of the test, for instance
+// with defer or t.Cleanup
+func Summarize(t TestingT, mocks ...*Mock) {
+	if h, ok := t.(helper); ok {
+		h.Helper()
+	}
+	t.Logf("%s", summarize(mocks))
+}
+
+// summarize returns the table that Summarize logs
+func summarize(mocks []*Mock) string {
+	var invocations []Invocation
+	for _, m := range mocks {
+		invocations = append(invocations, m.Invocations()...)
+	}
+	if len(invocations) == 0 {
+		return "No mocked commands were invoked"
+	}
+
+	sort.SliceStable(invocations, func(i, j int) bool {
+		return invocations[i].Sequence < invocations[j].Sequence
+	})
+
+	var buf bytes.Buffer
+	tw := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "COMMAND\tEXIT\tDURATION\tSTDOUT\tSTDERR\n")
+	for _, i := range invocations {
+		command := i.Name
+		for _, arg := range i.Args {
+			command += " " + summaryArg(arg)
+		}
+		exit := strconv.Itoa(i.ExitCode)
+		if i.Expectation == nil {
+			exit += " (unexpected)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%v\t%dB\t%dB\n",
+			command, exit, i.FinishedAt.Sub(i.StartedAt).Round(time.Millisecond), i.StdoutBytes, i.StderrBytes)
+	}
+	_ = tw.Flush()
+
+	return fmt.Sprintf("%d mocked commands were invoked:\n%s", len(invocations), strings.TrimRight(buf.String(), "\n"))
+}
+
+// summaryArg quotes args that would be ambiguous in a space separated command, and
+// shortens long ones to keep the table compact
+func summaryArg(arg string) string {
+	if len(arg) > 40 {
+		arg = arg[:40] + "…"
+	}
+	if arg == "" || strings.ContainsAny(arg, " \t\n\"'") {
+		return strconv.Quote(arg)
+	}
+	return arg
+}
@@ -0,0 +1,56 @@
+package bintest_test
+
+import (
+	"os/exec"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/bintest/v3"
+	"github.com/buildkite/bintest/v3/testutil"
+	"github.com/fortytw2/leaktest"
+)
+
+func TestSummarize(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	git, closeGit := mustMock(t, "git")
+	defer closeGit()
+	docker, closeDocker := mustMock(t, "docker")
+	defer closeDocker()
+
+	git.Expect("commit", "-m", "feed the llamas").AndWriteToStdout("committed\n")
+	docker.Expect("push").AndExitWith(2)
+
+	_ = exec.Command(git.Path, "commit", "-m", "feed the llamas").Run()
+	_ = exec.Command(docker.Path, "push").Run()
+	_ = exec.Command(git.Path, "pull").Run()
+
+	mt := &testutil.TestingT{}
+	bintest.Summarize(mt, git, docker)
+
+	if len(mt.Logs) != 1 {
+		t.Fatalf("Expected a single log, got %q", mt.Logs)
+	}
+	lines := strings.Split(mt.Logs[0], "\n")
+	if len(lines) != 5 || lines[0] != "3 mocked commands were invoked:" {
+		t.Fatalf("Unexpected summary %q", mt.Logs[0])
+	}
+
+	for i, pattern := range []string{
+		`^COMMAND +EXIT +DURATION +STDOUT +STDERR$`,
+		`^git commit -m "feed the llamas" +0 +\S+ +10B +0B$`,
+		`^docker push +2 +\S+ +0B +0B$`,
+		`^git pull +1 \(unexpected\) +\S+ +0B +\d+B$`,
+	} {
+		if !regexp.MustCompile(pattern).MatchString(lines[i+1]) {
+			t.Errorf("Expected line %d to match %s, got %q", i+1, pattern, lines[i+1])
+		}
+	}
+
+	empty := &testutil.TestingT{}
+	bintest.Summarize(empty)
+	if len(empty.Logs) != 1 || empty.Logs[0] != "No mocked commands were invoked" {
+		t.Fatalf("Unexpected logs %q", empty.Logs)
+	}
+}
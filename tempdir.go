@@ -0,0 +1,84 @@
+package bintest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var (
+	// the directory that temp dirs are created in, empty until one has been picked
+	tempDirBase   string
+	tempDirBaseMu sync.Mutex
+
+	// the bases that this process holds an owner lock in
+	ownerLocks = map[string]bool{}
+)
+
+// SetTempDir sets the directory that proxies and the compile cache are created in, which
+// must allow binaries to be executed. An empty dir goes back to picking one automatically.
+// The compile cache stays where it was created, so call it before compiling any proxies
+func SetTempDir(dir string) {
+	tempDirBaseMu.Lock()
+	defer tempDirBaseMu.Unlock()
+	tempDirBase = dir
+}
+
+// mkdirTemp creates a new temp dir like os.MkdirTemp, in a directory that allows binaries
+// to be executed. The pid is added to the pattern so CleanupStale can tell which process
+// the dir belongs to
+func mkdirTemp(pattern string) (string, error) {
+	tempDirBaseMu.Lock()
+	defer tempDirBaseMu.Unlock()
+
+	if tempDirBase == "" {
+		tempDirBase = pickTempDirBase(tempDirCandidates(), canExecIn)
+		debugf("[tempdir] Creating temp dirs in %s", tempDirBase)
+	}
+	base := tempDirBase
+
+	if err := os.MkdirAll(base, 0o700); err != nil {
+		return "", err
+	}
+	if !ownerLocks[base] {
+		// the lock is held until the process exits, which releases it even after a crash
+		if _, err := lockFile(ownerLockPath(base, os.Getpid())); err != nil {
+			return "", fmt.Errorf("Error locking temp dir %s: %v", base, err)
+		}
+		ownerLocks[base] = true
+	}
+	return os.MkdirTemp(base, fmt.Sprintf("%s-%d-", pattern, os.Getpid()))
+}
+
+// ownerLockPath returns the path of the lock file that the process with pid holds while
+// it has temp dirs in base
+func ownerLockPath(base string, pid int) string {
+	return filepath.Join(base, fmt.Sprintf("bintest-owner-%d.lock", pid))
+}
+
+// tempDirCandidates returns the directories to try creating temp dirs in, in order. Temp dirs
+// are often mounted noexec on hardened hosts, so the user's cache dir and the working
+// directory are tried after it
+func tempDirCandidates() []string {
+	candidates := []string{os.TempDir()}
+	if dir, err := os.UserCacheDir(); err == nil {
+		candidates = append(candidates, filepath.Join(dir, "bintest"))
+	}
+	if wd, err := os.Getwd(); err == nil {
+		candidates = append(candidates, filepath.Join(wd, ".bintest"))
+	}
+	return candidates
+}
+
+// pickTempDirBase returns the first candidate that canExec allows binaries to be executed
+// in, or the first candidate if none of them do
+func pickTempDirBase(candidates []string, canExec func(dir string) bool) string {
+	for _, dir := range candidates {
+		if canExec(dir) {
+			return dir
+		}
+		debugf("[tempdir] Can't execute binaries in %s, it may be mounted noexec", dir)
+	}
+	return candidates[0]
+}
@@ -0,0 +1,47 @@
+package bintest
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPickTempDirBaseSkipsNoexecDirs(t *testing.T) {
+	candidates := []string{"/tmp", "/home/llama/.cache/bintest", "/src/.bintest"}
+
+	base := pickTempDirBase(candidates, func(dir string) bool {
+		return dir != "/tmp"
+	})
+	if base != "/home/llama/.cache/bintest" {
+		t.Fatalf("Expected the user cache dir, got %s", base)
+	}
+
+	base = pickTempDirBase(candidates, func(dir string) bool {
+		return false
+	})
+	if base != "/tmp" {
+		t.Fatalf("Expected the first candidate when none can exec, got %s", base)
+	}
+}
+
+func TestCanExecInTempDir(t *testing.T) {
+	if !canExecIn(t.TempDir()) {
+		t.Fatal("Expected to be able to execute binaries in the test's temp dir")
+	}
+}
+
+func TestSetTempDir(t *testing.T) {
+	dir := t.TempDir()
+	SetTempDir(dir)
+	defer SetTempDir("")
+
+	proxy, err := CompileProxy("llamas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+
+	if !strings.HasPrefix(proxy.Path, dir+string(filepath.Separator)) {
+		t.Fatalf("Expected proxy to be created in %s, got %s", dir, proxy.Path)
+	}
+}
@@ -0,0 +1,40 @@
+//go:build !windows
+
+package bintest
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// canExecIn returns whether binaries can be executed in dir, by running a script there.
+// Directories that don't exist yet are created
+func canExecIn(dir string) bool {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return false
+	}
+
+	f, err := os.CreateTemp(dir, "bintest-exec-check")
+	if err != nil {
+		return false
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString("#!/bin/sh\nexit 0\n")
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false
+	}
+	if err := os.Chmod(f.Name(), 0o700); err != nil {
+		return false
+	}
+
+	// anything other than being denied, like there not being a /bin/sh, isn't noexec
+	err = exec.Command(filepath.Clean(f.Name())).Run()
+	return !errors.Is(err, fs.ErrPermission)
+}
@@ -0,0 +1,8 @@
+//go:build windows
+
+package bintest
+
+// canExecIn always returns true, windows doesn't have noexec mounts
+func canExecIn(dir string) bool {
+	return true
+}
@@ -0,0 +1,307 @@
+package bintest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TLSEnvVar is the certificates clients use to call servers that require mutual TLS, for
+// clients that don't have them compiled in, like test binaries linked with
+// LinkTestBinaryAsProxy. See ClientTLSConfig
+const TLSEnvVar = `BINTEST_TLS`
+
+// MutualTLS makes servers started from then on only accept calls over TLS from clients
+// with a certificate that the server issued, for environments that don't allow
+// unauthenticated listeners. Each server generates its own certificates, which are compiled
+// into its proxies, and which PersistRemote saves with its token. It must be set before the
+// servers are started
+var MutualTLS bool
+
+const (
+	// caLifetime is how long the CA and client certificates servers generate are valid for.
+	// They're compiled into proxies, which outlive the server when PersistRemote restores them
+	caLifetime = 10 * 365 * 24 * time.Hour
+
+	// certificateLifetime is how long the certificates servers present are valid for, they're
+	// renewed a day before they expire so that long-running servers keep working
+	certificateLifetime = 7 * 24 * time.Hour
+)
+
+// serverTLS is the certificates of a server with MutualTLS
+type serverTLS struct {
+	sync.Mutex
+	hostname string
+	ca       *x509.Certificate
+	caKey    *ecdsa.PrivateKey
+
+	// bundle is the client certificate, see tlsBundle
+	bundle string
+
+	// certificate is the server's, it's issued by ca when it's needed
+	certificate *tls.Certificate
+}
+
+// enableMutualTLS generates certificates for the server and its clients, and wraps the
+// server's listener to require TLS with a client certificate
+func (s *Server) enableMutualTLS(host string) error {
+	ca, caKey, err := newCertificate(nil, nil, pkix.Name{CommonName: "bintest CA"}, nil)
+	if err != nil {
+		return err
+	}
+
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+
+	s.tls = &serverTLS{hostname: hostname}
+	if err := s.tls.setCA(ca, caKey); err != nil {
+		return err
+	}
+
+	s.Listener = tls.NewListener(s.Listener, &tls.Config{
+		GetConfigForClient: s.tls.config,
+		MinVersion:         tls.VersionTLS12,
+	})
+	s.URL = "https://" + strings.TrimPrefix(s.URL, "http://")
+
+	return nil
+}
+
+// clientTLSBundle returns the certificates for the server's clients, or an empty string if
+// it doesn't use MutualTLS
+func (s *Server) clientTLSBundle() string {
+	if s.tls == nil {
+		return ""
+	}
+	s.tls.Lock()
+	defer s.tls.Unlock()
+	return s.tls.bundle
+}
+
+// setCA switches to a CA and issues a client certificate from it. The server's certificate
+// is issued again when it's next needed
+func (st *serverTLS) setCA(ca *x509.Certificate, caKey *ecdsa.PrivateKey) error {
+	clientCert, clientKey, err := newCertificate(ca, caKey, pkix.Name{CommonName: "bintest client"}, nil)
+	if err != nil {
+		return err
+	}
+
+	bundle, err := tlsBundle(ca, clientCert, clientKey)
+	if err != nil {
+		return err
+	}
+
+	st.Lock()
+	defer st.Unlock()
+	st.ca, st.caKey, st.bundle, st.certificate = ca, caKey, bundle, nil
+	return nil
+}
+
+// config returns the TLS config for a connection, renewing the server's certificate if it
+// expires within a day
+func (st *serverTLS) config(*tls.ClientHelloInfo) (*tls.Config, error) {
+	st.Lock()
+	defer st.Unlock()
+
+	if st.certificate == nil || time.Now().Add(24*time.Hour).After(st.certificate.Leaf.NotAfter) {
+		cert, key, err := newCertificate(st.ca, st.caKey, pkix.Name{CommonName: st.hostname},
+			[]string{st.hostname, "localhost", "127.0.0.1", "::1"})
+		if err != nil {
+			return nil, err
+		}
+		st.certificate = &tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key, Leaf: cert}
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(st.ca)
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{*st.certificate},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// savedTLS is how PersistRemote saves the certificates of a server with MutualTLS, so that
+// its proxies keep working after it's restarted
+type savedTLS struct {
+	// CA is the PEM encoded CA certificate and key
+	CA string `json:"ca"`
+
+	// Bundle is the client certificate, see tlsBundle
+	Bundle string `json:"bundle"`
+}
+
+// save returns the certificates for saving
+func (st *serverTLS) save() (*savedTLS, error) {
+	st.Lock()
+	defer st.Unlock()
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(st.caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var b []byte
+	b = append(b, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: st.ca.Raw})...)
+	b = append(b, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})...)
+
+	return &savedTLS{CA: string(b), Bundle: st.bundle}, nil
+}
+
+// restore switches to saved certificates
+func (st *serverTLS) restore(saved *savedTLS) error {
+	caBlock, rest := pem.Decode([]byte(saved.CA))
+	keyBlock, _ := pem.Decode(rest)
+	if caBlock == nil || keyBlock == nil {
+		return errors.New("Expected a CA and a key in the saved TLS certificates")
+	}
+
+	ca, err := x509.ParseCertificate(caBlock.Bytes)
+	if err != nil {
+		return fmt.Errorf("Failed to parse saved TLS CA: %v", err)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return fmt.Errorf("Failed to parse saved TLS key: %v", err)
+	}
+	caKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return errors.New("Expected the saved TLS key to be an ECDSA key")
+	}
+
+	// the client certificate is the one compiled into proxies, so it's kept as it was
+	if _, err := ClientTLSConfig(saved.Bundle); err != nil {
+		return err
+	}
+
+	st.Lock()
+	defer st.Unlock()
+	st.ca, st.caKey, st.bundle, st.certificate = ca, caKey, saved.Bundle, nil
+	return nil
+}
+
+// newCertificate creates a certificate signed by parent, or a self-signed CA if parent is
+// nil. Certificates with hosts are for servers, the others are for clients
+func newCertificate(parent *x509.Certificate, parentKey *ecdsa.PrivateKey, subject pkix.Name, hosts []string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(caLifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+
+	switch {
+	case parent == nil:
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	case len(hosts) > 0:
+		template.NotAfter = time.Now().Add(certificateLifetime)
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		for _, h := range hosts {
+			if ip := net.ParseIP(h); ip != nil {
+				template.IPAddresses = append(template.IPAddresses, ip)
+			} else {
+				template.DNSNames = append(template.DNSNames, h)
+			}
+		}
+	default:
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cert, key, nil
+}
+
+// tlsBundle encodes the CA and a client certificate and key as PEM, base64 encoded so that
+// it can be compiled in with -ldflags or put in the environment
+func tlsBundle(ca, cert *x509.Certificate, key *ecdsa.PrivateKey) (string, error) {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	var b []byte
+	b = append(b, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})...)
+	b = append(b, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	b = append(b, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})...)
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// ClientTLSConfig returns the TLS config for a client from the certificates a server with
+// MutualTLS generated for it, see TLSEnvVar
+func ClientTLSConfig(bundle string) (*tls.Config, error) {
+	b, err := base64.RawURLEncoding.DecodeString(bundle)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode TLS certificates: %v", err)
+	}
+
+	var blocks []*pem.Block
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		blocks = append(blocks, block)
+	}
+	if len(blocks) != 3 {
+		return nil, errors.New("Expected a CA, a certificate and a key in the TLS certificates")
+	}
+
+	ca, err := x509.ParseCertificate(blocks[0].Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse TLS CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	cert, err := tls.X509KeyPair(pem.EncodeToMemory(blocks[1]), pem.EncodeToMemory(blocks[2]))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse TLS certificate: %v", err)
+	}
+
+	return &tls.Config{
+		RootCAs:      pool,
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
@@ -0,0 +1,100 @@
+package bintest
+
+import (
+	"context"
+	"crypto/x509/pkix"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPersistRemoteRestoresMutualTLSCertificates(t *testing.T) {
+	MutualTLS = true
+	defer func() {
+		MutualTLS = false
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	statePath := filepath.Join(t.TempDir(), "state.json")
+
+	first, err := NewServerOn("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.EnableRemote("secret")
+	if err := first.PersistRemote(statePath); err != nil {
+		t.Fatal(err)
+	}
+	bundle := first.clientTLSBundle()
+	if err := first.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := NewServerOn(first.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := second.Shutdown(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+	second.EnableRemote("secret")
+	if err := second.PersistRemote(statePath); err != nil {
+		t.Fatal(err)
+	}
+	if second.clientTLSBundle() != bundle {
+		t.Fatalf("Expected the restarted server to restore its certificates")
+	}
+
+	// a client with the first server's certificate can still call it
+	config, err := ClientTLSConfig(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+
+	req, err := http.NewRequest("GET", second.URL+"/remote/mocks/llamas", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected the request to reach the remote API, got %s", resp.Status)
+	}
+}
+
+func TestServerTLSRenewsExpiringCertificates(t *testing.T) {
+	ca, caKey, err := newCertificate(nil, nil, pkix.Name{CommonName: "bintest CA"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := &serverTLS{hostname: "127.0.0.1"}
+	if err := st.setCA(ca, caKey); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := st.config(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issued := config.Certificates[0].Leaf
+
+	if config, err = st.config(nil); err != nil || config.Certificates[0].Leaf != issued {
+		t.Fatalf("Expected the certificate to be reused, got %v", err)
+	}
+
+	st.certificate.Leaf.NotAfter = time.Now().Add(time.Hour)
+	if config, err = st.config(nil); err != nil || config.Certificates[0].Leaf == issued {
+		t.Fatalf("Expected the expiring certificate to be renewed, got %v", err)
+	}
+}
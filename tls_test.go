@@ -0,0 +1,63 @@
+package bintest_test
+
+import (
+	"crypto/tls"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/bintest/v3"
+)
+
+func TestMutualTLS(t *testing.T) {
+	bintest.MutualTLS = true
+	defer func() {
+		bintest.MutualTLS = false
+	}()
+
+	server := bintest.WithIsolatedServer(t)
+	if !strings.HasPrefix(server.URL, "https://") {
+		t.Fatalf("Expected the server to use TLS, got %s", server.URL)
+	}
+
+	m, err := server.NewMock("llamas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.CheckAndClose(t)
+
+	transports := []string{bintest.TransportHTTP, bintest.TransportStream, bintest.TransportWebSocket}
+	m.Expect("eat").AndWriteToStdout("yum").Exactly(len(transports))
+
+	for _, transport := range transports {
+		cmd := exec.Command(m.Path, "eat")
+		cmd.Env = append(os.Environ(), bintest.TransportEnvVar+"="+transport)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("%s: %v: %s", transport, err, out)
+		}
+		if string(out) != "yum" {
+			t.Fatalf("%s: Unexpected output %q", transport, out)
+		}
+	}
+
+	// clients without a certificate from the server are rejected, even if they skip
+	// verifying the server's
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	if resp, err := client.Post(server.URL+"/calls/new", "application/json", strings.NewReader(`{}`)); err == nil {
+		_ = resp.Body.Close()
+		t.Fatalf("Expected a client without a certificate to be rejected, got %s", resp.Status)
+	}
+}
+
+func TestClientTLSConfigRejectsInvalidBundles(t *testing.T) {
+	for _, bundle := range []string{"not base64!", "bGxhbWFz"} {
+		if _, err := bintest.ClientTLSConfig(bundle); err == nil {
+			t.Errorf("Expected an error for %q", bundle)
+		}
+	}
+}
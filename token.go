@@ -0,0 +1,63 @@
+package bintest
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+)
+
+const (
+	// TokenEnvVar is the token clients send to the server, for clients that don't have it
+	// compiled in, like test binaries linked with LinkTestBinaryAsProxy
+	TokenEnvVar = `BINTEST_TOKEN`
+
+	// TokenHeader is the header that requests to the server send its token in
+	TokenHeader = `Bintest-Token`
+)
+
+// Token returns the secret that proxies have to send with every request to the server.
+// Servers generate a random one when they start, so that other processes can't make calls
+func (s *Server) Token() string {
+	s.tokenMu.RLock()
+	defer s.tokenMu.RUnlock()
+	return s.token
+}
+
+// setToken changes the server's token, for restoring a server's state. Proxies compiled
+// with the old one are rejected from then on
+func (s *Server) setToken(token string) {
+	s.tokenMu.Lock()
+	defer s.tokenMu.Unlock()
+	s.token = token
+}
+
+// authorized returns whether r has the server's token
+func (s *Server) authorized(r *http.Request) bool {
+	token := s.Token()
+	if token == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get(TokenHeader)), []byte(token)) == 1
+}
+
+// clientVars are the variables compiled into the server's proxies
+func (s *Server) clientVars() []string {
+	vars := []string{
+		"main.server=" + s.URL,
+	}
+	if token := s.Token(); token != "" {
+		vars = append(vars, "main.token="+token)
+	}
+	if bundle := s.clientTLSBundle(); bundle != "" {
+		vars = append(vars, "main.tlsBundle="+bundle)
+	}
+	return vars
+}
+
+// randomToken returns a random hex string for a server's token
+func randomToken() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
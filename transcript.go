@@ -0,0 +1,128 @@
+package bintest
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// TranscriptEntry is a structured record of a single invocation of a mock
+type TranscriptEntry struct {
+	Name string   `json:"name"`
+	Args []string `json:"args"`
+
+	// Sequence orders entries across mocks, Parent is the Sequence of the entry that made
+	// this one, see Call.ParentSequence
+	Sequence uint64 `json:"sequence"`
+	Parent   uint64 `json:"parent,omitempty"`
+
+	// Env only contains the variables that differ from the test process environment
+	Env []string `json:"env,omitempty"`
+	Dir string   `json:"dir"`
+
+	// StdinSHA256 is the hash of all of the stdin that was read, including any past the
+	// capture limit, and StdinBytes is how much was read
+	StdinSHA256 string `json:"stdinSha256,omitempty"`
+	StdinBytes  int64  `json:"stdinBytes,omitempty"`
+
+	// Stdout and Stderr are the captured output, see Mock.CaptureOutputLimit
+	Stdout string `json:"stdout,omitempty"`
+	Stderr string `json:"stderr,omitempty"`
+
+	ExitCode   int       `json:"exitCode"`
+	Expected   bool      `json:"expected"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+}
+
+// Transcript is an ordered record of the invocations of a mock
+type Transcript []TranscriptEntry
+
+// WriteJSON writes the transcript to w as indented JSON
+func (t Transcript) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(t)
+}
+
+// Transcript returns a structured record of the invocations of the mock, suitable for
+// archiving what commands were run
+func (m *Mock) Transcript() Transcript {
+	m.Lock()
+	defer m.Unlock()
+	return m.transcript()
+}
+
+func (m *Mock) transcript() Transcript {
+	processEnv := map[string]bool{}
+	for _, e := range os.Environ() {
+		processEnv[e] = true
+	}
+
+	transcript := make(Transcript, 0, len(m.invocations))
+	for _, invocation := range m.invocations {
+		entry := TranscriptEntry{
+			Name:        m.Name,
+			Args:        invocation.Args,
+			Sequence:    invocation.Sequence,
+			Parent:      invocation.ParentSequence,
+			Dir:         invocation.Dir,
+			StdinSHA256: invocation.StdinSHA256,
+			StdinBytes:  invocation.StdinBytes,
+			Stdout:      string(invocation.Stdout),
+			Stderr:      string(invocation.Stderr),
+			ExitCode:    invocation.ExitCode,
+			Expected:    invocation.Expectation != nil,
+			StartedAt:   invocation.StartedAt,
+			FinishedAt:  invocation.FinishedAt,
+		}
+
+		for _, e := range invocation.Env {
+			if !processEnv[e] {
+				entry.Env = append(entry.Env, e)
+			}
+		}
+
+		transcript = append(transcript, entry)
+	}
+
+	return transcript
+}
+
+// TranscriptNode is an entry in a tree of invocations, with the invocations it made as its
+// children
+type TranscriptNode struct {
+	TranscriptEntry
+	Children []*TranscriptNode `json:"children,omitempty"`
+}
+
+// TranscriptTree combines the transcripts of mocks into a tree, where invocations made by
+// the passthrough command or call func of another invocation are its children. Siblings
+// are in the order they were made
+func TranscriptTree(mocks ...*Mock) []*TranscriptNode {
+	var entries Transcript
+	for _, m := range mocks {
+		entries = append(entries, m.Transcript()...)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Sequence < entries[j].Sequence
+	})
+
+	nodes := map[uint64]*TranscriptNode{}
+	for _, entry := range entries {
+		nodes[entry.Sequence] = &TranscriptNode{TranscriptEntry: entry}
+	}
+
+	var roots []*TranscriptNode
+	for _, entry := range entries {
+		node := nodes[entry.Sequence]
+		if parent, ok := nodes[entry.Parent]; ok && entry.Parent != 0 {
+			parent.Children = append(parent.Children, node)
+		} else {
+			roots = append(roots, node)
+		}
+	}
+	return roots
+}
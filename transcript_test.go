@@ -0,0 +1,244 @@
+package bintest_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/bintest/v3"
+	"github.com/buildkite/bintest/v3/testutil"
+	"github.com/fortytw2/leaktest"
+)
+
+func TestMockTranscript(t *testing.T) {
+	defer leaktest.Check(t)()
+	m, close := mustMock(t, "llamas")
+	defer close()
+
+	m.Expect("eat", "grass").WithStdin("hay").AndExitWith(3)
+
+	cmd := exec.Command(m.Path, "eat", "grass")
+	cmd.Env = append(os.Environ(), "LLAMA_MOOD=hungry")
+	cmd.Stdin = strings.NewReader("hay")
+	_ = cmd.Run()
+	_ = exec.Command(m.Path, "spit").Run()
+
+	transcript := m.Transcript()
+	if len(transcript) != 2 {
+		t.Fatalf("Expected 2 entries, got %d", len(transcript))
+	}
+
+	first := transcript[0]
+	if !reflect.DeepEqual(first.Args, []string{"eat", "grass"}) {
+		t.Errorf("Unexpected args %v", first.Args)
+	}
+	if !reflect.DeepEqual(first.Env, []string{"LLAMA_MOOD=hungry"}) {
+		t.Errorf("Unexpected env %v", first.Env)
+	}
+	if first.ExitCode != 3 || !first.Expected {
+		t.Errorf("Unexpected entry %#v", first)
+	}
+	if expected := "4e30ea25cda1c18cfc423e4d9dfa57b7051a9ef311e09ed43f8e33523f3d9533"; first.StdinSHA256 != expected {
+		t.Errorf("Unexpected stdin hash %q", first.StdinSHA256)
+	}
+	if first.FinishedAt.Before(first.StartedAt) {
+		t.Errorf("Finished before started")
+	}
+
+	if second := transcript[1]; second.Expected || second.ExitCode != 1 {
+		t.Errorf("Unexpected entry %#v", second)
+	}
+
+	var buf bytes.Buffer
+	if err := transcript.WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded bintest.Transcript
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != 2 || decoded[0].ExitCode != 3 {
+		t.Errorf("Unexpected decoded transcript %#v", decoded)
+	}
+}
+
+func TestMockTranscriptHashesStdinPastTheCaptureLimit(t *testing.T) {
+	defer leaktest.Check(t)()
+	m, close := mustMock(t, "llamas")
+	defer close()
+
+	m.CaptureStdinLimit(4)
+	m.Expect("eat").AndCallFunc(func(c *bintest.Call) {
+		_, _ = io.Copy(io.Discard, c.Stdin)
+		c.Exit(0)
+	})
+
+	stdin := strings.Repeat("hay", 1000)
+
+	cmd := exec.Command(m.Path, "eat")
+	cmd.Stdin = strings.NewReader(stdin)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Unexpected error %v: %s", err, out)
+	}
+
+	entry := m.Transcript()[0]
+	if expected := fmt.Sprintf("%x", sha256.Sum256([]byte(stdin))); entry.StdinSHA256 != expected {
+		t.Errorf("Expected the hash of all of stdin %q, got %q", expected, entry.StdinSHA256)
+	}
+	if entry.StdinBytes != int64(len(stdin)) {
+		t.Errorf("Expected %d stdin bytes, got %d", len(stdin), entry.StdinBytes)
+	}
+	if captured := m.Invocations()[0].Stdin; string(captured) != "hayh" {
+		t.Errorf("Expected stdin to be captured up to the limit, got %q", captured)
+	}
+}
+
+// snapshotTB records failures from Snapshot rather than failing the test
+type snapshotTB struct {
+	testing.TB
+	name   string
+	errors []string
+}
+
+func (s *snapshotTB) Name() string { return s.name }
+
+func (s *snapshotTB) Errorf(format string, args ...interface{}) {
+	s.errors = append(s.errors, fmt.Sprintf(format, args...))
+}
+
+func TestSnapshot(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	git, closeGit := mustMock(t, "git")
+	defer closeGit()
+	docker, closeDocker := mustMock(t, "docker")
+	defer closeDocker()
+
+	git.Expect("fetch", "origin").AndExitWith(0)
+	docker.Expect("build", "-t", "llamas:latest", ".").AndExitWith(0)
+	git.Expect("push", "origin", "main").AndExitWith(1)
+
+	for _, cmd := range []*exec.Cmd{
+		exec.Command(git.Path, "fetch", "origin"),
+		exec.Command(docker.Path, "build", "-t", "llamas:latest", "."),
+		exec.Command(git.Path, "push", "origin", "main"),
+		exec.Command(docker.Path, "run", "it"),
+	} {
+		_ = cmd.Run()
+	}
+
+	bintest.Snapshot(t, git, docker)
+
+	t.Run("mismatch", func(t *testing.T) {
+		t.Setenv(bintest.UpdateGoldenEnvVar, "")
+		tb := &snapshotTB{TB: t, name: "TestSnapshot"}
+		bintest.Snapshot(tb, git)
+
+		if len(tb.errors) != 1 || !strings.Contains(tb.errors[0], `First difference at line 3, expected "docker build -t llamas:latest .", got "git push origin main"`) {
+			t.Fatalf("Expected a mismatch, got %q", tb.errors)
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		t.Setenv(bintest.UpdateGoldenEnvVar, "")
+		tb := &snapshotTB{TB: t, name: "TestSnapshotMissing"}
+		bintest.Snapshot(tb, git)
+
+		if len(tb.errors) != 1 || !strings.Contains(tb.errors[0], "can't be read") {
+			t.Fatalf("Expected the snapshot to be missing, got %q", tb.errors)
+		}
+	})
+
+	t.Run("TestingT", func(t *testing.T) {
+		t.Setenv(bintest.UpdateGoldenEnvVar, "")
+		tt := &namedT{name: "TestSnapshotMissing"}
+		bintest.Snapshot(tt, git)
+
+		if len(tt.Errors) != 1 || !strings.Contains(tt.Errors[0], "can't be read") {
+			t.Fatalf("Expected the snapshot to be missing, got %q", tt.Errors)
+		}
+	})
+
+	t.Run("without a name", func(t *testing.T) {
+		tt := &testutil.TestingT{}
+		bintest.Snapshot(tt, git)
+
+		if len(tt.Errors) != 1 || !strings.Contains(tt.Errors[0], "needs a Name method") {
+			t.Fatalf("Expected Snapshot to need a name, got %q", tt.Errors)
+		}
+	})
+}
+
+// namedT is a TestingT with a name, but none of the other methods of testing.TB
+type namedT struct {
+	testutil.TestingT
+	name string
+}
+
+func (n *namedT) Name() string { return n.name }
+
+func TestMockNestedInvocations(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	makeMock, cleanupMake := mustMock(t, "make")
+	defer cleanupMake()
+	gcc, cleanupGcc := mustMock(t, "gcc")
+	defer cleanupGcc()
+	ld, cleanupLd := mustMock(t, "ld")
+	defer cleanupLd()
+
+	makeMock.Expect("-c", bintest.MatchAny()).AndPassthroughToLocalCommand(sh)
+	gcc.Expect(bintest.MatchAny()).Exactly(2).AndCallFunc(func(c *bintest.Call) {
+		c.Exit(exitCode(c.Command(ld.Path).Run()))
+	})
+	ld.Expect().Exactly(2)
+
+	cmd := exec.Command(makeMock.Path, "-c", `"$GCC" a.c && "$GCC" b.c`)
+	cmd.Env = append(os.Environ(), "GCC="+gcc.Path)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+
+	parent := makeMock.Invocation(0)
+	for _, invocation := range gcc.Invocations() {
+		if invocation.ParentSequence != parent.Sequence {
+			t.Errorf("Expected gcc to be called by make (%d), got %d", parent.Sequence, invocation.ParentSequence)
+		}
+	}
+
+	tree := bintest.TranscriptTree(makeMock, gcc, ld)
+	if len(tree) != 1 || tree[0].Name != "make" || len(tree[0].Children) != 2 {
+		t.Fatalf("Expected make with 2 children, got %+v", tree)
+	}
+	for _, child := range tree[0].Children {
+		if child.Name != "gcc" || len(child.Children) != 1 || child.Children[0].Name != "ld" {
+			t.Errorf("Expected gcc to call ld, got %+v", child)
+		}
+	}
+
+	bintest.CheckAll(t, makeMock, gcc, ld)
+}
+
+func exitCode(err error) int {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	} else if err != nil {
+		return 1
+	}
+	return 0
+}
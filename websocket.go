@@ -0,0 +1,152 @@
+package bintest
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"math/rand"
+)
+
+// The websocket transport carries the same frames as the stream transport, as the
+// payloads of binary websocket messages. Only as much of RFC 6455 as bintest needs
+// is implemented: no extensions, and control frames other than close are ignored.
+
+const websocketGUID = `258EAFA5-E914-47DA-95CA-C5AB0DC85B11`
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+)
+
+func websocketAccept(key string) string {
+	h := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// wsReader reads the payloads of websocket messages as a continuous stream
+type wsReader struct {
+	r         *bufio.Reader
+	remaining uint64
+	masked    bool
+	mask      [4]byte
+	offset    int
+}
+
+func (ws *wsReader) Read(p []byte) (int, error) {
+	for ws.remaining == 0 {
+		if err := ws.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	if uint64(len(p)) > ws.remaining {
+		p = p[:ws.remaining]
+	}
+
+	n, err := ws.r.Read(p)
+	if ws.masked {
+		for i := 0; i < n; i++ {
+			p[i] ^= ws.mask[(ws.offset+i)%4]
+		}
+	}
+	ws.offset += n
+	ws.remaining -= uint64(n)
+	return n, err
+}
+
+// next reads the header of the next data frame
+func (ws *wsReader) next() error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(ws.r, header); err != nil {
+		return err
+	}
+
+	opcode := header[0] & 0x0f
+	ws.masked = header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7f)
+
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(ws.r, ext); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(ws.r, ext); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(ext)
+	}
+
+	if ws.masked {
+		if _, err := io.ReadFull(ws.r, ws.mask[:]); err != nil {
+			return err
+		}
+	}
+
+	switch opcode {
+	case wsOpClose:
+		return io.EOF
+	case wsOpContinuation, wsOpText, wsOpBinary:
+		ws.remaining = length
+		ws.offset = 0
+	default:
+		if _, err := ws.r.Discard(int(length)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// wsWriter writes each Write as a single binary websocket message. Clients must mask
+// the messages they send
+type wsWriter struct {
+	w    *bufio.Writer
+	mask bool
+}
+
+func (ws *wsWriter) Write(p []byte) (int, error) {
+	header := []byte{0x80 | wsOpBinary, 0}
+
+	switch {
+	case len(p) < 126:
+		header[1] = byte(len(p))
+	case len(p) <= 0xffff:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(len(p)))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(len(p)))
+	}
+
+	payload := p
+	if ws.mask {
+		header[1] |= 0x80
+		var mask [4]byte
+		binary.BigEndian.PutUint32(mask[:], rand.Uint32())
+		header = append(header, mask[:]...)
+
+		payload = make([]byte, len(p))
+		for i := range p {
+			payload[i] = p[i] ^ mask[i%4]
+		}
+	}
+
+	if _, err := ws.w.Write(header); err != nil {
+		return 0, err
+	}
+	if _, err := ws.w.Write(payload); err != nil {
+		return 0, err
+	}
+	if err := ws.w.Flush(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,40 @@
+package bintest
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestWebSocketAccept(t *testing.T) {
+	// from RFC 6455, section 1.3
+	if accept := websocketAccept("dGhlIHNhbXBsZSBub25jZQ=="); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Unexpected accept %q", accept)
+	}
+}
+
+func TestWebSocketFramesRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 10, 200, 70000} {
+		var buf bytes.Buffer
+		w := &wsWriter{w: bufio.NewWriter(&buf), mask: true}
+
+		payload := []byte(strings.Repeat("x", size))
+		if err := writeFrame(w, frameStdout, payload); err != nil {
+			t.Fatal(err)
+		}
+
+		r := &wsReader{r: bufio.NewReader(&buf)}
+		typ, actual, err := readFrame(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if typ != frameStdout || !bytes.Equal(actual, payload) {
+			t.Fatalf("Unexpected frame %q of %d bytes", typ, len(actual))
+		}
+		if _, _, err := readFrame(r); err != io.EOF {
+			t.Fatalf("Expected EOF, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package bintest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// WrapperCmd is a batch script wrapper, found by cmd /C name and by code that runs name.cmd
+	WrapperCmd = ".cmd"
+
+	// WrapperBat is the same as WrapperCmd, with the older extension
+	WrapperBat = ".bat"
+
+	// WrapperPowerShell is a PowerShell script wrapper, for code that runs name.ps1
+	WrapperPowerShell = ".ps1"
+)
+
+// WriteScriptWrappers writes scripts next to the proxy binary that run it with the same
+// arguments, so that Windows code that explicitly invokes name.cmd or name.ps1 finds the
+// proxy. The wrappers are removed when the proxy is closed
+func (p *Proxy) WriteScriptWrappers(exts ...string) error {
+	base := strings.TrimSuffix(p.Path, ".exe")
+	exe := filepath.Base(p.Path)
+
+	for _, ext := range exts {
+		var script string
+		switch ext {
+		case WrapperCmd, WrapperBat:
+			script = "@\"%~dp0" + exe + "\" %*\r\n@exit /b %ERRORLEVEL%\r\n"
+		case WrapperPowerShell:
+			script = "$input | & \"$PSScriptRoot\\" + exe + "\" @args\r\nexit $LASTEXITCODE\r\n"
+		default:
+			return fmt.Errorf("Unknown script wrapper %q", ext)
+		}
+
+		path := base + ext
+		if err := os.WriteFile(path, []byte(script), 0o755); err != nil {
+			return fmt.Errorf("Error writing script wrapper %s: %v", path, err)
+		}
+
+		p.closedMu.Lock()
+		p.wrappers = append(p.wrappers, path)
+		p.closedMu.Unlock()
+	}
+
+	return nil
+}
+
+// WithScriptWrappers writes script wrappers for the mock binary, see Proxy.WriteScriptWrappers
+func (m *Mock) WithScriptWrappers(exts ...string) *Mock {
+	if err := m.proxy.WriteScriptWrappers(exts...); err != nil {
+		panic(err)
+	}
+	return m
+}
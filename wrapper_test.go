@@ -0,0 +1,51 @@
+package bintest_test
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/bintest/v3"
+	"github.com/fortytw2/leaktest"
+)
+
+func TestMockWithScriptWrappers(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	m, err := bintest.NewMock("llamas")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.WithScriptWrappers(bintest.WrapperCmd, bintest.WrapperPowerShell)
+
+	base := strings.TrimSuffix(m.Path, ".exe")
+	for _, ext := range []string{".cmd", ".ps1"} {
+		if _, err := os.Stat(base + ext); err != nil {
+			t.Fatalf("Expected a %s wrapper: %v", ext, err)
+		}
+	}
+
+	// the wrappers can only be run on windows
+	if runtime.GOOS == "windows" {
+		m.Expect("spit", "far").AndWriteToStdout("ptooey")
+
+		out, err := exec.Command("cmd", "/C", base+".cmd", "spit", "far").Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != "ptooey" {
+			t.Fatalf("Unexpected output %q", out)
+		}
+	}
+
+	if err := m.CheckAndClose(t); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(base + ".cmd"); !os.IsNotExist(err) {
+		t.Fatalf("Expected the wrapper to be removed, got %v", err)
+	}
+}